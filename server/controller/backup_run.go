@@ -1,6 +1,9 @@
 package controller
 
 import (
+	"errors"
+	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -36,7 +39,7 @@ func handleBackupRunGet(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
 		return
 	}
-	run, err := service.ServiceGetBackupRun(uint(id))
+	run, err := service.ServiceGetBackupRunDetail(uint(id))
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "backup run not found"})
@@ -76,6 +79,43 @@ func handleBackupRunLogs(c *gin.Context) {
 	c.JSON(http.StatusOK, logs)
 }
 
+func handleBackupRunProgress(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	progress, err := service.ServiceGetBackupRunProgress(uint(id))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "backup run not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, progress)
+}
+
+func handleBackupRunCopiesRetry(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	copies, err := service.ServiceRetryRunCopies(uint(id))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "backup run not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "copies": copies})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, copies)
+}
+
 func handleBackupRunDelete(c *gin.Context) {
 	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
@@ -83,7 +123,23 @@ func handleBackupRunDelete(c *gin.Context) {
 		return
 	}
 
-	if err := service.ServiceDeleteBackupRun(uint(id)); err != nil {
+	keepFiles := false
+	if value := c.Query("keep_files"); value != "" {
+		if keepFiles, err = strconv.ParseBool(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid keep_files"})
+			return
+		}
+	}
+
+	force := false
+	if value := c.Query("force"); value != "" {
+		if force, err = strconv.ParseBool(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid force"})
+			return
+		}
+	}
+
+	if err := service.ServiceDeleteBackupRun(uint(id), keepFiles, force); err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "backup run not found"})
 			return
@@ -95,6 +151,27 @@ func handleBackupRunDelete(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
+func handleBackupRunBulkDelete(c *gin.Context) {
+	var input struct {
+		RunIDs    []uint `json:"run_ids"`
+		KeepFiles bool   `json:"keep_files"`
+		Force     bool   `json:"force"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || len(input.RunIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "run_ids is required"})
+		return
+	}
+
+	results := service.ServiceDeleteBackupRuns(input.RunIDs, input.KeepFiles, input.Force)
+	deleted := 0
+	for _, result := range results {
+		if result.Deleted {
+			deleted++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted, "failed": len(results) - deleted, "results": results})
+}
+
 func handleBackupFileDownload(c *gin.Context) {
 	fileID, err := strconv.ParseUint(c.Param("fileId"), 10, 32)
 	if err != nil {
@@ -108,12 +185,75 @@ func handleBackupFileDownload(c *gin.Context) {
 		return
 	}
 
-	// Check if file exists on disk
-	if _, err := os.Stat(file.LocalPath); os.IsNotExist(err) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "file not found on disk"})
+	reader, size, err := service.ServiceOpenBackupFile(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "file not found on disk"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
+	defer reader.Close()
 
 	// Serve the file for download
-	c.FileAttachment(file.LocalPath, filepath.Base(file.RemotePath))
+	name := filepath.Base(file.RemotePath)
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		// Plain files support range requests
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		http.ServeContent(c.Writer, c.Request, name, file.CreatedAt, seeker)
+		return
+	}
+	c.DataFromReader(http.StatusOK, size, "application/octet-stream", reader, map[string]string{
+		"Content-Disposition": mime.FormatMediaType("attachment", map[string]string{"filename": name}),
+	})
+}
+
+func handleBackupRunBrowse(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	path := c.Query("path")
+	if path == "" {
+		path = "/"
+	}
+
+	entries, err := service.ServiceBrowseBackupRun(uint(id), path)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "backup run not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+func handleBackupRunRestore(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var input struct {
+		TargetPath string `json:"target_path"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.TargetPath == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "target_path is required"})
+		return
+	}
+
+	result, err := service.ServiceRestoreBackupRun(uint(id), input.TargetPath)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "backup run not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "result": result})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, result)
 }
@@ -48,3 +48,49 @@ func handleFileRuleDelete(c *gin.Context) {
 	}
 	c.Status(http.StatusOK)
 }
+
+func handleFileRulePreview(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	preview, err := service.ServicePreviewSavedFileRule(uint(id))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "file rule not found"})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, preview)
+}
+
+// handleServerFileRulePreview previews a rule that has not been saved yet
+func handleServerFileRulePreview(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var input entity.FileRule
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
+		return
+	}
+	if input.RemotePath == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "remote_path is required"})
+		return
+	}
+	preview, err := service.ServicePreviewFileRule(uint(id), &input)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "server not found"})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, preview)
+}
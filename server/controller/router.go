@@ -25,13 +25,25 @@ func SetupRouter(r *gin.Engine) {
 		api.DELETE("/servers/:id", handleServerDelete)
 		api.POST("/servers/:id/test-connection", handleServerTestConnection)
 		api.GET("/servers/:id/files", handleServerListFiles)
+		api.GET("/servers/:id/docker", handleServerListDocker)
+		api.GET("/servers/:id/host-key", handleServerHostKeyGet)
+		api.POST("/servers/:id/host-key/approve", handleServerHostKeyApprove)
+		api.DELETE("/servers/:id/host-key", handleServerHostKeyReset)
+		api.POST("/servers/:id/file-rules/preview", handleServerFileRulePreview)
 
 		api.GET("/storage-locations", handleStorageLocationsList)
 		api.POST("/storage-locations", handleStorageLocationsCreate)
 		api.PUT("/storage-locations/:id", handleStorageLocationUpdate)
 		api.DELETE("/storage-locations/:id", handleStorageLocationDelete)
+		api.POST("/storage-locations/:id/test-connection", handleStorageLocationTestConnection)
+		api.GET("/storage-locations/:id/browse", handleStorageLocationBrowse)
 		api.GET("/local-files", handleLocalFilesList)
 
+		api.GET("/encryption-keys", handleEncryptionKeysList)
+		api.POST("/encryption-keys", handleEncryptionKeysCreate)
+		api.POST("/encryption-keys/:id/rotate", handleEncryptionKeyRotate)
+		api.DELETE("/encryption-keys/:id", handleEncryptionKeyDelete)
+
 		api.GET("/naming-rules", handleNamingRulesList)
 		api.POST("/naming-rules", handleNamingRulesCreate)
 		api.POST("/naming-rules/translate", handleNamingRuleTranslate)
@@ -51,18 +63,26 @@ func SetupRouter(r *gin.Engine) {
 		api.POST("/backup-profiles/:id/run", handleBackupProfileRun)
 		api.POST("/backup-profiles/:id/execute", handleBackupProfileExecute)
 		api.POST("/backup-profiles/:id/dry-run", handleBackupProfileDryRun)
+		api.GET("/backup-profiles/:id/retention/preview", handleBackupProfileRetentionPreview)
+		api.POST("/backup-profiles/:id/retention/apply", handleBackupProfileRetentionApply)
 
 		api.PUT("/commands/:id", handleCommandUpdate)
 		api.DELETE("/commands/:id", handleCommandDelete)
 
 		api.PUT("/file-rules/:id", handleFileRuleUpdate)
 		api.DELETE("/file-rules/:id", handleFileRuleDelete)
+		api.GET("/file-rules/:id/preview", handleFileRulePreview)
 
 		api.GET("/backup-runs", handleBackupRunsList)
 		api.GET("/backup-runs/:id", handleBackupRunGet)
 		api.GET("/backup-runs/:id/files", handleBackupRunFiles)
 		api.GET("/backup-runs/:id/logs", handleBackupRunLogs)
+		api.GET("/backup-runs/:id/progress", handleBackupRunProgress)
+		api.GET("/backup-runs/:id/browse", handleBackupRunBrowse)
+		api.POST("/backup-runs/:id/restore", handleBackupRunRestore)
+		api.POST("/backup-runs/:id/copies/retry", handleBackupRunCopiesRetry)
 		api.DELETE("/backup-runs/:id", handleBackupRunDelete)
+		api.POST("/backup-runs/bulk-delete", handleBackupRunBulkDelete)
 		api.GET("/backup-files/:fileId/download", handleBackupFileDownload)
 
 		// Templates
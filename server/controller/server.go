@@ -38,6 +38,8 @@ func handleServersCreate(c *gin.Context) {
 		portStr := c.PostForm("port")
 		authType := c.PostForm("auth_type")
 		password := c.PostForm("password")
+		passphrase := c.PostForm("passphrase")
+		transferMode := c.PostForm("transfer_mode")
 		if name == "" || host == "" || username == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "missing required fields"})
 			return
@@ -48,21 +50,69 @@ func handleServersCreate(c *gin.Context) {
 				port = p
 			}
 		}
+		maxSessions := 0
+		if maxStr := c.PostForm("max_sessions"); maxStr != "" {
+			if m, err := strconv.Atoi(maxStr); err == nil {
+				maxSessions = m
+			}
+		}
+		var jumpHostID *uint
+		if jumpStr := c.PostForm("jump_host_id"); jumpStr != "" {
+			j, err := strconv.ParseUint(jumpStr, 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid jump_host_id"})
+				return
+			}
+			jid := uint(j)
+			jumpHostID = &jid
+		}
 		if authType == "password" {
 			if password == "" {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "password is required for password auth"})
 				return
 			}
-			// Optionally: test password SSH connection here if desired
 			server := &entity.Server{
-				Name:     name,
-				Host:     host,
-				Port:     port,
-				Username: username,
-				AuthType: "password",
-				Password: password,
+				Name:         name,
+				Host:         host,
+				Port:         port,
+				Username:     username,
+				AuthType:     "password",
+				Password:     password,
+				JumpHostID:   jumpHostID,
+				TransferMode: transferMode,
+				MaxSessions:  maxSessions,
+			}
+			// The connection is tested before storing, this also records the host key
+			server, err := service.ServiceCreateServerFromJSON(server)
+			if err != nil {
+				if service.IsConnectionTestFailure(err) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				} else {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				}
+				return
+			}
+			c.JSON(http.StatusCreated, server)
+			return
+		}
+		if authType == "agent" {
+			candidate := &entity.Server{
+				Name:         name,
+				Host:         host,
+				Port:         port,
+				Username:     username,
+				AuthType:     "agent",
+				JumpHostID:   jumpHostID,
+				TransferMode: transferMode,
+				MaxSessions:  maxSessions,
+			}
+			// Test the SSH connection before storing, this also records the host key
+			if err := service.TestSSHConnectionUsingServer(candidate); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "SSH connection test failed: " + err.Error()})
+				return
 			}
-			if err := service.DB.Create(server).Error; err != nil {
+			server, err := service.ServiceCreateServerWithKey(candidate)
+			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
@@ -85,12 +135,24 @@ func handleServersCreate(c *gin.Context) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "key file is empty"})
 			return
 		}
-		// Test the SSH connection before storing
-		if err := service.TestSSHConnection(host, username, string(keyContent), port); err != nil {
+		candidate := &entity.Server{
+			Name:                 name,
+			Host:                 host,
+			Port:                 port,
+			Username:             username,
+			AuthType:             "key",
+			PrivateKeyPath:       string(keyContent),
+			PrivateKeyPassphrase: passphrase,
+			JumpHostID:           jumpHostID,
+			TransferMode:         transferMode,
+			MaxSessions:          maxSessions,
+		}
+		// Test the SSH connection before storing, this also records the host key
+		if err := service.TestSSHConnectionUsingServer(candidate); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "SSH connection test failed: " + err.Error()})
 			return
 		}
-		server, err := service.ServiceCreateServerWithKey(name, host, port, username, keyContent)
+		server, err := service.ServiceCreateServerWithKey(candidate)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -111,7 +173,11 @@ func handleServersCreate(c *gin.Context) {
 	}
 	server, err := service.ServiceCreateServerFromJSON(&input)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if service.IsConnectionTestFailure(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 	c.JSON(http.StatusCreated, server)
@@ -217,3 +283,90 @@ func handleServerListFiles(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, entries)
 }
+
+// handleServerListDocker lists the containers and volumes of a server for
+// docker file rules
+func handleServerListDocker(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	inventory, err := service.ServiceListServerDocker(uint(id))
+	if err != nil {
+		// Like the file listing, report the error with empty lists
+		c.JSON(http.StatusOK, gin.H{
+			"containers": []interface{}{},
+			"volumes":    []interface{}{},
+			"error":      err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, inventory)
+}
+
+func handleServerHostKeyGet(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	info, err := service.ServiceGetServerHostKey(uint(id))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "server not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+func handleServerHostKeyApprove(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	// The fingerprint is optional; when given, only that exact key is approved
+	var input struct {
+		Fingerprint string `json:"fingerprint"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
+			return
+		}
+	}
+	info, err := service.ServiceApproveServerHostKey(uint(id), input.Fingerprint)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "server not found"})
+		} else if service.IsHostKeyMismatch(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+func handleServerHostKeyReset(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	if err := service.ServiceResetServerHostKey(uint(id)); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "server not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.Status(http.StatusOK)
+}
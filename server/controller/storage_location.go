@@ -28,7 +28,7 @@ func handleStorageLocationsCreate(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
 		return
 	}
-	if input.Name == "" || input.BasePath == "" {
+	if input.Name == "" || ((input.Type == "" || input.Type == "local") && input.BasePath == "") {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "missing required fields"})
 		return
 	}
@@ -72,3 +72,49 @@ func handleStorageLocationDelete(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "storage location deleted"})
 }
+
+func handleStorageLocationTestConnection(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	free, err := service.ServiceTestStorageLocation(uint(id))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "storage location not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	response := gin.H{
+		"success": true,
+		"message": "storage location is writable",
+	}
+	if free >= 0 {
+		response["free_bytes"] = free
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func handleStorageLocationBrowse(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	entries, err := service.ServiceBrowseStorageLocation(uint(id), c.Query("path"))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "storage location not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
@@ -4,13 +4,16 @@ import "time"
 
 // BackupFile tracks individual files downloaded during a run
 type BackupFile struct {
-	ID          uint      `gorm:"primaryKey" json:"id"`
-	BackupRunID uint      `gorm:"not null" json:"backup_run_id"`
-	FileRuleID  uint      `json:"file_rule_id,omitempty"`
-	RemotePath  string    `gorm:"not null" json:"remote_path"`
-	LocalPath   string    `gorm:"not null" json:"local_path"`
-	SizeBytes   int64     `json:"size_bytes"`
-	FileSize    int64     `json:"file_size,omitempty"`
-	Checksum    string    `json:"checksum,omitempty"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID                uint       `gorm:"primaryKey" json:"id"`
+	BackupRunID       uint       `gorm:"not null" json:"backup_run_id"`
+	FileRuleID        uint       `json:"file_rule_id,omitempty"`
+	RemotePath        string     `gorm:"not null" json:"remote_path"`
+	LocalPath         string     `gorm:"not null" json:"local_path"`
+	SizeBytes         int64      `json:"size_bytes"`
+	FileSize          int64      `json:"file_size,omitempty"`
+	Checksum          string     `json:"checksum,omitempty"`
+	ChecksumAlgorithm string     `json:"checksum_algorithm,omitempty"`
+	ModTime           *time.Time `json:"mod_time,omitempty"`
+	Reused            bool       `json:"reused"`
+	CreatedAt         time.Time  `json:"created_at"`
 }
@@ -0,0 +1,14 @@
+package entity
+
+import "time"
+
+// BackupFileError records a file that could not be backed up in a run that
+// continued past it
+type BackupFileError struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	BackupRunID uint      `gorm:"not null;index" json:"backup_run_id"`
+	FileRuleID  uint      `json:"file_rule_id,omitempty"`
+	RemotePath  string    `gorm:"not null" json:"remote_path"`
+	Error       string    `gorm:"type:text;not null" json:"error"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -13,10 +13,54 @@ type BackupProfile struct {
 	Enabled           bool      `json:"enabled"`
 	CreatedAt         time.Time `json:"created_at"`
 
+	// Number of files downloaded in parallel, limited by the server's MaxSessions
+	TransferConcurrency int `gorm:"default:1" json:"transfer_concurrency"`
+	// Algorithm used to checksum downloaded files
+	ChecksumAlgorithm string `gorm:"type:text;default:sha256;check:checksum_algorithm IN ('sha256', 'sha512', 'sha1', 'md5')" json:"checksum_algorithm"`
+	// Compare every checksum with the one computed on the server (e.g. by sha256sum)
+	VerifyChecksums bool `json:"verify_checksums"`
+	// How often a file is downloaded again after a checksum mismatch before it fails
+	ChecksumRetries int `json:"checksum_retries"`
+	// Reuse unchanged files of the previous successful run: "off", "metadata"
+	// (same size and mtime) or "checksum" (same remote checksum)
+	IncrementalMode string `gorm:"type:text;default:off;check:incremental_mode IN ('off', 'metadata', 'checksum')" json:"incremental_mode"`
+	// Pack each run into a single compressed archive: "none", "tar.gz" or "tar.zst"
+	ArchiveFormat string `gorm:"type:text;default:none;check:archive_format IN ('none', 'tar.gz', 'tar.zst')" json:"archive_format"`
+	// Compression level of the archive, 0 uses the format's default
+	ArchiveLevel int `json:"archive_level"`
+	// Key new runs are encrypted with, overrides the storage location's key
+	EncryptionKeyID *uint `json:"encryption_key_id,omitempty"`
+	// What happens when a file cannot be backed up: "stop" fails the run,
+	// "skip" continues without the file and "threshold" continues until more
+	// than MaxFailedFiles files failed
+	ErrorPolicy    string `gorm:"type:text;default:stop;check:error_policy IN ('stop', 'skip', 'threshold')" json:"error_policy"`
+	MaxFailedFiles int    `json:"max_failed_files"`
+	// What happens to the files of a failed run: "delete" removes them, "keep"
+	// leaves them in the staging directory and "quarantine" moves them to
+	// the quarantine directory of the storage location
+	FailedRunCleanup string `gorm:"type:text;default:delete;check:failed_run_cleanup IN ('delete', 'keep', 'quarantine')" json:"failed_run_cleanup"`
+
+	// Retention of successful runs, evaluated after every successful run and
+	// on a schedule. A run survives if any rule keeps it, 0 disables a rule
+	// and without rules every run is kept. The newest run is always kept.
+	RetentionKeepLast    int `json:"retention_keep_last"`
+	RetentionKeepDaily   int `json:"retention_keep_daily"`
+	RetentionKeepWeekly  int `json:"retention_keep_weekly"`
+	RetentionKeepMonthly int `json:"retention_keep_monthly"`
+	RetentionKeepYearly  int `json:"retention_keep_yearly"`
+	// Runs younger than this many days are never removed
+	RetentionMinAgeDays int `json:"retention_min_age_days"`
+	// Older runs are removed once the kept runs together are larger than
+	// this, except runs protected by RetentionMinAgeDays
+	RetentionMaxTotalBytes int64 `json:"retention_max_total_bytes"`
+
 	Server          *Server          `json:"server,omitempty"`
 	StorageLocation *StorageLocation `json:"storage_location,omitempty"`
 	NamingRule      *NamingRule      `json:"naming_rule,omitempty"`
 	Commands        []Command        `json:"commands,omitempty"`
 	FileRules       []FileRule       `json:"file_rules,omitempty"`
 	BackupRuns      []BackupRun      `json:"backup_runs,omitempty"`
+	// Secondary locations every successful run is copied to after it was
+	// written to StorageLocation
+	CopyTargets []BackupProfileCopyTarget `json:"copy_targets,omitempty"`
 }
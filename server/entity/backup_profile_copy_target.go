@@ -0,0 +1,9 @@
+package entity
+
+// BackupProfileCopyTarget is a secondary storage location the successful
+// runs of a profile are copied to
+type BackupProfileCopyTarget struct {
+	ID                uint `gorm:"primaryKey" json:"id"`
+	BackupProfileID   uint `gorm:"not null;index" json:"backup_profile_id"`
+	StorageLocationID uint `gorm:"not null" json:"storage_location_id"`
+}
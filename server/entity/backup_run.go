@@ -15,5 +15,39 @@ type BackupRun struct {
 	ErrorMessage    string    `json:"error_message,omitempty"`
 	Log             string    `json:"log,omitempty"`
 
-	BackupFiles []BackupFile `json:"backup_files,omitempty"`
+	// Bytes downloaded in this run and bytes hard-linked from the previous run
+	TransferredBytes int64 `json:"transferred_bytes"`
+	ReusedBytes      int64 `json:"reused_bytes"`
+	ReusedFiles      int   `json:"reused_files"`
+
+	// Set when the files of the run are stored in a deduplicating chunk store
+	ManifestPath string `json:"manifest_path,omitempty"`
+	// Set when the files of the run are packed into a compressed archive
+	ArchivePath         string `json:"archive_path,omitempty"`
+	CompressedSizeBytes int64  `json:"compressed_size_bytes,omitempty"`
+	// Key the files of the run are encrypted with
+	EncryptionKeyID *uint `json:"encryption_key_id,omitempty"`
+	// Sidecar with modes, owners, mtimes, symlinks and directories
+	MetadataPath string `json:"metadata_path,omitempty"`
+	// Files skipped because of errors, the run is "partial" if it still succeeded
+	FailedFiles int `json:"failed_files"`
+	// Location the run was written to, nil for runs that predate it and are
+	// stored on the local file system
+	StorageLocationID *uint `json:"storage_location_id,omitempty"`
+
+	// Progress of the file transfer, written periodically while it runs.
+	// The totals grow as rules are listed, the ETA is nil while unknown.
+	ProgressFilesDone      int64      `json:"progress_files_done"`
+	ProgressFilesTotal     int64      `json:"progress_files_total"`
+	ProgressBytesDone      int64      `json:"progress_bytes_done"`
+	ProgressBytesTotal     int64      `json:"progress_bytes_total"`
+	ProgressRulesDone      int        `json:"progress_rules_done"`
+	ProgressRulesTotal     int        `json:"progress_rules_total"`
+	ProgressBytesPerSecond float64    `json:"progress_bytes_per_second"`
+	ProgressETASeconds     *int64     `json:"progress_eta_seconds,omitempty"`
+	ProgressUpdatedAt      *time.Time `json:"progress_updated_at,omitempty"`
+
+	BackupFiles []BackupFile      `json:"backup_files,omitempty"`
+	FileErrors  []BackupFileError `json:"file_errors,omitempty"`
+	Copies      []BackupRunCopy   `json:"copies,omitempty"`
 }
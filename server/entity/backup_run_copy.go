@@ -0,0 +1,23 @@
+package entity
+
+import "time"
+
+// BackupRunCopy tracks the copy of a run in a secondary storage location.
+// Copies hold every file unpacked below their own directory, also for
+// archived and deduplicated runs. Encrypted files stay encrypted.
+type BackupRunCopy struct {
+	ID                uint `gorm:"primaryKey" json:"id"`
+	BackupRunID       uint `gorm:"not null;index" json:"backup_run_id"`
+	StorageLocationID uint `gorm:"not null" json:"storage_location_id"`
+	// "pending", "copying", "completed" or "failed"
+	Status          string `gorm:"type:text" json:"status"`
+	LocalBackupPath string `json:"local_backup_path,omitempty"`
+	MetadataPath    string `json:"metadata_path,omitempty"`
+	CopiedFiles     int    `json:"copied_files"`
+	CopiedBytes     int64  `json:"copied_bytes"`
+	// Failed copies are retried until they reached the maximum attempts
+	Attempts     int        `json:"attempts"`
+	ErrorMessage string     `json:"error_message,omitempty"`
+	StartTime    *time.Time `json:"start_time,omitempty"`
+	EndTime      *time.Time `json:"end_time,omitempty"`
+}
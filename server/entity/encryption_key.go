@@ -0,0 +1,24 @@
+package entity
+
+import "time"
+
+// EncryptionKey encrypts backups at rest. Profiles and storage locations refer
+// to the key new runs are encrypted with, runs keep the key they were written
+// with so that rotated keys still decrypt them.
+type EncryptionKey struct {
+	ID   uint   `gorm:"primaryKey" json:"id"`
+	Name string `gorm:"not null" json:"name"`
+	// "age" for X25519 age recipients or "passphrase" for AES-GCM with a
+	// key derived from a passphrase
+	Type string `gorm:"type:text;not null;check:type IN ('age', 'passphrase')" json:"type"`
+	// Public age recipient (age1...)
+	Recipient string `json:"recipient,omitempty"`
+	// age identity (AGE-SECRET-KEY-1...) or passphrase; age keys without an
+	// identity can only encrypt
+	Secret string `json:"secret,omitempty"`
+	// Hex encoded scrypt salt of passphrase keys
+	Salt        string     `json:"salt,omitempty"`
+	RotatedAt   *time.Time `json:"rotated_at,omitempty"`
+	RotatedToID *uint      `json:"rotated_to_id,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
@@ -1,8 +1,9 @@
 package entity
 
 type FileSystemEntry struct {
-	Name  string `json:"name"`
-	Path  string `json:"path"`
-	IsDir bool   `json:"is_dir"`
-	Size  int64  `json:"size"`
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	IsDir  bool   `json:"is_dir"`
+	Size   int64  `json:"size"`
+	FileID uint   `json:"file_id,omitempty"`
 }
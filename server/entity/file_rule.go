@@ -2,12 +2,37 @@ package entity
 
 import "time"
 
-// FileRule defines what files or directories to copy
+// FileRule defines what files or directories to copy, or which command's
+// output to store
 type FileRule struct {
 	ID              uint      `gorm:"primaryKey" json:"id"`
 	BackupProfileID uint      `gorm:"not null" json:"backup_profile_id"`
 	RemotePath      string    `gorm:"not null" json:"remote_path"`
 	Recursive       bool      `gorm:"default:true" json:"recursive"`
 	ExcludePattern  string    `json:"exclude_pattern,omitempty"`
+	IncludePattern  string    `json:"include_pattern,omitempty"`
 	CreatedAt       time.Time `json:"created_at"`
+
+	// How recursive directories are fetched: "auto" (tar when available),
+	// "files" (one transfer per file) or "tar" (a single tar stream)
+	TransferMode string `gorm:"type:text;default:auto;check:transfer_mode IN ('auto', 'files', 'tar')" json:"transfer_mode"`
+
+	// What happens to symlinks below the rule: "follow" backs up their
+	// targets, "copy" records the links themselves and "skip" ignores them
+	SymlinkPolicy string `gorm:"type:text;default:copy;check:symlink_policy IN ('follow', 'copy', 'skip')" json:"symlink_policy"`
+
+	// Where the data comes from: "path" copies RemotePath, "command" runs
+	// Command and streams its stdout into OutputName in the run directory.
+	// For command rules RemotePath is set to OutputName. "docker_volume" and
+	// "docker_container" copy RemotePath inside the volume or container named
+	// DockerTarget; volumes are read by a temporary DockerImage container.
+	SourceType   string `gorm:"type:text;default:path;check:source_type IN ('path', 'command', 'docker_volume', 'docker_container')" json:"source_type"`
+	Command      string `json:"command,omitempty"`
+	OutputName   string `json:"output_name,omitempty"`
+	DockerTarget string `json:"docker_target,omitempty"`
+	DockerImage  string `json:"docker_image,omitempty"`
+
+	// How command output is compressed while it is written: "none", "gzip"
+	// or "zstd"
+	Compression string `gorm:"type:text;default:none;check:compression IN ('none', 'gzip', 'zstd')" json:"compression"`
 }
@@ -9,8 +9,27 @@ type Server struct {
 	Host           string    `gorm:"not null" json:"host"`
 	Port           int       `gorm:"default:22" json:"port"`
 	Username       string    `gorm:"not null" json:"username"`
-	AuthType       string    `gorm:"type:text;check:auth_type IN ('password', 'key')" json:"auth_type"`
+	AuthType       string    `gorm:"type:text;check:auth_type IN ('password', 'key', 'agent')" json:"auth_type"`
 	Password       string    `json:"password,omitempty"`
 	PrivateKeyPath string    `json:"-"`
 	CreatedAt      time.Time `json:"created_at"`
+
+	// Passphrase for encrypted private keys
+	PrivateKeyPassphrase string `json:"private_key_passphrase,omitempty"`
+
+	// How files are transferred: "auto" (SFTP, falling back to cat/scp),
+	// "sftp" (SFTP only) or "shell" (cat/scp only)
+	TransferMode string `gorm:"type:text;default:auto;check:transfer_mode IN ('auto', 'sftp', 'shell')" json:"transfer_mode"`
+
+	// Sessions allowed per connection, should match MaxSessions in the server's sshd_config
+	MaxSessions int `gorm:"default:10" json:"max_sessions"`
+
+	// Optional server to tunnel the connection through (like OpenSSH ProxyJump)
+	JumpHostID *uint `json:"jump_host_id,omitempty"`
+
+	// Accepted SSH host key in authorized_keys format, recorded on first
+	// successful connection or on explicit approval
+	HostKey            string     `json:"host_key,omitempty"`
+	HostKeyFingerprint string     `json:"host_key_fingerprint,omitempty"`
+	HostKeyApprovedAt  *time.Time `json:"host_key_approved_at,omitempty"`
 }
@@ -2,10 +2,42 @@ package entity
 
 import "time"
 
-// StorageLocation defines where backups are stored locally
+// StorageLocation defines where backups are stored
 type StorageLocation struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	Name      string    `gorm:"not null" json:"name"`
+	ID   uint   `gorm:"primaryKey" json:"id"`
+	Name string `gorm:"not null" json:"name"`
+	// Directory on the local file system or the remote server, the key
+	// prefix inside the bucket for object storage, or a directory below the
+	// WebDAV endpoint
 	BasePath  string    `gorm:"not null" json:"base_path"`
 	CreatedAt time.Time `json:"created_at"`
+
+	// "local" writes to the file system of the server running backapp, "s3"
+	// to an S3-compatible object storage, "sftp" to a directory on a server
+	// over SFTP and "webdav" to a WebDAV share
+	Type string `gorm:"type:text;default:local;check:type IN ('local', 's3', 'sftp', 'webdav')" json:"type"`
+
+	// S3 endpoint URL like https://s3.eu-central-1.amazonaws.com, bucket and
+	// credentials. The secret is never returned to clients.
+	Endpoint        string `json:"endpoint,omitempty"`
+	Region          string `json:"region,omitempty"`
+	Bucket          string `json:"bucket,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+
+	// Server whose SSH connection sftp storage uses, BasePath is a directory
+	// on that server
+	ServerID *uint `json:"server_id,omitempty"`
+
+	// WebDAV credentials, the endpoint is the URL of the share like
+	// https://cloud.example.com/remote.php/dav/files/user. The password is
+	// never returned to clients.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// "plain" keeps a directory tree per run, "dedup" stores file contents once
+	// in a content-addressed chunk store below BasePath
+	Mode string `gorm:"type:text;default:plain;check:mode IN ('plain', 'dedup')" json:"mode"`
+	// Key runs stored here are encrypted with unless their profile sets one
+	EncryptionKeyID *uint `json:"encryption_key_id,omitempty"`
 }
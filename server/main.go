@@ -49,6 +49,11 @@ func main() {
 	// Initialize database via service layer
 	service.InitDB(*dbPath)
 
+	// Runs left as running were interrupted by the last shutdown
+	if err := service.ServiceFailInterruptedRuns(); err != nil {
+		log.Printf("Warning: Failed to clean up interrupted backup runs: %v", err)
+	}
+
 	// Initialize and load scheduled backups
 	scheduler := service.GetScheduler()
 	if err := scheduler.LoadAllSchedules(); err != nil {
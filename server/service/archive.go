@@ -0,0 +1,295 @@
+package service
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"backapp-server/entity"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveIndex records where each file starts inside a run archive so that a
+// single file can be extracted without decompressing everything before it
+type archiveIndex struct {
+	RunID          uint                `json:"run_id"`
+	Format         string              `json:"format"`
+	CreatedAt      time.Time           `json:"created_at"`
+	OriginalSize   int64               `json:"original_size"`
+	CompressedSize int64               `json:"compressed_size"`
+	Files          []archiveIndexEntry `json:"files"`
+}
+
+type archiveIndexEntry struct {
+	LocalPath  string `json:"local_path"`
+	RemotePath string `json:"remote_path"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	// Offset of the compressed member holding the tar header and content
+	Offset int64 `json:"offset"`
+}
+
+// normalizeArchiveFormat defaults an empty archive format and rejects unknown ones
+func normalizeArchiveFormat(format string) (string, error) {
+	switch format {
+	case "":
+		return "none", nil
+	case "none", "tar.gz", "tar.zst":
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported archive_format: %s", format)
+	}
+}
+
+// archiveIndexPath returns the path of the index belonging to an archive
+func archiveIndexPath(archivePath string) string {
+	return archivePath + ".index.json"
+}
+
+// countingWriter counts the bytes written to the underlying writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// memberWriter forwards writes to the compressor of the current member
+type memberWriter struct {
+	current io.WriteCloser
+}
+
+func (m *memberWriter) Write(p []byte) (int, error) {
+	return m.current.Write(p)
+}
+
+// newCompressor starts a new compressed member on w
+func newCompressor(w io.Writer, format string, level int) (io.WriteCloser, error) {
+	switch format {
+	case "tar.gz":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "tar.zst":
+		encoderLevel := zstd.SpeedDefault
+		if level != 0 {
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLevel), zstd.WithEncoderConcurrency(1))
+	default:
+		return nil, fmt.Errorf("unsupported archive format: %s", format)
+	}
+}
+
+// createRunArchive packs the files of a run into a single compressed tar next
+// to backupDir and removes the loose files. Every file is compressed as its
+// own gzip member or zstd frame, which keeps the archive readable by standard
+// tools while the index allows seeking to a single file.
+func createRunArchive(backupDir string, runID uint, files []entity.BackupFile, format string, level int) (string, *archiveIndex, error) {
+	archivePath := filepath.Clean(backupDir) + "." + format
+	tmp, err := os.CreateTemp(filepath.Dir(archivePath), ".tmp-archive-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create archive: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	buffered := bufio.NewWriter(tmp)
+	counter := &countingWriter{w: buffered}
+	members := &memberWriter{}
+	tw := tar.NewWriter(members)
+	index := &archiveIndex{RunID: runID, Format: format, CreatedAt: time.Now()}
+
+	for _, file := range files {
+		name, err := filepath.Rel(backupDir, file.LocalPath)
+		if err != nil {
+			return "", nil, err
+		}
+		// Finish the previous entry and member before starting a new one
+		if members.current != nil {
+			if err := tw.Flush(); err != nil {
+				return "", nil, err
+			}
+			if err := members.current.Close(); err != nil {
+				return "", nil, err
+			}
+		}
+		offset := counter.n
+		if members.current, err = newCompressor(counter, format, level); err != nil {
+			return "", nil, err
+		}
+
+		size, err := addArchiveEntry(tw, file.LocalPath, filepath.ToSlash(name))
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to archive %s: %v", file.LocalPath, err)
+		}
+		index.OriginalSize += size
+		index.Files = append(index.Files, archiveIndexEntry{
+			LocalPath:  file.LocalPath,
+			RemotePath: file.RemotePath,
+			Name:       filepath.ToSlash(name),
+			Size:       size,
+			Offset:     offset,
+		})
+	}
+
+	// The end of archive marker goes into the last member
+	if members.current == nil {
+		if members.current, err = newCompressor(counter, format, level); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", nil, err
+	}
+	if err := members.current.Close(); err != nil {
+		return "", nil, err
+	}
+	if err := buffered.Flush(); err != nil {
+		return "", nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", nil, err
+	}
+	index.CompressedSize = counter.n
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return "", nil, err
+	}
+	if err := writeFileAtomic(archiveIndexPath(archivePath), data); err != nil {
+		return "", nil, fmt.Errorf("failed to write archive index: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), archivePath); err != nil {
+		return "", nil, fmt.Errorf("failed to move archive into place: %v", err)
+	}
+
+	for _, file := range files {
+		if err := os.Remove(file.LocalPath); err != nil && !os.IsNotExist(err) {
+			return "", nil, fmt.Errorf("failed to remove %s: %v", file.LocalPath, err)
+		}
+	}
+	removeEmptyDirs(backupDir)
+	return archivePath, index, nil
+}
+
+// addArchiveEntry writes a local file to tw under name and returns its size
+func addArchiveEntry(tw *tar.Writer, localPath, name string) (int64, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return 0, err
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return 0, err
+	}
+	return io.Copy(tw, file)
+}
+
+func loadArchiveIndex(archivePath string) (*archiveIndex, error) {
+	data, err := os.ReadFile(archiveIndexPath(archivePath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive index: %v", err)
+	}
+	var index archiveIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid archive index of %s: %v", archivePath, err)
+	}
+	return &index, nil
+}
+
+// archiveFileReader reads one file out of a run archive
+type archiveFileReader struct {
+	io.Reader
+	file   *os.File
+	closer func()
+}
+
+func (r *archiveFileReader) Close() error {
+	if r.closer != nil {
+		r.closer()
+	}
+	return r.file.Close()
+}
+
+// openArchiveFile returns a reader for the file stored under localPath in a
+// run archive, decompressing only the member that holds it
+func openArchiveFile(archivePath, localPath string) (io.ReadCloser, int64, error) {
+	index, err := loadArchiveIndex(archivePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	var entry *archiveIndexEntry
+	for i := range index.Files {
+		if index.Files[i].LocalPath == localPath {
+			entry = &index.Files[i]
+			break
+		}
+	}
+	if entry == nil {
+		return nil, 0, fmt.Errorf("%s is not part of archive %s: %w", localPath, archivePath, os.ErrNotExist)
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := file.Seek(entry.Offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	reader := &archiveFileReader{file: file}
+	var decompressed io.Reader
+	switch index.Format {
+	case "tar.gz":
+		gz, err := gzip.NewReader(bufio.NewReader(file))
+		if err != nil {
+			file.Close()
+			return nil, 0, fmt.Errorf("failed to read archive member: %v", err)
+		}
+		decompressed = gz
+	case "tar.zst":
+		zr, err := zstd.NewReader(bufio.NewReader(file), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			file.Close()
+			return nil, 0, fmt.Errorf("failed to read archive member: %v", err)
+		}
+		decompressed = zr
+		reader.closer = zr.Close
+	default:
+		file.Close()
+		return nil, 0, fmt.Errorf("unsupported archive format: %s", index.Format)
+	}
+
+	tr := tar.NewReader(decompressed)
+	header, err := tr.Next()
+	if err != nil || header.Name != entry.Name {
+		reader.Close()
+		return nil, 0, fmt.Errorf("archive index of %s does not match its content", archivePath)
+	}
+	reader.Reader = tr
+	return reader, header.Size, nil
+}
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"backapp-server/entity"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// readWholeArchive lists the names and contents of an archive the way
+// standard tools read it, from the start without the index
+func readWholeArchive(t *testing.T, archivePath, format string) map[string][]byte {
+	t.Helper()
+	file, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var decompressed io.Reader
+	switch format {
+	case "tar.gz":
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressed = gz
+	case "tar.zst":
+		zr, err := zstd.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		decompressed = zr
+	}
+	contents := make(map[string][]byte)
+	tr := tar.NewReader(decompressed)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return contents
+		}
+		if err != nil {
+			t.Fatalf("reading %s: %v", archivePath, err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[header.Name] = data
+	}
+}
+
+func TestRunArchiveRoundTrip(t *testing.T) {
+	for _, format := range []string{"tar.gz", "tar.zst"} {
+		t.Run(format, func(t *testing.T) {
+			backupDir := filepath.Join(t.TempDir(), "backup")
+			names := []string{"first.bin", "sub/middle.txt", "sub/empty", "last.log"}
+			contents := map[string][]byte{
+				"first.bin":      randomBytes(t, 200000),
+				"sub/middle.txt": bytes.Repeat([]byte("middle "), 1000),
+				"sub/empty":      {},
+				"last.log":       []byte("last"),
+			}
+			var files []entity.BackupFile
+			for _, name := range names {
+				localPath := filepath.Join(backupDir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(localPath, contents[name], 0644); err != nil {
+					t.Fatal(err)
+				}
+				files = append(files, entity.BackupFile{LocalPath: localPath, RemotePath: "/" + name, SizeBytes: int64(len(contents[name]))})
+			}
+
+			archivePath, index, err := createRunArchive(backupDir, 1, files, format, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if archivePath != backupDir+"."+format {
+				t.Errorf("archive path = %s", archivePath)
+			}
+			if _, err := os.Stat(backupDir); !os.IsNotExist(err) {
+				t.Errorf("backup directory was not removed: %v", err)
+			}
+			info, err := os.Stat(archivePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if index.CompressedSize != info.Size() || index.OriginalSize != 200000+7000+4 || len(index.Files) != len(names) {
+				t.Errorf("index sizes %d, %d with %d files, archive has %d bytes", index.OriginalSize, index.CompressedSize, len(index.Files), info.Size())
+			}
+			for i := 1; i < len(index.Files); i++ {
+				if index.Files[i].Offset <= index.Files[i-1].Offset {
+					t.Errorf("offset of %s does not follow the one of %s", index.Files[i].Name, index.Files[i-1].Name)
+				}
+			}
+
+			// The middle file is read by its offset only, anything before it
+			// may be damaged
+			archive, err := os.ReadFile(archivePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			damaged := bytes.Clone(archive)
+			for i := int64(0); i < index.Files[1].Offset; i++ {
+				damaged[i] = 0
+			}
+			if err := os.WriteFile(archivePath, damaged, 0644); err != nil {
+				t.Fatal(err)
+			}
+			for _, i := range []int{1, 2, 3} {
+				reader, size, err := openArchiveFile(archivePath, files[i].LocalPath)
+				if err != nil {
+					t.Fatalf("open %s: %v", names[i], err)
+				}
+				data, err := io.ReadAll(reader)
+				reader.Close()
+				if err != nil || !bytes.Equal(data, contents[names[i]]) || size != int64(len(data)) {
+					t.Errorf("%s read %d of %d bytes, %v", names[i], len(data), size, err)
+				}
+			}
+			if _, _, err := openArchiveFile(archivePath, files[0].LocalPath); err == nil {
+				t.Error("the damaged first file was read")
+			}
+
+			if err := os.WriteFile(archivePath, archive, 0644); err != nil {
+				t.Fatal(err)
+			}
+			whole := readWholeArchive(t, archivePath, format)
+			if len(whole) != len(names) {
+				t.Errorf("archive holds %d files, want %d", len(whole), len(names))
+			}
+			for name, content := range contents {
+				if !bytes.Equal(whole[name], content) {
+					t.Errorf("%s differs when the archive is read as a whole", name)
+				}
+			}
+			if _, _, err := openArchiveFile(archivePath, filepath.Join(backupDir, "missing")); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("opening a file missing from the archive = %v, want os.ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestRunArchiveWithoutFiles(t *testing.T) {
+	for _, format := range []string{"tar.gz", "tar.zst"} {
+		t.Run(format, func(t *testing.T) {
+			backupDir := filepath.Join(t.TempDir(), "backup")
+			if err := os.MkdirAll(backupDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			archivePath, index, err := createRunArchive(backupDir, 1, nil, format, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(index.Files) != 0 || index.OriginalSize != 0 || index.CompressedSize == 0 {
+				t.Errorf("index of an empty archive = %+v", index)
+			}
+			if whole := readWholeArchive(t, archivePath, format); len(whole) != 0 {
+				t.Errorf("empty archive holds %d files", len(whole))
+			}
+			loaded, err := loadArchiveIndex(archivePath)
+			if err != nil || len(loaded.Files) != 0 || loaded.Format != format {
+				t.Errorf("loaded index = %+v, %v", loaded, err)
+			}
+		})
+	}
+}
+
+func TestRunArchiveLevels(t *testing.T) {
+	for _, format := range []string{"tar.gz", "tar.zst"} {
+		for _, level := range []int{1, 9} {
+			backupDir := filepath.Join(t.TempDir(), "backup")
+			localPath := filepath.Join(backupDir, "file")
+			if err := os.MkdirAll(backupDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(localPath, []byte("level"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			archivePath, _, err := createRunArchive(backupDir, 1, []entity.BackupFile{{LocalPath: localPath}}, format, level)
+			if err != nil {
+				t.Fatalf("%s level %d: %v", format, level, err)
+			}
+			if whole := readWholeArchive(t, archivePath, format); string(whole["file"]) != "level" {
+				t.Errorf("%s level %d holds %q", format, level, whole["file"])
+			}
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"sync"
 	"time"
 
 	"backapp-server/entity"
@@ -14,6 +15,16 @@ import (
 // BackupExecutor handles the execution of backup profiles
 type BackupExecutor struct{}
 
+// activeRuns holds the IDs of the runs executing in this process. Runs marked
+// as running that are not in it were interrupted by a restart.
+var activeRuns sync.Map
+
+// runActive reports whether a run is executing in this process
+func runActive(runID uint) bool {
+	_, ok := activeRuns.Load(runID)
+	return ok
+}
+
 // NewBackupExecutor creates a new backup executor
 func NewBackupExecutor() *BackupExecutor {
 	return &BackupExecutor{}
@@ -54,13 +65,16 @@ func (e *BackupExecutor) ExecuteBackup(profileID uint, allowDisabled bool) error
 
 	// Create backup run record
 	run := &entity.BackupRun{
-		BackupProfileID: profileID,
-		Status:          "running",
-		StartTime:       time.Now(),
+		BackupProfileID:   profileID,
+		Status:            "running",
+		StartTime:         time.Now(),
+		StorageLocationID: &profile.StorageLocationID,
 	}
 	if err := DB.Create(run).Error; err != nil {
 		return fmt.Errorf("failed to create backup run: %v", err)
 	}
+	activeRuns.Store(run.ID, true)
+	defer activeRuns.Delete(run.ID)
 
 	e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Starting backup for profile: %s", profile.Name))
 
@@ -73,6 +87,14 @@ func (e *BackupExecutor) ExecuteBackup(profileID uint, allowDisabled bool) error
 		run.Status = "failed"
 		run.ErrorMessage = err.Error()
 		e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("Backup failed: %v", err))
+		if message, cleanupErr := cleanupFailedRun(run, profile.FailedRunCleanup); cleanupErr != nil {
+			e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("Failed to clean up the failed run: %v", cleanupErr))
+		} else if message != "" {
+			e.logToDatabase(run.ID, "INFO", message)
+		}
+	} else if run.FailedFiles > 0 {
+		run.Status = "partial"
+		e.logToDatabase(run.ID, "WARNING", fmt.Sprintf("Backup completed, %d files were skipped because of errors", run.FailedFiles))
 	} else {
 		run.Status = "completed"
 		e.logToDatabase(run.ID, "INFO", "Backup completed successfully")
@@ -86,15 +108,77 @@ func (e *BackupExecutor) ExecuteBackup(profileID uint, allowDisabled bool) error
 		e.logToDatabase(run.ID, "DEBUG", fmt.Sprintf("Run status updated to: %s", run.Status))
 	}
 
+	// Copy the run to the secondary locations before retention looks at it
+	if err == nil {
+		copyRunToTargets(run, func(level, message string) {
+			e.logToDatabase(run.ID, level, message)
+		})
+	}
+
+	// Expire older runs now that a new one exists
+	if err == nil && hasRetention(&profile) {
+		if _, retentionErr := applyRetention(&profile, func(level, message string) {
+			e.logToDatabase(run.ID, level, message)
+		}); retentionErr != nil {
+			e.logToDatabase(run.ID, "WARNING", fmt.Sprintf("Retention was not applied: %v", retentionErr))
+		}
+	}
+
 	return err
 }
 
+// transferOptions returns the file transfer options of a profile. The number
+// of parallel downloads leaves one session free for the SFTP subsystem.
+func transferOptions(profile *entity.BackupProfile) TransferOptions {
+	concurrency := max(profile.TransferConcurrency, 1)
+	if profile.Server != nil {
+		concurrency = min(concurrency, max(serverMaxSessions(profile.Server)-1, 1))
+	}
+	return TransferOptions{
+		Concurrency:       concurrency,
+		ChecksumAlgorithm: profile.ChecksumAlgorithm,
+		VerifyChecksums:   profile.VerifyChecksums,
+		ChecksumRetries:   profile.ChecksumRetries,
+		IncrementalMode:   profile.IncrementalMode,
+		ErrorPolicy:       profile.ErrorPolicy,
+		MaxFailedFiles:    profile.MaxFailedFiles,
+	}
+}
+
 // executeBackupInternal performs the actual backup execution
 func (e *BackupExecutor) executeBackupInternal(profile *entity.BackupProfile, run *entity.BackupRun) error {
+	// Runs on the local file system are staged, archived and deduplicated,
+	// other backends receive the files directly
+	backend, err := newStorageBackend(profile.StorageLocation)
+	if err != nil {
+		e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("Failed to open storage location: %v", err))
+		return err
+	}
+	defer backend.Close()
+	local := isLocalBackend(backend)
+	if !local {
+		// Profiles are checked when they are saved, older ones may still ask
+		// for this
+		var unsupported error
+		if profile.StorageLocation.Mode == "dedup" {
+			unsupported = fmt.Errorf("deduplication is only supported on local storage")
+		} else if profile.ArchiveFormat != "" && profile.ArchiveFormat != "none" {
+			unsupported = fmt.Errorf("archives are only supported on local storage")
+		}
+		if unsupported != nil {
+			e.logToDatabase(run.ID, "ERROR", unsupported.Error())
+			return unsupported
+		}
+	}
+
 	// Create SSH client
 	e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Connecting to server: %s@%s:%d", profile.Server.Username, profile.Server.Host, profile.Server.Port))
 	sshClient, err := NewSSHClient(profile.Server)
 	if err != nil {
+		if IsHostKeyMismatch(err) {
+			e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("HOST KEY VERIFICATION FAILED for %s: %v", profile.Server.Name, err))
+			return fmt.Errorf("host key verification failed: %w", err)
+		}
 		e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("Failed to create SSH client: %v", err))
 		return fmt.Errorf("failed to create SSH client: %v", err)
 	}
@@ -108,50 +192,157 @@ func (e *BackupExecutor) executeBackupInternal(profile *entity.BackupProfile, ru
 		return fmt.Errorf("pre-backup commands failed: %v", err)
 	}
 
-	// Generate backup directory name using naming rule
+	// Generate backup directory name using naming rule. The run is written
+	// to a staging directory and only moved there once it succeeded.
 	backupDirName := e.generateBackupName(profile)
-	backupDir := filepath.Join(profile.StorageLocation.BasePath, backupDirName)
-	e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Backup directory: %s", backupDir))
+	e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Backup directory: %s", backend.Join(backupDirName)))
+	var backupDir string
+	if local {
+		backupDir = filepath.Join(stagingRoot(profile.StorageLocation.BasePath, run.ID), backupDirName)
+		e.logToDatabase(run.ID, "DEBUG", fmt.Sprintf("Staging directory: %s", backupDir))
 
-	// Create backup directory
-	if err := os.MkdirAll(backupDir, 0755); err != nil {
-		e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("Failed to create backup directory: %v", err))
-		return fmt.Errorf("failed to create backup directory: %v", err)
-	}
-	absBackupDir, absErr := filepath.Abs(backupDir)
-	if absErr != nil {
-		e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("Failed to get absolute path of backup directory: %v", absErr))
+		// Create backup directory
+		if err := os.MkdirAll(backupDir, 0755); err != nil {
+			e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("Failed to create backup directory: %v", err))
+			return fmt.Errorf("failed to create backup directory: %v", err)
+		}
+		absBackupDir, absErr := filepath.Abs(backupDir)
+		if absErr != nil {
+			e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("Failed to get absolute path of backup directory: %v", absErr))
+		} else {
+			e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Absolute backup directory path: %s", absBackupDir))
+		}
+		e.logToDatabase(run.ID, "INFO", "Backup directory created")
 	} else {
-		e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Absolute backup directory path: %s", absBackupDir))
+		if backupDir, err = backendRunDir(backend, backupDirName, run.ID); err != nil {
+			e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("Failed to access the storage location: %v", err))
+			return err
+		}
+		e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Streaming files to %s storage at %s", profile.StorageLocation.Type, backupDir))
+		if free := freeSpace(backend); free >= 0 {
+			e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Free space on the storage location: %.2f GB", float64(free)/1024/1024/1024))
+		}
+	}
+	run.LocalBackupPath = backupDir
+	// Recorded right away so that a run interrupted by a restart can be
+	// cleaned up
+	if err := DB.Model(run).Update("local_backup_path", backupDir).Error; err != nil {
+		log.Printf("Failed to record the backup directory of run %d: %v", run.ID, err)
 	}
-	e.logToDatabase(run.ID, "INFO", "Backup directory created")
 
 	// Transfer files
 	e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Starting file transfer (%d rules)", len(profile.FileRules)))
-	transferService := NewFileTransferService(sshClient, backupDir, run.ID)
+	options := transferOptions(profile)
+	if local {
+		options.ResumeDir = resumeDir(profile.StorageLocation.BasePath, profile.ID)
+	} else {
+		options.Backend = backend
+	}
+	if keyID := profileEncryptionKeyID(profile); keyID != nil {
+		cipher, err := loadKeyCipher(*keyID)
+		if err != nil {
+			e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("Failed to load encryption key: %v", err))
+			return err
+		}
+		options.Cipher = cipher
+		run.EncryptionKeyID = keyID
+		e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Encrypting files with %s key %s", cipher.key.Type, cipher.key.Name))
+	}
+	if options.IncrementalMode != "" && options.IncrementalMode != "off" {
+		previousRun, previous, err := previousBackupFiles(profile.ID, run.ID)
+		if err != nil {
+			e.logToDatabase(run.ID, "WARNING", fmt.Sprintf("Failed to load the previous run, running a full backup: %v", err))
+		} else if previousRun == nil {
+			e.logToDatabase(run.ID, "INFO", "No previous successful run, running a full backup")
+		} else if !sameStorage(previousRun, run, local) {
+			e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Run %d is in another storage location, running a full backup", previousRun.ID))
+		} else if !sameEncryptionKey(previousRun.EncryptionKeyID, run.EncryptionKeyID) {
+			e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Run %d used a different encryption key, running a full backup", previousRun.ID))
+		} else if packed := packedRun(previousRun); packed != "" {
+			e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Run %d %s and has no files to reuse, running a full backup", previousRun.ID, packed))
+		} else {
+			e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Incremental backup based on run %d (%d files, compared by %s)", previousRun.ID, len(previous), options.IncrementalMode))
+			options.Previous = previous
+		}
+	}
+	transferService := NewFileTransferService(sshClient, backupDir, run.ID, options)
+	stopProgress := trackProgress(run, transferService.Progress())
 	backupFiles, err := transferService.TransferFiles(profile.FileRules)
+	stopProgress()
+	// Skipped files are recorded even if too many of them failed the run
+	failures := transferService.Failures()
+	for i := range failures {
+		if err := DB.Create(&failures[i]).Error; err != nil {
+			log.Printf("Failed to save file error record: %v", err)
+		}
+	}
+	run.FailedFiles = len(failures)
 	if err != nil {
 		e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("File transfer failed: %v", err))
 		return fmt.Errorf("file transfer failed: %v", err)
 	}
 	e.logToDatabase(run.ID, "INFO", fmt.Sprintf("File transfer completed: %d files", len(backupFiles)))
+	if run.FailedFiles > 0 {
+		e.logToDatabase(run.ID, "WARNING", fmt.Sprintf("%d files were skipped because of errors", run.FailedFiles))
+	}
 
-	// Save backup files to database
-	for i := range backupFiles {
-		backupFiles[i].BackupRunID = run.ID
-		if err := DB.Create(&backupFiles[i]).Error; err != nil {
-			log.Printf("Failed to save backup file record: %v", err)
+	// Modes, owners, mtimes, symlinks and directories go into a sidecar that
+	// restores reapply
+	metadataPath := runMetadataPath(backupDir)
+	if err := writeRunMetadata(backend, metadataPath, run.ID, transferService.Metadata()); err != nil {
+		e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("Failed to write metadata sidecar: %v", err))
+		return err
+	}
+	run.MetadataPath = metadataPath
+
+	if options.Cipher != nil && (profile.StorageLocation.Mode == "dedup" || (profile.ArchiveFormat != "" && profile.ArchiveFormat != "none")) {
+		e.logToDatabase(run.ID, "WARNING", "Encrypted files neither compress nor deduplicate, consider disabling archives and dedup for this profile")
+	}
+
+	if profile.ArchiveFormat != "" && profile.ArchiveFormat != "none" {
+		if profile.StorageLocation.Mode == "dedup" {
+			e.logToDatabase(run.ID, "WARNING", "Archived runs are not stored in the deduplicated chunk store")
+		}
+		e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Packing files into a %s archive", profile.ArchiveFormat))
+		archivePath, index, err := createRunArchive(backupDir, run.ID, backupFiles, profile.ArchiveFormat, profile.ArchiveLevel)
+		if err != nil {
+			e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("Failed to create archive: %v", err))
+			return fmt.Errorf("failed to create archive: %v", err)
 		}
+		run.ArchivePath = archivePath
+		run.CompressedSizeBytes = index.CompressedSize
+		e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Archive created: %s (%.2f MB compressed from %.2f MB)",
+			archivePath, float64(index.CompressedSize)/1024/1024, float64(index.OriginalSize)/1024/1024))
+	} else if profile.StorageLocation.Mode == "dedup" {
+		e.logToDatabase(run.ID, "INFO", "Storing files in the deduplicated chunk store")
+		stats, err := ingestRunIntoChunkStore(profile.StorageLocation.BasePath, backupDir, run.ID, backupFiles)
+		if err != nil {
+			e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("Failed to store files in chunk store: %v", err))
+			return fmt.Errorf("failed to store files in chunk store: %v", err)
+		}
+		run.ManifestPath = stats.ManifestPath
+		e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Chunk store: %d new chunks (%.2f MB), %d chunks already stored (%.2f MB)",
+			stats.NewChunks, float64(stats.NewBytes)/1024/1024, stats.ReusedChunks, float64(stats.ReusedBytes)/1024/1024))
 	}
 
 	// Calculate total size
 	var totalSize int64
 	for _, file := range backupFiles {
 		totalSize += file.SizeBytes
+		if file.Reused {
+			run.ReusedBytes += file.SizeBytes
+			run.ReusedFiles++
+		} else {
+			run.TransferredBytes += file.SizeBytes
+		}
 	}
 	run.TotalSizeBytes = totalSize
 	run.TotalFiles = len(backupFiles)
 	e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Total size: %.2f MB, Total files: %d", float64(totalSize)/1024/1024, len(backupFiles)))
+	if run.ReusedFiles > 0 {
+		e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Transferred %.2f MB, reused %d unchanged files (%.2f MB) from the previous run",
+			float64(run.TransferredBytes)/1024/1024, run.ReusedFiles, float64(run.ReusedBytes)/1024/1024))
+	}
 
 	// Execute post-backup commands
 	e.logToDatabase(run.ID, "INFO", "Executing post-backup commands")
@@ -160,6 +351,23 @@ func (e *BackupExecutor) executeBackupInternal(profile *entity.BackupProfile, ru
 		return fmt.Errorf("post-backup commands failed: %v", err)
 	}
 
+	// Move the complete run into the storage location
+	if local {
+		if err := commitStagedRun(run, backupFiles, profile.StorageLocation.BasePath); err != nil {
+			e.logToDatabase(run.ID, "ERROR", fmt.Sprintf("Failed to move the run into the storage location: %v", err))
+			return err
+		}
+	}
+	e.logToDatabase(run.ID, "INFO", fmt.Sprintf("Backup stored in %s", run.LocalBackupPath))
+
+	// Save backup files to database
+	for i := range backupFiles {
+		backupFiles[i].BackupRunID = run.ID
+		if err := DB.Create(&backupFiles[i]).Error; err != nil {
+			log.Printf("Failed to save backup file record: %v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"fmt"
+
 	"backapp-server/entity"
 
 	"gorm.io/gorm"
@@ -14,19 +16,78 @@ func ServiceListBackupProfiles() ([]entity.BackupProfile, error) {
 		Preload("NamingRule").
 		Preload("Commands").
 		Preload("FileRules").
+		Preload("CopyTargets").
 		Preload("BackupRuns", func(db *gorm.DB) *gorm.DB {
 			return db.Order("start_time DESC").Limit(10)
 		}).
 		Find(&profiles).Error; err != nil {
 		return nil, err
 	}
+	for i := range profiles {
+		profiles[i].Server = sanitizeServer(profiles[i].Server)
+		sanitizeStorageLocation(profiles[i].StorageLocation)
+	}
 	return profiles, nil
 }
 
+// validateProfileStorage checks that the storage location of a profile
+// exists and supports its archive format and storage mode. Runs are only
+// staged, archived and deduplicated on local storage.
+func validateProfileStorage(locationID uint, archiveFormat string) error {
+	var location entity.StorageLocation
+	if err := DB.First(&location, locationID).Error; err != nil {
+		return fmt.Errorf("storage location %d not found", locationID)
+	}
+	if location.Type == "" || location.Type == storageLocal {
+		return nil
+	}
+	if location.Mode == "dedup" {
+		return fmt.Errorf("deduplication is only supported on local storage, storage location %s is %s", location.Name, location.Type)
+	}
+	if archiveFormat != "" && archiveFormat != "none" {
+		return fmt.Errorf("archives are only supported on local storage, storage location %s is %s", location.Name, location.Type)
+	}
+	return nil
+}
+
 func ServiceCreateBackupProfile(input *entity.BackupProfile) (*entity.BackupProfile, error) {
+	algorithm, err := normalizeChecksumAlgorithm(input.ChecksumAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	input.ChecksumAlgorithm = algorithm
+	if input.IncrementalMode, err = normalizeIncrementalMode(input.IncrementalMode); err != nil {
+		return nil, err
+	}
+	if input.ArchiveFormat, err = normalizeArchiveFormat(input.ArchiveFormat); err != nil {
+		return nil, err
+	}
+	if input.EncryptionKeyID, err = normalizeEncryptionKeyID(input.EncryptionKeyID); err != nil {
+		return nil, err
+	}
+	if input.ErrorPolicy, err = normalizeErrorPolicy(input.ErrorPolicy); err != nil {
+		return nil, err
+	}
+	input.MaxFailedFiles = max(input.MaxFailedFiles, 0)
+	if input.FailedRunCleanup, err = normalizeFailedRunCleanup(input.FailedRunCleanup); err != nil {
+		return nil, err
+	}
+	if err := validateProfileStorage(input.StorageLocationID, input.ArchiveFormat); err != nil {
+		return nil, err
+	}
+	normalizeRetention(input)
+	copyTargets := input.CopyTargets
+	if err := normalizeCopyTargets(input.StorageLocationID, copyTargets); err != nil {
+		return nil, err
+	}
+	input.CopyTargets = nil
 	if err := DB.Create(input).Error; err != nil {
 		return nil, err
 	}
+	if err := replaceCopyTargets(input.ID, copyTargets); err != nil {
+		return nil, err
+	}
+	input.CopyTargets = copyTargets
 
 	// Schedule the profile if it has a cron expression and is enabled
 	scheduler := GetScheduler()
@@ -51,15 +112,79 @@ func ServiceUpdateBackupProfile(id uint, input *entity.BackupProfile) (*entity.B
 	if err != nil {
 		return nil, err
 	}
+	algorithm, err := normalizeChecksumAlgorithm(input.ChecksumAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	incrementalMode, err := normalizeIncrementalMode(input.IncrementalMode)
+	if err != nil {
+		return nil, err
+	}
+	archiveFormat, err := normalizeArchiveFormat(input.ArchiveFormat)
+	if err != nil {
+		return nil, err
+	}
+	encryptionKeyID, err := normalizeEncryptionKeyID(input.EncryptionKeyID)
+	if err != nil {
+		return nil, err
+	}
+	errorPolicy, err := normalizeErrorPolicy(input.ErrorPolicy)
+	if err != nil {
+		return nil, err
+	}
+	failedRunCleanup, err := normalizeFailedRunCleanup(input.FailedRunCleanup)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateProfileStorage(input.StorageLocationID, archiveFormat); err != nil {
+		return nil, err
+	}
 	profile.Name = input.Name
 	profile.ServerID = input.ServerID
 	profile.StorageLocationID = input.StorageLocationID
 	profile.NamingRuleID = input.NamingRuleID
 	profile.ScheduleCron = input.ScheduleCron
 	profile.Enabled = input.Enabled
+	if input.TransferConcurrency > 0 {
+		profile.TransferConcurrency = input.TransferConcurrency
+	}
+	profile.ChecksumAlgorithm = algorithm
+	profile.VerifyChecksums = input.VerifyChecksums
+	profile.ChecksumRetries = max(input.ChecksumRetries, 0)
+	profile.IncrementalMode = incrementalMode
+	profile.ArchiveFormat = archiveFormat
+	profile.ArchiveLevel = input.ArchiveLevel
+	profile.EncryptionKeyID = encryptionKeyID
+	profile.ErrorPolicy = errorPolicy
+	profile.MaxFailedFiles = max(input.MaxFailedFiles, 0)
+	profile.FailedRunCleanup = failedRunCleanup
+	profile.RetentionKeepLast = input.RetentionKeepLast
+	profile.RetentionKeepDaily = input.RetentionKeepDaily
+	profile.RetentionKeepWeekly = input.RetentionKeepWeekly
+	profile.RetentionKeepMonthly = input.RetentionKeepMonthly
+	profile.RetentionKeepYearly = input.RetentionKeepYearly
+	profile.RetentionMinAgeDays = input.RetentionMinAgeDays
+	profile.RetentionMaxTotalBytes = input.RetentionMaxTotalBytes
+	normalizeRetention(profile)
+	// Copy targets stay unchanged if the input leaves them out
+	copyTargets := input.CopyTargets
+	if copyTargets == nil {
+		if err := DB.Where("backup_profile_id = ?", id).Find(&copyTargets).Error; err != nil {
+			return nil, err
+		}
+	}
+	if err := normalizeCopyTargets(profile.StorageLocationID, copyTargets); err != nil {
+		return nil, err
+	}
 	if err := DB.Save(profile).Error; err != nil {
 		return nil, err
 	}
+	if input.CopyTargets != nil {
+		if err := replaceCopyTargets(id, copyTargets); err != nil {
+			return nil, err
+		}
+	}
+	profile.CopyTargets = copyTargets
 
 	// Update schedule
 	scheduler := GetScheduler()
@@ -93,6 +218,7 @@ func ServiceDuplicateBackupProfile(id uint) (*entity.BackupProfile, error) {
 	// Clear associations to prevent GORM from modifying original records
 	duplicate.Commands = nil
 	duplicate.FileRules = nil
+	duplicate.CopyTargets = nil
 	duplicate.BackupRuns = nil
 	duplicate.Server = nil
 	duplicate.StorageLocation = nil
@@ -123,6 +249,11 @@ func ServiceDuplicateBackupProfile(id uint) (*entity.BackupProfile, error) {
 		}
 	}
 
+	// Duplicate copy targets
+	if err := replaceCopyTargets(duplicate.ID, original.CopyTargets); err != nil {
+		return nil, err
+	}
+
 	return &duplicate, nil
 }
 
@@ -134,11 +265,13 @@ func ServiceGetBackupProfileFull(id uint) (*entity.BackupProfile, error) {
 		Preload("NamingRule").
 		Preload("Commands").
 		Preload("FileRules").
+		Preload("CopyTargets").
 		First(&profile, id).Error; err != nil {
 		return nil, err
 	}
 	if profile.Server != nil {
 		profile.Server = sanitizeServer(profile.Server)
 	}
+	sanitizeStorageLocation(profile.StorageLocation)
 	return &profile, nil
 }
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"backapp-server/entity"
+)
+
+func TestListBackupProfilesHidesServerSecrets(t *testing.T) {
+	InitDB(filepath.Join(t.TempDir(), "test.db"))
+	server := &entity.Server{
+		Name:                 "secret",
+		Host:                 "example.com",
+		Port:                 22,
+		Username:             "backup",
+		AuthType:             "key",
+		Password:             "server-password",
+		PrivateKeyPath:       "/keys/id_server",
+		PrivateKeyPassphrase: "key-passphrase",
+	}
+	if err := DB.Create(server).Error; err != nil {
+		t.Fatal(err)
+	}
+	profile := &entity.BackupProfile{Name: "profile", ServerID: server.ID, StorageLocationID: 1, NamingRuleID: 1}
+	if err := DB.Create(profile).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	profiles, err := ServiceListBackupProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 1 || profiles[0].Server == nil || profiles[0].Server.Host != "example.com" {
+		t.Fatalf("profiles = %+v, want the profile with its server", profiles)
+	}
+	data, err := json.Marshal(profiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"server-password", "/keys/id_server", "key-passphrase"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("list response contains %q", secret)
+		}
+	}
+
+	stored, err := GetServerByID(server.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Password != "server-password" || stored.PrivateKeyPassphrase != "key-passphrase" {
+		t.Error("sanitizing the response changed the stored server")
+	}
+}
+
+func TestProfileStorageSupportsArchivesAndDedup(t *testing.T) {
+	InitDB(filepath.Join(t.TempDir(), "test.db"))
+	server := &entity.Server{Name: "server", Host: "example.com", Username: "backup", AuthType: "key"}
+	if err := DB.Create(server).Error; err != nil {
+		t.Fatal(err)
+	}
+	s3 := &entity.StorageLocation{Name: "s3", Type: storageS3, Endpoint: "http://127.0.0.1:1", Bucket: "backups"}
+	// Created directly, locations in dedup mode must be local
+	s3Dedup := &entity.StorageLocation{Name: "s3 dedup", Type: storageS3, Mode: "dedup", Endpoint: "http://127.0.0.1:1", Bucket: "backups"}
+	for _, location := range []*entity.StorageLocation{s3, s3Dedup} {
+		if err := DB.Create(location).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		locationID uint
+		format     string
+		want       string
+	}{
+		{"local archive", 1, "tar.gz", ""},
+		{"s3 without archive", s3.ID, "none", ""},
+		{"s3 default format", s3.ID, "", ""},
+		{"s3 archive", s3.ID, "tar.zst", "archives"},
+		{"s3 dedup", s3Dedup.ID, "none", "deduplication"},
+		{"missing location", 999, "none", "not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := &entity.BackupProfile{Name: tt.name, ServerID: server.ID, StorageLocationID: tt.locationID, NamingRuleID: 1, ArchiveFormat: tt.format}
+			_, err := ServiceCreateBackupProfile(profile)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("create = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("create = %v, want an error about %s", err, tt.want)
+			}
+
+			// Updating a valid profile to the same settings fails as well
+			valid := &entity.BackupProfile{Name: tt.name, ServerID: server.ID, StorageLocationID: 1, NamingRuleID: 1}
+			if _, err := ServiceCreateBackupProfile(valid); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ServiceUpdateBackupProfile(valid.ID, profile); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("update = %v, want an error about %s", err, tt.want)
+			}
+		})
+	}
+
+	// A local location archived into cannot become object storage
+	if _, err := ServiceUpdateStorageLocation(1, &entity.StorageLocation{Type: storageS3, Endpoint: "http://127.0.0.1:1", Bucket: "backups"}); err == nil || !strings.Contains(err.Error(), "archives") {
+		t.Errorf("changing an archived location to s3 = %v, want an error about archives", err)
+	}
+}
+
+func TestUnsupportedStorageIsLogged(t *testing.T) {
+	InitDB(filepath.Join(t.TempDir(), "test.db"))
+	location := &entity.StorageLocation{Name: "s3", Type: storageS3, Endpoint: "http://127.0.0.1:1", Bucket: "backups"}
+	if err := DB.Create(location).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Saved before profiles were checked against their location
+	profile := &entity.BackupProfile{Name: "profile", StorageLocationID: location.ID, NamingRuleID: 1, ArchiveFormat: "tar.gz"}
+	if err := DB.Create(profile).Error; err != nil {
+		t.Fatal(err)
+	}
+	profile.StorageLocation = location
+	run := &entity.BackupRun{BackupProfileID: profile.ID, Status: "running"}
+	if err := DB.Create(run).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewBackupExecutor().executeBackupInternal(profile, run); err == nil {
+		t.Fatal("archiving into s3 succeeded")
+	}
+	var logs []entity.BackupRunLog
+	if err := DB.Where("backup_run_id = ? AND level = ?", run.ID, "ERROR").Find(&logs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || !strings.Contains(logs[0].Message, "archives are only supported on local storage") {
+		t.Errorf("error logs = %+v", logs)
+	}
+}
@@ -1,6 +1,22 @@
 package service
 
-import "backapp-server/entity"
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"backapp-server/entity"
+
+	"gorm.io/gorm"
+)
 
 func ServiceCreateBackupRun(profileID uint) (*entity.BackupRun, error) {
 	run := &entity.BackupRun{
@@ -13,6 +29,46 @@ func ServiceCreateBackupRun(profileID uint) (*entity.BackupRun, error) {
 	return run, nil
 }
 
+// ServiceFailInterruptedRuns marks the runs a stopped server left as running
+// as failed and cleans up their files following the failed run cleanup of
+// their profile. It is called at startup before any backup starts.
+func ServiceFailInterruptedRuns() error {
+	var runs []entity.BackupRun
+	if err := DB.Where("status = ?", "running").Find(&runs).Error; err != nil {
+		return err
+	}
+	logf := NewBackupExecutor().logToDatabase
+	for i := range runs {
+		run := &runs[i]
+		if runActive(run.ID) {
+			continue
+		}
+		run.Status = "failed"
+		run.EndTime = time.Now()
+		run.ErrorMessage = "backup was interrupted by a server restart"
+		logf(run.ID, "ERROR", "Backup was interrupted by a server restart")
+
+		// Files of runs whose profile is gone are kept for inspection
+		policy := failedRunsKeep
+		var profile entity.BackupProfile
+		if err := DB.First(&profile, run.BackupProfileID).Error; err == nil {
+			policy = profile.FailedRunCleanup
+		}
+		if message, err := cleanupFailedRun(run, policy); err != nil {
+			logf(run.ID, "ERROR", fmt.Sprintf("Failed to clean up the interrupted run: %v", err))
+		} else if message != "" {
+			logf(run.ID, "INFO", message)
+		}
+		if err := DB.Save(run).Error; err != nil {
+			return err
+		}
+	}
+	if len(runs) > 0 {
+		log.Printf("Marked %d interrupted backup runs as failed", len(runs))
+	}
+	return nil
+}
+
 func ServiceListBackupRuns(profileID *int, status string) ([]entity.BackupRun, error) {
 	query := DB.Model(&entity.BackupRun{})
 	if profileID != nil {
@@ -36,6 +92,20 @@ func ServiceGetBackupRun(id uint) (*entity.BackupRun, error) {
 	return &run, nil
 }
 
+// ServiceGetBackupRunDetail returns a run together with the files it skipped
+// because of errors and its copies in secondary locations
+func ServiceGetBackupRunDetail(id uint) (*entity.BackupRun, error) {
+	var run entity.BackupRun
+	if err := DB.Preload("FileErrors", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id ASC")
+	}).Preload("Copies", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id ASC")
+	}).First(&run, id).Error; err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
 func ServiceListBackupFilesForRun(runID uint) ([]entity.BackupFile, error) {
 	var files []entity.BackupFile
 	if err := DB.Where("backup_run_id = ?", runID).Find(&files).Error; err != nil {
@@ -52,26 +122,247 @@ func ServiceGetBackupFile(fileID uint) (*entity.BackupFile, error) {
 	return &file, nil
 }
 
-// ServiceDeleteBackupRun deletes a backup run and associated files and logs
-func ServiceDeleteBackupRun(runID uint) error {
-	// Ensure it exists
-	var run entity.BackupRun
-	if err := DB.First(&run, runID).Error; err != nil {
-		return err
+// ServiceOpenBackupFile opens the content of a backup file for reading,
+// reassembling it from the chunk store if the run was deduplicated or
+// extracting it if the run was archived. Encrypted runs are decrypted while
+// reading. Files the primary location lost are read from a completed copy.
+// It returns an error wrapping os.ErrNotExist if the content is missing.
+func ServiceOpenBackupFile(file *entity.BackupFile) (io.ReadCloser, int64, error) {
+	run, err := ServiceGetBackupRun(file.BackupRunID)
+	if err != nil {
+		return nil, 0, err
+	}
+	backend, err := runBackend(run)
+	if err != nil {
+		if reader, size, copyErr := openCopiedFile(run, file); copyErr == nil {
+			return reader, size, nil
+		}
+		return nil, 0, err
+	}
+	reader, size, err := openBackupFile(run, file, backend)
+	if err != nil {
+		backend.Close()
+		// Fall back to a secondary location if the primary lost the file
+		if reader, size, copyErr := openCopiedFile(run, file); copyErr == nil {
+			return reader, size, nil
+		}
+		return nil, 0, err
+	}
+	if isLocalBackend(backend) {
+		// Local files stay seekable for range requests
+		return reader, size, nil
+	}
+	return &backendReader{ReadCloser: reader, backend: backend}, size, nil
+}
+
+// openBackupFile opens the content of a file of run stored in backend and
+// decrypts it if the run is encrypted
+func openBackupFile(run *entity.BackupRun, file *entity.BackupFile, backend storageBackend) (io.ReadCloser, int64, error) {
+	reader, size, err := openStoredFile(run, file, backend)
+	if err != nil || run.EncryptionKeyID == nil {
+		return reader, size, err
 	}
 
-	// Delete dependent records: logs and files
-	if err := DB.Where("backup_run_id = ?", runID).Delete(&entity.BackupRunLog{}).Error; err != nil {
-		return err
+	cipher, err := loadKeyCipher(*run.EncryptionKeyID)
+	if err != nil {
+		reader.Close()
+		return nil, 0, err
 	}
-	if err := DB.Where("backup_run_id = ?", runID).Delete(&entity.BackupFile{}).Error; err != nil {
-		return err
+	plain, err := cipher.Decrypt(reader)
+	if err != nil {
+		reader.Close()
+		return nil, 0, err
+	}
+	return &decryptingReader{Reader: plain, closer: reader}, file.SizeBytes, nil
+}
+
+// openStoredFile opens the content of a backup file as it is stored
+func openStoredFile(run *entity.BackupRun, file *entity.BackupFile, backend storageBackend) (io.ReadCloser, int64, error) {
+	if run.ManifestPath != "" {
+		return openManifestFile(run.ManifestPath, file.LocalPath)
+	}
+	if run.ArchivePath != "" {
+		return openArchiveFile(run.ArchivePath, file.LocalPath)
+	}
+	return backend.Open(file.LocalPath)
+}
+
+// ServiceBrowseBackupRun lists the directories and files of a run directly
+// below the remote directory dir
+func ServiceBrowseBackupRun(runID uint, dir string) ([]entity.FileSystemEntry, error) {
+	if _, err := ServiceGetBackupRun(runID); err != nil {
+		return nil, err
+	}
+	files, err := ServiceListBackupFilesForRun(runID)
+	if err != nil {
+		return nil, err
 	}
 
-	// Delete the run itself
-	if err := DB.Delete(&run).Error; err != nil {
+	dir = path.Clean("/" + dir)
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	entries := make(map[string]*entity.FileSystemEntry)
+	for _, file := range files {
+		remotePath := path.Clean("/" + file.RemotePath)
+		if !strings.HasPrefix(remotePath, prefix) {
+			continue
+		}
+		name, rest, isDir := strings.Cut(strings.TrimPrefix(remotePath, prefix), "/")
+		entry, ok := entries[name]
+		if !ok {
+			entry = &entity.FileSystemEntry{Name: name, Path: prefix + name, IsDir: isDir}
+			entries[name] = entry
+		}
+		entry.Size += file.SizeBytes
+		if !isDir && rest == "" {
+			entry.FileID = file.ID
+		}
+	}
+
+	results := make([]entity.FileSystemEntry, 0, len(entries))
+	for _, entry := range entries {
+		results = append(results, *entry)
+	}
+	// Sort: directories first, then by name
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].IsDir != results[j].IsDir {
+			return results[i].IsDir
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+// RestoreResult summarizes a restore of a backup run
+type RestoreResult struct {
+	TargetPath     string   `json:"target_path"`
+	Files          int      `json:"files"`
+	Bytes          int64    `json:"bytes"`
+	Directories    int      `json:"directories"`
+	Symlinks       int      `json:"symlinks"`
+	MetadataErrors []string `json:"metadata_errors,omitempty"`
+}
+
+// ServiceRestoreBackupRun writes all files of a run below targetPath, keeping
+// their remote directory structure. Files with a recorded checksum are
+// verified while they are written. Directories, symlinks, permissions,
+// ownership and mtimes are restored from the metadata sidecar if the run has
+// one.
+func ServiceRestoreBackupRun(runID uint, targetPath string) (*RestoreResult, error) {
+	if targetPath == "" {
+		return nil, fmt.Errorf("target path is required")
+	}
+	targetPath, err := filepath.Abs(targetPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target path: %v", err)
+	}
+	run, err := ServiceGetBackupRun(runID)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ServiceListBackupFilesForRun(runID)
+	if err != nil {
+		return nil, err
+	}
+
+	backend, err := runBackend(run)
+	if err != nil {
+		return nil, err
+	}
+	defer backend.Close()
+
+	result := &RestoreResult{TargetPath: targetPath}
+	for i := range files {
+		file := &files[i]
+		// Cleaning against the root keeps the file inside targetPath
+		destPath := filepath.Join(targetPath, filepath.FromSlash(path.Clean("/"+file.RemotePath)))
+		written, err := restoreBackupFile(run, file, backend, destPath)
+		if err != nil {
+			return result, fmt.Errorf("failed to restore %s: %v", file.RemotePath, err)
+		}
+		result.Files++
+		result.Bytes += written
+	}
+
+	if run.MetadataPath != "" {
+		meta, err := loadRunMetadata(backend, run.MetadataPath)
+		if err != nil {
+			return result, err
+		}
+		restoreRunMetadata(targetPath, meta, result)
+	}
+	return result, nil
+}
+
+// restoreBackupFile copies the content of file to destPath and verifies it
+// against the recorded checksum
+func restoreBackupFile(run *entity.BackupRun, file *entity.BackupFile, backend storageBackend, destPath string) (int64, error) {
+	reader, _, err := openBackupFile(run, file, backend)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return 0, err
+	}
+	destFile, err := os.Create(destPath)
+	if err != nil {
+		return 0, err
+	}
+	defer destFile.Close()
+
+	var writer io.Writer = destFile
+	sum, sumErr := newChecksum(file.ChecksumAlgorithm)
+	verify := file.Checksum != "" && sumErr == nil
+	if verify {
+		writer = io.MultiWriter(destFile, sum)
+	}
+	written, err := io.Copy(writer, reader)
+	if err != nil {
+		return written, err
+	}
+	if verify {
+		if actual := hex.EncodeToString(sum.Sum(nil)); actual != file.Checksum {
+			return written, fmt.Errorf("restored content does not match the recorded checksum (%s instead of %s)", actual, file.Checksum)
+		}
+	}
+	return written, destFile.Close()
+}
+
+// ServiceDeleteBackupRun deletes a backup run with its files and logs. With
+// keepFiles only the records go and the files stay in the storage location.
+// force also deletes runs left as running by an interrupted backup.
+func ServiceDeleteBackupRun(runID uint, keepFiles, force bool) error {
+	// Ensure it exists
+	var run entity.BackupRun
+	if err := DB.First(&run, runID).Error; err != nil {
 		return err
 	}
+	return deleteRun(&run, keepFiles, force)
+}
 
-	return nil
+// DeleteResult is the outcome of deleting one run of a bulk delete
+type DeleteResult struct {
+	RunID   uint   `json:"run_id"`
+	Deleted bool   `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ServiceDeleteBackupRuns deletes several runs, continuing after failures
+func ServiceDeleteBackupRuns(runIDs []uint, keepFiles, force bool) []DeleteResult {
+	results := make([]DeleteResult, 0, len(runIDs))
+	for _, runID := range runIDs {
+		result := DeleteResult{RunID: runID}
+		if err := ServiceDeleteBackupRun(runID, keepFiles, force); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				result.Error = "backup run not found"
+			} else {
+				result.Error = err.Error()
+			}
+		} else {
+			result.Deleted = true
+		}
+		results = append(results, result)
+	}
+	return results
 }
@@ -8,7 +8,7 @@ import (
 func ServiceGetBackupRunLogs(runID uint) ([]entity.BackupRunLog, error) {
 	var logs []entity.BackupRunLog
 	err := DB.Where("backup_run_id = ?", runID).
-		Order("timestamp ASC").
+		Order("timestamp ASC, id ASC").
 		Find(&logs).Error
 	return logs, err
 }
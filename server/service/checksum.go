@@ -0,0 +1,127 @@
+package service
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"path"
+	"strings"
+)
+
+// defaultChecksumAlgorithm is used when a profile does not choose one
+const defaultChecksumAlgorithm = "sha256"
+
+// checksumAlgorithms maps the supported algorithms to their hash constructor
+// and the coreutils command computing the same digest on the remote server
+var checksumAlgorithms = map[string]struct {
+	newHash func() hash.Hash
+	command string
+}{
+	"sha256": {sha256.New, "sha256sum"},
+	"sha512": {sha512.New, "sha512sum"},
+	"sha1":   {sha1.New, "sha1sum"},
+	"md5":    {md5.New, "md5sum"},
+}
+
+// normalizeChecksumAlgorithm defaults an empty algorithm and rejects unknown ones
+func normalizeChecksumAlgorithm(algorithm string) (string, error) {
+	if algorithm == "" {
+		return defaultChecksumAlgorithm, nil
+	}
+	if _, ok := checksumAlgorithms[algorithm]; !ok {
+		return "", fmt.Errorf("unsupported checksum_algorithm: %s", algorithm)
+	}
+	return algorithm, nil
+}
+
+// newChecksum returns a new hash for algorithm
+func newChecksum(algorithm string) (hash.Hash, error) {
+	algorithm, err := normalizeChecksumAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return checksumAlgorithms[algorithm].newHash(), nil
+}
+
+// ChecksumMismatchError is returned when a downloaded file does not match the
+// checksum computed on the remote server
+type ChecksumMismatchError struct {
+	Path   string
+	Local  string
+	Remote string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: local %s, remote %s", e.Path, e.Local, e.Remote)
+}
+
+// isChecksumMismatch reports whether err was caused by a checksum mismatch
+func isChecksumMismatch(err error) bool {
+	var mismatch *ChecksumMismatchError
+	return errors.As(err, &mismatch)
+}
+
+// RemoteChecksum computes the checksum of a remote file with the matching
+// coreutils command, e.g. sha256sum
+func (c *SSHClient) RemoteChecksum(remotePath, algorithm string) (string, error) {
+	algorithm, err := normalizeChecksumAlgorithm(algorithm)
+	if err != nil {
+		return "", err
+	}
+	output, err := c.RunCommand(shellPathCommand(checksumAlgorithms[algorithm].command, remotePath))
+	if err != nil {
+		return "", fmt.Errorf("failed to compute remote checksum of %s: %v: %s", remotePath, err, strings.TrimSpace(output))
+	}
+	fields := strings.Fields(strings.TrimPrefix(output, "\\"))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum output for %s", remotePath)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// RemoteChecksums computes the checksums of all regular files below root with
+// a single command and returns them keyed by remote path
+func (c *SSHClient) RemoteChecksums(root, algorithm string) (map[string]string, error) {
+	algorithm, err := normalizeChecksumAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	cmd := fmt.Sprintf("cd %s && find . -type f -exec %s {} +", shellQuote(optionSafePath(root)), checksumAlgorithms[algorithm].command)
+	return c.remoteChecksums(cmd, root)
+}
+
+// remoteChecksums runs cmd, which prints the checksums of files relative to
+// its working directory like sha256sum, and keys them by path below root
+func (c *SSHClient) remoteChecksums(cmd, root string) (map[string]string, error) {
+	output, _, err := c.runCommandOutput(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute remote checksums in %s: %v", root, err)
+	}
+
+	sums := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		// Names containing a backslash or newline are escaped and the line
+		// is prefixed with a backslash
+		escaped := strings.HasPrefix(line, "\\")
+		if escaped {
+			line = line[1:]
+		}
+		sum, name, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		name = strings.TrimPrefix(strings.TrimPrefix(name, " "), "*")
+		if escaped {
+			name = strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\r", "\r").Replace(name)
+		}
+		sums[path.Join(root, strings.TrimPrefix(name, "./"))] = strings.ToLower(sum)
+	}
+	return sums, nil
+}
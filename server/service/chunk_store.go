@@ -0,0 +1,344 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"backapp-server/entity"
+)
+
+// dedupChunkSize is the size of the chunks files are split into in a
+// deduplicating storage location
+const dedupChunkSize = 4 << 20
+
+// chunkStoreMu serializes writing manifests and garbage collection so that
+// chunks of a run being stored are never collected
+var chunkStoreMu sync.Mutex
+
+// runManifest lists the files of a run stored in a chunk store and the chunks
+// their content consists of
+type runManifest struct {
+	RunID     uint           `json:"run_id"`
+	CreatedAt time.Time      `json:"created_at"`
+	Files     []manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	LocalPath  string   `json:"local_path"`
+	RemotePath string   `json:"remote_path"`
+	Size       int64    `json:"size"`
+	Checksum   string   `json:"checksum,omitempty"`
+	Chunks     []string `json:"chunks"`
+}
+
+// chunkStoreStats summarizes how much of a run was already in the chunk store
+type chunkStoreStats struct {
+	NewChunks      int
+	NewBytes       int64
+	ReusedChunks   int
+	ReusedBytes    int64
+	ManifestPath   string
+	RemovedChunks  int
+	ReclaimedBytes int64
+}
+
+// chunkDir returns the directory holding the chunks of a storage location
+func chunkDir(basePath string) string {
+	return filepath.Join(basePath, ".chunks")
+}
+
+// manifestDir returns the directory holding the run manifests of a storage location
+func manifestDir(basePath string) string {
+	return filepath.Join(basePath, ".manifests")
+}
+
+// chunkPath returns where the chunk with the given hash is stored
+func chunkPath(basePath, sum string) string {
+	return filepath.Join(chunkDir(basePath), sum[:2], sum)
+}
+
+// storeLocationBasePath returns the storage location base path a manifest
+// belongs to
+func storeLocationBasePath(manifestPath string) string {
+	return filepath.Dir(filepath.Dir(manifestPath))
+}
+
+// ingestRunIntoChunkStore moves the downloaded files of a run into the chunk
+// store of basePath and writes the run manifest. The plain files are removed
+// afterwards, leaving backupDir empty.
+func ingestRunIntoChunkStore(basePath, backupDir string, runID uint, files []entity.BackupFile) (*chunkStoreStats, error) {
+	chunkStoreMu.Lock()
+	defer chunkStoreMu.Unlock()
+
+	stats := &chunkStoreStats{}
+	manifest := runManifest{RunID: runID, CreatedAt: time.Now()}
+	for _, file := range files {
+		chunks, err := storeFileChunks(basePath, file.LocalPath, stats)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store %s in chunk store: %v", file.LocalPath, err)
+		}
+		manifest.Files = append(manifest.Files, manifestFile{
+			LocalPath:  file.LocalPath,
+			RemotePath: file.RemotePath,
+			Size:       file.SizeBytes,
+			Checksum:   file.Checksum,
+			Chunks:     chunks,
+		})
+	}
+
+	stats.ManifestPath = filepath.Join(manifestDir(basePath), fmt.Sprintf("run-%d.json", runID))
+	if err := writeManifest(stats.ManifestPath, &manifest); err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if err := os.Remove(file.LocalPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove %s: %v", file.LocalPath, err)
+		}
+	}
+	removeEmptyDirs(backupDir)
+	return stats, nil
+}
+
+// storeFileChunks splits a file into chunks, stores the ones missing from the
+// chunk store and returns the hashes of all chunks in order
+func storeFileChunks(basePath, localPath string, stats *chunkStoreStats) ([]string, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	chunks := []string{}
+	buf := make([]byte, dedupChunkSize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			hash := hex.EncodeToString(sum[:])
+			stored, storeErr := storeChunk(basePath, hash, buf[:n])
+			if storeErr != nil {
+				return nil, storeErr
+			}
+			if stored {
+				stats.NewChunks++
+				stats.NewBytes += int64(n)
+			} else {
+				stats.ReusedChunks++
+				stats.ReusedBytes += int64(n)
+			}
+			chunks = append(chunks, hash)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return chunks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// storeChunk writes data under its hash unless the chunk already exists. It
+// reports whether the chunk was written.
+func storeChunk(basePath, hash string, data []byte) (bool, error) {
+	path := chunkPath(basePath, hash)
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func writeManifest(path string, manifest *runManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+func loadManifest(path string) (*runManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	var manifest runManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", path, err)
+	}
+	return &manifest, nil
+}
+
+// removeEmptyDirs removes root and all directories below it that are empty
+func removeEmptyDirs(root string) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			removeEmptyDirs(filepath.Join(root, entry.Name()))
+		}
+	}
+	// Fails on purpose if the directory still has content
+	os.Remove(root)
+}
+
+// deleteRunManifest removes the manifest of a run and garbage collects the
+// chunks no other run references
+func deleteRunManifest(manifestPath string) (*chunkStoreStats, error) {
+	chunkStoreMu.Lock()
+	defer chunkStoreMu.Unlock()
+
+	if err := os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove manifest: %v", err)
+	}
+	return collectChunks(storeLocationBasePath(manifestPath))
+}
+
+// collectChunks deletes all chunks of a storage location that are not
+// referenced by any manifest. chunkStoreMu must be held.
+func collectChunks(basePath string) (*chunkStoreStats, error) {
+	referenced := make(map[string]bool)
+	manifests, err := filepath.Glob(filepath.Join(manifestDir(basePath), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range manifests {
+		manifest, err := loadManifest(path)
+		if err != nil {
+			// Never delete chunks based on an incomplete picture
+			return nil, err
+		}
+		for _, file := range manifest.Files {
+			for _, chunk := range file.Chunks {
+				referenced[chunk] = true
+			}
+		}
+	}
+
+	stats := &chunkStoreStats{}
+	err = filepath.WalkDir(chunkDir(basePath), func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || referenced[entry.Name()] {
+			return nil
+		}
+		// Leftovers of interrupted writes are collected as well
+		if !strings.HasPrefix(entry.Name(), ".tmp-") && len(entry.Name()) != sha256.Size*2 {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		stats.RemovedChunks++
+		stats.ReclaimedBytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect chunks: %v", err)
+	}
+	return stats, nil
+}
+
+// chunkReader reads a file by concatenating its chunks
+type chunkReader struct {
+	basePath string
+	chunks   []string
+	current  *os.File
+}
+
+// openManifestFile returns a reader reassembling the file stored under
+// localPath in the manifest
+func openManifestFile(manifestPath, localPath string) (io.ReadCloser, int64, error) {
+	manifest, err := loadManifest(manifestPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, file := range manifest.Files {
+		if file.LocalPath == localPath {
+			return &chunkReader{basePath: storeLocationBasePath(manifestPath), chunks: file.Chunks}, file.Size, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("%s is not part of manifest %s: %w", localPath, manifestPath, os.ErrNotExist)
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			file, err := os.Open(chunkPath(r.basePath, r.chunks[0]))
+			if err != nil {
+				return 0, fmt.Errorf("missing chunk %s: %v", r.chunks[0], err)
+			}
+			r.current = file
+			r.chunks = r.chunks[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"backapp-server/entity"
+)
+
+// writeRunFiles writes the files of a run into backupDir and returns their
+// records
+func writeRunFiles(t *testing.T, backupDir string, contents map[string][]byte) []entity.BackupFile {
+	t.Helper()
+	var files []entity.BackupFile
+	for name, content := range contents {
+		localPath := filepath.Join(backupDir, name)
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(localPath, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, entity.BackupFile{LocalPath: localPath, RemotePath: "/" + name, SizeBytes: int64(len(content))})
+	}
+	return files
+}
+
+// readManifestFile reassembles a file from the chunk store, reading it in
+// pieces that do not line up with the chunks
+func readManifestFile(t *testing.T, manifestPath, localPath string) []byte {
+	t.Helper()
+	reader, size, err := openManifestFile(manifestPath, localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	var out bytes.Buffer
+	if _, err := io.CopyBuffer(struct{ io.Writer }{&out}, reader, make([]byte, 4097)); err != nil {
+		t.Fatalf("reading %s: %v", localPath, err)
+	}
+	if int64(out.Len()) != size {
+		t.Errorf("%s: read %d bytes, manifest size %d", localPath, out.Len(), size)
+	}
+	return out.Bytes()
+}
+
+// chunkCount returns the number of chunks stored in basePath
+func chunkCount(t *testing.T, basePath string) int {
+	t.Helper()
+	chunks, err := filepath.Glob(filepath.Join(chunkDir(basePath), "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(chunks)
+}
+
+func TestChunkStoreSharesChunksBetweenRuns(t *testing.T) {
+	base := t.TempDir()
+	shared := randomBytes(t, dedupChunkSize)
+	first := map[string][]byte{
+		"big.bin":    append(bytes.Clone(shared), randomBytes(t, 100)...),
+		"small.txt":  []byte("small"),
+		"empty":      {},
+		"sub/exact":  randomBytes(t, dedupChunkSize),
+		"sub/shared": shared,
+	}
+	second := map[string][]byte{
+		"big.bin":   append(bytes.Clone(shared), randomBytes(t, 200)...),
+		"small.txt": []byte("small"),
+	}
+
+	firstDir := filepath.Join(base, "first")
+	stats, err := ingestRunIntoChunkStore(base, firstDir, 1, writeRunFiles(t, firstDir, first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// shared, the tail of big.bin, small.txt and sub/exact
+	if stats.NewChunks != 4 || stats.ReusedChunks != 1 {
+		t.Errorf("first run stored %d new and %d reused chunks, want 4 and 1", stats.NewChunks, stats.ReusedChunks)
+	}
+	if _, err := os.Stat(firstDir); !os.IsNotExist(err) {
+		t.Errorf("backup directory of the first run still exists: %v", err)
+	}
+	firstManifest := stats.ManifestPath
+
+	secondDir := filepath.Join(base, "second")
+	stats, err = ingestRunIntoChunkStore(base, secondDir, 2, writeRunFiles(t, secondDir, second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NewChunks != 1 || stats.ReusedChunks != 2 || stats.ReusedBytes != dedupChunkSize+5 {
+		t.Errorf("second run stored %d new and %d reused chunks of %d bytes", stats.NewChunks, stats.ReusedChunks, stats.ReusedBytes)
+	}
+	secondManifest := stats.ManifestPath
+	if got := chunkCount(t, base); got != 5 {
+		t.Fatalf("chunk store holds %d chunks, want 5", got)
+	}
+
+	for name, content := range first {
+		if got := readManifestFile(t, firstManifest, filepath.Join(firstDir, name)); !bytes.Equal(got, content) {
+			t.Errorf("%s of the first run was not rebuilt", name)
+		}
+	}
+	if _, _, err := openManifestFile(firstManifest, filepath.Join(firstDir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("opening a file missing from the manifest = %v, want os.ErrNotExist", err)
+	}
+
+	// A leftover of an interrupted write is collected with the chunks
+	leftover := filepath.Join(chunkDir(base), "00", ".tmp-123")
+	if err := os.MkdirAll(filepath.Dir(leftover), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(leftover, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err = deleteRunManifest(firstManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tail of big.bin and sub/exact only belonged to the first run
+	if stats.RemovedChunks != 3 || stats.ReclaimedBytes != 100+dedupChunkSize+int64(len("partial")) {
+		t.Errorf("deleting the first run removed %d chunks of %d bytes", stats.RemovedChunks, stats.ReclaimedBytes)
+	}
+	for name, content := range second {
+		if got := readManifestFile(t, secondManifest, filepath.Join(secondDir, name)); !bytes.Equal(got, content) {
+			t.Errorf("%s of the second run was not rebuilt after deleting the first run", name)
+		}
+	}
+
+	if _, err := deleteRunManifest(secondManifest); err != nil {
+		t.Fatal(err)
+	}
+	if got := chunkCount(t, base); got != 0 {
+		t.Errorf("%d chunks are left after deleting all runs", got)
+	}
+}
+
+func TestCollectChunksKeepsChunksOfUnreadableManifests(t *testing.T) {
+	base := t.TempDir()
+	backupDir := filepath.Join(base, "run")
+	stats, err := ingestRunIntoChunkStore(base, backupDir, 1, writeRunFiles(t, backupDir, map[string][]byte{"file": []byte("data")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stats.ManifestPath, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chunkStoreMu.Lock()
+	_, err = collectChunks(base)
+	chunkStoreMu.Unlock()
+	if err == nil {
+		t.Error("collectChunks succeeded with an unreadable manifest")
+	}
+	if got := chunkCount(t, base); got != 1 {
+		t.Errorf("chunk store holds %d chunks, want 1", got)
+	}
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"backapp-server/entity"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Source types of a file rule
+const (
+	ruleSourcePath    = "path"
+	ruleSourceCommand = "command"
+)
+
+// Compression of command output
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// compressionExtensions are appended to output names that lack them
+var compressionExtensions = map[string]string{
+	compressionGzip: ".gz",
+	compressionZstd: ".zst",
+}
+
+// normalizeRuleSource defaults the source type and compression of rule and
+// validates the fields of command and docker rules. The output name of a
+// command rule is cleaned, gets the extension of its compression and becomes
+// the rule's remote path.
+func normalizeRuleSource(rule *entity.FileRule) error {
+	switch rule.Compression {
+	case "":
+		rule.Compression = compressionNone
+	case compressionNone, compressionGzip, compressionZstd:
+	default:
+		return fmt.Errorf("unsupported compression: %s", rule.Compression)
+	}
+
+	switch rule.SourceType {
+	case "", ruleSourcePath:
+		rule.SourceType = ruleSourcePath
+		rule.Command = ""
+		rule.OutputName = ""
+		rule.DockerTarget = ""
+		rule.DockerImage = ""
+		return nil
+	case ruleSourceDockerVolume, ruleSourceDockerContainer:
+		return normalizeDockerSource(rule)
+	case ruleSourceCommand:
+	default:
+		return fmt.Errorf("unsupported source_type: %s", rule.SourceType)
+	}
+
+	if strings.TrimSpace(rule.Command) == "" {
+		return fmt.Errorf("command is required for command rules")
+	}
+	name := path.Clean(strings.ReplaceAll(rule.OutputName, "\\", "/"))
+	if rule.OutputName == "" || name == "." || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("output_name must be a relative file name inside the backup directory")
+	}
+	if ext := compressionExtensions[rule.Compression]; !strings.HasSuffix(name, ext) {
+		name += ext
+	}
+	rule.OutputName = name
+	rule.RemotePath = name
+	rule.DockerTarget = ""
+	rule.DockerImage = ""
+	return nil
+}
+
+// newOutputCompressor wraps w with the compressor of compression, nil for none
+func newOutputCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case compressionGzip:
+		return gzip.NewWriter(w), nil
+	case compressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	default:
+		return nil, nil
+	}
+}
+
+// transferCommandOutput runs the command of rule on the remote server and
+// streams its stdout into the output file, compressing and encrypting it on
+// the way. Nothing is written to the remote disk. The checksum covers the
+// stored, compressed content; it cannot be verified remotely because running
+// the command again would produce different output.
+func (s *FileTransferService) transferCommandOutput(rule entity.FileRule) ([]entity.BackupFile, error) {
+	localPath := filepath.Join(s.destDir, filepath.FromSlash(rule.OutputName))
+	if err := s.mkdirAll(filepath.Dir(localPath)); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %v", err)
+	}
+	sum, err := newChecksum(s.options.ChecksumAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	// The size of the output is counted towards the total as it is written
+	s.progress.addTotal(1, 0)
+	progress := s.progress.file(-1)
+	defer progress.finish()
+	dst := s.newDestination(localPath, sum, progress)
+
+	s.logToDatabase("INFO", fmt.Sprintf("Streaming output of command into %s: %s", rule.OutputName, rule.Command))
+	started := time.Now()
+	stream, err := s.sshClient.StreamCommand(rule.Command)
+	if err != nil {
+		s.logToDatabase("ERROR", fmt.Sprintf("Failed to start command for %s: %v", rule.OutputName, err))
+		return nil, fmt.Errorf("failed to start command: %v", err)
+	}
+	defer stream.Close()
+
+	raw, stored, err := writeCommandOutput(stream, dst, rule.Compression)
+	if err == nil {
+		if err = stream.Wait(); err != nil {
+			err = fmt.Errorf("command failed: %v", err)
+		}
+	}
+	if err == nil {
+		err = dst.commit()
+	}
+	if err != nil {
+		dst.discard()
+		s.logToDatabase("ERROR", fmt.Sprintf("Failed to store output of command into %s: %v", rule.OutputName, err))
+		return nil, err
+	}
+
+	message := fmt.Sprintf("Stored %.2f KB of command output in %s", float64(raw)/1024, rule.OutputName)
+	if rule.Compression != compressionNone {
+		message += fmt.Sprintf(" (%.2f KB %s compressed)", float64(stored)/1024, rule.Compression)
+	}
+	s.logToDatabase("INFO", message)
+
+	modTime := started
+	return []entity.BackupFile{{
+		RemotePath:        rule.OutputName,
+		LocalPath:         localPath,
+		SizeBytes:         stored,
+		FileSize:          stored,
+		Checksum:          hex.EncodeToString(sum.Sum(nil)),
+		ChecksumAlgorithm: s.options.ChecksumAlgorithm,
+		ModTime:           &modTime,
+		FileRuleID:        rule.ID,
+	}}, nil
+}
+
+// writeCommandOutput copies r into the partial file of dst through the
+// compressor and returns the size of the output and of the stored content
+func writeCommandOutput(r io.Reader, dst *localDestination, compression string) (int64, int64, error) {
+	out, err := dst.open(0)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer out.Close()
+
+	stored := &countingWriter{w: out}
+	var w io.Writer = stored
+	compressor, err := newOutputCompressor(stored, compression)
+	if err != nil {
+		return 0, 0, err
+	}
+	if compressor != nil {
+		w = compressor
+	}
+	raw, err := io.Copy(w, r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read command output: %v", err)
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return 0, 0, err
+	}
+	return raw, stored.n, nil
+}
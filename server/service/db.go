@@ -4,6 +4,7 @@ import (
 	"backapp-server/entity"
 	"log"
 	"os"
+	"strings"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -29,15 +30,58 @@ func InitDB(dataSourceName string) {
 		&entity.BackupRun{},
 		&entity.BackupFile{},
 		&entity.BackupRunLog{},
+		&entity.BackupFileError{},
+		&entity.EncryptionKey{},
+		&entity.BackupProfileCopyTarget{},
+		&entity.BackupRunCopy{},
 	)
 	if err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
+	migrateCheckConstraints()
 
 	// Initialize default storage locations and naming rules
 	initializeDefaults()
 }
 
+// checkConstraintMigrations lists CHECK constraints together with a value they
+// must accept. SQLite keeps the constraint from the original CREATE TABLE, so
+// AutoMigrate alone does not pick up newly allowed values.
+var checkConstraintMigrations = []struct {
+	model      interface{}
+	table      string
+	name       string
+	mustAccept string
+}{
+	{&entity.Server{}, "servers", "chk_servers_auth_type", "'agent'"},
+	{&entity.FileRule{}, "file_rules", "chk_file_rules_source_type", "'docker_volume'"},
+	{&entity.StorageLocation{}, "storage_locations", "chk_storage_locations_type", "'webdav'"},
+}
+
+// migrateCheckConstraints recreates outdated CHECK constraints
+func migrateCheckConstraints() {
+	for _, m := range checkConstraintMigrations {
+		var ddl string
+		if err := DB.Raw("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", m.table).Scan(&ddl).Error; err != nil {
+			log.Printf("Error reading schema of %s: %v", m.table, err)
+			continue
+		}
+		if strings.Contains(ddl, m.mustAccept) {
+			continue
+		}
+		migrator := DB.Migrator()
+		if err := migrator.DropConstraint(m.model, m.name); err != nil {
+			log.Printf("Error dropping constraint %s: %v", m.name, err)
+			continue
+		}
+		if err := migrator.CreateConstraint(m.model, m.name); err != nil {
+			log.Printf("Error creating constraint %s: %v", m.name, err)
+			continue
+		}
+		log.Printf("Updated constraint %s", m.name)
+	}
+}
+
 func initializeDefaults() {
 	// Check if any storage locations exist
 	var storageCount int64
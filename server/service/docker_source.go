@@ -0,0 +1,207 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"backapp-server/entity"
+)
+
+// Docker source types of a file rule
+const (
+	ruleSourceDockerVolume    = "docker_volume"
+	ruleSourceDockerContainer = "docker_container"
+)
+
+const (
+	// defaultDockerImage runs tar for volume backups
+	defaultDockerImage = "alpine"
+	// dockerVolumeMount is where volumes are mounted in that container
+	dockerVolumeMount = "/backapp-volume"
+)
+
+var (
+	dockerNamePattern  = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+	dockerImagePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_./:@-]*$`)
+)
+
+// isDockerSource reports whether sourceType reads from Docker
+func isDockerSource(sourceType string) bool {
+	return sourceType == ruleSourceDockerVolume || sourceType == ruleSourceDockerContainer
+}
+
+// normalizeDockerSource validates the volume or container of a docker rule,
+// defaults its image and cleans the path inside it
+func normalizeDockerSource(rule *entity.FileRule) error {
+	if !dockerNamePattern.MatchString(rule.DockerTarget) {
+		return fmt.Errorf("docker_target must be a volume or container name")
+	}
+	if rule.SourceType == ruleSourceDockerVolume {
+		if rule.DockerImage == "" {
+			rule.DockerImage = defaultDockerImage
+		}
+		if !dockerImagePattern.MatchString(rule.DockerImage) {
+			return fmt.Errorf("invalid docker_image: %s", rule.DockerImage)
+		}
+	} else {
+		rule.DockerImage = ""
+		if rule.RemotePath == "" {
+			return fmt.Errorf("remote_path inside the container is required")
+		}
+	}
+	rule.RemotePath = path.Clean("/" + rule.RemotePath)
+	rule.Command = ""
+	rule.OutputName = ""
+	return nil
+}
+
+// dockerRecordedRoot returns the path the files of a docker rule are
+// recorded under, so that they do not collide with files of the host
+func dockerRecordedRoot(rule entity.FileRule) string {
+	kind := "containers"
+	if rule.SourceType == ruleSourceDockerVolume {
+		kind = "volumes"
+	}
+	return path.Join("/docker", kind, rule.DockerTarget, rule.RemotePath)
+}
+
+// dockerPath returns the path of the rule inside the container that reads it
+func dockerPath(rule entity.FileRule) string {
+	if rule.SourceType == ruleSourceDockerVolume {
+		return path.Join(dockerVolumeMount, rule.RemotePath)
+	}
+	return rule.RemotePath
+}
+
+// dockerCommand returns a host command running args in the container, or in
+// a temporary container that mounts the volume read-only
+func dockerCommand(rule entity.FileRule, args ...string) string {
+	if rule.SourceType == ruleSourceDockerVolume {
+		mount := rule.DockerTarget + ":" + dockerVolumeMount + ":ro"
+		return shellCommand("docker run --rm --network none -v", append([]string{mount, rule.DockerImage}, args...)...)
+	}
+	return shellCommand("docker exec", append([]string{rule.DockerTarget}, args...)...)
+}
+
+// checkDockerTarget makes sure the volume exists, docker run would silently
+// create an empty one, or that the container is running
+func (c *SSHClient) checkDockerTarget(rule entity.FileRule) error {
+	if rule.SourceType == ruleSourceDockerVolume {
+		if output, err := c.RunCommand(shellCommand("docker volume inspect --format '{{.Name}}'", rule.DockerTarget)); err != nil {
+			return fmt.Errorf("docker volume %s not found: %s", rule.DockerTarget, strings.TrimSpace(output))
+		}
+		return nil
+	}
+	output, err := c.RunCommand(shellCommand("docker inspect --type container --format '{{.State.Running}}'", rule.DockerTarget))
+	if err != nil {
+		return fmt.Errorf("docker container %s not found: %s", rule.DockerTarget, strings.TrimSpace(output))
+	}
+	if strings.TrimSpace(output) != "true" {
+		return fmt.Errorf("docker container %s is not running", rule.DockerTarget)
+	}
+	return nil
+}
+
+// transferDockerSource streams a volume or a path inside a container as tar
+// and unpacks it. The files are recorded below dockerRecordedRoot. Patterns
+// are applied while unpacking, tar inside the container may not support
+// excludes.
+func (s *FileTransferService) transferDockerSource(rule entity.FileRule, filter *fileFilter) ([]entity.BackupFile, error) {
+	if err := s.sshClient.checkDockerTarget(rule); err != nil {
+		s.logToDatabase("ERROR", err.Error())
+		return nil, err
+	}
+
+	dir := dockerPath(rule)
+	args := []string{"tar", "-cf", "-"}
+	if rule.SymlinkPolicy == symlinksFollow {
+		args = append(args, "-h")
+	}
+	args = append(args, "-C", dir, ".")
+
+	recorded := rule
+	recorded.RemotePath = dockerRecordedRoot(rule)
+	s.logToDatabase("INFO", fmt.Sprintf("Streaming %s from docker %s %s as tar", rule.RemotePath, strings.TrimPrefix(rule.SourceType, "docker_"), rule.DockerTarget))
+
+	remoteSums := func() (map[string]string, error) {
+		algorithm, err := normalizeChecksumAlgorithm(s.options.ChecksumAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		script := fmt.Sprintf("cd %s && find . -type f -exec %s {} +", shellQuote(optionSafePath(dir)), checksumAlgorithms[algorithm].command)
+		return s.sshClient.remoteChecksums(dockerCommand(rule, "sh", "-c", script), recorded.RemotePath)
+	}
+	return s.streamTar(recorded, filter, dockerCommand(rule, args...), remoteSums, false)
+}
+
+// DockerInventory lists the containers and volumes of a server
+type DockerInventory struct {
+	Containers []DockerContainer `json:"containers"`
+	Volumes    []DockerVolume    `json:"volumes"`
+}
+
+type DockerContainer struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Image  string `json:"image"`
+	State  string `json:"state"`
+	Status string `json:"status"`
+}
+
+type DockerVolume struct {
+	Name       string `json:"name"`
+	Driver     string `json:"driver"`
+	Mountpoint string `json:"mountpoint"`
+}
+
+// ServiceListServerDocker lists the containers and volumes on a server
+func ServiceListServerDocker(serverID uint) (*DockerInventory, error) {
+	server, err := GetServerByID(serverID)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewSSHClient(server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer client.Close()
+
+	if !client.HasCommand("docker") {
+		return nil, fmt.Errorf("docker is not installed on %s", server.Name)
+	}
+	inventory := &DockerInventory{Containers: []DockerContainer{}, Volumes: []DockerVolume{}}
+
+	output, _, err := client.runCommandOutput("docker ps --all --no-trunc --format '{{json .}}'")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+	for _, line := range strings.Split(output, "\n") {
+		var container struct{ ID, Names, Image, State, Status string }
+		if json.Unmarshal([]byte(line), &container) != nil {
+			continue
+		}
+		inventory.Containers = append(inventory.Containers, DockerContainer{
+			ID:     container.ID,
+			Name:   strings.Split(container.Names, ",")[0],
+			Image:  container.Image,
+			State:  container.State,
+			Status: container.Status,
+		})
+	}
+
+	output, _, err = client.runCommandOutput("docker volume ls --format '{{json .}}'")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes: %v", err)
+	}
+	for _, line := range strings.Split(output, "\n") {
+		var volume struct{ Name, Driver, Mountpoint string }
+		if json.Unmarshal([]byte(line), &volume) != nil {
+			continue
+		}
+		inventory.Volumes = append(inventory.Volumes, DockerVolume(volume))
+	}
+	return inventory, nil
+}
@@ -0,0 +1,272 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"backapp-server/entity"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Passphrase keys encrypt files with AES-256-GCM in chunks. The key
+// encryption key is derived once per key with scrypt, every file gets its own
+// key derived with HKDF from a random nonce in its header:
+//
+//	"backapp-aesgcm/v1\n" | 16 byte salt | 32 byte file nonce | chunks
+//
+// Each chunk holds up to aesChunkSize bytes of plaintext and is sealed with
+// the nonce counter (11 bytes, big endian) | last chunk flag (1 byte).
+const (
+	aesMagic     = "backapp-aesgcm/v1\n"
+	aesSaltSize  = 16
+	aesNonceSize = 32
+	aesChunkSize = 64 * 1024
+	// scrypt cost parameters of the key encryption key
+	aesScryptN = 1 << 15
+	aesScryptR = 8
+	aesScryptP = 1
+)
+
+// keyCipher encrypts and decrypts files with an encryption key
+type keyCipher struct {
+	key *entity.EncryptionKey
+
+	// age keys
+	recipient age.Recipient
+	identity  age.Identity
+
+	// passphrase keys
+	salt []byte
+	kek  []byte
+}
+
+// newKeyCipher prepares the cipher of key, deriving the key encryption key of
+// passphrase keys
+func newKeyCipher(key *entity.EncryptionKey) (*keyCipher, error) {
+	c := &keyCipher{key: key}
+	switch key.Type {
+	case "age":
+		recipient, err := age.ParseX25519Recipient(key.Recipient)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient of key %s: %v", key.Name, err)
+		}
+		c.recipient = recipient
+		if key.Secret != "" {
+			identity, err := age.ParseX25519Identity(key.Secret)
+			if err != nil {
+				return nil, fmt.Errorf("invalid age identity of key %s: %v", key.Name, err)
+			}
+			c.identity = identity
+		}
+	case "passphrase":
+		salt, err := hex.DecodeString(key.Salt)
+		if err != nil || len(salt) != aesSaltSize {
+			return nil, fmt.Errorf("invalid salt of key %s", key.Name)
+		}
+		c.salt = salt
+		c.kek, err = scrypt.Key([]byte(key.Secret), salt, aesScryptN, aesScryptR, aesScryptP, 32)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive key %s: %v", key.Name, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encryption key type: %s", key.Type)
+	}
+	return c, nil
+}
+
+// loadKeyCipher loads an encryption key and prepares its cipher
+func loadKeyCipher(keyID uint) (*keyCipher, error) {
+	var key entity.EncryptionKey
+	if err := DB.First(&key, keyID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load encryption key %d: %v", keyID, err)
+	}
+	return newKeyCipher(&key)
+}
+
+// Encrypt returns a writer encrypting everything written to it into w. Close
+// must be called to write the final chunk.
+func (c *keyCipher) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	if c.recipient != nil {
+		return age.Encrypt(w, c.recipient)
+	}
+
+	nonce := make([]byte, aesNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	aead, err := c.fileAEAD(nonce)
+	if err != nil {
+		return nil, err
+	}
+	header := append(append([]byte(aesMagic), c.salt...), nonce...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &aesStreamWriter{w: w, aead: aead, buf: make([]byte, 0, aesChunkSize)}, nil
+}
+
+// Decrypt returns a reader decrypting r
+func (c *keyCipher) Decrypt(r io.Reader) (io.Reader, error) {
+	if c.recipient != nil {
+		if c.identity == nil {
+			return nil, fmt.Errorf("key %s only holds the age recipient, decrypt the file offline with its identity", c.key.Name)
+		}
+		return age.Decrypt(r, c.identity)
+	}
+
+	header := make([]byte, len(aesMagic)+aesSaltSize+aesNonceSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %v", err)
+	}
+	if string(header[:len(aesMagic)]) != aesMagic {
+		return nil, errors.New("file is not encrypted with a passphrase key")
+	}
+	if !bytes.Equal(header[len(aesMagic):len(aesMagic)+aesSaltSize], c.salt) {
+		return nil, fmt.Errorf("file was not encrypted with key %s", c.key.Name)
+	}
+	aead, err := c.fileAEAD(header[len(aesMagic)+aesSaltSize:])
+	if err != nil {
+		return nil, err
+	}
+	return &aesStreamReader{r: bufio.NewReaderSize(r, aesChunkSize+aesOverhead), aead: aead}, nil
+}
+
+// fileAEAD derives the AES-GCM cipher of a single file
+func (c *keyCipher) fileAEAD(nonce []byte) (cipher.AEAD, error) {
+	fileKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.kek, nonce, []byte(aesMagic)), fileKey); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aesOverhead is the size of the authentication tag of every chunk
+const aesOverhead = 16
+
+// chunkNonce returns the nonce of chunk counter
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// aesStreamWriter seals chunks of plaintext. A full chunk is only written
+// once more data follows, so that the final chunk can always be flagged.
+type aesStreamWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+func (s *aesStreamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(s.buf) == aesChunkSize {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):aesChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *aesStreamWriter) flush(last bool) error {
+	sealed := s.aead.Seal(nil, chunkNonce(s.counter, last), s.buf, nil)
+	s.counter++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+func (s *aesStreamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.flush(true)
+}
+
+// aesStreamReader opens the chunks written by aesStreamWriter
+type aesStreamReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	done    bool
+}
+
+func (s *aesStreamReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *aesStreamReader) next() error {
+	sealed := make([]byte, aesChunkSize+aesOverhead)
+	n, err := io.ReadFull(s.r, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return errors.New("encrypted file is truncated")
+		}
+		return err
+	}
+	// A chunk is the last one if nothing follows it
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, peekErr := s.r.Peek(1); peekErr == io.EOF {
+			last = true
+		}
+	}
+
+	plain, err := s.aead.Open(sealed[:0], chunkNonce(s.counter, last), sealed[:n], nil)
+	if err != nil {
+		return errors.New("failed to decrypt file: wrong key or corrupted data")
+	}
+	s.counter++
+	s.buf = plain
+	s.done = last
+	return nil
+}
+
+// decryptingReader closes the underlying stored file of a decrypted stream
+type decryptingReader struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *decryptingReader) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"backapp-server/entity"
+
+	"filippo.io/age"
+	"gorm.io/gorm"
+)
+
+// sanitizeEncryptionKey removes the secret before a key is returned to clients
+func sanitizeEncryptionKey(key *entity.EncryptionKey) *entity.EncryptionKey {
+	key.Secret = ""
+	return key
+}
+
+func ServiceListEncryptionKeys() ([]entity.EncryptionKey, error) {
+	var keys []entity.EncryptionKey
+	if err := DB.Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		sanitizeEncryptionKey(&keys[i])
+	}
+	return keys, nil
+}
+
+// prepareEncryptionKey validates a new key and fills in generated values. It
+// reports whether the secret was generated and has to be shown to the user.
+func prepareEncryptionKey(key *entity.EncryptionKey) (bool, error) {
+	switch key.Type {
+	case "age":
+		if key.Secret != "" {
+			identity, err := age.ParseX25519Identity(key.Secret)
+			if err != nil {
+				return false, fmt.Errorf("invalid age identity: %v", err)
+			}
+			key.Recipient = identity.Recipient().String()
+			return false, nil
+		}
+		if key.Recipient != "" {
+			// Encrypt only, the identity stays offline
+			if _, err := age.ParseX25519Recipient(key.Recipient); err != nil {
+				return false, fmt.Errorf("invalid age recipient: %v", err)
+			}
+			return false, nil
+		}
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			return false, err
+		}
+		key.Secret = identity.String()
+		key.Recipient = identity.Recipient().String()
+		return true, nil
+	case "passphrase":
+		if len(key.Secret) < 8 {
+			return false, fmt.Errorf("passphrase must be at least 8 characters long")
+		}
+		salt := make([]byte, aesSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return false, err
+		}
+		key.Salt = hex.EncodeToString(salt)
+		key.Recipient = ""
+		return false, nil
+	default:
+		return false, fmt.Errorf("unsupported encryption key type: %s", key.Type)
+	}
+}
+
+// ServiceCreateEncryptionKey stores a new key. Generated age identities are
+// returned once so that they can be kept somewhere safe.
+func ServiceCreateEncryptionKey(input *entity.EncryptionKey) (*entity.EncryptionKey, error) {
+	key := &entity.EncryptionKey{
+		Name:      input.Name,
+		Type:      input.Type,
+		Recipient: input.Recipient,
+		Secret:    input.Secret,
+	}
+	generated, err := prepareEncryptionKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := DB.Create(key).Error; err != nil {
+		return nil, err
+	}
+	if !generated {
+		sanitizeEncryptionKey(key)
+	}
+	return key, nil
+}
+
+// ServiceRotateEncryptionKey replaces a key by a new one of the same type.
+// Profiles and storage locations switch to the new key, existing runs keep
+// being decrypted with the old key, which is retained. Passphrase keys need
+// the new passphrase, age keys may pass a new identity or recipient or get a
+// generated one.
+func ServiceRotateEncryptionKey(id uint, secret, recipient string) (*entity.EncryptionKey, error) {
+	var old entity.EncryptionKey
+	if err := DB.First(&old, id).Error; err != nil {
+		return nil, err
+	}
+	if old.RotatedAt != nil {
+		return nil, fmt.Errorf("key %s was already rotated", old.Name)
+	}
+
+	key := &entity.EncryptionKey{
+		Name:      old.Name,
+		Type:      old.Type,
+		Secret:    secret,
+		Recipient: recipient,
+	}
+	generated, err := prepareEncryptionKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(key).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&entity.BackupProfile{}).Where("encryption_key_id = ?", old.ID).
+			Update("encryption_key_id", key.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&entity.StorageLocation{}).Where("encryption_key_id = ?", old.ID).
+			Update("encryption_key_id", key.ID).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		return tx.Model(&old).Updates(map[string]interface{}{
+			"rotated_at":    &now,
+			"rotated_to_id": key.ID,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !generated {
+		sanitizeEncryptionKey(key)
+	}
+	return key, nil
+}
+
+// ServiceDeleteEncryptionKey deletes a key that no profile, storage location
+// or run uses anymore
+func ServiceDeleteEncryptionKey(id uint) error {
+	var key entity.EncryptionKey
+	if err := DB.First(&key, id).Error; err != nil {
+		return err
+	}
+	for _, model := range []interface{}{&entity.BackupProfile{}, &entity.StorageLocation{}, &entity.BackupRun{}} {
+		var count int64
+		if err := DB.Model(model).Where("encryption_key_id = ?", id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("encryption key %s is still in use", key.Name)
+		}
+	}
+	return DB.Delete(&key).Error
+}
+
+// normalizeEncryptionKeyID checks that new runs can be encrypted with the
+// referenced key. An id of 0 means no encryption.
+func normalizeEncryptionKeyID(id *uint) (*uint, error) {
+	if id == nil || *id == 0 {
+		return nil, nil
+	}
+	var key entity.EncryptionKey
+	if err := DB.First(&key, *id).Error; err != nil {
+		return nil, fmt.Errorf("encryption key %d not found", *id)
+	}
+	if key.RotatedAt != nil {
+		return nil, fmt.Errorf("encryption key %s was rotated, use its replacement", key.Name)
+	}
+	return id, nil
+}
+
+// profileEncryptionKeyID returns the key new runs of a profile are encrypted
+// with, or nil if they are stored in plaintext
+func profileEncryptionKeyID(profile *entity.BackupProfile) *uint {
+	if profile.EncryptionKeyID != nil {
+		return profile.EncryptionKeyID
+	}
+	if profile.StorageLocation != nil {
+		return profile.StorageLocation.EncryptionKeyID
+	}
+	return nil
+}
+
+// sameEncryptionKey reports whether two runs were stored with the same key
+func sameEncryptionKey(a, b *uint) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"backapp-server/entity"
+)
+
+// newTestPassphraseCipher prepares a passphrase key without storing it
+func newTestPassphraseCipher(t *testing.T, passphrase string) *keyCipher {
+	t.Helper()
+	key := &entity.EncryptionKey{Name: "test", Type: "passphrase", Secret: passphrase}
+	if _, err := prepareEncryptionKey(key); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newKeyCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// encryptBytes encrypts data with c, writing it in pieces of odd sizes
+func encryptBytes(t *testing.T, c *keyCipher, data []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := c.Encrypt(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 1000+len(rest)%7777)
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// decryptBytes decrypts all of data with c
+func decryptBytes(c *keyCipher, data []byte) ([]byte, error) {
+	r, err := c.Decrypt(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// randomBytes returns n random bytes
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPassphraseStreamRoundTrip(t *testing.T) {
+	c := newTestPassphraseCipher(t, "correct horse")
+	header := len(aesMagic) + aesSaltSize + aesNonceSize
+	tests := []struct {
+		name   string
+		size   int
+		chunks int
+	}{
+		{"empty", 0, 1},
+		{"shorter than a chunk", 100, 1},
+		{"one chunk", aesChunkSize, 1},
+		{"exact multiple of the chunk size", 3 * aesChunkSize, 3},
+		{"several chunks", 3*aesChunkSize + 17, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := randomBytes(t, tt.size)
+			encrypted := encryptBytes(t, c, data)
+			if want := header + tt.size + tt.chunks*aesOverhead; len(encrypted) != want {
+				t.Errorf("encrypted size = %d, want %d", len(encrypted), want)
+			}
+			got, err := decryptBytes(c, encrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("decrypted %d bytes, they differ from the %d bytes written", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestPassphraseStreamRejectsTruncation(t *testing.T) {
+	c := newTestPassphraseCipher(t, "correct horse")
+	header := len(aesMagic) + aesSaltSize + aesNonceSize
+	sealedChunk := aesChunkSize + aesOverhead
+	tests := []struct {
+		name   string
+		size   int
+		length int
+	}{
+		{"empty without its chunk", 0, header},
+		{"header only", 3*aesChunkSize + 17, header},
+		{"at the first chunk boundary", 3*aesChunkSize + 17, header + sealedChunk},
+		{"before the last chunk", 3*aesChunkSize + 17, header + 3*sealedChunk},
+		{"before the last full chunk", 3 * aesChunkSize, header + 2*sealedChunk},
+		{"inside a chunk", 3*aesChunkSize + 17, header + sealedChunk + 100},
+		{"inside the last chunk", 100, header + 50},
+		{"inside the header", 100, header - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted := encryptBytes(t, c, randomBytes(t, tt.size))
+			if _, err := decryptBytes(c, encrypted[:tt.length]); err == nil {
+				t.Errorf("file of %d bytes truncated to %d of %d bytes was accepted", tt.size, tt.length, len(encrypted))
+			}
+		})
+	}
+}
+
+func TestPassphraseStreamRejectsWrongKey(t *testing.T) {
+	c := newTestPassphraseCipher(t, "correct horse")
+	encrypted := encryptBytes(t, c, randomBytes(t, 2*aesChunkSize+5))
+
+	other := newTestPassphraseCipher(t, "battery staple")
+	if _, err := decryptBytes(other, encrypted); err == nil || !strings.Contains(err.Error(), "not encrypted with key") {
+		t.Errorf("decrypt with another key = %v, want an error about the key", err)
+	}
+
+	// Same salt, other passphrase
+	key := *c.key
+	key.Secret = "battery staple"
+	sameSalt, err := newKeyCipher(&key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptBytes(sameSalt, encrypted); err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Errorf("decrypt with the wrong passphrase = %v, want an error about the key", err)
+	}
+
+	tampered := bytes.Clone(encrypted)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := decryptBytes(c, tampered); err == nil {
+		t.Error("tampered file was accepted")
+	}
+}
+
+func TestDecryptAfterKeyRotation(t *testing.T) {
+	for _, tt := range []struct {
+		keyType string
+		secret  string
+		rotated string
+	}{
+		{"passphrase", "correct horse", "battery staple"},
+		{"age", "", ""},
+	} {
+		t.Run(tt.keyType, func(t *testing.T) {
+			profile, location := newRunTestProfile(t, failedRunsKeep)
+			key, err := ServiceCreateEncryptionKey(&entity.EncryptionKey{Name: "key", Type: tt.keyType, Secret: tt.secret})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := loadKeyCipher(key.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := randomBytes(t, aesChunkSize+1)
+			stored := filepath.Join(location.BasePath, "run", "file")
+			if err := os.MkdirAll(filepath.Dir(stored), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(stored, encryptBytes(t, c, data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			run := &entity.BackupRun{BackupProfileID: profile.ID, Status: "completed", StorageLocationID: &location.ID, EncryptionKeyID: &key.ID}
+			if err := DB.Create(run).Error; err != nil {
+				t.Fatal(err)
+			}
+			file := &entity.BackupFile{BackupRunID: run.ID, RemotePath: "/file", LocalPath: stored, SizeBytes: int64(len(data))}
+			if err := DB.Create(file).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			rotated, err := ServiceRotateEncryptionKey(key.ID, tt.rotated, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rotated.ID == key.ID {
+				t.Fatal("rotation kept the key")
+			}
+			reader, _, err := ServiceOpenBackupFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("reading a file written before the rotation: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("file written before the rotation decrypted to other content")
+			}
+
+			newCipher, err := loadKeyCipher(rotated.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := decryptBytes(newCipher, encryptBytes(t, newCipher, data)); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("round trip with the rotated key: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"backapp-server/entity"
+)
+
+// Error policies of a profile
+const (
+	errorPolicyStop      = "stop"
+	errorPolicySkip      = "skip"
+	errorPolicyThreshold = "threshold"
+)
+
+// normalizeErrorPolicy defaults an empty error policy and rejects unknown ones
+func normalizeErrorPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return errorPolicyStop, nil
+	case errorPolicyStop, errorPolicySkip, errorPolicyThreshold:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unsupported error_policy: %s", policy)
+	}
+}
+
+// errTooManyFailures aborts a run with the threshold error policy
+var errTooManyFailures = errors.New("too many failed files")
+
+// fileFailed records that remotePath could not be backed up. It returns err
+// if the error policy aborts the run, or nil if the run continues without the
+// file.
+func (s *FileTransferService) fileFailed(rule entity.FileRule, remotePath string, err error) error {
+	if s.options.ErrorPolicy == "" || s.options.ErrorPolicy == errorPolicyStop {
+		return err
+	}
+
+	s.failuresMu.Lock()
+	s.failures = append(s.failures, entity.BackupFileError{
+		BackupRunID: s.runID,
+		FileRuleID:  rule.ID,
+		RemotePath:  remotePath,
+		Error:       err.Error(),
+	})
+	failed := len(s.failures)
+	s.failuresMu.Unlock()
+
+	if s.options.ErrorPolicy == errorPolicyThreshold && failed > s.options.MaxFailedFiles {
+		return fmt.Errorf("%w: %d files failed, more than the %d allowed: %v", errTooManyFailures, failed, s.options.MaxFailedFiles, err)
+	}
+	s.logToDatabase("WARNING", fmt.Sprintf("Skipping %s: %v", remotePath, err))
+	return nil
+}
+
+// Failures returns the files that were skipped because of errors
+func (s *FileTransferService) Failures() []entity.BackupFileError {
+	s.failuresMu.Lock()
+	defer s.failuresMu.Unlock()
+	return append([]entity.BackupFileError(nil), s.failures...)
+}
+
+// Messages of GNU and BSD tar and find about single files they could not
+// read, e.g. "tar: ./a: Cannot open: Permission denied" or
+// "find: './b': Permission denied"
+var (
+	tarFileError  = regexp.MustCompile(`^tar: (.+?): ((?:Cannot|Can't|Couldn't) .+|.*[Pp]ermission denied.*)$`)
+	findFileError = regexp.MustCompile(`^find: [‘'](.+)[’']: (.+)$`)
+)
+
+// tarFileErrors returns the files tar or find reported as unreadable on
+// stderr, keyed by their path relative to the archive root. ok is false if
+// stderr contains any other error, which means the archive cannot be trusted.
+func tarFileErrors(stderr string) (failed map[string]string, ok bool) {
+	failed = make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" ||
+			strings.HasPrefix(line, "tar: Exiting with failure status") ||
+			strings.HasPrefix(line, "tar: Error exit delayed") ||
+			strings.HasSuffix(line, "file changed as we read it") ||
+			strings.HasPrefix(line, "find: File system loop detected") {
+			continue
+		}
+		if m := tarFileError.FindStringSubmatch(line); m != nil {
+			failed[m[1]] = m[2]
+		} else if m := findFileError.FindStringSubmatch(line); m != nil {
+			failed[m[1]] = m[2]
+		} else {
+			return nil, false
+		}
+	}
+	return failed, len(failed) > 0
+}
@@ -3,9 +3,9 @@ package service
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
-	"strings"
 
 	"backapp-server/entity"
 )
@@ -17,8 +17,9 @@ func ServiceListServerFiles(serverId uint, remotePath string) ([]entity.FileSyst
 		return nil, err
 	}
 
-	// For local servers, use local filesystem
-	if server.Host == "localhost" || server.Host == "127.0.0.1" {
+	// For local servers, use local filesystem. Behind a jump host "localhost"
+	// refers to the jump host itself, so those still go through SSH.
+	if server.JumpHostID == nil && (server.Host == "localhost" || server.Host == "127.0.0.1") {
 		return listLocalFiles(remotePath)
 	}
 
@@ -78,49 +79,21 @@ func listRemoteFiles(client *SSHClient, remotePath string) ([]entity.FileSystemE
 		remotePath = "/home"
 	}
 
-	// Use ls command to list files
-	cmd := fmt.Sprintf("ls -la %s", remotePath)
-	output, err := client.RunCommand(cmd)
+	infos, err := client.ReadDir(remotePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list remote files: %w", err)
 	}
 
-	var results []entity.FileSystemEntry
-	lines := strings.Split(string(output), "\n")
-
-	for _, line := range lines {
-		if line == "" || strings.HasPrefix(line, "total") {
-			continue
-		}
-
-		// Parse ls -la output: permissions links owner group size date... name
-		parts := strings.Fields(line)
-		if len(parts) < 9 {
-			continue
-		}
-
-		// Skip "." and ".."
-		name := parts[len(parts)-1]
-		if name == "." || name == ".." {
-			continue
-		}
-
-		isDir := strings.HasPrefix(parts[0], "d")
+	results := make([]entity.FileSystemEntry, 0, len(infos))
+	for _, info := range infos {
 		size := int64(0)
-		if !isDir {
-			fmt.Sscanf(parts[4], "%d", &size)
+		if !info.IsDir() {
+			size = info.Size
 		}
-
-		path := remotePath
-		if !strings.HasSuffix(path, "/") {
-			path += "/"
-		}
-		path += name
-
 		results = append(results, entity.FileSystemEntry{
-			Name:  name,
-			Path:  path,
-			IsDir: isDir,
+			Name:  path.Base(info.Path),
+			Path:  info.Path,
+			IsDir: info.IsDir(),
 			Size:  size,
 		})
 	}
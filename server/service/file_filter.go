@@ -0,0 +1,274 @@
+package service
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"backapp-server/entity"
+)
+
+// filePattern is a single gitignore style pattern
+type filePattern struct {
+	text string
+	// negate re-includes what earlier patterns matched ("!pattern")
+	negate bool
+	// dirOnly only matches directories ("pattern/")
+	dirOnly bool
+	// anchored patterns are matched against the path relative to the rule
+	// root ("/pattern" or "a/b"), others against any trailing part of it
+	anchored bool
+	segments []string
+}
+
+// fileFilter decides which files below the remote path of a rule are backed
+// up. Patterns follow gitignore semantics:
+//
+//   - "*" and "?" match within a path segment, "**" matches any number of
+//     segments
+//   - a leading or inner "/" anchors a pattern at the rule root, otherwise it
+//     matches at any depth
+//   - a trailing "/" only matches directories
+//   - "!" negates a pattern, the last matching pattern wins
+//   - files below an excluded directory cannot be re-included
+//
+// A file is backed up if no exclude pattern matches it or any of its parent
+// directories and, when include patterns are set, an include pattern matches
+// it or one of its parent directories and no negated one does.
+type fileFilter struct {
+	excludes []filePattern
+	includes []filePattern
+}
+
+// splitFilePatterns splits pattern text into lines. Commas separate patterns
+// as well, so that the comma lists of older rules keep working.
+func splitFilePatterns(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return r == '\n' || r == '\r' || r == ','
+	})
+}
+
+// parseFilePatterns parses gitignore style patterns, ignoring blank lines and
+// comments
+func parseFilePatterns(text string) ([]filePattern, error) {
+	var patterns []filePattern
+	for _, line := range splitFilePatterns(text) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := filePattern{text: line}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.HasPrefix(line, "/") {
+			p.anchored = true
+			line = strings.TrimLeft(line, "/")
+		} else if strings.Contains(line, "/") {
+			p.anchored = true
+		}
+		if line == "" {
+			return nil, fmt.Errorf("invalid pattern %q", p.text)
+		}
+
+		if !p.anchored {
+			p.segments = append(p.segments, "**")
+		}
+		for _, segment := range strings.Split(line, "/") {
+			if segment == "" {
+				continue
+			}
+			if segment == "**" {
+				if len(p.segments) > 0 && p.segments[len(p.segments)-1] == "**" {
+					continue
+				}
+			} else if _, err := path.Match(segment, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", p.text, err)
+			}
+			p.segments = append(p.segments, segment)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// newFileFilter parses the include and exclude patterns of a rule
+func newFileFilter(rule entity.FileRule) (*fileFilter, error) {
+	excludes, err := parseFilePatterns(rule.ExcludePattern)
+	if err != nil {
+		return nil, fmt.Errorf("exclude_pattern: %v", err)
+	}
+	includes, err := parseFilePatterns(rule.IncludePattern)
+	if err != nil {
+		return nil, fmt.Errorf("include_pattern: %v", err)
+	}
+	return &fileFilter{excludes: excludes, includes: includes}, nil
+}
+
+// matchSegments matches path segments against pattern segments
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			if len(rest) == 0 {
+				// A trailing "**" matches everything inside, not the directory itself
+				return len(name) > 0
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(rest, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// lastMatch returns the last pattern matching the path segments, or nil
+func lastMatch(patterns []filePattern, segments []string, isDir bool) *filePattern {
+	var match *filePattern
+	for i := range patterns {
+		p := &patterns[i]
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if matchSegments(p.segments, segments) {
+			match = p
+		}
+	}
+	return match
+}
+
+// Excluded reports whether relPath, relative to the rule root, or one of its
+// parent directories is excluded
+func (f *fileFilter) Excluded(relPath string, isDir bool) bool {
+	if f == nil || len(f.excludes) == 0 {
+		return false
+	}
+	segments := strings.Split(relPath, "/")
+	for i := range segments {
+		match := lastMatch(f.excludes, segments[:i+1], isDir || i < len(segments)-1)
+		if match != nil && !match.negate {
+			return true
+		}
+	}
+	return false
+}
+
+// Included reports whether relPath or one of its parent directories matches
+// the include patterns. Like with excludes, a negated pattern matching a
+// parent directory cannot be overridden further down.
+func (f *fileFilter) Included(relPath string, isDir bool) bool {
+	if f == nil || len(f.includes) == 0 {
+		return true
+	}
+	included := false
+	segments := strings.Split(relPath, "/")
+	for i := range segments {
+		match := lastMatch(f.includes, segments[:i+1], isDir || i < len(segments)-1)
+		if match == nil {
+			continue
+		}
+		if match.negate {
+			return false
+		}
+		included = true
+	}
+	return included
+}
+
+// Matches reports whether the file at relPath is backed up
+func (f *fileFilter) Matches(relPath string) bool {
+	return !f.Excluded(relPath, false) && f.Included(relPath, false)
+}
+
+// pushdownSegment reports whether a single pattern segment means the same to
+// find -name and tar --exclude as it does here. "*" is only allowed at either
+// end, because tar lets it match across "/".
+func pushdownSegment(segment string) bool {
+	if strings.ContainsAny(segment, `?[\`) {
+		return false
+	}
+	return !strings.Contains(strings.Trim(segment, "*"), "*")
+}
+
+// pushdownPatterns returns the exclude patterns that can be evaluated
+// remotely. Negated patterns could re-include anything, so nothing is pushed
+// down when there are any.
+func (f *fileFilter) pushdownPatterns() []filePattern {
+	if f == nil {
+		return nil
+	}
+	var patterns []filePattern
+	for _, p := range f.excludes {
+		if p.negate {
+			return nil
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+// FindPruneArgs returns find arguments that prune what the exclude patterns
+// exclude below root, so that excluded trees are never walked. Patterns find
+// cannot evaluate exactly are left to Excluded.
+func (f *fileFilter) FindPruneArgs(root string) string {
+	prefix := strings.TrimSuffix(root, "/") + "/"
+	literalRoot := !strings.ContainsAny(root, `*?[\`)
+
+	var tests []string
+	for _, p := range f.pushdownPatterns() {
+		var test string
+		switch {
+		case !p.anchored && len(p.segments) == 2 && pushdownSegment(p.segments[1]):
+			test = "-name " + shellQuote(p.segments[1])
+		case p.anchored && literalRoot && !strings.ContainsAny(strings.Join(p.segments, "/"), `*?[\`):
+			test = "-path " + shellQuote(prefix+strings.Join(p.segments, "/"))
+		default:
+			continue
+		}
+		if p.dirOnly {
+			test = `\( -type d ` + test + ` \)`
+		}
+		tests = append(tests, test)
+	}
+	if len(tests) == 0 {
+		return ""
+	}
+	return `\( ` + strings.Join(tests, " -o ") + ` \) -prune -o`
+}
+
+// TarExcludeArgs returns tar --exclude options for the exclude patterns tar
+// matches the same way. Anything else is filtered while unpacking.
+func (f *fileFilter) TarExcludeArgs() string {
+	var args []string
+	for _, p := range f.pushdownPatterns() {
+		if p.anchored || p.dirOnly || len(p.segments) != 2 || !pushdownSegment(p.segments[1]) {
+			continue
+		}
+		args = append(args, "--exclude="+shellQuote(p.segments[1]))
+	}
+	return strings.Join(args, " ")
+}
+
+// relativeRemotePath returns remotePath relative to root
+func relativeRemotePath(root, remotePath string) string {
+	root = path.Clean(root)
+	rel := strings.TrimPrefix(path.Clean(remotePath), root)
+	return strings.TrimPrefix(rel, "/")
+}
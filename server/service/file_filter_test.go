@@ -0,0 +1,245 @@
+package service
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"backapp-server/entity"
+)
+
+func mustFileFilter(t *testing.T, exclude, include string) *fileFilter {
+	t.Helper()
+	filter, err := newFileFilter(entity.FileRule{ExcludePattern: exclude, IncludePattern: include})
+	if err != nil {
+		t.Fatalf("newFileFilter(%q, %q): %v", exclude, include, err)
+	}
+	return filter
+}
+
+func TestFileFilterMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		exclude string
+		include string
+		path    string
+		want    bool
+	}{
+		{"no patterns", "", "", "a/b.txt", true},
+		{"extension", "*.log", "", "app.log", false},
+		{"extension at depth", "*.log", "", "var/app.log", false},
+		{"other extension", "*.log", "", "app.txt", true},
+		{"unanchored name", "log", "", "log", false},
+		{"unanchored directory", "log", "", "srv/log/app.txt", false},
+		{"no partial segment", "log", "", "srv/catalog", true},
+		{"no partial parent", "log", "", "catalog/app.txt", true},
+		{"leading slash anchors", "/build", "", "build/out.o", false},
+		{"anchored only at root", "/build", "", "src/build/out.o", true},
+		{"inner slash anchors", "a/b", "", "a/b", false},
+		{"inner slash not at depth", "a/b", "", "x/a/b", true},
+		{"dir only matches directory", "cache/", "", "cache/entry", false},
+		{"dir only skips file", "cache/", "", "cache", true},
+		{"dir only skips nested file", "cache/", "", "sub/cache", true},
+		{"double star inside", "**/tmp/**", "", "a/b/tmp/x", false},
+		{"double star at root", "**/tmp/**", "", "tmp/x", false},
+		{"trailing double star skips directory itself", "**/tmp/**", "", "tmp", true},
+		{"double star zero segments", "docs/**/*.md", "", "docs/a.md", false},
+		{"double star many segments", "docs/**/*.md", "", "docs/x/y/a.md", false},
+		{"double star anchored", "docs/**/*.md", "", "a/docs/a.md", true},
+		{"negation re-includes", "*.log\n!keep.log", "", "keep.log", true},
+		{"negation keeps others excluded", "*.log\n!keep.log", "", "app.log", false},
+		{"last pattern wins", "!keep.log\n*.log", "", "keep.log", false},
+		{"no re-include below excluded dir", "logs/\n!logs/keep.txt", "", "logs/keep.txt", false},
+		{"escaped bang", `\!important`, "", "!important", false},
+		{"comments and blank lines", "# *.txt\n\n", "", "a.txt", true},
+		{"comma separated", "a.txt, b.txt", "", "b.txt", false},
+		{"include extension", "", "*.conf", "etc/app.conf", true},
+		{"include misses", "", "*.conf", "etc/app.txt", false},
+		{"include directory", "", "etc/", "etc/nginx/nginx.conf", true},
+		{"include directory only at root", "", "/etc/", "srv/etc/app.conf", false},
+		{"include negation", "", "etc/\n!etc/secret", "etc/secret", false},
+		{"include negated parent", "", "etc/\n!etc/secret/", "etc/secret/key", false},
+		{"exclude beats include", "*.bak", "etc/", "etc/app.bak", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := mustFileFilter(t, tt.exclude, tt.include)
+			if got := filter.Matches(tt.path); got != tt.want {
+				t.Errorf("Matches(%q) with exclude %q, include %q = %v, want %v", tt.path, tt.exclude, tt.include, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileFilterExcludedAndIncluded(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		{"cache/", "cache", true, true},
+		{"cache/", "cache", false, false},
+		{"/build", "build", true, true},
+		{"**/tmp/**", "tmp", true, false},
+		{"**/tmp/**", "tmp/sub", true, true},
+		{"log", "srv/catalog", true, false},
+	}
+	for _, tt := range tests {
+		filter := mustFileFilter(t, tt.pattern, "")
+		if got := filter.Excluded(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("Excluded(%q, %v) with %q = %v, want %v", tt.path, tt.isDir, tt.pattern, got, tt.want)
+		}
+		filter = mustFileFilter(t, "", tt.pattern)
+		if got := filter.Included(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("Included(%q, %v) with %q = %v, want %v", tt.path, tt.isDir, tt.pattern, got, tt.want)
+		}
+	}
+
+	var nilFilter *fileFilter
+	if nilFilter.Excluded("a", false) || !nilFilter.Included("a", false) || !nilFilter.Matches("a") {
+		t.Error("a nil filter must back up everything")
+	}
+}
+
+func TestParseFilePatternsInvalid(t *testing.T) {
+	for _, pattern := range []string{"/", "!/", "a[", "!"} {
+		if _, err := parseFilePatterns(pattern); err == nil {
+			t.Errorf("parseFilePatterns(%q) succeeded", pattern)
+		}
+	}
+}
+
+func TestFilePushdownArgs(t *testing.T) {
+	tests := []struct {
+		exclude string
+		prune   string
+		tar     string
+	}{
+		{"", "", ""},
+		{"*.log", `\( -name '*.log' \) -prune -o`, `--exclude='*.log'`},
+		{"cache/", `\( \( -type d -name 'cache' \) \) -prune -o`, ""},
+		{"/build", `\( -path '/srv/build' \) -prune -o`, ""},
+		{"a/b\nlog", `\( -path '/srv/a/b' -o -name 'log' \) -prune -o`, `--exclude='log'`},
+		{"a?c\n*mid*dle", "", ""},
+		{"docs/**/*.md", "", ""},
+		{"*.log\n!keep.log", "", ""},
+	}
+	for _, tt := range tests {
+		filter := mustFileFilter(t, tt.exclude, "")
+		if got := filter.FindPruneArgs("/srv/"); got != tt.prune {
+			t.Errorf("FindPruneArgs with %q = %s, want %s", tt.exclude, got, tt.prune)
+		}
+		if got := filter.TarExcludeArgs(); got != tt.tar {
+			t.Errorf("TarExcludeArgs with %q = %s, want %s", tt.exclude, got, tt.tar)
+		}
+	}
+}
+
+// pushdownTree is walked by find and tar to compare their pruning with Excluded
+var pushdownTree = []string{
+	"app.log",
+	"keep.log",
+	"log/inner.txt",
+	"srv/catalog",
+	"srv/log/app.txt",
+	"build/out.o",
+	"src/build/out.o",
+	"cache/entry",
+	"sub/cache",
+	"a/b/c.txt",
+	"x/a/b",
+	"tmp/x",
+	"docs/x/a.md",
+	"-dash",
+	"with space.tmp",
+	"abc",
+	"middle",
+}
+
+// remoteListing runs a shell command that prints the paths below root and
+// returns them relative to root
+func remoteListing(t *testing.T, root, cmd string) map[string]bool {
+	t.Helper()
+	out, err := exec.Command("/bin/sh", "-c", cmd).Output()
+	if err != nil {
+		t.Fatalf("%s: %v", cmd, err)
+	}
+	listed := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(line, root), "/"), "/")
+		line = strings.TrimPrefix(line, "./")
+		if line != "" && line != "." {
+			listed[line] = true
+		}
+	}
+	return listed
+}
+
+func TestFilePushdownAgreesWithExcluded(t *testing.T) {
+	for _, name := range []string{"find", "tar"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skip("no " + name)
+		}
+	}
+	root := t.TempDir()
+	for _, rel := range pushdownTree {
+		file := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// exactFind and exactTar are set if the tool evaluates every pattern itself
+	tests := []struct {
+		exclude   string
+		exactFind bool
+		exactTar  bool
+	}{
+		{"*.log", true, true},
+		{"log", true, true},
+		{"/build", true, false},
+		{"cache/", true, false},
+		{"a/b", true, false},
+		{"*.tmp\n-dash", true, true},
+		{"a?c\n*mid*dle\ndocs/**/*.md\n**/tmp/**", false, false},
+		{"*.log\n!keep.log", false, false},
+	}
+	for _, tt := range tests {
+		filter := mustFileFilter(t, tt.exclude, "")
+		findCmd := "find " + shellQuote(root) + " -mindepth 1"
+		if prune := filter.FindPruneArgs(root); prune != "" {
+			findCmd += " " + prune
+		}
+		tarCmd := "tar -cf -"
+		if excludes := filter.TarExcludeArgs(); excludes != "" {
+			tarCmd += " " + excludes
+		}
+		tarCmd += " -C " + shellQuote(root) + " . | tar -tf -"
+
+		for tool, listing := range map[string]struct {
+			listed map[string]bool
+			exact  bool
+		}{
+			"find": {remoteListing(t, root, findCmd+" -print"), tt.exactFind},
+			"tar":  {remoteListing(t, root, tarCmd), tt.exactTar},
+		} {
+			for _, rel := range pushdownTree {
+				// Pushed down patterns may leave files for Excluded, but must
+				// never drop a file that is backed up
+				excluded := filter.Excluded(rel, false)
+				if !listing.listed[rel] && !excluded {
+					t.Errorf("%s with %q dropped %q, which is not excluded", tool, tt.exclude, rel)
+				}
+				if listing.exact && listing.listed[rel] && excluded {
+					t.Errorf("%s with %q kept %q, which is excluded", tool, tt.exclude, rel)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileMetadata describes a backed up file, directory or symlink as it was on
+// the remote server
+type fileMetadata struct {
+	RemotePath string    `json:"remote_path"`
+	Type       string    `json:"type"`
+	Mode       string    `json:"mode"`
+	Uid        int       `json:"uid"`
+	Gid        int       `json:"gid"`
+	ModTime    time.Time `json:"mod_time"`
+	LinkTarget string    `json:"link_target,omitempty"`
+}
+
+// runMetadata is the sidecar stored next to a run with the metadata of
+// everything it backed up, including symlinks and empty directories
+type runMetadata struct {
+	RunID     uint           `json:"run_id"`
+	CreatedAt time.Time      `json:"created_at"`
+	Entries   []fileMetadata `json:"entries"`
+}
+
+// runMetadataPath returns the path of the metadata sidecar of a run directory
+func runMetadataPath(backupDir string) string {
+	return filepath.Clean(backupDir) + ".metadata.json"
+}
+
+// normalizeSymlinkPolicy defaults an empty symlink policy and rejects unknown ones
+func normalizeSymlinkPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return symlinksCopy, nil
+	case symlinksFollow, symlinksCopy, symlinksSkip:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unsupported symlink_policy: %s", policy)
+	}
+}
+
+// unixPermissions returns the permission bits of mode including setuid,
+// setgid and sticky in their st_mode positions
+func unixPermissions(mode os.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perm |= 0o4000
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= 0o2000
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= 0o1000
+	}
+	return perm
+}
+
+// remoteMetadata returns the metadata of a listed remote entry
+func remoteMetadata(info RemoteFileInfo) fileMetadata {
+	meta := fileMetadata{
+		RemotePath: info.Path,
+		Type:       "file",
+		Mode:       fmt.Sprintf("%04o", unixPermissions(info.Mode)),
+		Uid:        info.Uid,
+		Gid:        info.Gid,
+		ModTime:    info.ModTime,
+	}
+	switch {
+	case info.IsDir():
+		meta.Type = "dir"
+	case info.IsSymlink():
+		meta.Type = "symlink"
+		meta.LinkTarget = info.LinkTarget
+	}
+	return meta
+}
+
+// fileMode parses the recorded permission bits
+func (m *fileMetadata) fileMode() (os.FileMode, error) {
+	raw, err := strconv.ParseUint(m.Mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode %q", m.Mode)
+	}
+	return fileModeFromUnix(uint32(raw)) &^ os.ModeType, nil
+}
+
+// applyLocalMetadata gives a downloaded file the permissions and mtime of the
+// remote file. The owner can always read and write the local copy, ownership
+// is only kept in the sidecar.
+func applyLocalMetadata(localPath string, meta fileMetadata) {
+	if mode, err := meta.fileMode(); err == nil {
+		os.Chmod(localPath, mode.Perm()|0o600)
+	}
+	if !meta.ModTime.IsZero() {
+		os.Chtimes(localPath, meta.ModTime, meta.ModTime)
+	}
+}
+
+func writeRunMetadata(backend storageBackend, metadataPath string, runID uint, entries []fileMetadata) error {
+	data, err := json.MarshalIndent(runMetadata{RunID: runID, CreatedAt: time.Now(), Entries: entries}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeStorageFile(backend, metadataPath, data); err != nil {
+		return fmt.Errorf("failed to write metadata: %v", err)
+	}
+	return nil
+}
+
+func loadRunMetadata(backend storageBackend, metadataPath string) (*runMetadata, error) {
+	data, err := readStorageFile(backend, metadataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %v", err)
+	}
+	var meta runMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("invalid metadata %s: %v", metadataPath, err)
+	}
+	return &meta, nil
+}
+
+// restoreRunMetadata recreates the directories and symlinks of a run below
+// targetPath and reapplies permissions, ownership and mtimes. Ownership is
+// only changed when running as root. Problems with single entries are
+// collected in the result instead of aborting the restore.
+func restoreRunMetadata(targetPath string, meta *runMetadata, result *RestoreResult) {
+	destPath := func(remotePath string) string {
+		return filepath.Join(targetPath, filepath.FromSlash(path.Clean("/"+remotePath)))
+	}
+	warn := func(format string, args ...interface{}) {
+		result.MetadataErrors = append(result.MetadataErrors, fmt.Sprintf(format, args...))
+	}
+	chown := os.Geteuid() == 0
+
+	var dirs []fileMetadata
+	for _, entry := range meta.Entries {
+		dest := destPath(entry.RemotePath)
+		switch entry.Type {
+		case "dir":
+			if err := os.MkdirAll(dest, 0o755); err != nil {
+				warn("failed to create directory %s: %v", dest, err)
+				continue
+			}
+			result.Directories++
+			dirs = append(dirs, entry)
+
+		case "symlink":
+			if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+				warn("failed to create directory for %s: %v", dest, err)
+				continue
+			}
+			if info, err := os.Lstat(dest); err == nil {
+				if info.Mode()&os.ModeSymlink == 0 {
+					warn("not replacing %s with a symlink", dest)
+					continue
+				}
+				os.Remove(dest)
+			}
+			if err := os.Symlink(entry.LinkTarget, dest); err != nil {
+				warn("failed to create symlink %s: %v", dest, err)
+				continue
+			}
+			result.Symlinks++
+			if chown {
+				if err := os.Lchown(dest, entry.Uid, entry.Gid); err != nil {
+					warn("failed to change owner of %s: %v", dest, err)
+				}
+			}
+
+		default:
+			if _, err := os.Stat(dest); err != nil {
+				continue
+			}
+			applyRestoredMetadata(dest, entry, chown, warn)
+		}
+	}
+
+	// Directories last and deepest first, creating entries inside them would
+	// change their mtime again
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i].RemotePath, "/") > strings.Count(dirs[j].RemotePath, "/")
+	})
+	for _, entry := range dirs {
+		applyRestoredMetadata(destPath(entry.RemotePath), entry, chown, warn)
+	}
+}
+
+// applyRestoredMetadata sets ownership, permissions and mtime of a restored
+// file or directory
+func applyRestoredMetadata(dest string, entry fileMetadata, chown bool, warn func(string, ...interface{})) {
+	if chown {
+		if err := os.Lchown(dest, entry.Uid, entry.Gid); err != nil {
+			warn("failed to change owner of %s: %v", dest, err)
+		}
+	}
+	// chmod after chown, changing the owner clears setuid and setgid
+	if mode, err := entry.fileMode(); err != nil {
+		warn("%s: %v", dest, err)
+	} else if err := os.Chmod(dest, mode); err != nil {
+		warn("failed to change mode of %s: %v", dest, err)
+	}
+	if !entry.ModTime.IsZero() {
+		if err := os.Chtimes(dest, entry.ModTime, entry.ModTime); err != nil {
+			warn("failed to set mtime of %s: %v", dest, err)
+		}
+	}
+}
@@ -1,6 +1,11 @@
 package service
 
-import "backapp-server/entity"
+import (
+	"fmt"
+	"time"
+
+	"backapp-server/entity"
+)
 
 func ServiceListFileRulesForProfile(profileID int) ([]entity.FileRule, error) {
 	var rules []entity.FileRule
@@ -10,7 +15,33 @@ func ServiceListFileRulesForProfile(profileID int) ([]entity.FileRule, error) {
 	return rules, nil
 }
 
+// normalizeRuleTransferMode defaults an empty transfer mode and rejects unknown ones
+func normalizeRuleTransferMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return "auto", nil
+	case "auto", "files", "tar":
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unsupported transfer_mode: %s", mode)
+	}
+}
+
 func ServiceCreateFileRule(input *entity.FileRule) (*entity.FileRule, error) {
+	mode, err := normalizeRuleTransferMode(input.TransferMode)
+	if err != nil {
+		return nil, err
+	}
+	input.TransferMode = mode
+	if input.SymlinkPolicy, err = normalizeSymlinkPolicy(input.SymlinkPolicy); err != nil {
+		return nil, err
+	}
+	if err := normalizeRuleSource(input); err != nil {
+		return nil, err
+	}
+	if _, err := newFileFilter(*input); err != nil {
+		return nil, err
+	}
 	if err := DB.Create(input).Error; err != nil {
 		return nil, err
 	}
@@ -25,6 +56,27 @@ func ServiceUpdateFileRule(id uint, input *entity.FileRule) (*entity.FileRule, e
 	rule.RemotePath = input.RemotePath
 	rule.Recursive = input.Recursive
 	rule.ExcludePattern = input.ExcludePattern
+	rule.IncludePattern = input.IncludePattern
+	rule.SourceType = input.SourceType
+	rule.Command = input.Command
+	rule.OutputName = input.OutputName
+	rule.Compression = input.Compression
+	rule.DockerTarget = input.DockerTarget
+	rule.DockerImage = input.DockerImage
+	if err := normalizeRuleSource(&rule); err != nil {
+		return nil, err
+	}
+	if _, err := newFileFilter(rule); err != nil {
+		return nil, err
+	}
+	mode, err := normalizeRuleTransferMode(input.TransferMode)
+	if err != nil {
+		return nil, err
+	}
+	rule.TransferMode = mode
+	if rule.SymlinkPolicy, err = normalizeSymlinkPolicy(input.SymlinkPolicy); err != nil {
+		return nil, err
+	}
 	if err := DB.Save(&rule).Error; err != nil {
 		return nil, err
 	}
@@ -34,3 +86,91 @@ func ServiceUpdateFileRule(id uint, input *entity.FileRule) (*entity.FileRule, e
 func ServiceDeleteFileRule(id uint) error {
 	return DB.Delete(&entity.FileRule{}, id).Error
 }
+
+// fileRulePreviewLimit caps the number of files listed in a preview
+const fileRulePreviewLimit = 1000
+
+// FileRulePreview lists the files a rule currently matches on its server
+type FileRulePreview struct {
+	Files      []FileRulePreviewFile `json:"files"`
+	TotalFiles int                   `json:"total_files"`
+	TotalBytes int64                 `json:"total_bytes"`
+	Truncated  bool                  `json:"truncated"`
+}
+
+type FileRulePreviewFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// ServicePreviewFileRule lists the files rule would back up from a server
+// without transferring anything
+func ServicePreviewFileRule(serverID uint, rule *entity.FileRule) (*FileRulePreview, error) {
+	if rule.SourceType == ruleSourceCommand {
+		// Running the command could change the server
+		return nil, fmt.Errorf("command rules cannot be previewed")
+	}
+	if isDockerSource(rule.SourceType) {
+		return nil, fmt.Errorf("docker rules cannot be previewed")
+	}
+	filter, err := newFileFilter(*rule)
+	if err != nil {
+		return nil, err
+	}
+	server, err := GetServerByID(serverID)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewSSHClient(server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer client.Close()
+
+	policy, err := normalizeSymlinkPolicy(rule.SymlinkPolicy)
+	if err != nil {
+		return nil, err
+	}
+	info, err := client.Stat(rule.RemotePath)
+	if err != nil {
+		return nil, err
+	}
+	files := []RemoteFileInfo{*info}
+	if info.IsDir() {
+		entries, err := client.ListTree(rule.RemotePath, rule.Recursive, filter, policy)
+		if err != nil {
+			return nil, err
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			if entry.Mode.IsRegular() {
+				files = append(files, entry)
+			}
+		}
+	}
+
+	preview := &FileRulePreview{Files: []FileRulePreviewFile{}, TotalFiles: len(files)}
+	for _, file := range files {
+		preview.TotalBytes += file.Size
+		if len(preview.Files) == fileRulePreviewLimit {
+			preview.Truncated = true
+			continue
+		}
+		preview.Files = append(preview.Files, FileRulePreviewFile{Path: file.Path, Size: file.Size, ModTime: file.ModTime})
+	}
+	return preview, nil
+}
+
+// ServicePreviewSavedFileRule previews a stored rule on the server of its profile
+func ServicePreviewSavedFileRule(id uint) (*FileRulePreview, error) {
+	var rule entity.FileRule
+	if err := DB.First(&rule, id).Error; err != nil {
+		return nil, err
+	}
+	var profile entity.BackupProfile
+	if err := DB.First(&profile, rule.BackupProfileID).Error; err != nil {
+		return nil, err
+	}
+	return ServicePreviewFileRule(profile.ServerID, &rule)
+}
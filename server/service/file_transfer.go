@@ -1,11 +1,14 @@
 package service
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
 	"backapp-server/entity"
@@ -16,19 +19,108 @@ type FileTransferService struct {
 	sshClient *SSHClient
 	destDir   string
 	runID     uint
+	options   TransferOptions
+	logMu     sync.Mutex
+	// metadata of everything transferred, written to the run sidecar
+	metadata []fileMetadata
+	// files skipped because of errors
+	failuresMu sync.Mutex
+	failures   []entity.BackupFileError
+	// files and bytes done, see Progress
+	progress *transferProgress
+}
+
+// TransferOptions configures how a FileTransferService downloads files
+type TransferOptions struct {
+	// Concurrency is the number of files downloaded at the same time
+	Concurrency int
+	// ChecksumAlgorithm is used to hash every downloaded file
+	ChecksumAlgorithm string
+	// VerifyChecksums compares each checksum with the one computed remotely
+	VerifyChecksums bool
+	// ChecksumRetries is how often a file is downloaded again after a mismatch
+	ChecksumRetries int
+	// IncrementalMode decides when files of Previous are reused
+	IncrementalMode string
+	// Previous holds the files of the previous run keyed by remote path
+	Previous map[string]entity.BackupFile
+	// Cipher encrypts files while they are written, nil stores plaintext
+	Cipher *keyCipher
+	// ErrorPolicy decides whether a failed file aborts the transfer, see
+	// entity.BackupProfile
+	ErrorPolicy    string
+	MaxFailedFiles int
+	// ResumeDir keeps partial downloads of failed files for the next run,
+	// empty to discard them
+	ResumeDir string
+	// Backend receives the files instead of the local file system, the
+	// destination directory is then a name in the backend
+	Backend storageBackend
+}
+
+// transferJob is a single remote file to download to localPath
+type transferJob struct {
+	remote    RemoteFileInfo
+	localPath string
 }
 
 // NewFileTransferService creates a new file transfer service
-func NewFileTransferService(sshClient *SSHClient, destDir string, runID uint) *FileTransferService {
+func NewFileTransferService(sshClient *SSHClient, destDir string, runID uint, options TransferOptions) *FileTransferService {
+	options.Concurrency = max(options.Concurrency, 1)
+	options.ChecksumRetries = max(options.ChecksumRetries, 0)
+	if options.ChecksumAlgorithm == "" {
+		options.ChecksumAlgorithm = defaultChecksumAlgorithm
+	}
+	if options.IncrementalMode == "" {
+		options.IncrementalMode = "off"
+	}
 	return &FileTransferService{
 		sshClient: sshClient,
 		destDir:   destDir,
 		runID:     runID,
+		options:   options,
+		progress:  newTransferProgress(),
+	}
+}
+
+// storage returns the backend the files are written to
+func (s *FileTransferService) storage() storageBackend {
+	if s.options.Backend != nil {
+		return s.options.Backend
+	}
+	return &localBackend{basePath: s.destDir}
+}
+
+// mkdirAll creates a local directory, backends need none
+func (s *FileTransferService) mkdirAll(dir string) error {
+	if s.options.Backend != nil {
+		return nil
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// applyMetadata applies the mtime and mode of a remote file to its local copy
+func (s *FileTransferService) applyMetadata(localPath string, info RemoteFileInfo) {
+	if s.options.Backend == nil {
+		applyLocalMetadata(localPath, remoteMetadata(info))
+	}
+}
+
+// newDestination returns where a file is written to, encrypting it if a
+// cipher is set
+func (s *FileTransferService) newDestination(localPath string, sum hash.Hash, progress *fileProgress) *localDestination {
+	dst := &localDestination{path: localPath, sum: sum, progress: progress, backend: s.options.Backend}
+	if s.options.Cipher != nil {
+		dst.wrap = s.options.Cipher.Encrypt
 	}
+	return dst
 }
 
-// logToDatabase writes a log entry to the database
+// logToDatabase writes a log entry to the database. Entries are written one at
+// a time so that parallel workers keep a consistent order.
 func (s *FileTransferService) logToDatabase(level, message string) {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
 	logEntry := &entity.BackupRunLog{
 		BackupRunID: s.runID,
 		Timestamp:   time.Now(),
@@ -40,22 +132,49 @@ func (s *FileTransferService) logToDatabase(level, message string) {
 	}
 }
 
+// Metadata returns the metadata of all files, directories and symlinks
+// transferred so far
+func (s *FileTransferService) Metadata() []fileMetadata {
+	return s.metadata
+}
+
+// dropMetadata removes the metadata of the files at remotePaths
+func (s *FileTransferService) dropMetadata(remotePaths map[string]bool) {
+	kept := s.metadata[:0]
+	for _, meta := range s.metadata {
+		if meta.Type == "file" && remotePaths[meta.RemotePath] {
+			continue
+		}
+		kept = append(kept, meta)
+	}
+	s.metadata = kept
+}
+
 // TransferFiles transfers files according to file rules
 func (s *FileTransferService) TransferFiles(fileRules []entity.FileRule) ([]entity.BackupFile, error) {
 	var backupFiles []entity.BackupFile
 
 	// Ensure destination directory exists
-	if err := os.MkdirAll(s.destDir, 0755); err != nil {
+	if err := s.mkdirAll(s.destDir); err != nil {
 		s.logToDatabase("ERROR", fmt.Sprintf("Failed to create destination directory: %v", err))
 		return nil, fmt.Errorf("failed to create destination directory: %v", err)
 	}
+	if s.options.ResumeDir != "" {
+		pruneResumeDir(s.options.ResumeDir)
+	}
 
+	s.progress.rulesTotal.Store(int64(len(fileRules)))
 	for i, rule := range fileRules {
 		s.logToDatabase("INFO", fmt.Sprintf("Processing rule %d/%d: %s", i+1, len(fileRules), rule.RemotePath))
 		files, err := s.transferFileRule(rule)
+		s.progress.rulesDone.Add(1)
 		if err != nil {
-			s.logToDatabase("ERROR", fmt.Sprintf("Failed to transfer files for rule %d: %v", rule.ID, err))
-			return nil, fmt.Errorf("failed to transfer files for rule %d: %v", rule.ID, err)
+			// A rule that cannot be transferred at all counts as one failed file
+			if errors.Is(err, errTooManyFailures) || s.fileFailed(rule, rule.RemotePath, err) != nil {
+				s.logToDatabase("ERROR", fmt.Sprintf("Failed to transfer files for rule %d: %v", rule.ID, err))
+				return nil, fmt.Errorf("failed to transfer files for rule %d: %w", rule.ID, err)
+			}
+			continue
 		}
 		s.logToDatabase("INFO", fmt.Sprintf("Rule %d complete: transferred %d files", i+1, len(files)))
 		backupFiles = append(backupFiles, files...)
@@ -66,200 +185,323 @@ func (s *FileTransferService) TransferFiles(fileRules []entity.FileRule) ([]enti
 
 // transferFileRule transfers files for a single file rule
 func (s *FileTransferService) transferFileRule(rule entity.FileRule) ([]entity.BackupFile, error) {
-	s.logToDatabase("DEBUG", fmt.Sprintf("Checking remote path: %s", rule.RemotePath))
-	// Check if remote path exists and is a file or directory
-	checkCmd := fmt.Sprintf("test -e '%s' && echo exists || echo notfound", rule.RemotePath)
-	output, err := s.sshClient.RunCommand(checkCmd)
-	if err != nil || strings.TrimSpace(output) != "exists" {
-		s.logToDatabase("ERROR", fmt.Sprintf("Remote path does not exist: %s", rule.RemotePath))
-		return nil, fmt.Errorf("remote path does not exist: %s", rule.RemotePath)
+	if rule.SourceType == ruleSourceCommand {
+		return s.transferCommandOutput(rule)
 	}
 
-	// Check if it's a directory
-	isDirCmd := fmt.Sprintf("test -d '%s' && echo yes || echo no", rule.RemotePath)
-	isDirOutput, err := s.sshClient.RunCommand(isDirCmd)
+	filter, err := newFileFilter(rule)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check if path is directory: %v", err)
+		s.logToDatabase("ERROR", fmt.Sprintf("Invalid patterns in rule %d: %v", rule.ID, err))
+		return nil, err
+	}
+	if isDockerSource(rule.SourceType) {
+		return s.transferDockerSource(rule, filter)
 	}
 
-	isDir := strings.TrimSpace(isDirOutput) == "yes"
+	s.logToDatabase("DEBUG", fmt.Sprintf("Checking remote path: %s", rule.RemotePath))
+	// Check if remote path exists and is a file or directory
+	info, err := s.sshClient.Stat(rule.RemotePath)
+	if err != nil {
+		if isRemoteNotExist(err) {
+			s.logToDatabase("ERROR", fmt.Sprintf("Remote path does not exist: %s", rule.RemotePath))
+			return nil, fmt.Errorf("remote path does not exist: %s", rule.RemotePath)
+		}
+		s.logToDatabase("ERROR", fmt.Sprintf("Failed to stat remote path %s: %v", rule.RemotePath, err))
+		return nil, fmt.Errorf("failed to stat remote path: %v", err)
+	}
 
-	if isDir {
+	if info.IsDir() {
 		if rule.Recursive {
-			return s.transferDirectory(rule)
+			return s.transferDirectory(rule, filter)
 		}
 		// Non-recursive directory transfer
-		return s.transferDirectoryShallow(rule)
+		return s.transferDirectoryShallow(rule, filter)
 	}
 
 	// Single file transfer
-	return s.transferSingleFile(rule)
+	return s.transferSingleFile(rule, info)
 }
 
 // transferSingleFile transfers a single file
-func (s *FileTransferService) transferSingleFile(rule entity.FileRule) ([]entity.BackupFile, error) {
-	fileName := filepath.Base(rule.RemotePath)
+func (s *FileTransferService) transferSingleFile(rule entity.FileRule, info *RemoteFileInfo) ([]entity.BackupFile, error) {
+	fileName := filepath.Base(info.Path)
 	localPath := filepath.Join(s.destDir, fileName)
 
-	s.logToDatabase("DEBUG", fmt.Sprintf("Transferring file: %s", rule.RemotePath))
-	// Get file size
-	sizeCmd := fmt.Sprintf("stat -c%%s '%s' 2>/dev/null || stat -f%%z '%s'", rule.RemotePath, rule.RemotePath)
-	sizeOutput, err := s.sshClient.RunCommand(sizeCmd)
-	if err != nil {
-		s.logToDatabase("ERROR", fmt.Sprintf("Failed to get file size for %s: %v", rule.RemotePath, err))
-		return nil, fmt.Errorf("failed to get file size: %v", err)
-	}
-
-	var fileSize int64
-	fmt.Sscanf(strings.TrimSpace(sizeOutput), "%d", &fileSize)
+	s.logToDatabase("DEBUG", fmt.Sprintf("Transferring file: %s", info.Path))
 
 	// Download file
-	if err := s.sshClient.CopyFileFromRemote(rule.RemotePath, localPath); err != nil {
-		s.logToDatabase("ERROR", fmt.Sprintf("Failed to copy file %s: %v", rule.RemotePath, err))
-		return nil, fmt.Errorf("failed to copy file: %v", err)
-	}
-	s.logToDatabase("DEBUG", fmt.Sprintf("File transferred successfully: %s (%.2f KB)", fileName, float64(fileSize)/1024))
-
-	backupFile := entity.BackupFile{
-		RemotePath: rule.RemotePath,
-		LocalPath:  localPath,
-		SizeBytes:  fileSize,
-		FileSize:   fileSize,
-		FileRuleID: rule.ID,
+	s.progress.addTotal(1, info.Size)
+	backupFile, err := s.transferJob(rule, transferJob{remote: *info, localPath: localPath})
+	if err != nil {
+		return nil, err
 	}
+	s.metadata = append(s.metadata, remoteMetadata(*info))
+	s.logToDatabase("DEBUG", fmt.Sprintf("File transferred successfully: %s (%.2f KB)", fileName, float64(info.Size)/1024))
 
-	return []entity.BackupFile{backupFile}, nil
+	return []entity.BackupFile{*backupFile}, nil
 }
 
 // transferDirectoryShallow transfers only files in the directory (non-recursive)
-func (s *FileTransferService) transferDirectoryShallow(rule entity.FileRule) ([]entity.BackupFile, error) {
+func (s *FileTransferService) transferDirectoryShallow(rule entity.FileRule, filter *fileFilter) ([]entity.BackupFile, error) {
 	// List files in directory (non-recursive)
-	listCmd := fmt.Sprintf("find '%s' -maxdepth 1 -type f", rule.RemotePath)
-	output, err := s.sshClient.RunCommand(listCmd)
+	entries, err := s.sshClient.ListTree(rule.RemotePath, false, filter, rule.SymlinkPolicy)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list files: %v", err)
 	}
+	return s.transferEntries(rule, entries)
+}
 
-	files := strings.Split(strings.TrimSpace(output), "\n")
-	var backupFiles []entity.BackupFile
+// transferDirectory transfers a directory recursively
+func (s *FileTransferService) transferDirectory(rule entity.FileRule, filter *fileFilter) ([]entity.BackupFile, error) {
+	if s.useTar(rule) {
+		return s.transferDirectoryTar(rule, filter)
+	}
 
-	for _, file := range files {
-		file = strings.TrimSpace(file)
-		if file == "" {
-			continue
-		}
+	s.logToDatabase("INFO", fmt.Sprintf("Listing files in directory: %s", rule.RemotePath))
+	entries, err := s.sshClient.ListTree(rule.RemotePath, true, filter, rule.SymlinkPolicy)
+	if err != nil {
+		s.logToDatabase("ERROR", fmt.Sprintf("Failed to list files in %s: %v", rule.RemotePath, err))
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
+	return s.transferEntries(rule, entries)
+}
 
-		if s.shouldExclude(file, rule.ExcludePattern) {
-			continue
+// transferEntries downloads the regular files of a directory listing,
+// preserving the directory structure. Directories are created locally and
+// symlinks are only recorded in the metadata.
+func (s *FileTransferService) transferEntries(rule entity.FileRule, entries []RemoteFileInfo) ([]entity.BackupFile, error) {
+	var (
+		jobs  []transferJob
+		bytes int64
+	)
+	for _, entry := range entries {
+		localPath := filepath.Join(s.destDir, filepath.FromSlash(relativeRemotePath(rule.RemotePath, entry.Path)))
+		switch {
+		case entry.IsDir():
+			if err := s.mkdirAll(localPath); err != nil {
+				return nil, fmt.Errorf("failed to create directory: %v", err)
+			}
+		case entry.Mode.IsRegular():
+			jobs = append(jobs, transferJob{remote: entry, localPath: localPath})
+			bytes += entry.Size
 		}
+	}
 
-		// Create a temporary rule for this single file
-		singleFileRule := entity.FileRule{
-			ID:         rule.ID,
-			RemotePath: file,
+	s.logToDatabase("INFO", fmt.Sprintf("Found %d files to transfer (%.2f MB)", len(jobs), float64(bytes)/1024/1024))
+	s.progress.addTotal(int64(len(jobs)), bytes)
+	files, err := s.runTransfers(rule, jobs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skipped files are left out of the metadata
+	transferred := make(map[string]bool, len(files))
+	for _, file := range files {
+		transferred[file.RemotePath] = true
+	}
+	for _, entry := range entries {
+		if !entry.Mode.IsRegular() || transferred[entry.Path] {
+			s.metadata = append(s.metadata, remoteMetadata(entry))
 		}
+	}
+	return files, nil
+}
 
-		transferred, err := s.transferSingleFile(singleFileRule)
-		if err != nil {
-			return nil, fmt.Errorf("failed to transfer file %s: %v", file, err)
+// runTransfers downloads jobs using up to Concurrency workers. The returned
+// files keep the order of jobs. Failed files are skipped as far as the error
+// policy allows, after a failure that aborts the transfer no new downloads
+// are started, and the errors of all downloads that were already running are
+// returned together.
+func (s *FileTransferService) runTransfers(rule entity.FileRule, jobs []transferJob) ([]entity.BackupFile, error) {
+	workers := min(s.options.Concurrency, len(jobs))
+	if workers > 1 {
+		s.logToDatabase("DEBUG", fmt.Sprintf("Downloading %d files with %d parallel transfers", len(jobs), workers))
+	}
+
+	results := make([]*entity.BackupFile, len(jobs))
+	var (
+		mu     sync.Mutex
+		errs   []error
+		failed bool
+		wg     sync.WaitGroup
+	)
+	next := make(chan int)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				file, err := s.transferJob(rule, jobs[i])
+				if err != nil {
+					err = s.fileFailed(rule, jobs[i].remote.Path, err)
+				}
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, err)
+					failed = true
+				} else if file != nil {
+					results[i] = file
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range jobs {
+		mu.Lock()
+		stop := failed
+		mu.Unlock()
+		if stop {
+			break
 		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
 
-		backupFiles = append(backupFiles, transferred...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
 
+	backupFiles := make([]entity.BackupFile, 0, len(jobs))
+	for _, file := range results {
+		if file != nil {
+			backupFiles = append(backupFiles, *file)
+		}
+	}
 	return backupFiles, nil
 }
 
-// transferDirectory transfers a directory recursively
-func (s *FileTransferService) transferDirectory(rule entity.FileRule) ([]entity.BackupFile, error) {
-	s.logToDatabase("INFO", fmt.Sprintf("Listing files in directory: %s", rule.RemotePath))
-	// Build find command with exclude pattern if provided
-	findCmd := fmt.Sprintf("find '%s' -type f", rule.RemotePath)
+// transferJob downloads a single job and returns the resulting backup file.
+// The job counts as done for the progress whether it succeeds or fails.
+func (s *FileTransferService) transferJob(rule entity.FileRule, job transferJob) (*entity.BackupFile, error) {
+	progress := s.progress.file(job.remote.Size)
+	defer progress.finish()
 
-	output, err := s.sshClient.RunCommand(findCmd)
-	if err != nil {
-		s.logToDatabase("ERROR", fmt.Sprintf("Failed to list files in %s: %v", rule.RemotePath, err))
-		return nil, fmt.Errorf("failed to list files: %v", err)
+	// Create parent directory
+	if err := s.mkdirAll(filepath.Dir(job.localPath)); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %v", err)
 	}
 
-	files := strings.Split(strings.TrimSpace(output), "\n")
-	s.logToDatabase("INFO", fmt.Sprintf("Found %d files to transfer", len(files)))
-	var backupFiles []entity.BackupFile
-
-	for _, file := range files {
-		file = strings.TrimSpace(file)
-		if file == "" {
-			continue
-		}
-
-		if s.shouldExclude(file, rule.ExcludePattern) {
-			continue
-		}
+	if file, ok := s.reuseFile(rule, job); ok {
+		s.logToDatabase("DEBUG", fmt.Sprintf("Unchanged since the previous run, linked: %s", job.remote.Path))
+		return file, nil
+	}
 
-		// Preserve directory structure
-		relPath := strings.TrimPrefix(file, rule.RemotePath)
-		relPath = strings.TrimPrefix(relPath, "/")
-		localPath := filepath.Join(s.destDir, relPath)
+	checksum, err := s.downloadFile(job.remote, job.localPath, progress)
+	if err != nil {
+		// Do not leave a partial file behind if the run continues without it
+		s.storage().Remove(job.localPath)
+		s.logToDatabase("ERROR", fmt.Sprintf("Failed to copy file %s: %v", job.remote.Path, err))
+		return nil, fmt.Errorf("failed to copy file %s: %v", job.remote.Path, err)
+	}
+	s.applyMetadata(job.localPath, job.remote)
+
+	return &entity.BackupFile{
+		RemotePath:        job.remote.Path,
+		LocalPath:         job.localPath,
+		SizeBytes:         job.remote.Size,
+		FileSize:          job.remote.Size,
+		Checksum:          checksum,
+		ChecksumAlgorithm: s.options.ChecksumAlgorithm,
+		ModTime:           remoteModTime(job.remote),
+		FileRuleID:        rule.ID,
+	}, nil
+}
 
-		// Create parent directory
-		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
-			return nil, fmt.Errorf("failed to create directory: %v", err)
-		}
+// downloadFile downloads remote to localPath and returns its checksum. With
+// VerifyChecksums the file is downloaded again on a mismatch with the remote
+// checksum, up to ChecksumRetries times. Resumed downloads are always
+// verified and downloaded again from the start at least once on a mismatch.
+// The bytes written are counted by progress, which may be nil.
+func (s *FileTransferService) downloadFile(remote RemoteFileInfo, localPath string, progress *fileProgress) (string, error) {
+	sum, err := newChecksum(s.options.ChecksumAlgorithm)
+	if err != nil {
+		return "", err
+	}
 
-		// Get file size
-		sizeCmd := fmt.Sprintf("stat -c%%s '%s' 2>/dev/null || stat -f%%z '%s'", file, file)
-		sizeOutput, err := s.sshClient.RunCommand(sizeCmd)
+	for attempt := 0; ; attempt++ {
+		resumed, err := s.copyFile(remote, localPath, sum, progress)
 		if err != nil {
-			continue // Skip files that can't be stat'd
+			return "", err
 		}
-
-		var fileSize int64
-		fmt.Sscanf(strings.TrimSpace(sizeOutput), "%d", &fileSize)
-
-		// Download file
-		if err := s.sshClient.CopyFileFromRemote(file, localPath); err != nil {
-			return nil, fmt.Errorf("failed to copy file %s: %v", file, err)
+		checksum := hex.EncodeToString(sum.Sum(nil))
+
+		retries := s.options.ChecksumRetries
+		if resumed {
+			retries = max(retries, 1)
+			err = s.verifyResumed(remote, localPath, checksum)
+		} else {
+			err = s.verifyChecksum(remote.Path, checksum)
 		}
-
-		backupFile := entity.BackupFile{
-			RemotePath: file,
-			LocalPath:  localPath,
-			SizeBytes:  fileSize,
-			FileSize:   fileSize,
-			FileRuleID: rule.ID,
+		if err == nil || !isChecksumMismatch(err) || attempt >= retries {
+			return checksum, err
 		}
-
-		backupFiles = append(backupFiles, backupFile)
+		s.logToDatabase("WARNING", fmt.Sprintf("%v, downloading again (attempt %d/%d)", err, attempt+1, retries))
+		progress.restart()
 	}
-
-	return backupFiles, nil
 }
 
-// shouldExclude checks if a file should be excluded based on the pattern
-func (s *FileTransferService) shouldExclude(filePath, excludePattern string) bool {
-	if excludePattern == "" {
-		return false
+// copyFile downloads remote to localPath, encrypting it if a cipher is set.
+// A partial download kept by an earlier run is continued, and downloads that
+// fail are kept for the next run. It reports whether the download was resumed.
+func (s *FileTransferService) copyFile(remote RemoteFileInfo, localPath string, sum hash.Hash, progress *fileProgress) (bool, error) {
+	dst := s.newDestination(localPath, sum, progress)
+	if dst.resumable() {
+		if offset := s.claimPartial(remote, localPath); offset > 0 {
+			dst.offset = offset
+			s.logToDatabase("INFO", fmt.Sprintf("Resuming %s at %.2f MB from an earlier run", remote.Path, float64(offset)/1024/1024))
+		}
 	}
 
-	// Simple pattern matching - supports wildcards
-	patterns := strings.Split(excludePattern, ",")
-	for _, pattern := range patterns {
-		pattern = strings.TrimSpace(pattern)
-		if pattern == "" {
-			continue
+	resumed, err := s.sshClient.downloadResumable(remote.Path, dst)
+	if err != nil {
+		if !s.keepPartial(remote, dst) {
+			dst.discard()
 		}
+		return false, err
+	}
+	if resumed {
+		s.logToDatabase("INFO", fmt.Sprintf("Resumed download of %s, verifying it against the remote checksum", remote.Path))
+	}
+	return resumed, dst.commit()
+}
 
-		// Simple wildcard matching
-		matched, err := filepath.Match(pattern, filepath.Base(filePath))
-		if err == nil && matched {
-			return true
+// verifyResumed compares the checksum of a resumed download with the remote
+// checksum even if VerifyChecksums is off. If the remote checksum cannot be
+// computed, the size has to match.
+func (s *FileTransferService) verifyResumed(remote RemoteFileInfo, localPath, checksum string) error {
+	remoteSum, err := s.sshClient.RemoteChecksum(remote.Path, s.options.ChecksumAlgorithm)
+	if err != nil {
+		stat, statErr := os.Stat(localPath)
+		if statErr != nil {
+			return statErr
 		}
-
-		// Check if pattern is in the path
-		if strings.Contains(filePath, pattern) {
-			return true
+		if remote.Size > 0 && stat.Size() != remote.Size {
+			return fmt.Errorf("resumed download of %s has %d bytes, expected %d", remote.Path, stat.Size(), remote.Size)
 		}
+		s.logToDatabase("WARNING", fmt.Sprintf("Could not verify the resumed download of %s, only its size matches: %v", remote.Path, err))
+		return nil
 	}
+	if remoteSum != checksum {
+		return &ChecksumMismatchError{Path: remote.Path, Local: checksum, Remote: remoteSum}
+	}
+	return nil
+}
 
-	return false
+// verifyChecksum compares checksum with the checksum of the remote file when
+// VerifyChecksums is enabled
+func (s *FileTransferService) verifyChecksum(remotePath, checksum string) error {
+	if !s.options.VerifyChecksums {
+		return nil
+	}
+	remote, err := s.sshClient.RemoteChecksum(remotePath, s.options.ChecksumAlgorithm)
+	if err != nil {
+		return err
+	}
+	if remote != checksum {
+		return &ChecksumMismatchError{Path: remotePath, Local: checksum, Remote: remote}
+	}
+	return nil
 }
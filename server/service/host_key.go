@@ -0,0 +1,225 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"backapp-server/entity"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyMismatchError is returned when a server presents a host key that
+// differs from the one recorded for it
+type HostKeyMismatchError struct {
+	Host     string
+	Expected string
+	Actual   string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s: expected %s, got %s (the server key changed or the connection is being intercepted; re-approve the key only if the change is expected)",
+		e.Host, e.Expected, e.Actual)
+}
+
+// IsHostKeyMismatch reports whether err was caused by a host key mismatch
+func IsHostKeyMismatch(err error) bool {
+	var mismatch *HostKeyMismatchError
+	return errors.As(err, &mismatch)
+}
+
+// errHostKeyScanned aborts a handshake once the host key has been captured
+var errHostKeyScanned = errors.New("host key scanned")
+
+// HostKeyInfo describes the recorded and currently presented host key of a server
+type HostKeyInfo struct {
+	ServerID             uint       `json:"server_id"`
+	StoredKey            string     `json:"stored_key,omitempty"`
+	StoredFingerprint    string     `json:"stored_fingerprint,omitempty"`
+	ApprovedAt           *time.Time `json:"approved_at,omitempty"`
+	PresentedKey         string     `json:"presented_key,omitempty"`
+	PresentedFingerprint string     `json:"presented_fingerprint,omitempty"`
+	Matches              bool       `json:"matches"`
+	ScanError            string     `json:"scan_error,omitempty"`
+}
+
+// hostKeyVerifier checks presented host keys against the key recorded on a
+// server, trusting the first key seen when none has been recorded yet
+type hostKeyVerifier struct {
+	server    *entity.Server
+	presented ssh.PublicKey
+}
+
+func newHostKeyVerifier(server *entity.Server) *hostKeyVerifier {
+	return &hostKeyVerifier{server: server}
+}
+
+// callback implements ssh.HostKeyCallback
+func (v *hostKeyVerifier) callback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	v.presented = key
+	if v.server.HostKey == "" {
+		// Trust on first use, the key is recorded once the connection succeeds
+		return nil
+	}
+
+	expected, _, _, _, err := ssh.ParseAuthorizedKey([]byte(v.server.HostKey))
+	if err != nil {
+		return fmt.Errorf("stored host key is invalid: %v", err)
+	}
+	if !sameHostKey(expected, key) {
+		return &HostKeyMismatchError{
+			Host:     hostname,
+			Expected: ssh.FingerprintSHA256(expected),
+			Actual:   ssh.FingerprintSHA256(key),
+		}
+	}
+	return nil
+}
+
+// sameHostKey reports whether a and b are the same public key
+func sameHostKey(a, b ssh.PublicKey) bool {
+	return a.Type() == b.Type() && bytes.Equal(a.Marshal(), b.Marshal())
+}
+
+// trustOnFirstUse records the presented key on the server after a successful
+// connection if no key was recorded before
+func (v *hostKeyVerifier) trustOnFirstUse() error {
+	if v.server.HostKey != "" || v.presented == nil {
+		return nil
+	}
+	return recordHostKey(v.server, v.presented)
+}
+
+// recordHostKey stores key as the accepted host key of server. Servers that
+// have not been saved yet only get the in-memory fields populated.
+func recordHostKey(server *entity.Server, key ssh.PublicKey) error {
+	applyHostKey(server, key)
+	if server.ID == 0 {
+		return nil
+	}
+	return DB.Model(&entity.Server{}).Where("id = ?", server.ID).Updates(map[string]interface{}{
+		"host_key":             server.HostKey,
+		"host_key_fingerprint": server.HostKeyFingerprint,
+		"host_key_approved_at": server.HostKeyApprovedAt,
+	}).Error
+}
+
+// applyHostKey sets the host key fields of server from key
+func applyHostKey(server *entity.Server, key ssh.PublicKey) {
+	now := time.Now()
+	server.HostKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	server.HostKeyFingerprint = ssh.FingerprintSHA256(key)
+	server.HostKeyApprovedAt = &now
+}
+
+// scanHostKey connects to the server and returns the host key it presents
+// without authenticating
+func scanHostKey(server *entity.Server) (ssh.PublicKey, error) {
+	var presented ssh.PublicKey
+	config := &ssh.ClientConfig{
+		User: server.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			presented = key
+			return errHostKeyScanned
+		},
+		Timeout: 10 * time.Second,
+	}
+
+	jump, err := dialJumpHost(server, config.Timeout, nil)
+	if err != nil {
+		return nil, err
+	}
+	if jump != nil {
+		defer jump.Close()
+	}
+
+	client, err := dialAddress(jump, serverAddress(server), config)
+	if client != nil {
+		client.Close()
+	}
+	if presented == nil {
+		if err == nil {
+			err = errors.New("server did not present a host key")
+		}
+		return nil, fmt.Errorf("failed to scan host key: %v", err)
+	}
+	return presented, nil
+}
+
+// ServiceGetServerHostKey returns the stored host key of a server together with
+// the key the server currently presents
+func ServiceGetServerHostKey(id uint) (*HostKeyInfo, error) {
+	server, err := GetServerByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &HostKeyInfo{
+		ServerID:          server.ID,
+		StoredKey:         server.HostKey,
+		StoredFingerprint: server.HostKeyFingerprint,
+		ApprovedAt:        server.HostKeyApprovedAt,
+	}
+
+	presented, err := scanHostKey(server)
+	if err != nil {
+		info.ScanError = err.Error()
+		return info, nil
+	}
+	info.PresentedKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(presented)))
+	info.PresentedFingerprint = ssh.FingerprintSHA256(presented)
+	info.Matches = info.StoredFingerprint != "" && info.StoredFingerprint == info.PresentedFingerprint
+	return info, nil
+}
+
+// ServiceApproveServerHostKey records the key the server currently presents as
+// trusted. If fingerprint is set, it must match the presented key so that the
+// caller approves exactly the key they have verified.
+func ServiceApproveServerHostKey(id uint, fingerprint string) (*HostKeyInfo, error) {
+	server, err := GetServerByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	presented, err := scanHostKey(server)
+	if err != nil {
+		return nil, err
+	}
+	if fingerprint != "" && fingerprint != ssh.FingerprintSHA256(presented) {
+		return nil, &HostKeyMismatchError{
+			Host:     server.Host,
+			Expected: fingerprint,
+			Actual:   ssh.FingerprintSHA256(presented),
+		}
+	}
+	if err := recordHostKey(server, presented); err != nil {
+		return nil, err
+	}
+
+	return &HostKeyInfo{
+		ServerID:             server.ID,
+		StoredKey:            server.HostKey,
+		StoredFingerprint:    server.HostKeyFingerprint,
+		ApprovedAt:           server.HostKeyApprovedAt,
+		PresentedKey:         server.HostKey,
+		PresentedFingerprint: server.HostKeyFingerprint,
+		Matches:              true,
+	}, nil
+}
+
+// ServiceResetServerHostKey forgets the stored host key so that the next
+// successful connection records the new one
+func ServiceResetServerHostKey(id uint) error {
+	if _, err := GetServerByID(id); err != nil {
+		return err
+	}
+	return DB.Model(&entity.Server{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"host_key":             "",
+		"host_key_fingerprint": "",
+		"host_key_approved_at": nil,
+	}).Error
+}
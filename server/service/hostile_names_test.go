@@ -0,0 +1,337 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"backapp-server/entity"
+)
+
+// hostileNames are file names that break commands which do not quote paths
+// or parse listings line by line
+var hostileNames = []string{
+	"plain",
+	"with space",
+	" leading and trailing ",
+	"single'quote",
+	`double"quote`,
+	`back\slash`,
+	"new\nline",
+	"trailing newline\n",
+	"tab\there",
+	"-dash",
+	"--double-dash",
+	"$(touch pwned)",
+	"`touch pwned`",
+	"$HOME",
+	"semi;colon && true",
+	"pipe|and>redirect<",
+	"*",
+	"?[glob]",
+	"{brace,expansion}",
+	"~tilde",
+	"#hash",
+	"!bang",
+	"ünïcødé ✓",
+	"0 0 81a4 0 0 looks like stat",
+}
+
+// writeHostileTree creates every hostile name as a file in root and in a
+// directory that has a hostile name itself
+func writeHostileTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	contents := make(map[string]string)
+	for _, dir := range []string{"", "dir 'with\nhostile' $(name)"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range hostileNames {
+			rel := path.Join(dir, name)
+			content := "content of " + rel
+			if err := os.WriteFile(filepath.Join(root, rel), []byte(content), 0644); err != nil {
+				t.Fatalf("failed to create %q: %v", rel, err)
+			}
+			contents[path.Join(root, rel)] = content
+		}
+	}
+	return contents
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestShellQuoteHostileNames(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	for _, name := range hostileNames {
+		out, err := exec.Command("sh", "-c", "printf '%s' "+shellQuote(name)).Output()
+		if err != nil {
+			t.Fatalf("sh failed for %q: %v", name, err)
+		}
+		if string(out) != name {
+			t.Errorf("shellQuote(%q) came out of the shell as %q", name, out)
+		}
+	}
+}
+
+func TestParseShellStatNewlines(t *testing.T) {
+	output := "5 1600000000 81a4 1000 1000 /r/a\nb\n7 1600000000 41ed 0 0 /r/dir\n"
+	infos := parseShellStat(output, false)
+	if len(infos) != 2 || infos[0].Path != "/r/a\nb" || infos[1].Path != "/r/dir" || !infos[1].IsDir() {
+		t.Fatalf("unexpected newline terminated entries: %+v", infos)
+	}
+
+	output = "5 1600000000 81a4 1000 1000 /r/a\nb\x007 1600000000 41ed 0 0 /r/\n\x00"
+	infos = parseShellStat(output, true)
+	if len(infos) != 2 || infos[0].Path != "/r/a\nb" || infos[1].Path != "/r/\n" {
+		t.Fatalf("unexpected NUL terminated entries: %+v", infos)
+	}
+}
+
+func TestHostileNamesRemoteCommands(t *testing.T) {
+	for _, mode := range []string{"sftp", "shell"} {
+		t.Run(mode, func(t *testing.T) {
+			root := t.TempDir()
+			contents := writeHostileTree(t, root)
+			client := newTestSSHClient(t, mode)
+
+			entries, err := client.ListTree(root, true, nil, symlinksCopy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			listed := make(map[string]bool)
+			for _, entry := range entries {
+				if entry.Mode.IsRegular() {
+					listed[entry.Path] = true
+				}
+			}
+			for _, remotePath := range sortedKeys(contents) {
+				if !listed[remotePath] {
+					t.Errorf("ListTree is missing %q", remotePath)
+				}
+			}
+			if len(listed) != len(contents) {
+				t.Errorf("ListTree found %d files, want %d", len(listed), len(contents))
+			}
+
+			for _, remotePath := range sortedKeys(contents) {
+				info, err := client.Stat(remotePath)
+				if err != nil {
+					t.Errorf("Stat(%q): %v", remotePath, err)
+				} else if info.Size != int64(len(contents[remotePath])) {
+					t.Errorf("Stat(%q) size = %d, want %d", remotePath, info.Size, len(contents[remotePath]))
+				}
+			}
+
+			// Every download method
+			local := filepath.Join(t.TempDir(), "download")
+			downloads := map[string]func(string, *localDestination) error{
+				"default": client.copyFromRemote,
+				"cat":     client.copyFileUsingCat,
+				"scp":     client.copyFileUsingSCP,
+			}
+			if _, err := exec.LookPath("scp"); err != nil {
+				delete(downloads, "scp")
+			}
+			for method, download := range downloads {
+				for _, remotePath := range sortedKeys(contents) {
+					dst := &localDestination{path: local}
+					if err := download(remotePath, dst); err != nil {
+						t.Errorf("%s download of %q: %v", method, remotePath, err)
+						continue
+					}
+					if method != "default" {
+						if err := dst.commit(); err != nil {
+							t.Fatal(err)
+						}
+					}
+					data, err := os.ReadFile(local)
+					if err != nil || string(data) != contents[remotePath] {
+						t.Errorf("%s download of %q = %q, %v", method, remotePath, data, err)
+					}
+				}
+			}
+
+			// Relative paths resolve against the remote working directory,
+			// names starting with "-" must not be taken for options
+			t.Chdir(root)
+			for _, name := range []string{"-dash", "--double-dash"} {
+				if _, err := client.Stat(name); err != nil {
+					t.Errorf("Stat(%q): %v", name, err)
+				}
+				for method, download := range downloads {
+					dst := &localDestination{path: local}
+					if err := download(name, dst); err != nil {
+						t.Errorf("%s download of %q: %v", method, name, err)
+					}
+				}
+			}
+
+			if _, err := exec.LookPath("sha256sum"); err != nil {
+				return
+			}
+			sums, err := client.RemoteChecksums(root, "sha256")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, remotePath := range sortedKeys(contents) {
+				want := sha256.Sum256([]byte(contents[remotePath]))
+				if sums[remotePath] != hex.EncodeToString(want[:]) {
+					t.Errorf("RemoteChecksums[%q] = %q", remotePath, sums[remotePath])
+				}
+				sum, err := client.RemoteChecksum(remotePath, "sha256")
+				if err != nil || sum != hex.EncodeToString(want[:]) {
+					t.Errorf("RemoteChecksum(%q) = %q, %v", remotePath, sum, err)
+				}
+			}
+
+			if _, err := os.Stat(filepath.Join(root, "pwned")); err == nil {
+				t.Error("a file name was executed by the remote shell")
+			}
+		})
+	}
+}
+
+func TestHostileNamesTransfer(t *testing.T) {
+	for _, mode := range []string{"sftp", "shell"} {
+		for _, transferMode := range []string{"files", "tar"} {
+			t.Run(mode+"/"+transferMode, func(t *testing.T) {
+				if _, err := exec.LookPath("tar"); err != nil && transferMode == "tar" {
+					t.Skip("no tar")
+				}
+				root := t.TempDir()
+				contents := writeHostileTree(t, root)
+				client := newTestSSHClient(t, mode)
+
+				rule := entity.FileRule{
+					ID:             1,
+					RemotePath:     root,
+					Recursive:      true,
+					TransferMode:   transferMode,
+					SymlinkPolicy:  symlinksCopy,
+					ExcludePattern: "-dash",
+				}
+				dest := t.TempDir()
+				files, err := NewFileTransferService(client, dest, 0, TransferOptions{Concurrency: 2}).TransferFiles([]entity.FileRule{rule})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got := make(map[string]string)
+				for _, file := range files {
+					data, err := os.ReadFile(file.LocalPath)
+					if err != nil {
+						t.Errorf("failed to read %q: %v", file.LocalPath, err)
+						continue
+					}
+					got[file.RemotePath] = string(data)
+				}
+				for _, remotePath := range sortedKeys(contents) {
+					excluded := path.Base(remotePath) == "-dash"
+					if _, ok := got[remotePath]; ok == excluded {
+						t.Errorf("transferred %q: %v, excluded: %v", remotePath, ok, excluded)
+					} else if !excluded && got[remotePath] != contents[remotePath] {
+						t.Errorf("content of %q = %q", remotePath, got[remotePath])
+					}
+					rel := strings.TrimPrefix(remotePath, root+"/")
+					if _, err := os.Stat(filepath.Join(dest, filepath.FromSlash(rel))); (err == nil) == excluded {
+						t.Errorf("local copy of %q: %v", rel, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestHostileRootPaths(t *testing.T) {
+	parent := t.TempDir()
+	for _, rel := range []string{"a.txt", "sub/b.txt", "c.tmp"} {
+		file := filepath.Join(parent, "-root dir", filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte("content of "+rel), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a.txt", filepath.Join(parent, "-root dir", "link")); err != nil {
+		t.Fatal(err)
+	}
+	// A relative root starting with "-" must not be taken for a find option
+	t.Chdir(parent)
+	const root = "-root dir"
+	filter := mustFileFilter(t, "/sub\n*.tmp", "")
+	want := []string{root + "/a.txt", root + "/link"}
+
+	for _, mode := range []string{"sftp", "shell"} {
+		t.Run(mode, func(t *testing.T) {
+			client := newTestSSHClient(t, mode)
+			entries, err := client.ListTree(root, true, filter, symlinksCopy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					got = append(got, entry.Path)
+				}
+				if entry.IsSymlink() && entry.LinkTarget != "a.txt" {
+					t.Errorf("link target of %q = %q", entry.Path, entry.LinkTarget)
+				}
+			}
+			sort.Strings(got)
+			if strings.Join(got, "|") != strings.Join(want, "|") {
+				t.Errorf("ListTree(%q) = %q, want %q", root, got, want)
+			}
+
+			if _, err := exec.LookPath("sha256sum"); err == nil {
+				sums, err := client.RemoteChecksums(root, "sha256")
+				if err != nil {
+					t.Fatal(err)
+				}
+				sum := sha256.Sum256([]byte("content of a.txt"))
+				if sums[root+"/a.txt"] != hex.EncodeToString(sum[:]) {
+					t.Errorf("RemoteChecksums(%q) = %v", root, sums)
+				}
+			}
+
+			if _, err := exec.LookPath("tar"); err != nil {
+				return
+			}
+			// Copied symlinks are recorded in the metadata, not transferred
+			for policy, want := range map[string][]string{
+				symlinksCopy:   {root + "/a.txt"},
+				symlinksFollow: {root + "/a.txt", root + "/link"},
+			} {
+				rule := entity.FileRule{ID: 1, RemotePath: root, Recursive: true, TransferMode: "tar", SymlinkPolicy: policy, ExcludePattern: "/sub\n*.tmp"}
+				files, err := NewFileTransferService(client, t.TempDir(), 0, TransferOptions{Concurrency: 1}).TransferFiles([]entity.FileRule{rule})
+				if err != nil {
+					t.Errorf("tar transfer of %q with %s: %v", root, policy, err)
+					continue
+				}
+				var transferred []string
+				for _, file := range files {
+					transferred = append(transferred, path.Clean(file.RemotePath))
+				}
+				sort.Strings(transferred)
+				if strings.Join(transferred, "|") != strings.Join(want, "|") {
+					t.Errorf("tar transfer of %q with %s = %q, want %q", root, policy, transferred, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"backapp-server/entity"
+
+	"gorm.io/gorm"
+)
+
+// normalizeIncrementalMode defaults an empty incremental mode and rejects unknown ones
+func normalizeIncrementalMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return "off", nil
+	case "off", "metadata", "checksum":
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unsupported incremental_mode: %s", mode)
+	}
+}
+
+// previousBackupFiles returns the latest completed or partial run of a
+// profile other than runID together with its files keyed by remote path. The
+// run is nil if the profile has not completed a backup yet.
+func previousBackupFiles(profileID, runID uint) (*entity.BackupRun, map[string]entity.BackupFile, error) {
+	var run entity.BackupRun
+	err := DB.Where("backup_profile_id = ? AND id <> ? AND status IN ?", profileID, runID, []string{"completed", "partial"}).
+		Order("start_time DESC, id DESC").
+		First(&run).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []entity.BackupFile
+	if err := DB.Where("backup_run_id = ?", run.ID).Find(&files).Error; err != nil {
+		return nil, nil, err
+	}
+	previous := make(map[string]entity.BackupFile, len(files))
+	for _, file := range files {
+		previous[file.RemotePath] = file
+	}
+	return &run, previous, nil
+}
+
+// sameStorage reports whether the files of previous can be reused by run,
+// which requires both to be in the same storage location. Runs that do not
+// record their location are on the local file system.
+func sameStorage(previous, run *entity.BackupRun, local bool) bool {
+	if previous.StorageLocationID == nil {
+		return local
+	}
+	return run.StorageLocationID != nil && *previous.StorageLocationID == *run.StorageLocationID
+}
+
+// packedRun describes why the loose files of run cannot be reused, which is
+// empty if they can. Deduplicated and archived runs keep no loose files.
+func packedRun(run *entity.BackupRun) string {
+	switch {
+	case run.ManifestPath != "":
+		return "is stored in the chunk store"
+	case run.ArchivePath != "":
+		return "is packed into an archive"
+	}
+	return ""
+}
+
+// reuseFile hard-links job from the previous run if the remote file did not
+// change since then, object storage copies it on the server. It reports false
+// if the file has to be downloaded.
+func (s *FileTransferService) reuseFile(rule entity.FileRule, job transferJob) (*entity.BackupFile, bool) {
+	if s.options.IncrementalMode == "off" || s.options.Previous == nil {
+		return nil, false
+	}
+	prev, ok := s.options.Previous[job.remote.Path]
+	if !ok || prev.SizeBytes != job.remote.Size {
+		return nil, false
+	}
+
+	checksum := prev.Checksum
+	switch s.options.IncrementalMode {
+	case "metadata":
+		if prev.ModTime == nil || !prev.ModTime.Truncate(time.Second).Equal(job.remote.ModTime.Truncate(time.Second)) {
+			return nil, false
+		}
+	case "checksum":
+		if prev.Checksum == "" || prev.ChecksumAlgorithm != s.options.ChecksumAlgorithm {
+			return nil, false
+		}
+		remote, err := s.sshClient.RemoteChecksum(job.remote.Path, s.options.ChecksumAlgorithm)
+		if err != nil {
+			s.logToDatabase("WARNING", fmt.Sprintf("Could not compare checksum of %s, downloading it: %v", job.remote.Path, err))
+			return nil, false
+		}
+		if remote != prev.Checksum {
+			return nil, false
+		}
+	}
+
+	// The earlier copy must still be intact, otherwise it is downloaded again.
+	// Encrypted copies are larger than the plaintext by the encryption overhead.
+	size, err := s.storage().Stat(prev.LocalPath)
+	if err != nil {
+		return nil, false
+	}
+	if (s.options.Cipher == nil && size != prev.SizeBytes) || size < prev.SizeBytes {
+		return nil, false
+	}
+	if err := s.storage().Copy(prev.LocalPath, job.localPath); err != nil {
+		s.logToDatabase("WARNING", fmt.Sprintf("Could not link %s, downloading it: %v", prev.LocalPath, err))
+		return nil, false
+	}
+
+	return &entity.BackupFile{
+		RemotePath:        job.remote.Path,
+		LocalPath:         job.localPath,
+		SizeBytes:         job.remote.Size,
+		FileSize:          job.remote.Size,
+		Checksum:          checksum,
+		ChecksumAlgorithm: prev.ChecksumAlgorithm,
+		ModTime:           remoteModTime(job.remote),
+		Reused:            true,
+		FileRuleID:        rule.ID,
+	}, true
+}
+
+// remoteModTime returns the modification time of a remote file, or nil if it
+// is unknown
+func remoteModTime(info RemoteFileInfo) *time.Time {
+	if info.ModTime.IsZero() {
+		return nil
+	}
+	modTime := info.ModTime
+	return &modTime
+}
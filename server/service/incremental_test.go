@@ -0,0 +1,24 @@
+package service
+
+import (
+	"testing"
+
+	"backapp-server/entity"
+)
+
+func TestPackedRunHasNoFilesToReuse(t *testing.T) {
+	tests := []struct {
+		name   string
+		run    entity.BackupRun
+		packed bool
+	}{
+		{"plain", entity.BackupRun{LocalBackupPath: "/backups/run"}, false},
+		{"deduplicated", entity.BackupRun{LocalBackupPath: "/backups/run", ManifestPath: "/backups/.manifests/1.json"}, true},
+		{"archived", entity.BackupRun{LocalBackupPath: "/backups/run", ArchivePath: "/backups/run.tar.zst"}, true},
+	}
+	for _, tt := range tests {
+		if got := packedRun(&tt.run); (got != "") != tt.packed {
+			t.Errorf("%s: packedRun = %q, want packed %v", tt.name, got, tt.packed)
+		}
+	}
+}
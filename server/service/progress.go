@@ -0,0 +1,278 @@
+package service
+
+import (
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"backapp-server/entity"
+)
+
+const (
+	// progressPersistInterval is how often the progress of a running transfer
+	// is written to its BackupRun
+	progressPersistInterval = 5 * time.Second
+	// throughputWindow is the period the current throughput is averaged over
+	throughputWindow = 30 * time.Second
+)
+
+// activeProgress holds the progress of the transfers running in this process
+// keyed by run ID
+var activeProgress sync.Map
+
+// TransferProgress is a snapshot of the progress of a run. ETASeconds is nil
+// while no throughput has been measured yet or nothing is left to transfer
+// from the rules listed so far.
+type TransferProgress struct {
+	RunID          uint       `json:"run_id"`
+	Status         string     `json:"status"`
+	Live           bool       `json:"live"`
+	FilesDone      int64      `json:"files_done"`
+	FilesTotal     int64      `json:"files_total"`
+	BytesDone      int64      `json:"bytes_done"`
+	BytesTotal     int64      `json:"bytes_total"`
+	RulesDone      int        `json:"rules_done"`
+	RulesTotal     int        `json:"rules_total"`
+	BytesPerSecond float64    `json:"bytes_per_second"`
+	ETASeconds     *int64     `json:"eta_seconds"`
+	UpdatedAt      *time.Time `json:"updated_at"`
+}
+
+// transferProgress counts the files and bytes of a transfer. Totals are added
+// when a rule's listing is known, or entry by entry for tar streams and
+// command output, so they grow until the last rule was listed.
+type transferProgress struct {
+	filesDone  atomic.Int64
+	filesTotal atomic.Int64
+	bytesDone  atomic.Int64
+	bytesTotal atomic.Int64
+	rulesDone  atomic.Int64
+	rulesTotal atomic.Int64
+
+	mu      sync.Mutex
+	started time.Time
+	// samples of bytesDone within throughputWindow, oldest first
+	samples []progressSample
+}
+
+type progressSample struct {
+	at    time.Time
+	bytes int64
+}
+
+func newTransferProgress() *transferProgress {
+	return &transferProgress{started: time.Now()}
+}
+
+// addTotal adds files and bytes that are going to be transferred
+func (p *transferProgress) addTotal(files, bytes int64) {
+	p.filesTotal.Add(files)
+	p.bytesTotal.Add(bytes)
+}
+
+// file starts counting a file of size bytes that is part of the total. A
+// negative size means the size is unknown and every byte written also adds
+// to the total.
+func (p *transferProgress) file(size int64) *fileProgress {
+	return &fileProgress{progress: p, size: size}
+}
+
+// snapshot returns the current progress and records a throughput sample
+func (p *transferProgress) snapshot() TransferProgress {
+	now := time.Now()
+	done := p.bytesDone.Load()
+	progress := TransferProgress{
+		Live:       true,
+		FilesDone:  p.filesDone.Load(),
+		FilesTotal: p.filesTotal.Load(),
+		BytesDone:  done,
+		BytesTotal: p.bytesTotal.Load(),
+		RulesDone:  int(p.rulesDone.Load()),
+		RulesTotal: int(p.rulesTotal.Load()),
+		UpdatedAt:  &now,
+	}
+
+	p.mu.Lock()
+	p.samples = append(p.samples, progressSample{at: now, bytes: done})
+	for len(p.samples) > 2 && now.Sub(p.samples[1].at) >= throughputWindow {
+		p.samples = p.samples[1:]
+	}
+	// Until the window has two samples a second apart, average since start
+	first := progressSample{at: p.started}
+	if oldest := p.samples[0]; now.Sub(oldest.at) >= time.Second {
+		first = oldest
+	}
+	p.mu.Unlock()
+
+	if elapsed := now.Sub(first.at).Seconds(); elapsed > 0 {
+		progress.BytesPerSecond = max(float64(done-first.bytes), 0) / elapsed
+	}
+	// Rules that were not listed yet add to the total, so a transfer is
+	// only finished once every rule is done
+	remaining := max(progress.BytesTotal-done, 0)
+	if remaining == 0 && progress.RulesTotal > 0 && progress.RulesDone >= progress.RulesTotal {
+		eta := int64(0)
+		progress.ETASeconds = &eta
+	} else if remaining > 0 && progress.BytesPerSecond > 0 {
+		eta := int64(float64(remaining)/progress.BytesPerSecond + 0.5)
+		progress.ETASeconds = &eta
+	}
+	return progress
+}
+
+// fileProgress counts the bytes of a single file towards a transferProgress.
+// It is used by one goroutine at a time and may be nil.
+type fileProgress struct {
+	progress *transferProgress
+	size     int64
+	// counted is what was added to bytesDone for this file so far
+	counted int64
+}
+
+// add counts n written bytes, negative when written data is dropped again
+func (f *fileProgress) add(n int64) {
+	if f == nil {
+		return
+	}
+	f.counted += n
+	f.progress.bytesDone.Add(n)
+	if f.size < 0 {
+		f.progress.bytesTotal.Add(n)
+	}
+}
+
+// restart drops the bytes counted so far before the file is transferred again
+func (f *fileProgress) restart() {
+	if f != nil {
+		f.add(-f.counted)
+	}
+}
+
+// finish counts the file as done. Bytes of files that were reused, skipped or
+// only partially counted are settled to the size of the file.
+func (f *fileProgress) finish() {
+	if f == nil {
+		return
+	}
+	if f.size >= 0 {
+		f.progress.bytesDone.Add(f.size - f.counted)
+		f.counted = f.size
+	}
+	f.progress.filesDone.Add(1)
+}
+
+// progressWriter counts the bytes written to a localDestination
+type progressWriter struct {
+	w   io.Writer
+	dst *localDestination
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.dst.written += int64(n)
+	p.dst.progress.add(int64(n))
+	return n, err
+}
+
+// Progress returns the progress of the transfer
+func (s *FileTransferService) Progress() *transferProgress {
+	return s.progress
+}
+
+// applyProgress copies a progress snapshot into the progress fields of run
+func applyProgress(run *entity.BackupRun, progress TransferProgress) {
+	run.ProgressFilesDone = progress.FilesDone
+	run.ProgressFilesTotal = progress.FilesTotal
+	run.ProgressBytesDone = progress.BytesDone
+	run.ProgressBytesTotal = progress.BytesTotal
+	run.ProgressRulesDone = progress.RulesDone
+	run.ProgressRulesTotal = progress.RulesTotal
+	run.ProgressBytesPerSecond = progress.BytesPerSecond
+	run.ProgressETASeconds = progress.ETASeconds
+	run.ProgressUpdatedAt = progress.UpdatedAt
+}
+
+// saveProgress writes only the progress fields, the rest of the run belongs
+// to the executor
+func saveProgress(runID uint, progress TransferProgress) error {
+	var run entity.BackupRun
+	applyProgress(&run, progress)
+	return DB.Model(&entity.BackupRun{ID: runID}).Select(
+		"ProgressFilesDone", "ProgressFilesTotal", "ProgressBytesDone", "ProgressBytesTotal",
+		"ProgressRulesDone", "ProgressRulesTotal", "ProgressBytesPerSecond", "ProgressETASeconds", "ProgressUpdatedAt",
+	).Updates(&run).Error
+}
+
+// trackProgress publishes the progress of the transfer of run and writes it
+// to the database every progressPersistInterval. The returned function stops
+// tracking and stores the final progress in run.
+func trackProgress(run *entity.BackupRun, progress *transferProgress) func() {
+	activeProgress.Store(run.ID, progress)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(progressPersistInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := saveProgress(run.ID, progress.snapshot()); err != nil {
+					log.Printf("Failed to save progress of run %d: %v", run.ID, err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+		final := progress.snapshot()
+		// The final throughput is the average of the whole transfer
+		if elapsed := time.Since(progress.started).Seconds(); elapsed > 0 {
+			final.BytesPerSecond = float64(final.BytesDone) / elapsed
+		}
+		// A transfer that stopped early has no ETA
+		if final.BytesDone < final.BytesTotal {
+			final.ETASeconds = nil
+		}
+		applyProgress(run, final)
+		if err := saveProgress(run.ID, final); err != nil {
+			log.Printf("Failed to save progress of run %d: %v", run.ID, err)
+		}
+		activeProgress.Delete(run.ID)
+	}
+}
+
+// ServiceGetBackupRunProgress returns the live progress of a running
+// transfer, or the progress last stored with the run
+func ServiceGetBackupRunProgress(id uint) (*TransferProgress, error) {
+	run, err := ServiceGetBackupRun(id)
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := activeProgress.Load(run.ID); ok {
+		progress := value.(*transferProgress).snapshot()
+		progress.RunID = run.ID
+		progress.Status = run.Status
+		return &progress, nil
+	}
+	return &TransferProgress{
+		RunID:          run.ID,
+		Status:         run.Status,
+		FilesDone:      run.ProgressFilesDone,
+		FilesTotal:     run.ProgressFilesTotal,
+		BytesDone:      run.ProgressBytesDone,
+		BytesTotal:     run.ProgressBytesTotal,
+		RulesDone:      run.ProgressRulesDone,
+		RulesTotal:     run.ProgressRulesTotal,
+		BytesPerSecond: run.ProgressBytesPerSecond,
+		ETASeconds:     run.ProgressETASeconds,
+		UpdatedAt:      run.ProgressUpdatedAt,
+	}, nil
+}
@@ -0,0 +1,462 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// RemoteFileInfo describes a file or directory on a remote server
+type RemoteFileInfo struct {
+	Path    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+	Uid     int
+	Gid     int
+	// LinkTarget is set for symlinks that are not followed
+	LinkTarget string
+}
+
+// IsDir reports whether the entry is a directory
+func (f *RemoteFileInfo) IsDir() bool {
+	return f.Mode.IsDir()
+}
+
+// IsSymlink reports whether the entry is a symlink
+func (f *RemoteFileInfo) IsSymlink() bool {
+	return f.Mode&os.ModeSymlink != 0
+}
+
+// Symlink policies of file rules
+const (
+	symlinksFollow = "follow"
+	symlinksCopy   = "copy"
+	symlinksSkip   = "skip"
+)
+
+// sftpFileInfo converts an SFTP file info of remotePath
+func sftpFileInfo(remotePath string, info os.FileInfo) RemoteFileInfo {
+	result := RemoteFileInfo{
+		Path:    remotePath,
+		Size:    info.Size(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+	}
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		result.Uid = int(stat.UID)
+		result.Gid = int(stat.GID)
+	}
+	return result
+}
+
+// shellStatCommand returns a stat invocation printing size, mtime, raw mode,
+// owner, group and name of its arguments, using the flags understood by the
+// remote stat. With follow, symlinks are reported by their target. nul
+// reports whether entries are terminated by NUL bytes instead of newlines.
+func (c *SSHClient) shellStatCommand(follow bool) (cmd string, nul bool) {
+	c.mu.Lock()
+	if c.statCmd == "" {
+		// GNU stat can terminate entries with NUL bytes, so that names with
+		// newlines survive. BusyBox stat only takes -c and BSD stat only
+		// understands -f, their output is newline terminated.
+		output, _ := c.RunCommand(`stat --printf '%s\0' / >/dev/null 2>&1 && echo gnu || { stat -c %s / >/dev/null 2>&1 && echo busybox || echo bsd; }`)
+		switch strings.TrimSpace(output) {
+		case "gnu":
+			c.statCmd = `stat --printf '%s %Y %f %u %g %n\0'`
+			c.statNUL = true
+		case "bsd":
+			c.statCmd = "stat -f '%z %m %Xp %u %g %N'"
+		default:
+			c.statCmd = "stat -c '%s %Y %f %u %g %n'"
+		}
+	}
+	cmd, nul = c.statCmd, c.statNUL
+	c.mu.Unlock()
+	if follow {
+		cmd = strings.Replace(cmd, "stat ", "stat -L ", 1)
+	}
+	return cmd, nul
+}
+
+// Stat returns information about remotePath, following symlinks
+func (c *SSHClient) Stat(remotePath string) (*RemoteFileInfo, error) {
+	if client, err := c.sftpClient(); err == nil {
+		info, err := client.Stat(remotePath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", remotePath, err)
+		}
+		result := sftpFileInfo(remotePath, info)
+		return &result, nil
+	} else if c.transferMode == "sftp" {
+		return nil, err
+	}
+
+	statCmd, nul := c.shellStatCommand(true)
+	output, stderr, err := c.runCommandOutput(shellPathCommand(statCmd, remotePath))
+	if err != nil {
+		if strings.Contains(stderr, "No such file") {
+			return nil, fmt.Errorf("%s: %w", remotePath, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("failed to stat %s: %v", remotePath, err)
+	}
+	infos := parseShellStat(output, nul)
+	if len(infos) != 1 {
+		return nil, fmt.Errorf("unexpected stat output for %s: %q", remotePath, output)
+	}
+	infos[0].Path = remotePath
+	return &infos[0], nil
+}
+
+// ReadDir lists the entries of a remote directory
+func (c *SSHClient) ReadDir(remotePath string) ([]RemoteFileInfo, error) {
+	if client, err := c.sftpClient(); err == nil {
+		entries, err := client.ReadDir(remotePath)
+		if err != nil {
+			return nil, err
+		}
+		results := make([]RemoteFileInfo, 0, len(entries))
+		for _, entry := range entries {
+			info := sftpFileInfo(path.Join(remotePath, entry.Name()), entry)
+			// Report symlinks by their target, like stat -L does
+			if info.IsSymlink() {
+				if target, err := client.Stat(info.Path); err == nil {
+					info = sftpFileInfo(info.Path, target)
+				}
+			}
+			results = append(results, info)
+		}
+		return results, nil
+	} else if c.transferMode == "sftp" {
+		return nil, err
+	}
+
+	return c.findUsingShell(remotePath, "-mindepth 1 -maxdepth 1", true)
+}
+
+// ListTree returns the regular files and directories below root, descending
+// into subdirectories when recursive is set. Depending on symlinks, symlinks
+// are followed, returned with their LinkTarget or left out. Entries the filter
+// does not match are left out and excluded directories are not descended
+// into; filter may be nil.
+func (c *SSHClient) ListTree(root string, recursive bool, filter *fileFilter, symlinks string) ([]RemoteFileInfo, error) {
+	var entries []RemoteFileInfo
+	if client, err := c.sftpClient(); err == nil {
+		if entries, err = listTreeSFTP(client, root, recursive, filter, symlinks); err != nil {
+			return nil, err
+		}
+	} else if c.transferMode == "sftp" {
+		return nil, err
+	} else if entries, err = c.listTreeShell(root, recursive, filter, symlinks); err != nil {
+		return nil, err
+	}
+	return filterTree(root, entries, filter), nil
+}
+
+// maxFollowedSymlinks limits how many symlinked directories are followed
+// inside each other
+const maxFollowedSymlinks = 16
+
+// resolveSymlink returns the cleaned path a symlink points to, resolved
+// further by the server if it supports that
+func resolveSymlink(client *sftp.Client, linkPath string) (string, error) {
+	target, err := client.ReadLink(linkPath)
+	if err != nil {
+		return "", err
+	}
+	if !path.IsAbs(target) {
+		target = path.Join(path.Dir(linkPath), target)
+	}
+	return client.RealPath(target)
+}
+
+// listTreeSFTP walks root over SFTP. Symlinked directories are only followed
+// once per target, which breaks symlink loops.
+func listTreeSFTP(client *sftp.Client, root string, recursive bool, filter *fileFilter, symlinks string) ([]RemoteFileInfo, error) {
+	var results []RemoteFileInfo
+	visited := map[string]bool{path.Clean(root): true}
+	if real, err := client.RealPath(root); err == nil {
+		visited[real] = true
+	}
+
+	var walk func(dir string, links int) error
+	walk = func(dir string, links int) error {
+		entries, err := client.ReadDir(dir)
+		if err != nil {
+			if dir == root {
+				return err
+			}
+			// Skip unreadable directories, like find does
+			return nil
+		}
+		for _, entry := range entries {
+			info := sftpFileInfo(path.Join(dir, entry.Name()), entry)
+			nested := links
+			if info.IsSymlink() {
+				switch symlinks {
+				case symlinksCopy:
+					target, err := client.ReadLink(info.Path)
+					if err != nil {
+						continue
+					}
+					info.LinkTarget = target
+					results = append(results, info)
+					continue
+				case symlinksFollow:
+					target, err := client.Stat(info.Path)
+					if err != nil {
+						// Dangling symlink
+						continue
+					}
+					info = sftpFileInfo(info.Path, target)
+					if info.IsDir() {
+						real, err := resolveSymlink(client, info.Path)
+						if err != nil || visited[real] || links >= maxFollowedSymlinks {
+							continue
+						}
+						visited[real] = true
+						nested++
+					}
+				default:
+					continue
+				}
+			}
+
+			switch {
+			case info.IsDir():
+				if filter.Excluded(relativeRemotePath(root, info.Path), true) {
+					continue
+				}
+				results = append(results, info)
+				if recursive {
+					if err := walk(info.Path, nested); err != nil {
+						return err
+					}
+				}
+			case info.Mode.IsRegular():
+				results = append(results, info)
+			}
+		}
+		return nil
+	}
+
+	if err := walk(root, 0); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// listTreeShell lists root with find, pruning excluded directories remotely
+func (c *SSHClient) listTreeShell(root string, recursive bool, filter *fileFilter, symlinks string) ([]RemoteFileInfo, error) {
+	// find prints paths below the root as given, the "./" of a relative root
+	// is removed again
+	findRoot := optionSafePath(root)
+	unprefix := func(p string) string {
+		if findRoot != root {
+			return strings.TrimPrefix(p, "./")
+		}
+		return p
+	}
+	args := "-mindepth 1"
+	if !recursive {
+		args += " -maxdepth 1"
+	}
+	if prune := filter.FindPruneArgs(findRoot); prune != "" {
+		args += " " + prune
+	}
+	follow := symlinks == symlinksFollow
+	types := `\( -type f -o -type d \)`
+	if symlinks == symlinksCopy {
+		types = `\( -type f -o -type d -o -type l \)`
+	}
+
+	entries, err := c.findUsingShell(findRoot, args+" "+types, follow)
+	for i := range entries {
+		entries[i].Path = unprefix(entries[i].Path)
+	}
+	if err != nil || symlinks != symlinksCopy {
+		return entries, err
+	}
+
+	// Resolve the targets of all symlinks in one more command
+	hasSymlinks := false
+	for _, entry := range entries {
+		hasSymlinks = hasSymlinks || entry.IsSymlink()
+	}
+	if !hasSymlinks {
+		return entries, nil
+	}
+	// Pairs of link and target, each terminated by a NUL byte
+	cmd := fmt.Sprintf(`find %s %s -type l -exec sh -c 'for f; do printf "%%s\0%%s\0" "$f" "$(readlink -- "$f")"; done' sh {} +`, shellQuote(findRoot), args)
+	output, _, err := c.runCommandOutput(cmd)
+	if err != nil && output == "" {
+		return nil, fmt.Errorf("failed to read symlinks below %s: %v", root, err)
+	}
+	targets := make(map[string]string)
+	fields := strings.Split(output, "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		targets[unprefix(fields[i])] = fields[i+1]
+	}
+	results := entries[:0]
+	for _, entry := range entries {
+		if entry.IsSymlink() {
+			target, ok := targets[entry.Path]
+			if !ok {
+				continue
+			}
+			entry.LinkTarget = target
+		}
+		results = append(results, entry)
+	}
+	return results, nil
+}
+
+// filterTree applies filter to a listing. Directories are kept unless they
+// are excluded; with include patterns only if they are included themselves
+// or hold an included entry.
+func filterTree(root string, entries []RemoteFileInfo, filter *fileFilter) []RemoteFileInfo {
+	keep := make([]bool, len(entries))
+	needed := make(map[string]bool)
+	for i, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		rel := relativeRemotePath(root, entry.Path)
+		if !filter.Matches(rel) {
+			continue
+		}
+		keep[i] = true
+		for dir := path.Dir(rel); dir != "." && !needed[dir]; dir = path.Dir(dir) {
+			needed[dir] = true
+		}
+	}
+
+	results := make([]RemoteFileInfo, 0, len(entries))
+	for i, entry := range entries {
+		if entry.IsDir() {
+			rel := relativeRemotePath(root, entry.Path)
+			keep[i] = rel != "" && !filter.Excluded(rel, true) && (needed[rel] || filter.Included(rel, true))
+		}
+		if keep[i] {
+			results = append(results, entry)
+		}
+	}
+	return results
+}
+
+// findUsingShell lists entries below root with find and stats them in the same
+// command, so that no extra round trip per file is needed. With follow, find
+// and stat follow symlinks.
+func (c *SSHClient) findUsingShell(root, findArgs string, follow bool) ([]RemoteFileInfo, error) {
+	findCmd := "find "
+	if follow {
+		findCmd += "-L "
+	}
+	statCmd, nul := c.shellStatCommand(follow)
+	cmd := fmt.Sprintf("%s%s %s -exec %s {} +", findCmd, shellQuote(root), findArgs, statCmd)
+	output, _, err := c.runCommandOutput(cmd)
+	results := parseShellStat(output, nul)
+	if err != nil && len(results) == 0 {
+		return nil, fmt.Errorf("failed to list %s: %v", root, err)
+	}
+	return results, nil
+}
+
+// parseShellStat parses entries of "<size> <mtime> <hex mode> <uid> <gid> <path>".
+// With nul, entries are terminated by NUL bytes. Otherwise they are newline
+// terminated, and a line that does not start a new entry continues the name
+// of the previous one, which keeps names with newlines intact.
+func parseShellStat(output string, nul bool) []RemoteFileInfo {
+	var results []RemoteFileInfo
+	if nul {
+		for _, entry := range strings.Split(output, "\x00") {
+			if info, ok := parseShellStatEntry(entry); ok {
+				results = append(results, info)
+			}
+		}
+		return results
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		if info, ok := parseShellStatEntry(line); ok {
+			results = append(results, info)
+		} else if len(results) > 0 {
+			results[len(results)-1].Path += "\n" + line
+		}
+	}
+	return results
+}
+
+// parseShellStatEntry parses a single stat entry
+func parseShellStatEntry(entry string) (RemoteFileInfo, bool) {
+	parts := strings.SplitN(entry, " ", 6)
+	if len(parts) != 6 || parts[5] == "" {
+		return RemoteFileInfo{}, false
+	}
+	size, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return RemoteFileInfo{}, false
+	}
+	mtime, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return RemoteFileInfo{}, false
+	}
+	rawMode, err := strconv.ParseUint(parts[2], 16, 32)
+	if err != nil {
+		return RemoteFileInfo{}, false
+	}
+	uid, uidErr := strconv.Atoi(parts[3])
+	gid, gidErr := strconv.Atoi(parts[4])
+	if uidErr != nil || gidErr != nil {
+		return RemoteFileInfo{}, false
+	}
+	return RemoteFileInfo{
+		Path:    parts[5],
+		Size:    size,
+		Mode:    fileModeFromUnix(uint32(rawMode)),
+		ModTime: time.Unix(mtime, 0),
+		Uid:     uid,
+		Gid:     gid,
+	}, true
+}
+
+// fileModeFromUnix converts a raw st_mode value to an os.FileMode
+func fileModeFromUnix(raw uint32) os.FileMode {
+	mode := os.FileMode(raw & 0o777)
+	switch raw & 0o170000 {
+	case 0o040000:
+		mode |= fs.ModeDir
+	case 0o120000:
+		mode |= fs.ModeSymlink
+	case 0o010000:
+		mode |= fs.ModeNamedPipe
+	case 0o140000:
+		mode |= fs.ModeSocket
+	case 0o020000:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case 0o060000:
+		mode |= fs.ModeDevice
+	}
+	if raw&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if raw&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if raw&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// isRemoteNotExist reports whether err means the remote path does not exist
+func isRemoteNotExist(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
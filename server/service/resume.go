@@ -0,0 +1,123 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Partial downloads of large files that failed are kept per profile below
+// the staging directory, so that the next run continues them instead of
+// starting over
+const (
+	resumeDirName = "resume"
+	// minResumeBytes is the size from which a partial download is kept
+	minResumeBytes = 1 << 20
+	// resumeMaxAge is how long a kept partial download waits for a run
+	resumeMaxAge = 7 * 24 * time.Hour
+)
+
+// resumeState identifies the remote file a kept partial download belongs to.
+// It is only resumed while the remote file has the same size and mtime.
+type resumeState struct {
+	RemotePath string    `json:"remote_path"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+}
+
+// resumeDir returns the directory holding the kept partial downloads of a
+// profile
+func resumeDir(basePath string, profileID uint) string {
+	return filepath.Join(basePath, stagingDirName, resumeDirName, fmt.Sprintf("profile-%d", profileID))
+}
+
+// resumePaths returns the data and state file of the partial download of
+// remotePath in dir
+func resumePaths(dir, remotePath string) (string, string) {
+	key := sha256.Sum256([]byte(remotePath))
+	name := hex.EncodeToString(key[:16])
+	return filepath.Join(dir, name+".partial"), filepath.Join(dir, name+".json")
+}
+
+// keepPartial moves the partial download of remote into the resume directory
+// and reports whether it did. Encrypted, small and unidentifiable downloads
+// are not kept.
+func (s *FileTransferService) keepPartial(remote RemoteFileInfo, dst *localDestination) bool {
+	if s.options.ResumeDir == "" || !dst.resumable() || remote.Size == 0 || remote.ModTime.IsZero() {
+		return false
+	}
+	stat, err := os.Stat(partialPath(dst.path))
+	if err != nil || stat.Size() < minResumeBytes || stat.Size() >= remote.Size {
+		return false
+	}
+
+	data, err := json.Marshal(resumeState{RemotePath: remote.Path, Size: remote.Size, ModTime: remote.ModTime})
+	if err != nil {
+		return false
+	}
+	if err := os.MkdirAll(s.options.ResumeDir, 0755); err != nil {
+		return false
+	}
+	partial, state := resumePaths(s.options.ResumeDir, remote.Path)
+	if err := writeFileAtomic(state, data); err != nil {
+		return false
+	}
+	if err := os.Rename(partialPath(dst.path), partial); err != nil {
+		os.Remove(state)
+		return false
+	}
+	s.logToDatabase("INFO", fmt.Sprintf("Kept %.2f MB of %s, the next run resumes the download", float64(stat.Size())/1024/1024, remote.Path))
+	return true
+}
+
+// claimPartial moves a kept partial download of remote to the partial path
+// of localPath and returns its size. Kept downloads of files that changed
+// since are removed.
+func (s *FileTransferService) claimPartial(remote RemoteFileInfo, localPath string) int64 {
+	if s.options.ResumeDir == "" || remote.Size == 0 {
+		return 0
+	}
+	partial, state := resumePaths(s.options.ResumeDir, remote.Path)
+	data, err := os.ReadFile(state)
+	if err != nil {
+		return 0
+	}
+	defer os.Remove(state)
+
+	var kept resumeState
+	stat, statErr := os.Stat(partial)
+	if json.Unmarshal(data, &kept) != nil || statErr != nil ||
+		kept.RemotePath != remote.Path || kept.Size != remote.Size || !kept.ModTime.Equal(remote.ModTime) ||
+		stat.Size() >= remote.Size {
+		os.Remove(partial)
+		return 0
+	}
+	if err := os.Rename(partial, partialPath(localPath)); err != nil {
+		os.Remove(partial)
+		return 0
+	}
+	return stat.Size()
+}
+
+// pruneResumeDir removes kept partial downloads that were not resumed within
+// resumeMaxAge
+func pruneResumeDir(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < resumeMaxAge {
+			continue
+		}
+		if strings.HasSuffix(entry.Name(), ".partial") || strings.HasSuffix(entry.Name(), ".json") {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
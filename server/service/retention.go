@@ -0,0 +1,287 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"backapp-server/entity"
+)
+
+// retentionSchedule is the cron expression retention is evaluated with for
+// every profile, in addition to after each successful run
+const retentionSchedule = "@hourly"
+
+// retentionMu keeps evaluations of the scheduler, the executor and the API
+// from removing the same runs concurrently
+var retentionMu sync.Mutex
+
+// RetentionDecision tells whether a run is kept and which rules decided it
+type RetentionDecision struct {
+	RunID     uint      `json:"run_id"`
+	StartTime time.Time `json:"start_time"`
+	Status    string    `json:"status"`
+	Path      string    `json:"path"`
+	SizeBytes int64     `json:"size_bytes"`
+	Keep      bool      `json:"keep"`
+	Reasons   []string  `json:"reasons"`
+	// Error is set if removing the run failed, the run is kept then
+	Error string `json:"error,omitempty"`
+}
+
+// RetentionPlan lists the successful runs of a profile with the decision of
+// its retention rules, newest first
+type RetentionPlan struct {
+	ProfileID    uint                `json:"profile_id"`
+	DryRun       bool                `json:"dry_run"`
+	Runs         []RetentionDecision `json:"runs"`
+	KeptRuns     int                 `json:"kept_runs"`
+	RemovedRuns  int                 `json:"removed_runs"`
+	RemovedBytes int64               `json:"removed_bytes"`
+}
+
+// normalizeRetention turns negative retention rules off
+func normalizeRetention(profile *entity.BackupProfile) {
+	profile.RetentionKeepLast = max(profile.RetentionKeepLast, 0)
+	profile.RetentionKeepDaily = max(profile.RetentionKeepDaily, 0)
+	profile.RetentionKeepWeekly = max(profile.RetentionKeepWeekly, 0)
+	profile.RetentionKeepMonthly = max(profile.RetentionKeepMonthly, 0)
+	profile.RetentionKeepYearly = max(profile.RetentionKeepYearly, 0)
+	profile.RetentionMinAgeDays = max(profile.RetentionMinAgeDays, 0)
+	profile.RetentionMaxTotalBytes = max(profile.RetentionMaxTotalBytes, 0)
+}
+
+// hasRetention reports whether any retention rule of profile is set
+func hasRetention(profile *entity.BackupProfile) bool {
+	return profile.RetentionKeepLast > 0 || profile.RetentionKeepDaily > 0 || profile.RetentionKeepWeekly > 0 ||
+		profile.RetentionKeepMonthly > 0 || profile.RetentionKeepYearly > 0 || profile.RetentionMinAgeDays > 0 ||
+		profile.RetentionMaxTotalBytes > 0
+}
+
+// runStoredSize is the size a run takes in its storage location
+func runStoredSize(run *entity.BackupRun) int64 {
+	if run.ArchivePath != "" && run.CompressedSizeBytes > 0 {
+		return run.CompressedSizeBytes
+	}
+	return run.TotalSizeBytes
+}
+
+// retentionPeriods are the calendar periods of the grandfather-father-son
+// rules with the key of the period a time falls into
+var retentionPeriods = []struct {
+	name  string
+	count func(profile *entity.BackupProfile) int
+	key   func(t time.Time) string
+}{
+	{"daily", func(p *entity.BackupProfile) int { return p.RetentionKeepDaily }, func(t time.Time) string { return t.Format("2006-01-02") }},
+	{"weekly", func(p *entity.BackupProfile) int { return p.RetentionKeepWeekly }, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}},
+	{"monthly", func(p *entity.BackupProfile) int { return p.RetentionKeepMonthly }, func(t time.Time) string { return t.Format("2006-01") }},
+	{"yearly", func(p *entity.BackupProfile) int { return p.RetentionKeepYearly }, func(t time.Time) string { return t.Format("2006") }},
+}
+
+// evaluateRetention decides which of runs, sorted newest first, the rules of
+// profile keep. The newest run of every period is kept for the given number
+// of periods with a run, like restic's forget. The size limit is applied to
+// the runs kept by the other rules, removing from the oldest.
+func evaluateRetention(profile *entity.BackupProfile, runs []entity.BackupRun, now time.Time) []RetentionDecision {
+	decisions := make([]RetentionDecision, len(runs))
+	for i := range runs {
+		decisions[i] = RetentionDecision{
+			RunID:     runs[i].ID,
+			StartTime: runs[i].StartTime,
+			Status:    runs[i].Status,
+			Path:      runs[i].LocalBackupPath,
+			SizeBytes: runStoredSize(&runs[i]),
+			Reasons:   []string{},
+		}
+	}
+	keep := func(i int, reason string) {
+		decisions[i].Keep = true
+		decisions[i].Reasons = append(decisions[i].Reasons, reason)
+	}
+	if len(runs) == 0 {
+		return decisions
+	}
+
+	// Without count or age rules only the size limit removes runs
+	onlySize := profile.RetentionKeepLast == 0 && profile.RetentionKeepDaily == 0 && profile.RetentionKeepWeekly == 0 &&
+		profile.RetentionKeepMonthly == 0 && profile.RetentionKeepYearly == 0 && profile.RetentionMinAgeDays == 0
+
+	protected := make([]bool, len(runs))
+	keep(0, "newest run")
+	protected[0] = true
+	for i := range runs {
+		if i < profile.RetentionKeepLast {
+			keep(i, fmt.Sprintf("last %d", profile.RetentionKeepLast))
+		}
+		if profile.RetentionMinAgeDays > 0 && now.Sub(runs[i].StartTime) < time.Duration(profile.RetentionMinAgeDays)*24*time.Hour {
+			keep(i, fmt.Sprintf("younger than %d days", profile.RetentionMinAgeDays))
+			protected[i] = true
+		}
+		if onlySize {
+			keep(i, "no count rules")
+		}
+	}
+	for _, period := range retentionPeriods {
+		remaining := period.count(profile)
+		last := ""
+		for i := 0; i < len(runs) && remaining > 0; i++ {
+			key := period.key(runs[i].StartTime.Local())
+			if key == last {
+				continue
+			}
+			last = key
+			keep(i, fmt.Sprintf("%s %s", period.name, key))
+			remaining--
+		}
+	}
+
+	if limit := profile.RetentionMaxTotalBytes; limit > 0 {
+		var total int64
+		exceeded := false
+		for i := range decisions {
+			if !decisions[i].Keep {
+				continue
+			}
+			if !protected[i] && (exceeded || total+decisions[i].SizeBytes > limit) {
+				exceeded = true
+				decisions[i].Keep = false
+				decisions[i].Reasons = []string{fmt.Sprintf("exceeds maximum total size of %.2f MB", float64(limit)/1024/1024)}
+				continue
+			}
+			total += decisions[i].SizeBytes
+		}
+	}
+	for i := range decisions {
+		if !decisions[i].Keep && len(decisions[i].Reasons) == 0 {
+			decisions[i].Reasons = append(decisions[i].Reasons, "not kept by any rule")
+		}
+	}
+	return decisions
+}
+
+// planRetention loads the successful runs of a profile and evaluates its
+// retention rules on them
+func planRetention(profile *entity.BackupProfile) ([]entity.BackupRun, *RetentionPlan, error) {
+	var runs []entity.BackupRun
+	if err := DB.Where("backup_profile_id = ? AND status IN ?", profile.ID, []string{"completed", "partial"}).
+		Order("start_time DESC, id DESC").Find(&runs).Error; err != nil {
+		return nil, nil, err
+	}
+	plan := &RetentionPlan{ProfileID: profile.ID, DryRun: true, Runs: []RetentionDecision{}}
+	if hasRetention(profile) {
+		plan.Runs = evaluateRetention(profile, runs, time.Now())
+	} else {
+		for i := range runs {
+			plan.Runs = append(plan.Runs, RetentionDecision{
+				RunID: runs[i].ID, StartTime: runs[i].StartTime, Status: runs[i].Status, Path: runs[i].LocalBackupPath,
+				SizeBytes: runStoredSize(&runs[i]), Keep: true, Reasons: []string{"no retention rules"},
+			})
+		}
+	}
+	for _, decision := range plan.Runs {
+		if decision.Keep {
+			plan.KeptRuns++
+		} else {
+			plan.RemovedRuns++
+			plan.RemovedBytes += decision.SizeBytes
+		}
+	}
+	return runs, plan, nil
+}
+
+// applyRetention removes the runs of profile its retention rules do not
+// keep, files first, and reports every removal to logf. Profiles with a
+// running backup are skipped, it may be reusing files of older runs.
+func applyRetention(profile *entity.BackupProfile, logf func(level, message string)) (*RetentionPlan, error) {
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+
+	runs, plan, err := planRetention(profile)
+	if err != nil {
+		return nil, err
+	}
+	plan.DryRun = false
+	if plan.RemovedRuns == 0 {
+		return plan, nil
+	}
+	// Runs only marked as running were interrupted and do not use older runs
+	var running []uint
+	if err := DB.Model(&entity.BackupRun{}).Where("backup_profile_id = ? AND status = ?", profile.ID, "running").Pluck("id", &running).Error; err != nil {
+		return nil, err
+	}
+	for _, id := range running {
+		if runActive(id) {
+			return nil, fmt.Errorf("a backup of profile %d is running, retention is evaluated once it finished", profile.ID)
+		}
+		logf("WARNING", fmt.Sprintf("Run %d is marked as running but no backup is executing it", id))
+	}
+
+	plan.RemovedRuns = 0
+	plan.RemovedBytes = 0
+	for i := range plan.Runs {
+		decision := &plan.Runs[i]
+		if decision.Keep {
+			continue
+		}
+		run := &runs[i]
+		if err := deleteRun(run, false, false); err != nil {
+			decision.Error = err.Error()
+			logf("ERROR", fmt.Sprintf("Retention failed to remove run %d: %v", run.ID, err))
+			continue
+		}
+		plan.RemovedRuns++
+		plan.RemovedBytes += decision.SizeBytes
+		logf("INFO", fmt.Sprintf("Retention removed run %d from %s (%s, %.2f MB): %s",
+			run.ID, run.StartTime.Format("2006-01-02 15:04"), run.LocalBackupPath, float64(decision.SizeBytes)/1024/1024, decision.Reasons[0]))
+	}
+	return plan, nil
+}
+
+// applyAllRetention evaluates the retention rules of every profile
+func applyAllRetention() {
+	var profiles []entity.BackupProfile
+	if err := DB.Find(&profiles).Error; err != nil {
+		log.Printf("Failed to load profiles for retention: %v", err)
+		return
+	}
+	for i := range profiles {
+		if !hasRetention(&profiles[i]) {
+			continue
+		}
+		profile := &profiles[i]
+		_, err := applyRetention(profile, func(level, message string) {
+			log.Printf("[%s] Profile %d: %s", level, profile.ID, message)
+		})
+		if err != nil {
+			log.Printf("Retention of profile %d skipped: %v", profile.ID, err)
+		}
+	}
+}
+
+// ServicePreviewRetention returns what the retention rules of a profile would
+// remove without removing anything
+func ServicePreviewRetention(profileID uint) (*RetentionPlan, error) {
+	profile, err := ServiceGetBackupProfile(profileID)
+	if err != nil {
+		return nil, err
+	}
+	_, plan, err := planRetention(profile)
+	return plan, err
+}
+
+// ServiceApplyRetention removes the runs the retention rules of a profile do
+// not keep
+func ServiceApplyRetention(profileID uint) (*RetentionPlan, error) {
+	profile, err := ServiceGetBackupProfile(profileID)
+	if err != nil {
+		return nil, err
+	}
+	return applyRetention(profile, func(level, message string) {
+		log.Printf("[%s] Profile %d: %s", level, profile.ID, message)
+	})
+}
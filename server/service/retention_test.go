@@ -0,0 +1,230 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"backapp-server/entity"
+)
+
+// retentionRun is a run for evaluateRetention tests, started at a local time
+type retentionRun struct {
+	start string
+	size  int64
+}
+
+func retentionRuns(t *testing.T, specs []retentionRun) []entity.BackupRun {
+	t.Helper()
+	runs := make([]entity.BackupRun, len(specs))
+	for i, spec := range specs {
+		start, err := time.ParseInLocation("2006-01-02 15:04", spec.start, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs[i] = entity.BackupRun{ID: uint(i + 1), StartTime: start, Status: "completed", TotalSizeBytes: spec.size}
+	}
+	return runs
+}
+
+func TestEvaluateRetention(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile entity.BackupProfile
+		now     string
+		runs    []retentionRun
+		keep    []bool
+		reasons map[uint][]string
+	}{
+		{
+			name:    "daily keeps the newest run of each day",
+			profile: entity.BackupProfile{RetentionKeepDaily: 2},
+			runs:    []retentionRun{{start: "2024-01-10 20:00"}, {start: "2024-01-10 08:00"}, {start: "2024-01-09 12:00"}, {start: "2024-01-08 12:00"}},
+			keep:    []bool{true, false, true, false},
+			reasons: map[uint][]string{
+				1: {"newest run", "daily 2024-01-10"},
+				2: {"not kept by any rule"},
+				3: {"daily 2024-01-09"},
+			},
+		},
+		{
+			name:    "weekly uses ISO weeks across year boundaries",
+			profile: entity.BackupProfile{RetentionKeepWeekly: 3},
+			runs: []retentionRun{
+				{start: "2021-01-04 12:00"}, // 2021-W01
+				{start: "2021-01-03 12:00"}, // 2020-W53
+				{start: "2020-12-31 12:00"}, // 2020-W53
+				{start: "2019-12-30 12:00"}, // 2020-W01
+				{start: "2019-12-29 12:00"}, // 2019-W52
+			},
+			keep: []bool{true, true, false, true, false},
+			reasons: map[uint][]string{
+				1: {"newest run", "weekly 2021-W01"},
+				2: {"weekly 2020-W53"},
+				4: {"weekly 2020-W01"},
+			},
+		},
+		{
+			name:    "monthly skips months without runs",
+			profile: entity.BackupProfile{RetentionKeepMonthly: 3},
+			runs:    []retentionRun{{start: "2024-03-15 12:00"}, {start: "2024-03-01 12:00"}, {start: "2024-01-20 12:00"}, {start: "2024-01-05 12:00"}, {start: "2023-11-30 12:00"}, {start: "2023-10-01 12:00"}},
+			keep:    []bool{true, false, true, false, true, false},
+			reasons: map[uint][]string{5: {"monthly 2023-11"}},
+		},
+		{
+			name:    "yearly",
+			profile: entity.BackupProfile{RetentionKeepYearly: 2},
+			runs:    []retentionRun{{start: "2024-06-01 12:00"}, {start: "2024-01-01 00:30"}, {start: "2023-12-31 23:30"}, {start: "2022-05-01 12:00"}},
+			keep:    []bool{true, false, true, false},
+			reasons: map[uint][]string{3: {"yearly 2023"}},
+		},
+		{
+			name:    "keep last overlaps with the periods",
+			profile: entity.BackupProfile{RetentionKeepLast: 2, RetentionKeepDaily: 2},
+			runs:    []retentionRun{{start: "2024-01-10 20:00"}, {start: "2024-01-10 08:00"}, {start: "2024-01-09 12:00"}, {start: "2024-01-08 12:00"}},
+			keep:    []bool{true, true, true, false},
+			reasons: map[uint][]string{
+				1: {"newest run", "last 2", "daily 2024-01-10"},
+				2: {"last 2"},
+				3: {"daily 2024-01-09"},
+			},
+		},
+		{
+			name:    "rules combine across periods",
+			profile: entity.BackupProfile{RetentionKeepDaily: 1, RetentionKeepWeekly: 2, RetentionKeepMonthly: 2},
+			runs:    []retentionRun{{start: "2024-02-01 12:00"}, {start: "2024-01-31 12:00"}, {start: "2024-01-25 12:00"}, {start: "2024-01-15 12:00"}},
+			keep:    []bool{true, true, true, false},
+			reasons: map[uint][]string{
+				1: {"newest run", "daily 2024-02-01", "weekly 2024-W05", "monthly 2024-02"},
+				2: {"monthly 2024-01"},
+				3: {"weekly 2024-W04"},
+			},
+		},
+		{
+			name:    "min age keeps young runs",
+			profile: entity.BackupProfile{RetentionKeepLast: 1, RetentionMinAgeDays: 3},
+			now:     "2024-01-10 21:00",
+			runs:    []retentionRun{{start: "2024-01-10 20:00"}, {start: "2024-01-09 20:00"}, {start: "2024-01-08 22:00"}, {start: "2024-01-07 20:00"}},
+			keep:    []bool{true, true, true, false},
+			reasons: map[uint][]string{
+				2: {"younger than 3 days"},
+				4: {"not kept by any rule"},
+			},
+		},
+		{
+			name:    "size limit removes from the oldest",
+			profile: entity.BackupProfile{RetentionKeepLast: 4, RetentionMaxTotalBytes: 250},
+			runs:    []retentionRun{{"2024-01-04 12:00", 100}, {"2024-01-03 12:00", 100}, {"2024-01-02 12:00", 100}, {"2024-01-01 12:00", 10}},
+			keep:    []bool{true, true, false, false},
+			reasons: map[uint][]string{
+				3: {"exceeds maximum total size of 0.00 MB"},
+				4: {"exceeds maximum total size of 0.00 MB"},
+			},
+		},
+		{
+			name:    "size limit never removes the newest run",
+			profile: entity.BackupProfile{RetentionKeepLast: 2, RetentionMaxTotalBytes: 100},
+			runs:    []retentionRun{{"2024-01-02 12:00", 500}, {"2024-01-01 12:00", 10}},
+			keep:    []bool{true, false},
+		},
+		{
+			name:    "protected runs count toward the size limit",
+			profile: entity.BackupProfile{RetentionKeepLast: 4, RetentionMinAgeDays: 2, RetentionMaxTotalBytes: 120},
+			now:     "2024-01-10 21:00",
+			runs:    []retentionRun{{"2024-01-10 20:00", 50}, {"2024-01-09 20:00", 100}, {"2024-01-08 12:00", 10}, {"2024-01-07 12:00", 10}},
+			keep:    []bool{true, true, false, false},
+			reasons: map[uint][]string{2: {"last 4", "younger than 2 days"}},
+		},
+		{
+			name:    "size only profile",
+			profile: entity.BackupProfile{RetentionMaxTotalBytes: 250},
+			runs:    []retentionRun{{"2024-01-04 12:00", 100}, {"2024-01-03 12:00", 100}, {"2024-01-02 12:00", 100}, {"2024-01-01 12:00", 100}},
+			keep:    []bool{true, true, false, false},
+			reasons: map[uint][]string{
+				1: {"newest run", "no count rules"},
+				2: {"no count rules"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := retentionRuns(t, tt.runs)
+			now := runs[0].StartTime.Add(time.Hour)
+			if tt.now != "" {
+				now = retentionRuns(t, []retentionRun{{start: tt.now}})[0].StartTime
+			}
+			decisions := evaluateRetention(&tt.profile, runs, now)
+			if len(decisions) != len(runs) {
+				t.Fatalf("got %d decisions for %d runs", len(decisions), len(runs))
+			}
+			for i, decision := range decisions {
+				if decision.RunID != runs[i].ID || decision.Keep != tt.keep[i] {
+					t.Errorf("run %d (%s): keep = %v, want %v, reasons %v", runs[i].ID, tt.runs[i].start, decision.Keep, tt.keep[i], decision.Reasons)
+				}
+				if want, ok := tt.reasons[decision.RunID]; ok && !slices.Equal(decision.Reasons, want) {
+					t.Errorf("run %d: reasons = %q, want %q", decision.RunID, decision.Reasons, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluateRetentionArchiveSize(t *testing.T) {
+	runs := []entity.BackupRun{
+		{ID: 2, StartTime: time.Date(2024, 1, 2, 12, 0, 0, 0, time.Local), TotalSizeBytes: 100},
+		{ID: 1, StartTime: time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local), TotalSizeBytes: 1000, ArchivePath: "run.tar.zst", CompressedSizeBytes: 50},
+	}
+	profile := &entity.BackupProfile{RetentionMaxTotalBytes: 200}
+	decisions := evaluateRetention(profile, runs, runs[0].StartTime)
+	if !decisions[1].Keep || decisions[1].SizeBytes != 50 {
+		t.Errorf("archived run: keep = %v, size = %d, want kept with its compressed size", decisions[1].Keep, decisions[1].SizeBytes)
+	}
+	if len(evaluateRetention(profile, nil, time.Now())) != 0 {
+		t.Error("decisions without runs")
+	}
+}
+
+func TestApplyRetentionIgnoresInterruptedRuns(t *testing.T) {
+	profile, location := newRunTestProfile(t, failedRunsDelete)
+	profile.RetentionKeepLast = 1
+	if err := DB.Save(profile).Error; err != nil {
+		t.Fatal(err)
+	}
+	var dirs []string
+	for i, start := range []time.Time{time.Now().Add(-2 * time.Hour), time.Now().Add(-time.Hour)} {
+		dir := filepath.Join(location.BasePath, fmt.Sprintf("backup-%d", i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		run := &entity.BackupRun{BackupProfileID: profile.ID, Status: "completed", StartTime: start, LocalBackupPath: dir, StorageLocationID: &location.ID}
+		if err := DB.Create(run).Error; err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+	}
+	running := newStagedRun(t, profile, location)
+	logf := func(level, message string) {}
+
+	activeRuns.Store(running.ID, true)
+	if _, err := applyRetention(profile, logf); err == nil {
+		t.Error("retention was applied while a backup of the profile is executing")
+	}
+	activeRuns.Delete(running.ID)
+
+	plan, err := applyRetention(profile, logf)
+	if err != nil {
+		t.Fatalf("retention with an interrupted run: %v", err)
+	}
+	if plan.RemovedRuns != 1 {
+		t.Errorf("removed %d runs, want 1", plan.RemovedRuns)
+	}
+	if _, err := os.Stat(dirs[0]); !os.IsNotExist(err) {
+		t.Errorf("expired run directory still exists: %v", err)
+	}
+	if _, err := os.Stat(dirs[1]); err != nil {
+		t.Errorf("newest run directory was removed: %v", err)
+	}
+}
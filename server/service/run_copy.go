@@ -0,0 +1,470 @@
+package service
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"backapp-server/entity"
+
+	"gorm.io/gorm"
+)
+
+// copyRetrySchedule is the cron expression failed copies are retried with
+const copyRetrySchedule = "@every 15m"
+
+// maxCopyAttempts is how often a copy is attempted before it stays failed
+// until it is retried manually
+const maxCopyAttempts = 5
+
+// activeCopies holds the IDs of the copies in progress
+var activeCopies sync.Map
+
+// normalizeCopyTargets checks that the copy targets of a profile are existing
+// storage locations other than its primary location, each listed once
+func normalizeCopyTargets(primaryID uint, targets []entity.BackupProfileCopyTarget) error {
+	seen := make(map[uint]bool)
+	for i := range targets {
+		id := targets[i].StorageLocationID
+		if id == primaryID {
+			return fmt.Errorf("storage location %d is the primary location of the profile", id)
+		}
+		if seen[id] {
+			return fmt.Errorf("storage location %d is listed twice as copy target", id)
+		}
+		seen[id] = true
+		var location entity.StorageLocation
+		if err := DB.First(&location, id).Error; err != nil {
+			return fmt.Errorf("copy target storage location %d not found", id)
+		}
+	}
+	return nil
+}
+
+// replaceCopyTargets makes targets the copy targets of a profile, creating
+// them anew
+func replaceCopyTargets(profileID uint, targets []entity.BackupProfileCopyTarget) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("backup_profile_id = ?", profileID).Delete(&entity.BackupProfileCopyTarget{}).Error; err != nil {
+			return err
+		}
+		for i := range targets {
+			targets[i].ID = 0
+			targets[i].BackupProfileID = profileID
+			if err := tx.Create(&targets[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// runCopyActive reports whether a copy of a run is in progress
+func runCopyActive(runID uint) bool {
+	var ids []uint
+	if err := DB.Model(&entity.BackupRunCopy{}).Where("backup_run_id = ?", runID).Pluck("id", &ids).Error; err != nil {
+		return false
+	}
+	for _, id := range ids {
+		if _, ok := activeCopies.Load(id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// runLogf returns a logf writing to the log of a run
+func runLogf(runID uint) func(level, message string) {
+	executor := NewBackupExecutor()
+	return func(level, message string) {
+		executor.logToDatabase(runID, level, message)
+	}
+}
+
+// copyRunToTargets copies a successful run to every copy target of its
+// profile
+func copyRunToTargets(run *entity.BackupRun, logf func(level, message string)) {
+	var targets []entity.BackupProfileCopyTarget
+	if err := DB.Where("backup_profile_id = ?", run.BackupProfileID).Order("id ASC").Find(&targets).Error; err != nil {
+		logf("ERROR", fmt.Sprintf("Failed to load copy targets: %v", err))
+		return
+	}
+	for _, target := range targets {
+		runCopy := &entity.BackupRunCopy{
+			BackupRunID:       run.ID,
+			StorageLocationID: target.StorageLocationID,
+			Status:            "pending",
+		}
+		if err := DB.Create(runCopy).Error; err != nil {
+			logf("ERROR", fmt.Sprintf("Failed to create copy record: %v", err))
+			continue
+		}
+		copyRun(run, runCopy, logf)
+	}
+}
+
+// copyRun makes one attempt at a copy of run and records its outcome
+func copyRun(run *entity.BackupRun, runCopy *entity.BackupRunCopy, logf func(level, message string)) error {
+	if _, busy := activeCopies.LoadOrStore(runCopy.ID, true); busy {
+		return fmt.Errorf("copy %d is already in progress", runCopy.ID)
+	}
+	defer activeCopies.Delete(runCopy.ID)
+
+	start := time.Now()
+	runCopy.Status = "copying"
+	runCopy.Attempts++
+	runCopy.StartTime = &start
+	runCopy.EndTime = nil
+	runCopy.ErrorMessage = ""
+	runCopy.CopiedFiles = 0
+	runCopy.CopiedBytes = 0
+	if err := saveRunCopy(runCopy); err != nil {
+		return err
+	}
+	logf("INFO", fmt.Sprintf("Copying run to storage location %d (attempt %d)", runCopy.StorageLocationID, runCopy.Attempts))
+
+	err := transferRunCopy(run, runCopy)
+	end := time.Now()
+	runCopy.EndTime = &end
+	if err != nil {
+		runCopy.Status = "failed"
+		runCopy.ErrorMessage = err.Error()
+		logf("ERROR", fmt.Sprintf("Copy to storage location %d failed: %v", runCopy.StorageLocationID, err))
+	} else {
+		runCopy.Status = "completed"
+		logf("INFO", fmt.Sprintf("Copied %d files (%.2f MB) to %s, all checksums verified",
+			runCopy.CopiedFiles, float64(runCopy.CopiedBytes)/1024/1024, runCopy.LocalBackupPath))
+	}
+	if saveErr := saveRunCopy(runCopy); saveErr != nil {
+		log.Printf("Failed to update copy %d of run %d: %v", runCopy.ID, run.ID, saveErr)
+	}
+	return err
+}
+
+// saveRunCopy updates a copy record without recreating it if its run was
+// deleted meanwhile
+func saveRunCopy(runCopy *entity.BackupRunCopy) error {
+	result := DB.Model(runCopy).Select("*").Updates(runCopy)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("copy %d no longer exists", runCopy.ID)
+	}
+	return nil
+}
+
+// transferRunCopy writes every file of run and its metadata sidecar to the
+// location of runCopy, below a directory named like the run's directory in
+// the primary location. Each file is read back and compared with the
+// checksum of what was read from the primary location.
+func transferRunCopy(run *entity.BackupRun, runCopy *entity.BackupRunCopy) error {
+	sourceLocation, err := runStorageLocation(run)
+	if err != nil {
+		return err
+	}
+	source, err := newStorageBackend(sourceLocation)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	var targetLocation entity.StorageLocation
+	if err := DB.First(&targetLocation, runCopy.StorageLocationID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("storage location %d no longer exists", runCopy.StorageLocationID)
+		}
+		return err
+	}
+	target, err := newStorageBackend(&targetLocation)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	// Retries write into the directory of the first attempt
+	if runCopy.LocalBackupPath == "" {
+		dirName, ok := storageRelPath(source, run.LocalBackupPath)
+		if !ok {
+			return fmt.Errorf("%s is not inside storage location %s", run.LocalBackupPath, sourceLocation.Name)
+		}
+		dir, err := backendRunDir(target, dirName, run.ID)
+		if err != nil {
+			return err
+		}
+		runCopy.LocalBackupPath = dir
+		if err := saveRunCopy(runCopy); err != nil {
+			return err
+		}
+	}
+
+	files, err := ServiceListBackupFilesForRun(run.ID)
+	if err != nil {
+		return err
+	}
+	for i := range files {
+		file := &files[i]
+		rel, ok := relativeRunPath(run.LocalBackupPath, file.LocalPath)
+		if !ok {
+			return fmt.Errorf("%s is not inside the backup directory %s", file.LocalPath, run.LocalBackupPath)
+		}
+		reader, _, err := openStoredFile(run, file, source)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", file.RemotePath, err)
+		}
+		// The recorded checksum covers the stored content unless it is encrypted
+		algorithm, expected := "sha256", ""
+		if run.EncryptionKeyID == nil && file.Checksum != "" {
+			algorithm, expected = file.ChecksumAlgorithm, file.Checksum
+		}
+		written, err := copyVerified(reader, target, joinStorageName(target, runCopy.LocalBackupPath, rel), algorithm, expected)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy %s: %v", file.RemotePath, err)
+		}
+		runCopy.CopiedFiles++
+		runCopy.CopiedBytes += written
+	}
+
+	if run.MetadataPath != "" {
+		reader, _, err := source.Open(run.MetadataPath)
+		if err != nil {
+			return fmt.Errorf("failed to read metadata sidecar: %v", err)
+		}
+		metadataPath := runMetadataPath(runCopy.LocalBackupPath)
+		_, err = copyVerified(reader, target, metadataPath, "sha256", "")
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy metadata sidecar: %v", err)
+		}
+		runCopy.MetadataPath = metadataPath
+	}
+	return nil
+}
+
+// copyVerified writes reader to name in target and reads it back. The
+// checksum of what was read must match expected if it is set, and the
+// checksum of the written file the one of what was read.
+func copyVerified(reader io.Reader, target storageBackend, name, algorithm, expected string) (int64, error) {
+	sum, err := newChecksum(algorithm)
+	if err != nil {
+		return 0, err
+	}
+	writer, err := target.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(io.MultiWriter(writer, sum), reader)
+	if err != nil {
+		writer.Abort()
+		return written, err
+	}
+	actual := hex.EncodeToString(sum.Sum(nil))
+	if expected != "" && actual != expected {
+		writer.Abort()
+		return written, fmt.Errorf("content in the primary location does not match the recorded checksum (%s instead of %s)", actual, expected)
+	}
+	if err := writer.Close(); err != nil {
+		return written, err
+	}
+
+	copied, _, err := target.Open(name)
+	if err != nil {
+		return written, fmt.Errorf("failed to read back the copy: %v", err)
+	}
+	defer copied.Close()
+	check, _ := newChecksum(algorithm)
+	if _, err := io.Copy(check, copied); err != nil {
+		return written, fmt.Errorf("failed to read back the copy: %v", err)
+	}
+	if copiedSum := hex.EncodeToString(check.Sum(nil)); copiedSum != actual {
+		return written, fmt.Errorf("copy does not match the original (%s instead of %s)", copiedSum, actual)
+	}
+	return written, nil
+}
+
+// relativeRunPath returns the slash separated path of name below the backup
+// directory dir of a run
+func relativeRunPath(dir, name string) (string, bool) {
+	prefix := strings.TrimSuffix(path.Clean(filepath.ToSlash(dir)), "/") + "/"
+	rel, ok := strings.CutPrefix(path.Clean(filepath.ToSlash(name)), prefix)
+	return rel, ok && rel != ""
+}
+
+// joinStorageName returns the name of the slash separated path rel below the
+// name dir of backend
+func joinStorageName(backend storageBackend, dir, rel string) string {
+	if isLocalBackend(backend) {
+		return filepath.Join(dir, filepath.FromSlash(rel))
+	}
+	return path.Join(dir, rel)
+}
+
+// openCopiedFile opens a file of run from the first completed copy that has
+// it, for when the primary location lost it
+func openCopiedFile(run *entity.BackupRun, file *entity.BackupFile) (io.ReadCloser, int64, error) {
+	var copies []entity.BackupRunCopy
+	if err := DB.Where("backup_run_id = ? AND status = ?", run.ID, "completed").Order("id ASC").Find(&copies).Error; err != nil {
+		return nil, 0, err
+	}
+	rel, ok := relativeRunPath(run.LocalBackupPath, file.LocalPath)
+	if !ok || len(copies) == 0 {
+		return nil, 0, fmt.Errorf("run %d has no copy of %s", run.ID, file.RemotePath)
+	}
+
+	var lastErr error
+	for i := range copies {
+		backend, err := locationBackend(copies[i].StorageLocationID)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// Copies are unpacked, only the encryption of the run applies
+		copiedRun := *run
+		copiedRun.LocalBackupPath = copies[i].LocalBackupPath
+		copiedRun.ManifestPath = ""
+		copiedRun.ArchivePath = ""
+		copiedFile := *file
+		copiedFile.LocalPath = joinStorageName(backend, copies[i].LocalBackupPath, rel)
+		reader, size, err := openBackupFile(&copiedRun, &copiedFile, backend)
+		if err != nil {
+			backend.Close()
+			lastErr = err
+			continue
+		}
+		log.Printf("Read %s of run %d from its copy in storage location %d", file.RemotePath, run.ID, copies[i].StorageLocationID)
+		if isLocalBackend(backend) {
+			return reader, size, nil
+		}
+		return &backendReader{ReadCloser: reader, backend: backend}, size, nil
+	}
+	return nil, 0, lastErr
+}
+
+// deleteRunCopies removes the copies of run from the secondary locations and
+// forgets each copy once its files are gone
+func deleteRunCopies(run *entity.BackupRun) error {
+	var copies []entity.BackupRunCopy
+	if err := DB.Where("backup_run_id = ?", run.ID).Find(&copies).Error; err != nil {
+		return err
+	}
+	for i := range copies {
+		if err := deleteCopyFiles(&copies[i]); err != nil {
+			return fmt.Errorf("failed to remove the copy in storage location %d: %v", copies[i].StorageLocationID, err)
+		}
+		if err := DB.Delete(&copies[i]).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteCopyFiles removes the directory and metadata sidecar of a copy.
+// Copies in deleted locations cannot be reached anymore and are skipped.
+func deleteCopyFiles(runCopy *entity.BackupRunCopy) error {
+	if runCopy.LocalBackupPath == "" {
+		return nil
+	}
+	var location entity.StorageLocation
+	if err := DB.First(&location, runCopy.StorageLocationID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	backend, err := newStorageBackend(&location)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	names := []string{runCopy.LocalBackupPath}
+	if runCopy.MetadataPath != "" {
+		names = append(names, runCopy.MetadataPath)
+	}
+	for _, name := range names {
+		if !insideStorage(backend, name) {
+			return fmt.Errorf("refusing to delete %s, it is not inside storage location %s", name, location.Name)
+		}
+	}
+	if runCopy.MetadataPath != "" {
+		if err := backend.Remove(runCopy.MetadataPath); err != nil {
+			return err
+		}
+	}
+	return backend.RemoveAll(runCopy.LocalBackupPath)
+}
+
+// retryFailedCopies makes another attempt at every copy that failed, or was
+// interrupted by a restart, fewer than maxCopyAttempts times
+func retryFailedCopies() {
+	var copies []entity.BackupRunCopy
+	if err := DB.Where("status IN ? AND attempts < ?", []string{"pending", "copying", "failed"}, maxCopyAttempts).
+		Order("id ASC").Find(&copies).Error; err != nil {
+		log.Printf("Failed to load copies to retry: %v", err)
+		return
+	}
+	for i := range copies {
+		if _, busy := activeCopies.Load(copies[i].ID); busy {
+			continue
+		}
+		run, err := ServiceGetBackupRun(copies[i].BackupRunID)
+		if err != nil || (run.Status != "completed" && run.Status != "partial") {
+			continue
+		}
+		copyRun(run, &copies[i], runLogf(run.ID))
+	}
+}
+
+// ServiceRetryRunCopies makes another attempt at every copy of a run that is
+// not completed, regardless of how often it failed before. Copy targets added
+// to the profile after the run get a copy as well.
+func ServiceRetryRunCopies(runID uint) ([]entity.BackupRunCopy, error) {
+	run, err := ServiceGetBackupRun(runID)
+	if err != nil {
+		return nil, err
+	}
+	if run.Status != "completed" && run.Status != "partial" {
+		return nil, fmt.Errorf("only successful runs are copied")
+	}
+	var targets []entity.BackupProfileCopyTarget
+	if err := DB.Where("backup_profile_id = ?", run.BackupProfileID).Order("id ASC").Find(&targets).Error; err != nil {
+		return nil, err
+	}
+	for _, target := range targets {
+		var count int64
+		if err := DB.Model(&entity.BackupRunCopy{}).Where("backup_run_id = ? AND storage_location_id = ?", runID, target.StorageLocationID).
+			Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			runCopy := &entity.BackupRunCopy{BackupRunID: runID, StorageLocationID: target.StorageLocationID, Status: "pending"}
+			if err := DB.Create(runCopy).Error; err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var copies []entity.BackupRunCopy
+	if err := DB.Where("backup_run_id = ?", runID).Order("id ASC").Find(&copies).Error; err != nil {
+		return nil, err
+	}
+	logf := runLogf(runID)
+	var firstErr error
+	for i := range copies {
+		if copies[i].Status == "completed" {
+			continue
+		}
+		if err := copyRun(run, &copies[i], logf); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return copies, firstErr
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"backapp-server/entity"
+)
+
+// corruptingBackend returns other content than was written when a file is
+// read back
+type corruptingBackend struct {
+	storageBackend
+}
+
+func (b *corruptingBackend) Open(name string) (io.ReadCloser, int64, error) {
+	return io.NopCloser(strings.NewReader("corrupted")), int64(len("corrupted")), nil
+}
+
+func TestCopyVerified(t *testing.T) {
+	content := "content"
+	sum := sha256.Sum256([]byte(content))
+	checksum := hex.EncodeToString(sum[:])
+	local := &localBackend{basePath: t.TempDir()}
+
+	tests := []struct {
+		name     string
+		backend  storageBackend
+		expected string
+		wantErr  string
+		exists   bool
+	}{
+		{"verified", local, checksum, "", true},
+		{"no recorded checksum", local, "", "", true},
+		{"primary does not match", local, strings.Repeat("0", 64), "primary location", false},
+		{"read back does not match", &corruptingBackend{local}, checksum, "does not match the original", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := local.Join(strings.ReplaceAll(tt.name, " ", "-"))
+			written, err := copyVerified(strings.NewReader(content), tt.backend, name, "sha256", tt.expected)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("copyVerified = %v, want an error about %q", err, tt.wantErr)
+			}
+			if written != int64(len(content)) {
+				t.Errorf("written = %d", written)
+			}
+			if _, err := os.Stat(name); (err == nil) != tt.exists {
+				t.Errorf("copy exists: %v, want %v", err == nil, tt.exists)
+			}
+			if _, err := os.Stat(partialPath(name)); !os.IsNotExist(err) {
+				t.Errorf("partial file was left behind: %v", err)
+			}
+		})
+	}
+}
+
+// newCopiedRun creates a completed run in a new local location with a copy
+// target in another local location
+func newCopiedRun(t *testing.T) (*entity.BackupRun, *entity.StorageLocation) {
+	t.Helper()
+	profile, location := newRunTestProfile(t, failedRunsDelete)
+	target := &entity.StorageLocation{Name: "copies", Type: "local", BasePath: t.TempDir()}
+	if err := DB.Create(target).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Create(&entity.BackupProfileCopyTarget{BackupProfileID: profile.ID, StorageLocationID: target.ID}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	run := &entity.BackupRun{BackupProfileID: profile.ID, Status: "completed", StorageLocationID: &location.ID, LocalBackupPath: filepath.Join(location.BasePath, "backup")}
+	if err := DB.Create(run).Error; err != nil {
+		t.Fatal(err)
+	}
+	localPath := filepath.Join(run.LocalBackupPath, "etc", "app.conf")
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(localPath, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("content"))
+	file := &entity.BackupFile{BackupRunID: run.ID, RemotePath: "/etc/app.conf", LocalPath: localPath, SizeBytes: 7, Checksum: hex.EncodeToString(sum[:]), ChecksumAlgorithm: "sha256"}
+	if err := DB.Create(file).Error; err != nil {
+		t.Fatal(err)
+	}
+	return run, target
+}
+
+// runCopies returns the copy records of a run
+func runCopies(t *testing.T, runID uint) []entity.BackupRunCopy {
+	t.Helper()
+	var copies []entity.BackupRunCopy
+	if err := DB.Where("backup_run_id = ?", runID).Order("id ASC").Find(&copies).Error; err != nil {
+		t.Fatal(err)
+	}
+	return copies
+}
+
+func TestCopyRunMarksMismatchFailed(t *testing.T) {
+	run, target := newCopiedRun(t)
+	// The primary location changed the file after it was backed up
+	files, err := ServiceListBackupFilesForRun(run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(files[0].LocalPath, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	copyRunToTargets(run, runLogf(run.ID))
+	copies := runCopies(t, run.ID)
+	if len(copies) != 1 {
+		t.Fatalf("%d copies, want 1", len(copies))
+	}
+	if copies[0].Status != "failed" || !strings.Contains(copies[0].ErrorMessage, "checksum") || copies[0].Attempts != 1 {
+		t.Errorf("copy = %s after %d attempts: %s, want failed because of the checksum", copies[0].Status, copies[0].Attempts, copies[0].ErrorMessage)
+	}
+	if _, err := os.Stat(filepath.Join(target.BasePath, "backup", "etc", "app.conf")); !os.IsNotExist(err) {
+		t.Errorf("mismatching file was copied: %v", err)
+	}
+}
+
+func TestRetryFailedCopiesStopsAtMaxAttempts(t *testing.T) {
+	run, target := newCopiedRun(t)
+	// The copy target is a file, so every attempt fails
+	if err := os.Remove(target.BasePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(target.BasePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	copyRunToTargets(run, runLogf(run.ID))
+	for i := 0; i < maxCopyAttempts+2; i++ {
+		retryFailedCopies()
+	}
+	copies := runCopies(t, run.ID)
+	if len(copies) != 1 || copies[0].Status != "failed" || copies[0].Attempts != maxCopyAttempts {
+		t.Fatalf("copies = %+v, want one failed after %d attempts", copies, maxCopyAttempts)
+	}
+
+	// A manual retry goes beyond the limit and succeeds once the target is fixed
+	if err := os.Remove(target.BasePath); err != nil {
+		t.Fatal(err)
+	}
+	copies, err := ServiceRetryRunCopies(run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copies[0].Status != "completed" || copies[0].Attempts != maxCopyAttempts+1 || copies[0].CopiedFiles != 1 {
+		t.Errorf("manual retry = %s after %d attempts with %d files", copies[0].Status, copies[0].Attempts, copies[0].CopiedFiles)
+	}
+	if data, err := os.ReadFile(filepath.Join(target.BasePath, "backup", "etc", "app.conf")); err != nil || string(data) != "content" {
+		t.Errorf("copied file = %q, %v", data, err)
+	}
+	retryFailedCopies()
+	if copies := runCopies(t, run.ID); copies[0].Attempts != maxCopyAttempts+1 {
+		t.Errorf("completed copy was retried, %d attempts", copies[0].Attempts)
+	}
+}
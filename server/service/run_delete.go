@@ -0,0 +1,214 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"backapp-server/entity"
+
+	"gorm.io/gorm"
+)
+
+// runStorageLocation returns the storage location holding the files of run.
+// Runs that do not record their location were written to the location of
+// their profile.
+func runStorageLocation(run *entity.BackupRun) (*entity.StorageLocation, error) {
+	locationID := run.StorageLocationID
+	if locationID == nil {
+		var profile entity.BackupProfile
+		if err := DB.First(&profile, run.BackupProfileID).Error; err != nil {
+			return nil, fmt.Errorf("storage location of run %d is unknown: %v", run.ID, err)
+		}
+		locationID = &profile.StorageLocationID
+	}
+	var location entity.StorageLocation
+	if err := DB.First(&location, *locationID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("storage location of run %d no longer exists", run.ID)
+		}
+		return nil, err
+	}
+	return &location, nil
+}
+
+// insideStorage reports whether name lies strictly below the root of
+// backend. The chunk store of a local location is never inside.
+func insideStorage(backend storageBackend, name string) bool {
+	_, ok := storageRelPath(backend, name)
+	return ok
+}
+
+// storageRelPath returns the slash separated path of name below the root of
+// backend, if name lies strictly below it and outside the chunk store
+func storageRelPath(backend storageBackend, name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+	root := backend.Join()
+	if isLocalBackend(backend) {
+		return localRelPath(root, name)
+	}
+	// Relative names cannot be compared with absolute roots and vice versa
+	if path.IsAbs(name) != path.IsAbs(root) && root != "" && root != "." {
+		return "", false
+	}
+	if (root == "" || root == ".") && path.IsAbs(name) {
+		return "", false
+	}
+	dir := strings.TrimSuffix(path.Clean("/"+root), "/") + "/"
+	rel, ok := strings.CutPrefix(path.Clean("/"+name), dir)
+	if !ok || rel == "" {
+		return "", false
+	}
+	return rel, true
+}
+
+// insideLocalDir reports whether name lies strictly below root once both are
+// made absolute and symlinks in root and in the parent of name are resolved
+func insideLocalDir(root, name string) bool {
+	_, ok := localRelPath(root, name)
+	return ok
+}
+
+// localRelPath is storageRelPath for the local file system
+func localRelPath(root, name string) (string, bool) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", false
+	}
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	name, err = filepath.Abs(name)
+	if err != nil {
+		return "", false
+	}
+	if resolved, err := filepath.EvalSymlinks(filepath.Dir(name)); err == nil {
+		name = filepath.Join(resolved, filepath.Base(name))
+	}
+	rel, err := filepath.Rel(root, name)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	first := strings.SplitN(rel, string(filepath.Separator), 2)[0]
+	if first == filepath.Base(chunkDir("")) || first == filepath.Base(manifestDir("")) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// deleteRunFiles removes the backup directory, sidecars, archive and
+// manifest of run from its storage location. Every path is checked to lie
+// inside the location before anything is removed.
+func deleteRunFiles(run *entity.BackupRun) error {
+	location, err := runStorageLocation(run)
+	if err != nil {
+		return err
+	}
+	backend, err := newStorageBackend(location)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	var dirs, files []string
+	if run.LocalBackupPath != "" {
+		dirs = append(dirs, run.LocalBackupPath)
+	}
+	if run.MetadataPath != "" {
+		files = append(files, run.MetadataPath)
+	}
+	if run.ArchivePath != "" {
+		files = append(files, run.ArchivePath, archiveIndexPath(run.ArchivePath))
+	}
+	for _, name := range append(dirs, files...) {
+		if !insideStorage(backend, name) {
+			return fmt.Errorf("refusing to delete %s, it is not inside storage location %s", name, location.Name)
+		}
+	}
+	if run.ManifestPath != "" && !insideLocalDir(manifestDir(location.BasePath), run.ManifestPath) {
+		return fmt.Errorf("refusing to delete %s, it is not a manifest of storage location %s", run.ManifestPath, location.Name)
+	}
+
+	for _, name := range files {
+		if err := backend.Remove(name); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", name, err)
+		}
+	}
+	for _, dir := range dirs {
+		if err := backend.RemoveAll(dir); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", dir, err)
+		}
+		// Failed runs kept in staging or quarantine leave their run-<id> directory
+		if parent := filepath.Base(filepath.Dir(filepath.Dir(dir))); isLocalBackend(backend) && (parent == stagingDirName || parent == quarantineDirName) {
+			removeStagingRoot(filepath.Dir(dir))
+		}
+	}
+	if run.ManifestPath != "" {
+		stats, err := deleteRunManifest(run.ManifestPath)
+		if err != nil {
+			return fmt.Errorf("failed to collect the chunks of run %d: %v", run.ID, err)
+		}
+		log.Printf("Deleted manifest of run %d, removed %d unreferenced chunks (%.2f MB)",
+			run.ID, stats.RemovedChunks, float64(stats.ReclaimedBytes)/1024/1024)
+	}
+	return nil
+}
+
+// deleteRun removes the files of run from its storage location and its
+// copies, then its records. With keepFiles the files, and the manifest
+// keeping the chunks of a deduplicated run, stay in place detached from any
+// run. force deletes runs still marked as running that no backup in this
+// process is executing.
+func deleteRun(run *entity.BackupRun, keepFiles, force bool) error {
+	if run.Status == "running" {
+		if runActive(run.ID) {
+			return fmt.Errorf("run %d is still running", run.ID)
+		}
+		if !force {
+			return fmt.Errorf("run %d is marked as running but no backup is executing it, delete it with force", run.ID)
+		}
+	}
+	if runCopyActive(run.ID) {
+		return fmt.Errorf("run %d is being copied to a secondary storage location", run.ID)
+	}
+	if !keepFiles {
+		if err := deleteRunCopies(run); err != nil {
+			return err
+		}
+		if err := deleteRunFiles(run); err != nil {
+			return err
+		}
+	}
+	if err := deleteRunRecords(run); err != nil {
+		return err
+	}
+	if keepFiles {
+		log.Printf("Deleted run %d, kept its files in %s", run.ID, run.LocalBackupPath)
+	}
+	return nil
+}
+
+// deleteRunRecords deletes run together with its logs, files, file errors
+// and copies
+func deleteRunRecords(run *entity.BackupRun) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("backup_run_id = ?", run.ID).Delete(&entity.BackupRunLog{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("backup_run_id = ?", run.ID).Delete(&entity.BackupFile{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("backup_run_id = ?", run.ID).Delete(&entity.BackupFileError{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("backup_run_id = ?", run.ID).Delete(&entity.BackupRunCopy{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(run).Error
+	})
+}
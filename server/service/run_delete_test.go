@@ -0,0 +1,204 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"backapp-server/entity"
+)
+
+// newRunTestProfile creates a profile writing to a new local storage location
+func newRunTestProfile(t *testing.T, cleanup string) (*entity.BackupProfile, *entity.StorageLocation) {
+	t.Helper()
+	InitDB(filepath.Join(t.TempDir(), "test.db"))
+	location := &entity.StorageLocation{Name: "local", Type: "local", BasePath: t.TempDir()}
+	if err := DB.Create(location).Error; err != nil {
+		t.Fatal(err)
+	}
+	server := &entity.Server{Name: "server", Host: "example.com", Username: "backup", AuthType: "key"}
+	if err := DB.Create(server).Error; err != nil {
+		t.Fatal(err)
+	}
+	profile := &entity.BackupProfile{Name: "profile", ServerID: server.ID, StorageLocationID: location.ID, NamingRuleID: 1, FailedRunCleanup: cleanup}
+	if err := DB.Create(profile).Error; err != nil {
+		t.Fatal(err)
+	}
+	return profile, location
+}
+
+// newStagedRun creates a run marked as running with a file in its staging
+// directory, like a backup interrupted by a restart leaves it
+func newStagedRun(t *testing.T, profile *entity.BackupProfile, location *entity.StorageLocation) *entity.BackupRun {
+	t.Helper()
+	run := &entity.BackupRun{BackupProfileID: profile.ID, Status: "running", StorageLocationID: &location.ID}
+	if err := DB.Create(run).Error; err != nil {
+		t.Fatal(err)
+	}
+	run.LocalBackupPath = filepath.Join(stagingRoot(location.BasePath, run.ID), "backup")
+	if err := os.MkdirAll(run.LocalBackupPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(run.LocalBackupPath, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Save(run).Error; err != nil {
+		t.Fatal(err)
+	}
+	return run
+}
+
+func TestFailInterruptedRuns(t *testing.T) {
+	for _, tt := range []struct {
+		cleanup   string
+		keepFiles bool
+	}{
+		{failedRunsDelete, false},
+		{failedRunsKeep, true},
+	} {
+		t.Run(tt.cleanup, func(t *testing.T) {
+			profile, location := newRunTestProfile(t, tt.cleanup)
+			run := newStagedRun(t, profile, location)
+			active := newStagedRun(t, profile, location)
+			activeRuns.Store(active.ID, true)
+			defer activeRuns.Delete(active.ID)
+
+			if err := ServiceFailInterruptedRuns(); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := ServiceGetBackupRun(run.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status != "failed" || stored.ErrorMessage == "" || stored.EndTime.IsZero() {
+				t.Errorf("interrupted run: status %q, error %q, end %v", stored.Status, stored.ErrorMessage, stored.EndTime)
+			}
+			if _, err := os.Stat(run.LocalBackupPath); (err == nil) != tt.keepFiles {
+				t.Errorf("staged files exist: %v, want %v", err == nil, tt.keepFiles)
+			}
+			if stored, _ := ServiceGetBackupRun(active.ID); stored.Status != "running" {
+				t.Errorf("active run status = %q, want running", stored.Status)
+			}
+		})
+	}
+}
+
+func TestDeleteRunningRun(t *testing.T) {
+	profile, location := newRunTestProfile(t, failedRunsDelete)
+	run := newStagedRun(t, profile, location)
+
+	activeRuns.Store(run.ID, true)
+	if err := ServiceDeleteBackupRun(run.ID, false, true); err == nil {
+		t.Fatal("forced delete of an executing run succeeded")
+	}
+	activeRuns.Delete(run.ID)
+
+	if err := ServiceDeleteBackupRun(run.ID, false, false); err == nil {
+		t.Fatal("delete of a run marked as running succeeded without force")
+	}
+	if err := ServiceDeleteBackupRun(run.ID, false, true); err != nil {
+		t.Fatalf("forced delete: %v", err)
+	}
+	if _, err := ServiceGetBackupRun(run.ID); err == nil {
+		t.Error("run record still exists")
+	}
+	if _, err := os.Stat(stagingRoot(location.BasePath, run.ID)); !os.IsNotExist(err) {
+		t.Errorf("staging directory of the run still exists: %v", err)
+	}
+}
+
+func TestLocalRelPath(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "data")
+	for _, dir := range []string{"data/run", "data2/run", "outside"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(base, "outside"), filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(root, filepath.Join(base, "link")); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(base)
+
+	tests := []struct {
+		name string
+		path string
+		want string
+		ok   bool
+	}{
+		{"file", filepath.Join(root, "run", "file"), "run/file", true},
+		{"directory", filepath.Join(root, "run"), "run", true},
+		{"root", root, "", false},
+		{"root with trailing slash", root + "/", "", false},
+		{"parent", filepath.Join(root, ".."), "", false},
+		{"dot dot", root + "/..", "", false},
+		{"dot dot inside", root + "/run/../../outside/file", "", false},
+		{"dot dot staying inside", root + "/run/../other", "other", true},
+		{"sibling prefix", filepath.Join(base, "data2", "run"), "", false},
+		{"outside", filepath.Join(base, "outside", "file"), "", false},
+		{"symlink escape", filepath.Join(root, "escape", "file"), "", false},
+		{"symlink itself", filepath.Join(root, "escape"), "escape", true},
+		{"through a symlinked root", filepath.Join(base, "link", "run", "file"), "run/file", true},
+		{"relative", "data/run/file", "run/file", true},
+		{"relative sibling", "data2/run", "", false},
+		{"chunk store", filepath.Join(root, ".chunks"), "", false},
+		{"chunk", filepath.Join(root, ".chunks", "ab", "abcd"), "", false},
+		{"manifests", filepath.Join(root, ".manifests"), "", false},
+		{"manifest", filepath.Join(root, ".manifests", "run-1.json"), "", false},
+		{"chunk store prefix", filepath.Join(root, ".chunksfoo"), ".chunksfoo", true},
+		{"nested chunk store name", filepath.Join(root, "run", ".chunks", "x"), "run/.chunks/x", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, r := range []string{root, filepath.Join(base, "link"), "data"} {
+				rel, ok := localRelPath(r, tt.path)
+				if rel != tt.want || ok != tt.ok {
+					t.Errorf("localRelPath(%q, %q) = %q, %v, want %q, %v", r, tt.path, rel, ok, tt.want, tt.ok)
+				}
+			}
+			if got := insideStorage(&localBackend{basePath: root}, tt.path); got != tt.ok {
+				t.Errorf("insideStorage(%q) = %v, want %v", tt.path, got, tt.ok)
+			}
+		})
+	}
+	if insideStorage(&localBackend{basePath: root}, "") {
+		t.Error("an empty name is inside the storage location")
+	}
+}
+
+func TestStorageRelPathRemote(t *testing.T) {
+	tests := []struct {
+		root string
+		name string
+		want string
+		ok   bool
+	}{
+		{"backups", "backups/run/file", "run/file", true},
+		{"backups", "backups", "", false},
+		{"backups", "backups/", "", false},
+		{"backups", "backups/../other", "", false},
+		{"backups", "backups/run/../../other", "", false},
+		{"backups", "backups2/run", "", false},
+		{"backups", "/backups/run", "", false},
+		{"backups", "", "", false},
+		{"backups", "backups/.chunks/x", ".chunks/x", true},
+		{"", "run/file", "run/file", true},
+		{"", "/run/file", "", false},
+		{"", "..", "", false},
+		{"/srv/backups", "/srv/backups/run", "run", true},
+		{"/srv/backups", "/srv/backups2/run", "", false},
+		{"/srv/backups", "srv/backups/run", "", false},
+		{"/srv/backups", "/srv/backups/../backups2", "", false},
+	}
+	for _, tt := range tests {
+		for _, backend := range []storageBackend{&s3Backend{prefix: tt.root}, &sftpBackend{basePath: tt.root}} {
+			rel, ok := storageRelPath(backend, tt.name)
+			if rel != tt.want || ok != tt.ok {
+				t.Errorf("storageRelPath(%T %q, %q) = %q, %v, want %q, %v", backend, tt.root, tt.name, rel, ok, tt.want, tt.ok)
+			}
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"backapp-server/entity"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Objects are streamed as multipart uploads. Parts are buffered in memory and
+// start at the minimum part size, which doubles every 1000 parts so that the
+// 10000 parts S3 allows reach past the 5 TiB object size limit.
+const (
+	s3MinPartSize      = 16 << 20
+	s3PartSizeDoubling = 1000
+)
+
+// s3Backend stores runs in a bucket of an S3-compatible object storage.
+// Names are object keys below the prefix of the location.
+type s3Backend struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// parseS3Endpoint splits an endpoint URL into host and whether it uses TLS.
+// Endpoints without a scheme use https.
+func parseS3Endpoint(endpoint string) (string, bool, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return "", false, fmt.Errorf("invalid endpoint: %s", endpoint)
+	}
+	switch u.Scheme {
+	case "https":
+		return u.Host, true, nil
+	case "http":
+		return u.Host, false, nil
+	default:
+		return "", false, fmt.Errorf("unsupported endpoint scheme: %s", u.Scheme)
+	}
+}
+
+// s3Prefix cleans the key prefix of a location, keys have no leading slash
+func s3Prefix(basePath string) string {
+	return strings.TrimPrefix(path.Clean("/"+basePath), "/")
+}
+
+func newS3Backend(location *entity.StorageLocation) (*s3Backend, error) {
+	if location.Bucket == "" {
+		return nil, fmt.Errorf("bucket is required for s3 storage")
+	}
+	host, secure, err := parseS3Endpoint(location.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	client, err := minio.New(host, &minio.Options{
+		Creds:  credentials.NewStaticV4(location.AccessKeyID, location.SecretAccessKey, ""),
+		Secure: secure,
+		Region: location.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Backend{client: client, bucket: location.Bucket, prefix: s3Prefix(location.BasePath)}, nil
+}
+
+// notExist wraps errors of missing keys in os.ErrNotExist
+func (b *s3Backend) notExist(name string, err error) error {
+	if code := minio.ToErrorResponse(err).Code; code == "NoSuchKey" || code == "NotFound" {
+		return fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return err
+}
+
+// s3Writer buffers the current part of a multipart upload. Objects smaller
+// than one part are uploaded with a single request on Close.
+type s3Writer struct {
+	backend  *s3Backend
+	key      string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	buf      []byte
+	uploadID string
+	parts    []minio.CompletePart
+	done     bool
+}
+
+func (b *s3Backend) Join(elem ...string) string {
+	return path.Join(append([]string{b.prefix}, elem...)...)
+}
+
+func (b *s3Backend) Create(name string) (storageWriter, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &s3Writer{backend: b, key: name, ctx: ctx, cancel: cancel}, nil
+}
+
+// partSize returns the size of the next part
+func (w *s3Writer) partSize() int {
+	return s3MinPartSize << (len(w.parts) / s3PartSizeDoubling)
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, fmt.Errorf("write to closed upload of %s", w.key)
+	}
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), w.partSize()-len(w.buf))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(w.buf) == w.partSize() {
+			if err := w.flush(); err != nil {
+				w.Abort()
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush uploads the buffered data as the next part
+func (w *s3Writer) flush() error {
+	core := minio.Core{Client: w.backend.client}
+	if w.uploadID == "" {
+		uploadID, err := core.NewMultipartUpload(w.ctx, w.backend.bucket, w.key, minio.PutObjectOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to start upload of %s: %v", w.key, err)
+		}
+		w.uploadID = uploadID
+	}
+	number := len(w.parts) + 1
+	part, err := core.PutObjectPart(w.ctx, w.backend.bucket, w.key, w.uploadID, number,
+		bytes.NewReader(w.buf), int64(len(w.buf)), minio.PutObjectPartOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to upload part %d of %s: %v", number, w.key, err)
+	}
+	w.parts = append(w.parts, minio.CompletePart{PartNumber: number, ETag: part.ETag})
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.done {
+		return nil
+	}
+	if w.uploadID == "" {
+		_, err := w.backend.client.PutObject(w.ctx, w.backend.bucket, w.key, bytes.NewReader(w.buf), int64(len(w.buf)), minio.PutObjectOptions{})
+		w.done = true
+		w.cancel()
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %v", w.key, err)
+		}
+		return nil
+	}
+	if len(w.buf) > 0 {
+		if err := w.flush(); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	core := minio.Core{Client: w.backend.client}
+	if _, err := core.CompleteMultipartUpload(w.ctx, w.backend.bucket, w.key, w.uploadID, w.parts, minio.PutObjectOptions{}); err != nil {
+		w.Abort()
+		return fmt.Errorf("failed to complete upload of %s: %v", w.key, err)
+	}
+	w.done = true
+	w.cancel()
+	return nil
+}
+
+func (w *s3Writer) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.cancel()
+	if w.uploadID != "" {
+		core := minio.Core{Client: w.backend.client}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		core.AbortMultipartUpload(ctx, w.backend.bucket, w.key, w.uploadID)
+	}
+	w.buf = nil
+}
+
+func (b *s3Backend) Open(name string) (io.ReadCloser, int64, error) {
+	object, err := b.client.GetObject(context.Background(), b.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, 0, b.notExist(name, err)
+	}
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, 0, b.notExist(name, err)
+	}
+	return object, info.Size, nil
+}
+
+func (b *s3Backend) Stat(name string) (int64, error) {
+	info, err := b.client.StatObject(context.Background(), b.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return 0, b.notExist(name, err)
+	}
+	return info.Size, nil
+}
+
+// List returns the objects and common prefixes directly below dir
+func (b *s3Backend) List(dir string) ([]entity.FileSystemEntry, error) {
+	prefix := strings.Trim(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	results := []entity.FileSystemEntry{}
+	for object := range b.client.ListObjects(context.Background(), b.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		key := strings.TrimSuffix(object.Key, "/")
+		if key+"/" == prefix {
+			continue
+		}
+		results = append(results, entity.FileSystemEntry{
+			Name:  path.Base(key),
+			Path:  key,
+			IsDir: strings.HasSuffix(object.Key, "/"),
+			Size:  object.Size,
+		})
+	}
+	sortEntries(results)
+	return results, nil
+}
+
+func (b *s3Backend) Remove(name string) error {
+	return b.client.RemoveObject(context.Background(), b.bucket, name, minio.RemoveObjectOptions{})
+}
+
+func (b *s3Backend) RemoveAll(dir string) error {
+	prefix := strings.Trim(dir, "/")
+	if prefix == "" {
+		return fmt.Errorf("refusing to remove the whole bucket")
+	}
+	ctx := context.Background()
+	objects := b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: prefix + "/", Recursive: true})
+	for result := range b.client.RemoveObjects(ctx, b.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if result.Err != nil {
+			return fmt.Errorf("failed to remove %s: %v", result.ObjectName, result.Err)
+		}
+	}
+	return nil
+}
+
+// Copy copies src to dst on the server, in parts for large objects
+func (b *s3Backend) Copy(src, dst string) error {
+	_, err := b.client.ComposeObject(context.Background(),
+		minio.CopyDestOptions{Bucket: b.bucket, Object: dst},
+		minio.CopySrcOptions{Bucket: b.bucket, Object: src})
+	return b.notExist(src, err)
+}
+
+// Test checks the bucket exists and writes and removes a probe object
+func (b *s3Backend) Test() error {
+	exists, err := b.client.BucketExists(context.Background(), b.bucket)
+	if err != nil {
+		return fmt.Errorf("failed to access bucket %s: %v", b.bucket, err)
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", b.bucket)
+	}
+	probe := path.Join(b.prefix, fmt.Sprintf(".backapp-test-%d", time.Now().UnixNano()))
+	if err := writeStorageFile(b, probe, []byte("backapp")); err != nil {
+		return err
+	}
+	return b.Remove(probe)
+}
+
+func (b *s3Backend) Close() error {
+	return nil
+}
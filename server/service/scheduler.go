@@ -30,6 +30,12 @@ func GetScheduler() *BackupScheduler {
 			jobs:     make(map[uint]cron.EntryID),
 			executor: NewBackupExecutor(),
 		}
+		if _, err := scheduler.cron.AddFunc(retentionSchedule, applyAllRetention); err != nil {
+			log.Printf("Failed to schedule retention: %v", err)
+		}
+		if _, err := scheduler.cron.AddFunc(copyRetrySchedule, retryFailedCopies); err != nil {
+			log.Printf("Failed to schedule copy retries: %v", err)
+		}
 		scheduler.cron.Start()
 	})
 	return scheduler
@@ -1,6 +1,12 @@
 package service
 
-import "backapp-server/entity"
+import (
+	"fmt"
+
+	"backapp-server/entity"
+
+	"golang.org/x/crypto/ssh"
+)
 
 // internal helpers
 
@@ -10,6 +16,7 @@ func sanitizeServer(s *entity.Server) *entity.Server {
 	}
 	copy := *s
 	copy.PrivateKeyPath = ""
+	copy.PrivateKeyPassphrase = ""
 	copy.Password = ""
 	return &copy
 }
@@ -19,6 +26,7 @@ func sanitizeServers(list []entity.Server) []entity.Server {
 	for i := range list {
 		out[i] = list[i]
 		out[i].PrivateKeyPath = ""
+		out[i].PrivateKeyPassphrase = ""
 		out[i].Password = ""
 	}
 	return out
@@ -60,14 +68,73 @@ func ServiceGetServer(id uint) (*entity.Server, error) {
 	return sanitizeServer(server), nil
 }
 
+// validateJumpHost checks that jumpHostID refers to an existing server and
+// that using it from serverID does not create a loop
+func validateJumpHost(serverID uint, jumpHostID *uint) error {
+	if jumpHostID == nil || *jumpHostID == 0 {
+		return nil
+	}
+	seen := map[uint]bool{}
+	if serverID != 0 {
+		seen[serverID] = true
+	}
+	next := jumpHostID
+	for next != nil && *next != 0 {
+		if seen[*next] {
+			return fmt.Errorf("jump host %d would create a loop", *next)
+		}
+		seen[*next] = true
+		jump, err := GetServerByID(*next)
+		if err != nil {
+			return fmt.Errorf("jump host %d not found", *next)
+		}
+		next = jump.JumpHostID
+	}
+	return nil
+}
+
+// validateMaxSessions rejects session limits that leave no session for
+// commands next to the SFTP subsystem
+func validateMaxSessions(transferMode string, maxSessions int) error {
+	if transferMode == "sftp" && maxSessions == 1 {
+		return fmt.Errorf("sftp transfer mode needs max_sessions of at least 2")
+	}
+	return nil
+}
+
+// normalizeTransferMode defaults an empty transfer mode and rejects unknown ones
+func normalizeTransferMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return "auto", nil
+	case "auto", "sftp", "shell":
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unsupported transfer_mode: %s", mode)
+	}
+}
+
 func ServiceCreateServerFromJSON(input *entity.Server) (*entity.Server, error) {
+	if err := validateJumpHost(0, input.JumpHostID); err != nil {
+		return nil, err
+	}
+	transferMode, err := normalizeTransferMode(input.TransferMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateMaxSessions(transferMode, input.MaxSessions); err != nil {
+		return nil, err
+	}
 	server := &entity.Server{
-		Name:     input.Name,
-		Host:     input.Host,
-		Port:     input.Port,
-		Username: input.Username,
-		AuthType: input.AuthType,
-		Password: input.Password,
+		Name:         input.Name,
+		Host:         input.Host,
+		Port:         input.Port,
+		Username:     input.Username,
+		AuthType:     input.AuthType,
+		Password:     input.Password,
+		JumpHostID:   input.JumpHostID,
+		TransferMode: transferMode,
+		MaxSessions:  input.MaxSessions,
 	}
 	if server.Port == 0 {
 		server.Port = 22
@@ -75,19 +142,67 @@ func ServiceCreateServerFromJSON(input *entity.Server) (*entity.Server, error) {
 	if server.AuthType == "" {
 		server.AuthType = "key"
 	}
+	if input.HostKey != "" {
+		// The supplied key is only compared with the one the server presents,
+		// what gets pinned always comes from the server
+		expected, _, _, _, err := ssh.ParseAuthorizedKey([]byte(input.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid host_key: %v", err)
+		}
+		presented, err := scanHostKey(server)
+		if err != nil {
+			return nil, &ConnectionTestError{Err: err}
+		}
+		if !sameHostKey(expected, presented) {
+			return nil, &ConnectionTestError{Err: &HostKeyMismatchError{
+				Host:     serverAddress(server),
+				Expected: ssh.FingerprintSHA256(expected),
+				Actual:   ssh.FingerprintSHA256(presented),
+			}}
+		}
+		applyHostKey(server, presented)
+	}
+	// Private keys are uploaded separately and never read from JSON, so key
+	// servers are tested and pin their host key on first use instead
+	if server.AuthType != "key" {
+		// Test the SSH connection before storing, this also records the host key
+		if err := TestSSHConnectionUsingServer(server); err != nil {
+			return nil, &ConnectionTestError{Err: err}
+		}
+	}
 	if err := DB.Create(server).Error; err != nil {
 		return nil, err
 	}
 	return sanitizeServer(server), nil
 }
 
-func ServiceCreateServerWithKey(name, host string, port int, username string, keyContent []byte) (*entity.Server, error) {
+// ServiceCreateServerWithKey stores a server authenticated by a private key or
+// the ssh-agent. input carries the key content in PrivateKeyPath and the host
+// key accepted while testing the connection.
+func ServiceCreateServerWithKey(input *entity.Server) (*entity.Server, error) {
+	if err := validateJumpHost(0, input.JumpHostID); err != nil {
+		return nil, err
+	}
+	authType := input.AuthType
+	if authType != "agent" {
+		authType = "key"
+	}
+	transferMode, err := normalizeTransferMode(input.TransferMode)
+	if err != nil {
+		return nil, err
+	}
 	server := &entity.Server{
-		Name:     name,
-		Host:     host,
-		Port:     port,
-		Username: username,
-		AuthType: "key",
+		Name:               input.Name,
+		Host:               input.Host,
+		Port:               input.Port,
+		Username:           input.Username,
+		AuthType:           authType,
+		JumpHostID:         input.JumpHostID,
+		TransferMode:       transferMode,
+		MaxSessions:        input.MaxSessions,
+		HostKey:            input.HostKey,
+		HostKeyFingerprint: input.HostKeyFingerprint,
+		HostKeyApprovedAt:  input.HostKeyApprovedAt,
 	}
 	if server.Port == 0 {
 		server.Port = 22
@@ -95,7 +210,8 @@ func ServiceCreateServerWithKey(name, host string, port int, username string, ke
 	if err := DB.Create(server).Error; err != nil {
 		return nil, err
 	}
-	server.PrivateKeyPath = string(keyContent)
+	server.PrivateKeyPath = input.PrivateKeyPath
+	server.PrivateKeyPassphrase = input.PrivateKeyPassphrase
 	if err := DB.Save(server).Error; err != nil {
 		return nil, err
 	}
@@ -107,7 +223,28 @@ func ServiceUpdateServer(id uint, input *entity.Server) (*entity.Server, error)
 	if err != nil {
 		return nil, err
 	}
+	// A different address means a different host, so its key has to be learned again
+	if server.Host != input.Host || (input.Port != 0 && server.Port != input.Port) {
+		server.HostKey = ""
+		server.HostKeyFingerprint = ""
+		server.HostKeyApprovedAt = nil
+	}
+	if err := validateJumpHost(id, input.JumpHostID); err != nil {
+		return nil, err
+	}
+	transferMode, err := normalizeTransferMode(input.TransferMode)
+	if err != nil {
+		return nil, err
+	}
 	server.Name = input.Name
+	server.JumpHostID = input.JumpHostID
+	server.TransferMode = transferMode
+	if input.MaxSessions > 0 {
+		server.MaxSessions = input.MaxSessions
+	}
+	if err := validateMaxSessions(transferMode, server.MaxSessions); err != nil {
+		return nil, err
+	}
 	server.Host = input.Host
 	server.Port = input.Port
 	server.Username = input.Username
@@ -116,6 +253,10 @@ func ServiceUpdateServer(id uint, input *entity.Server) (*entity.Server, error)
 	if input.Password != "" {
 		server.Password = input.Password
 	}
+	// Same for the key passphrase
+	if input.PrivateKeyPassphrase != "" {
+		server.PrivateKeyPassphrase = input.PrivateKeyPassphrase
+	}
 	if server.Port == 0 {
 		server.Port = 22
 	}
@@ -126,5 +267,20 @@ func ServiceUpdateServer(id uint, input *entity.Server) (*entity.Server, error)
 }
 
 func ServiceDeleteServer(id uint) error {
+	// Servers used as a jump host cannot be removed without breaking others
+	var dependents int64
+	if err := DB.Model(&entity.Server{}).Where("jump_host_id = ?", id).Count(&dependents).Error; err != nil {
+		return err
+	}
+	if dependents > 0 {
+		return fmt.Errorf("server is used as jump host by %d other server(s)", dependents)
+	}
+	// Runs stored on the server could not be read anymore
+	if err := DB.Model(&entity.StorageLocation{}).Where("server_id = ?", id).Count(&dependents).Error; err != nil {
+		return err
+	}
+	if dependents > 0 {
+		return fmt.Errorf("server is used by %d sftp storage location(s)", dependents)
+	}
 	return DB.Delete(&entity.Server{}, id).Error
 }
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"backapp-server/entity"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCreateServerFromJSONHostKey(t *testing.T) {
+	InitDB(filepath.Join(t.TempDir(), "test.db"))
+	addr := startTestSSHServer(t, false)
+	presented, err := scanHostKey(&entity.Server{Host: addr, Username: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	presentedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(presented)))
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := listener.Addr().String()
+	listener.Close()
+
+	tests := []struct {
+		name     string
+		host     string
+		authType string
+		hostKey  string
+		// wantKey is set if the presented host key must be pinned
+		wantKey bool
+		// connectionFailure is set if the server must be rejected by the
+		// connection test, wantErr for any other error
+		connectionFailure bool
+		mismatch          bool
+		wantErr           bool
+	}{
+		{name: "presented key is recorded", host: addr, authType: "password", wantKey: true},
+		{name: "supplied key is checked", host: addr, authType: "password", hostKey: presentedKey, wantKey: true},
+		{name: "supplied key with comment", host: addr, authType: "password", hostKey: presentedKey + " host@example", wantKey: true},
+		{name: "supplied key differs", host: addr, authType: "password", hostKey: string(ssh.MarshalAuthorizedKey(other)), connectionFailure: true, mismatch: true},
+		{name: "invalid key", host: addr, authType: "password", hostKey: "not a key", wantErr: true},
+		{name: "unreachable server", host: closedAddr, authType: "password", connectionFailure: true},
+		{name: "key auth without uploaded key", host: closedAddr, authType: "key"},
+		{name: "default auth type", host: closedAddr},
+		{name: "key auth with supplied key", host: addr, authType: "key", hostKey: presentedKey, wantKey: true},
+		{name: "key auth with different key", host: addr, authType: "key", hostKey: string(ssh.MarshalAuthorizedKey(other)), connectionFailure: true, mismatch: true},
+		{name: "key auth with supplied key unreachable", host: closedAddr, authType: "key", hostKey: presentedKey, connectionFailure: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := &entity.Server{Name: tt.name, Host: tt.host, Username: "test", AuthType: tt.authType, HostKey: tt.hostKey}
+			if tt.authType == "password" {
+				input.Password = "test"
+			}
+			server, err := ServiceCreateServerFromJSON(input)
+			if tt.connectionFailure || tt.wantErr {
+				if err == nil {
+					t.Fatal("server was created")
+				}
+				if IsConnectionTestFailure(err) != tt.connectionFailure {
+					t.Errorf("IsConnectionTestFailure(%v) = %v", err, !tt.connectionFailure)
+				}
+				if IsHostKeyMismatch(err) != tt.mismatch {
+					t.Errorf("IsHostKeyMismatch(%v) = %v", err, !tt.mismatch)
+				}
+				var count int64
+				DB.Model(&entity.Server{}).Where("name = ?", tt.name).Count(&count)
+				if count != 0 {
+					t.Error("server was stored after the failed create")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err := GetServerByID(server.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.wantKey {
+				if stored.HostKey != "" || stored.HostKeyApprovedAt != nil {
+					t.Errorf("host key %q pinned before the first connection", stored.HostKey)
+				}
+			} else if stored.HostKey != presentedKey || stored.HostKeyFingerprint != ssh.FingerprintSHA256(presented) || stored.HostKeyApprovedAt == nil {
+				t.Errorf("stored host key %q (%s), want %q", stored.HostKey, stored.HostKeyFingerprint, presentedKey)
+			}
+			if server.Password != "" {
+				t.Error("create response contains the password")
+			}
+		})
+	}
+}
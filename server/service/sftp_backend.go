@@ -0,0 +1,209 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"backapp-server/entity"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpBackend stores runs in a directory on a server reached over SFTP, like
+// a Hetzner storage box. The connection uses the server's credentials, host
+// key and jump hosts. Names are paths on the server, relative ones start in
+// the login directory.
+type sftpBackend struct {
+	ssh      *SSHClient
+	client   *sftp.Client
+	basePath string
+}
+
+func newSFTPBackend(location *entity.StorageLocation) (*sftpBackend, error) {
+	if location.ServerID == nil {
+		return nil, fmt.Errorf("server is required for sftp storage")
+	}
+	server, err := GetServerByID(*location.ServerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server of sftp storage: %v", err)
+	}
+	sshClient, err := NewSSHClient(server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", server.Name, err)
+	}
+	client, err := sshClient.sftpClient()
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	return &sftpBackend{ssh: sshClient, client: client, basePath: path.Clean(location.BasePath)}, nil
+}
+
+// sftpWriter writes to the partial path of a file and renames it into place
+// on Close
+type sftpWriter struct {
+	client *sftp.Client
+	file   *sftp.File
+	path   string
+	done   bool
+}
+
+func (w *sftpWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *sftpWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	partial := w.file.Name()
+	if err := w.file.Close(); err != nil {
+		w.client.Remove(partial)
+		return err
+	}
+	// posix-rename replaces an existing file, plain SFTP rename does not
+	if err := w.client.PosixRename(partial, w.path); err != nil {
+		w.client.Remove(w.path)
+		if err := w.client.Rename(partial, w.path); err != nil {
+			w.client.Remove(partial)
+			return fmt.Errorf("failed to rename %s: %v", partial, err)
+		}
+	}
+	return nil
+}
+
+func (w *sftpWriter) Abort() {
+	if !w.done {
+		w.done = true
+		w.file.Close()
+		w.client.Remove(w.file.Name())
+	}
+}
+
+func (b *sftpBackend) Join(elem ...string) string {
+	return path.Join(append([]string{b.basePath}, elem...)...)
+}
+
+func (b *sftpBackend) Create(name string) (storageWriter, error) {
+	if err := b.client.MkdirAll(path.Dir(name)); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %v", path.Dir(name), err)
+	}
+	file, err := b.client.Create(partialPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return &sftpWriter{client: b.client, file: file, path: name}, nil
+}
+
+func (b *sftpBackend) Open(name string) (io.ReadCloser, int64, error) {
+	file, err := b.client.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+func (b *sftpBackend) Stat(name string) (int64, error) {
+	info, err := b.client.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return 0, fmt.Errorf("%s is not a regular file", name)
+	}
+	return info.Size(), nil
+}
+
+func (b *sftpBackend) List(dir string) ([]entity.FileSystemEntry, error) {
+	infos, err := b.client.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]entity.FileSystemEntry, 0, len(infos))
+	for _, info := range infos {
+		results = append(results, entity.FileSystemEntry{
+			Name:  info.Name(),
+			Path:  path.Join(dir, info.Name()),
+			IsDir: info.IsDir(),
+			Size:  info.Size(),
+		})
+	}
+	sortEntries(results)
+	return results, nil
+}
+
+func (b *sftpBackend) Remove(name string) error {
+	if err := b.client.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (b *sftpBackend) RemoveAll(dir string) error {
+	if err := b.client.RemoveAll(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Copy hard-links src to dst if the server supports it, and copies the
+// content through the connection otherwise
+func (b *sftpBackend) Copy(src, dst string) error {
+	if err := b.Remove(dst); err != nil {
+		return err
+	}
+	if err := b.client.MkdirAll(path.Dir(dst)); err != nil {
+		return err
+	}
+	if err := b.client.Link(src, dst); err == nil {
+		return nil
+	}
+	reader, _, err := b.Open(src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	writer, err := b.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Close()
+}
+
+func (b *sftpBackend) Test() error {
+	if err := b.client.MkdirAll(b.basePath); err != nil {
+		return fmt.Errorf("failed to create %s: %v", b.basePath, err)
+	}
+	probe := b.Join(fmt.Sprintf(".backapp-test-%d", time.Now().UnixNano()))
+	if err := writeStorageFile(b, probe, []byte("backapp")); err != nil {
+		return err
+	}
+	return b.Remove(probe)
+}
+
+// FreeSpace asks the server through the statvfs@openssh.com extension
+func (b *sftpBackend) FreeSpace() (int64, error) {
+	stat, err := b.client.StatVFS(b.basePath)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail * stat.Frsize), nil
+}
+
+func (b *sftpBackend) Close() error {
+	return b.ssh.Close()
+}
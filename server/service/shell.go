@@ -0,0 +1,40 @@
+package service
+
+import "strings"
+
+// Every remote command BackApp builds goes through these helpers. Paths are
+// always passed as single quoted words, which the shell never expands, and
+// after "--" where a command takes options, so that names starting with "-"
+// are not mistaken for options. find and cd take no "--" before their paths,
+// those get optionSafePath instead.
+
+// shellQuote quotes s for use as a single word in a POSIX shell command
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellCommand returns name followed by args quoted as single words
+func shellCommand(name string, args ...string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, arg := range args {
+		b.WriteByte(' ')
+		b.WriteString(shellQuote(arg))
+	}
+	return b.String()
+}
+
+// shellPathCommand returns the command prefix followed by "--" and the
+// quoted remote paths. prefix is used as is and must already be quoted.
+func shellPathCommand(prefix string, paths ...string) string {
+	return shellCommand(prefix+" --", paths...)
+}
+
+// optionSafePath prefixes relative paths with "./" so that a leading "-" is
+// not read as an option by commands that take no "--" before their paths
+func optionSafePath(p string) string {
+	if p == "" || p == "." || p == ".." || strings.HasPrefix(p, "/") || strings.HasPrefix(p, "./") || strings.HasPrefix(p, "../") {
+		return p
+	}
+	return "./" + p
+}
@@ -1,122 +1,102 @@
 package service
 
 import (
+	"errors"
 	"fmt"
-	"net"
 	"os"
 	"time"
 
 	"backapp-server/entity"
-
-	"golang.org/x/crypto/ssh"
 )
 
-// TestSSHConnection tests an SSH connection with a private key
-func TestSSHConnection(hostname, username, keyContent string, port int) error {
-	signer, err := ssh.ParsePrivateKey([]byte(keyContent))
-	if err != nil {
-		return fmt.Errorf("failed to parse private key: %v", err)
-	}
-
-	config := &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         10 * time.Second,
-	}
-
-	// Build address with port
-	address := hostname
-	if _, _, err := net.SplitHostPort(hostname); err != nil {
-		// hostname doesn't contain port, add it
-		if port == 0 {
-			port = 22
-		}
-		address = net.JoinHostPort(hostname, fmt.Sprintf("%d", port))
-	}
+// ConnectionTestError is returned when a server is not stored because the
+// connection test failed
+type ConnectionTestError struct {
+	Err error
+}
 
-	conn, err := ssh.Dial("tcp", address, config)
-	if err != nil {
-		return fmt.Errorf("SSH connection failed: %v", err)
-	}
-	defer conn.Close()
+func (e *ConnectionTestError) Error() string {
+	return "SSH connection test failed: " + e.Err.Error()
+}
 
-	sess, err := conn.NewSession()
-	if err != nil {
-		return fmt.Errorf("SSH session failed: %v", err)
-	}
-	defer sess.Close()
+func (e *ConnectionTestError) Unwrap() error {
+	return e.Err
+}
 
-	// Test with a simple command
-	_, err = sess.Output("echo test")
-	if err != nil {
-		return fmt.Errorf("SSH command failed: %v", err)
-	}
+// IsConnectionTestFailure reports whether err was caused by a failed
+// connection test
+func IsConnectionTestFailure(err error) bool {
+	var failure *ConnectionTestError
+	return errors.As(err, &failure)
+}
 
-	return nil
+// TestSSHConnection tests an SSH connection with a private key, which may be
+// encrypted with passphrase
+func TestSSHConnection(hostname, username, keyContent, passphrase string, port int) error {
+	return testSSHConnection(&entity.Server{
+		Host:                 hostname,
+		Port:                 port,
+		Username:             username,
+		AuthType:             "key",
+		PrivateKeyPath:       keyContent,
+		PrivateKeyPassphrase: passphrase,
+	})
 }
 
 // TestSSHConnectionWithPassword tests an SSH connection using username/password
 func TestSSHConnectionWithPassword(hostname, username, password string, port int) error {
-	config := &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         10 * time.Second,
-	}
-
-	// Build address with port
-	address := hostname
-	if _, _, err := net.SplitHostPort(hostname); err != nil {
-		// hostname doesn't contain port, add it
-		if port == 0 {
-			port = 22
-		}
-		address = net.JoinHostPort(hostname, fmt.Sprintf("%d", port))
-	}
-
-	conn, err := ssh.Dial("tcp", address, config)
-	if err != nil {
-		return fmt.Errorf("SSH connection failed: %v", err)
-	}
-	defer conn.Close()
-	sess, err := conn.NewSession()
-	if err != nil {
-		return fmt.Errorf("SSH session failed: %v", err)
-	}
-	defer sess.Close()
-	_, err = sess.Output("echo test")
-	if err != nil {
-		return fmt.Errorf("SSH command failed: %v", err)
-	}
-	return nil
+	return testSSHConnection(&entity.Server{
+		Host:     hostname,
+		Port:     port,
+		Username: username,
+		AuthType: "password",
+		Password: password,
+	})
 }
 
-// TestSSHConnectionUsingServer attempts an SSH connection using the server's auth type
+// TestSSHConnectionUsingServer attempts an SSH connection using the server's
+// auth type and jump hosts. For servers that are not saved yet, the accepted
+// host key is only set on the passed struct.
 func TestSSHConnectionUsingServer(server *entity.Server) error {
 	switch server.AuthType {
 	case "key":
 		if server.PrivateKeyPath == "" {
 			return fmt.Errorf("server has no private_key_path configured")
 		}
-		if stat, err := os.Stat(server.PrivateKeyPath); err == nil && !stat.IsDir() {
-			keyData, err := os.ReadFile(server.PrivateKeyPath)
-			if err != nil {
-				return fmt.Errorf("failed to read private key file: %v", err)
-			}
-			return TestSSHConnection(server.Host, server.Username, string(keyData), server.Port)
-		}
-		return TestSSHConnection(server.Host, server.Username, server.PrivateKeyPath, server.Port)
 	case "password":
 		if server.Password == "" {
 			return fmt.Errorf("server has no password configured")
 		}
-		return TestSSHConnectionWithPassword(server.Host, server.Username, server.Password, server.Port)
+	case "agent":
+		if os.Getenv("SSH_AUTH_SOCK") == "" {
+			return fmt.Errorf("SSH_AUTH_SOCK is not set, no ssh-agent available")
+		}
 	default:
 		return fmt.Errorf("unsupported auth_type: %s", server.AuthType)
 	}
+	return testSSHConnection(server)
+}
+
+// testSSHConnection connects to the server, verifying its host key, and runs a
+// simple command
+func testSSHConnection(server *entity.Server) error {
+	conn, err := dialServer(server, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sess, err := conn.newSession()
+	if err != nil {
+		return fmt.Errorf("SSH session failed: %v", err)
+	}
+	defer conn.closeSession(sess)
+
+	// Test with a simple command
+	_, err = sess.Output("echo test")
+	if err != nil {
+		return fmt.Errorf("SSH command failed: %v", err)
+	}
+
+	return nil
 }
@@ -1,29 +1,96 @@
 package service
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"backapp-server/entity"
 
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 // SSHClient wraps an SSH connection for executing commands and transferring files
 type SSHClient struct {
+	// connMu guards client and jump, which reconnect replaces. It is locked
+	// after mu.
+	connMu sync.Mutex
 	client *ssh.Client
 	config *ssh.ClientConfig
 	addr   string
+	jump   *SSHClient // connection to the jump host the client is tunnelled through
+	// server is dialed again when the connection is lost
+	server *entity.Server
+
+	// transferMode is "auto" (SFTP with cat/scp fallback), "sftp" or "shell" (cat/scp only)
+	transferMode string
+
+	// sessions holds one token per open session to stay below the server's MaxSessions
+	sessions chan struct{}
+
+	mu      sync.Mutex
+	sftp    *sftp.Client
+	sftpErr error
+	statCmd string
+	// statNUL is set if statCmd terminates every entry with a NUL byte
+	statNUL bool
+	// gnuTar caches whether the remote tar and find are the GNU versions
+	gnuTar *bool
 }
 
+// errSFTPDisabled is returned when SFTP is not used for the server
+var errSFTPDisabled = errors.New("SFTP is disabled for this server")
+
+// sessionWaitTimeout limits how long an operation waits for a free session
+// before giving up instead of hanging behind a stuck one
+var sessionWaitTimeout = 5 * time.Minute
+
+// maxJumpHosts limits the length of jump host chains
+const maxJumpHosts = 8
+
 // NewSSHClient creates a new SSH client for a server
 func NewSSHClient(server *entity.Server) (*SSHClient, error) {
-	var config *ssh.ClientConfig
+	return dialServer(server, 30*time.Second)
+}
 
+// serverMaxSessions returns how many sessions may be open on one connection
+// to the server, defaulting to OpenSSH's MaxSessions of 10
+func serverMaxSessions(server *entity.Server) int {
+	if server.MaxSessions <= 0 {
+		return 10
+	}
+	return server.MaxSessions
+}
+
+// serverAddress builds the host:port address of a server, defaulting to port 22
+func serverAddress(server *entity.Server) string {
+	if _, _, err := net.SplitHostPort(server.Host); err == nil {
+		return server.Host
+	}
+	// hostname doesn't contain port, add it
+	port := server.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(server.Host, fmt.Sprintf("%d", port))
+}
+
+// sshAuthMethods returns the authentication methods for the server's auth
+// type. The returned closer, if any, must be closed once the handshake is done.
+func sshAuthMethods(server *entity.Server) ([]ssh.AuthMethod, io.Closer, error) {
 	switch server.AuthType {
 	case "key":
 		var keyData []byte
@@ -33,71 +100,205 @@ func NewSSHClient(server *entity.Server) (*SSHClient, error) {
 		if stat, statErr := os.Stat(server.PrivateKeyPath); statErr == nil && !stat.IsDir() {
 			keyData, err = os.ReadFile(server.PrivateKeyPath)
 			if err != nil {
-				return nil, fmt.Errorf("failed to read private key file: %v", err)
+				return nil, nil, fmt.Errorf("failed to read private key file: %v", err)
 			}
 		} else {
 			// Treat as key content
 			keyData = []byte(server.PrivateKeyPath)
 		}
 
-		signer, err := ssh.ParsePrivateKey(keyData)
+		signer, err := parsePrivateKey(keyData, server.PrivateKeyPassphrase)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse private key: %v", err)
-		}
-
-		config = &ssh.ClientConfig{
-			User: server.Username,
-			Auth: []ssh.AuthMethod{
-				ssh.PublicKeys(signer),
-			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			Timeout:         30 * time.Second,
+			return nil, nil, err
 		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil, nil
 
 	case "password":
-		config = &ssh.ClientConfig{
-			User: server.Username,
-			Auth: []ssh.AuthMethod{
-				ssh.Password(server.Password),
-			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			Timeout:         30 * time.Second,
+		return []ssh.AuthMethod{ssh.Password(server.Password)}, nil, nil
+
+	case "agent":
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, nil, fmt.Errorf("SSH_AUTH_SOCK is not set, no ssh-agent available")
 		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to ssh-agent: %v", err)
+		}
+		return []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)}, conn, nil
 
 	default:
-		return nil, fmt.Errorf("unsupported auth_type: %s", server.AuthType)
+		return nil, nil, fmt.Errorf("unsupported auth_type: %s", server.AuthType)
+	}
+}
+
+// parsePrivateKey parses an OpenSSH or PEM private key, decrypting it with
+// passphrase if the key is encrypted
+func parsePrivateKey(keyData []byte, passphrase string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if err == nil {
+		return signer, nil
+	}
+
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("private key is encrypted, a passphrase is required")
+	}
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(keyData, []byte(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: %v", err)
+	}
+	return signer, nil
+}
+
+// dialServer connects and authenticates to a server, tunnelling through its
+// jump hosts if configured. The presented host key is checked against the one
+// stored on the server; if none is stored yet, the key is recorded once the
+// connection succeeds (trust on first use).
+func dialServer(server *entity.Server, timeout time.Duration) (*SSHClient, error) {
+	return dialServerChain(server, timeout, nil)
+}
+
+// dialServerChain dials server; chain holds the IDs of the servers that are
+// being dialed through it and is used to detect jump host loops
+func dialServerChain(server *entity.Server, timeout time.Duration, chain []uint) (*SSHClient, error) {
+	auth, authCloser, err := sshAuthMethods(server)
+	if err != nil {
+		return nil, err
+	}
+	if authCloser != nil {
+		defer authCloser.Close()
+	}
+
+	jump, err := dialJumpHost(server, timeout, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier := newHostKeyVerifier(server)
+	config := &ssh.ClientConfig{
+		User:            server.Username,
+		Auth:            auth,
+		HostKeyCallback: verifier.callback,
+		Timeout:         timeout,
 	}
 
-	// Build address with correct port
-	address := server.Host
-	if _, _, err := net.SplitHostPort(server.Host); err != nil {
-		// hostname doesn't contain port, add it
-		port := server.Port
-		if port == 0 {
-			port = 22
+	addr := serverAddress(server)
+	client, err := dialAddress(jump, addr, config)
+	if err != nil {
+		if jump != nil {
+			jump.Close()
 		}
-		address = net.JoinHostPort(server.Host, fmt.Sprintf("%d", port))
+		return nil, fmt.Errorf("SSH connection failed: %w", err)
+	}
+
+	sshClient := &SSHClient{
+		client:       client,
+		config:       config,
+		addr:         addr,
+		jump:         jump,
+		server:       server,
+		transferMode: server.TransferMode,
+		sessions:     make(chan struct{}, serverMaxSessions(server)),
+	}
+	if err := verifier.trustOnFirstUse(); err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("failed to record host key: %v", err)
+	}
+	go keepAlive(client)
+
+	return sshClient, nil
+}
+
+// dialJumpHost connects to the jump host of server, returning nil if the
+// server is reached directly
+func dialJumpHost(server *entity.Server, timeout time.Duration, chain []uint) (*SSHClient, error) {
+	if server.JumpHostID == nil || *server.JumpHostID == 0 {
+		return nil, nil
+	}
+
+	chain = append(chain, server.ID)
+	if len(chain) > maxJumpHosts {
+		return nil, fmt.Errorf("jump host chain is longer than %d hosts", maxJumpHosts)
+	}
+	for _, id := range chain {
+		if id == *server.JumpHostID {
+			return nil, fmt.Errorf("jump host loop detected at server %d", id)
+		}
+	}
+
+	jumpServer, err := GetServerByID(*server.JumpHostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load jump host %d: %v", *server.JumpHostID, err)
+	}
+	jump, err := dialServerChain(jumpServer, timeout, chain)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %w", jumpServer.Name, err)
+	}
+	return jump, nil
+}
+
+// dialAddress opens an SSH connection to addr, either directly or through a
+// TCP forward on the jump host like OpenSSH's ProxyJump
+func dialAddress(jump *SSHClient, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if jump == nil {
+		return ssh.Dial("tcp", addr, config)
+	}
+
+	conn, err := jump.client.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s through jump host: %v", addr, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
 
-	client, err := ssh.Dial("tcp", address, config)
+// newSession opens a session once the number of open sessions is below the
+// server's MaxSessions limit. Sessions must be closed with closeSession.
+func (c *SSHClient) newSession() (*ssh.Session, error) {
+	if err := c.acquireSession(); err != nil {
+		return nil, err
+	}
+	session, err := c.conn().NewSession()
 	if err != nil {
-		return nil, fmt.Errorf("SSH connection failed: %v", err)
+		<-c.sessions
+		return nil, fmt.Errorf("failed to create session: %v", err)
 	}
+	return session, nil
+}
 
-	return &SSHClient{
-		client: client,
-		config: config,
-		addr:   address,
-	}, nil
+// acquireSession takes a session slot, failing after sessionWaitTimeout
+func (c *SSHClient) acquireSession() error {
+	timer := time.NewTimer(sessionWaitTimeout)
+	defer timer.Stop()
+	select {
+	case c.sessions <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("no free session after %v, all %d sessions are in use", sessionWaitTimeout, cap(c.sessions))
+	}
+}
+
+// closeSession closes a session opened by newSession and frees its slot
+func (c *SSHClient) closeSession(session *ssh.Session) {
+	session.Close()
+	<-c.sessions
 }
 
 // RunCommand executes a command on the remote server
 func (c *SSHClient) RunCommand(cmd string) (string, error) {
-	session, err := c.client.NewSession()
+	session, err := c.newSession()
 	if err != nil {
-		return "", fmt.Errorf("failed to create session: %v", err)
+		return "", err
 	}
-	defer session.Close()
+	defer c.closeSession(session)
 
 	output, err := session.CombinedOutput(cmd)
 	if err != nil {
@@ -107,33 +308,440 @@ func (c *SSHClient) RunCommand(cmd string) (string, error) {
 	return string(output), nil
 }
 
-// CopyFileFromRemote downloads a file from the remote server using SCP
-func (c *SSHClient) CopyFileFromRemote(remotePath, localPath string) error {
-	log.Printf("Starting file copy from remote: %s to local: %s", remotePath, localPath)
+// runCommandOutput executes a command on the remote server and returns its
+// stdout and stderr separately, for output that is parsed
+func (c *SSHClient) runCommandOutput(cmd string) (string, string, error) {
+	session, err := c.newSession()
+	if err != nil {
+		return "", "", err
+	}
+	defer c.closeSession(session)
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run(cmd); err != nil {
+		return stdout.String(), stderr.String(), fmt.Errorf("command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), stderr.String(), nil
+}
+
+// RemoteStream is the stdout of a command running on the remote server
+type RemoteStream struct {
+	client  *SSHClient
+	session *ssh.Session
+	stdout  io.Reader
+	stderr  bytes.Buffer
+	done    bool
+}
+
+// StreamCommand starts cmd on the remote server and returns its stdout as a
+// stream. Callers must call Wait after reading the output, or Close to abort.
+func (c *SSHClient) StreamCommand(cmd string) (*RemoteStream, error) {
+	session, err := c.newSession()
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &RemoteStream{client: c, session: session}
+	stream.stdout, err = session.StdoutPipe()
+	if err != nil {
+		c.closeSession(session)
+		return nil, fmt.Errorf("failed to get stdout pipe: %v", err)
+	}
+	session.Stderr = &stream.stderr
+
+	if err := session.Start(cmd); err != nil {
+		c.closeSession(session)
+		return nil, fmt.Errorf("failed to start command: %v", err)
+	}
+	return stream, nil
+}
+
+// Read reads from the command's stdout
+func (r *RemoteStream) Read(p []byte) (int, error) {
+	return r.stdout.Read(p)
+}
+
+// Wait waits for the command to exit. The returned error wraps *ssh.ExitError
+// for non-zero exit codes and includes the command's stderr.
+func (r *RemoteStream) Wait() error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+	defer r.client.closeSession(r.session)
+
+	if err := r.session.Wait(); err != nil {
+		if stderr := strings.TrimSpace(r.stderr.String()); stderr != "" {
+			return fmt.Errorf("%w: %s", err, stderr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Stderr returns what the command wrote to stderr so far
+func (r *RemoteStream) Stderr() string {
+	return r.stderr.String()
+}
+
+// Close aborts the command if it has not been waited for
+func (r *RemoteStream) Close() error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+	r.client.closeSession(r.session)
+	return nil
+}
+
+// HasCommand reports whether name is available in the remote shell
+func (c *SSHClient) HasCommand(name string) bool {
+	_, err := c.RunCommand(shellCommand("command -v", name) + " >/dev/null 2>&1")
+	return err == nil
+}
+
+// sftpClient returns the SFTP session of the connection, starting it on first use
+func (c *SSHClient) sftpClient() (*sftp.Client, error) {
+	if c.transferMode == "shell" {
+		return nil, errSFTPDisabled
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sftp == nil && c.sftpErr == nil {
+		// The SFTP subsystem keeps its session slot until the client is closed,
+		// so it needs a second one left for commands
+		if cap(c.sessions) < 2 {
+			if c.transferMode != "sftp" {
+				return nil, errSFTPDisabled
+			}
+			c.sftpErr = errors.New("sftp transfer mode needs max_sessions of at least 2")
+			return nil, c.sftpErr
+		}
+		if err := c.acquireSession(); err != nil {
+			return nil, err
+		}
+		c.sftp, c.sftpErr = sftp.NewClient(c.conn())
+		if c.sftpErr != nil {
+			<-c.sessions
+			c.sftpErr = fmt.Errorf("failed to start SFTP subsystem: %v", c.sftpErr)
+			log.Printf("%v", c.sftpErr)
+		}
+	}
+	return c.sftp, c.sftpErr
+}
+
+// CopyFileFromRemote downloads a file from the remote server using SFTP,
+// falling back to cat and SCP depending on the transfer mode. If sum is not
+// nil, the downloaded content is hashed into it while streaming.
+func (c *SSHClient) CopyFileFromRemote(remotePath, localPath string, sum hash.Hash) error {
+	return c.copyFromRemote(remotePath, &localDestination{path: localPath, sum: sum})
+}
+
+// ResumeFileFromRemote continues an interrupted download, appending to the
+// partial file from its current size. sum covers the whole file afterwards.
+// The partial file is kept if the download fails again.
+func (c *SSHClient) ResumeFileFromRemote(remotePath, localPath string, sum hash.Hash) error {
+	var offset int64
+	if stat, err := os.Stat(partialPath(localPath)); err == nil && stat.Mode().IsRegular() {
+		offset = stat.Size()
+	}
+	dst := &localDestination{path: localPath, offset: offset, sum: sum}
+	if _, err := c.downloadResumable(remotePath, dst); err != nil {
+		return err
+	}
+	return dst.commit()
+}
+
+// partialPath returns the temporary name a download is written to until it is
+// complete, so that an interrupted download never looks like a valid file
+func partialPath(localPath string) string {
+	return filepath.Join(filepath.Dir(localPath), "."+filepath.Base(localPath)+".partial")
+}
+
+// localDestination is the local side of a download. Data is written to the
+// partial path and only renamed to path by commit, or streamed to a storage
+// backend where it appears once the writer is closed.
+type localDestination struct {
+	path string
+	// offset is where the download starts; data before it is expected to
+	// already be present in path
+	offset int64
+	// sum receives the downloaded content, may be nil
+	sum hash.Hash
+	// wrap transforms the content before it is written, e.g. to encrypt it.
+	// Wrapped downloads always start from the beginning.
+	wrap func(io.Writer) (io.WriteCloser, error)
+	// backend receives the content instead of the local file system if set.
+	// Uploads cannot be continued and always start from the beginning.
+	backend storageBackend
+	upload  storageWriter
+
+	// progress receives the bytes written, may be nil
+	progress *fileProgress
+	// written is the size of the partial file as counted by progress
+	written int64
+}
+
+// localWriter is a single download attempt into a localDestination. Close
+// must be called to complete the file.
+type localWriter struct {
+	io.Writer
+	file    io.WriteCloser
+	wrapped io.WriteCloser
+	closed  bool
+}
+
+func (w *localWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.wrapped != nil {
+		if err := w.wrapped.Close(); err != nil {
+			abortFile(w.file)
+			return err
+		}
+	}
+	return w.file.Close()
+}
+
+// abortFile closes a local file, or aborts an upload so that it does not
+// appear in the backend
+func abortFile(file io.WriteCloser) {
+	if upload, ok := file.(storageWriter); ok {
+		upload.Abort()
+	} else {
+		file.Close()
+	}
+}
+
+// resumable reports whether an interrupted download can continue where it
+// stopped
+func (d *localDestination) resumable() bool {
+	return d.wrap == nil && d.backend == nil
+}
+
+// open starts a download attempt at offset. The partial file is truncated to
+// offset and sum is reset to cover the data already present. Uploads to a
+// backend replace the previous attempt.
+func (d *localDestination) open(offset int64) (*localWriter, error) {
+	var file io.WriteCloser
+	if d.backend != nil {
+		if d.upload != nil {
+			d.upload.Abort()
+		}
+		offset = 0
+		resetChecksum(d.sum, "", 0)
+		upload, err := d.backend.Create(d.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start upload: %v", err)
+		}
+		d.upload = upload
+		file = upload
+	} else {
+		if err := resetChecksum(d.sum, partialPath(d.path), offset); err != nil {
+			return nil, err
+		}
+		localFile, err := openLocalFile(partialPath(d.path), offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create local file: %v", err)
+		}
+		file = localFile
+	}
+
+	w := &localWriter{file: file}
+	var (
+		out io.Writer = file
+		err error
+	)
+	if d.wrap != nil {
+		if w.wrapped, err = d.wrap(file); err != nil {
+			abortFile(file)
+			return nil, err
+		}
+		out = w.wrapped
+	}
+	w.Writer = checksumWriter(out, d.sum)
+	if d.progress != nil {
+		d.progress.add(offset - d.written)
+		d.written = offset
+		w.Writer = &progressWriter{w: w.Writer, dst: d}
+	}
+	return w, nil
+}
+
+// commit moves the complete download to its final path. Uploads are already
+// in place once their writer was closed.
+func (d *localDestination) commit() error {
+	if d.backend != nil {
+		return nil
+	}
+	if err := os.Rename(partialPath(d.path), d.path); err != nil {
+		return fmt.Errorf("failed to move download into place: %v", err)
+	}
+	return nil
+}
+
+// discard removes the partial file of a failed download
+func (d *localDestination) discard() {
+	if d.backend != nil {
+		if d.upload != nil {
+			d.upload.Abort()
+		}
+		d.backend.Remove(d.path)
+	} else {
+		os.Remove(partialPath(d.path))
+	}
+	d.progress.add(-d.written)
+	d.written = 0
+}
+
+// copyFromRemote downloads remotePath into dst, resuming it if the connection
+// is lost. The file only appears under its final name once the download is
+// complete.
+func (c *SSHClient) copyFromRemote(remotePath string, dst *localDestination) error {
+	if _, err := c.downloadResumable(remotePath, dst); err != nil {
+		dst.discard()
+		return err
+	}
+	return dst.commit()
+}
+
+// downloadFromRemote downloads remotePath into the partial file of dst,
+// trying SFTP, cat and SCP as the transfer mode allows
+func (c *SSHClient) downloadFromRemote(remotePath string, dst *localDestination) error {
+	if !dst.resumable() {
+		dst.offset = 0
+	}
+	log.Printf("Starting file copy from remote: %s to local: %s (offset %d)", remotePath, dst.path, dst.offset)
+
+	if _, sftpErr := c.sftpClient(); sftpErr == nil {
+		err := c.copyFileUsingSFTP(remotePath, dst)
+		if err == nil {
+			return nil
+		}
+		if c.transferMode == "sftp" {
+			return err
+		}
+		log.Printf("SFTP transfer failed: %v, falling back to cat", err)
+	} else if c.transferMode == "sftp" {
+		return sftpErr
+	}
 
 	// Try simple cat method first (more reliable)
-	err := c.copyFileUsingCat(remotePath, localPath)
+	err := c.copyFileUsingCat(remotePath, dst)
 	if err == nil {
 		log.Printf("File copied successfully using cat method")
 		return nil
 	}
 
 	log.Printf("Cat method failed: %v, falling back to SCP", err)
-	return c.copyFileUsingSCP(remotePath, localPath)
+	return c.copyFileUsingSCP(remotePath, dst)
 }
 
-// copyFileUsingCat downloads a file using cat (simpler and more reliable)
-func (c *SSHClient) copyFileUsingCat(remotePath, localPath string) error {
-	session, err := c.client.NewSession()
+// resetChecksum prepares sum for a new download attempt by hashing the first
+// offset bytes that are already present in localPath
+func resetChecksum(sum hash.Hash, localPath string, offset int64) error {
+	if sum == nil {
+		return nil
+	}
+	sum.Reset()
+	if offset == 0 {
+		return nil
+	}
+	localFile, err := os.Open(localPath)
 	if err != nil {
-		return fmt.Errorf("failed to create session: %v", err)
+		return fmt.Errorf("failed to open local file: %v", err)
 	}
-	defer session.Close()
+	defer localFile.Close()
+	if _, err := io.CopyN(sum, localFile, offset); err != nil {
+		return fmt.Errorf("failed to hash local file: %v", err)
+	}
+	return nil
+}
+
+// checksumWriter returns w, additionally feeding sum if it is set
+func checksumWriter(w io.Writer, sum hash.Hash) io.Writer {
+	if sum == nil {
+		return w
+	}
+	return io.MultiWriter(w, sum)
+}
+
+// openLocalFile opens localPath for writing at offset, truncating it when
+// offset is zero
+func openLocalFile(localPath string, offset int64) (*os.File, error) {
+	if offset == 0 {
+		return os.Create(localPath)
+	}
+	localFile, err := os.OpenFile(localPath, os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// Drop anything written past the offset
+	if err := localFile.Truncate(offset); err != nil {
+		localFile.Close()
+		return nil, err
+	}
+	if _, err := localFile.Seek(offset, io.SeekStart); err != nil {
+		localFile.Close()
+		return nil, err
+	}
+	return localFile, nil
+}
+
+// copyFileUsingSFTP downloads a file through the SFTP subsystem
+func (c *SSHClient) copyFileUsingSFTP(remotePath string, dst *localDestination) error {
+	client, err := c.sftpClient()
+	if err != nil {
+		return err
+	}
+
+	remoteFile, err := client.Open(remotePath)
+	if err != nil {
+		return fmt.Errorf("failed to open remote file: %w", err)
+	}
+	defer remoteFile.Close()
+
+	if dst.offset > 0 {
+		if _, err := remoteFile.Seek(dst.offset, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek remote file: %v", err)
+		}
+	}
+
+	localFile, err := dst.open(dst.offset)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(localFile, remoteFile); err != nil {
+		localFile.Close()
+		return fmt.Errorf("failed to copy file content: %v", err)
+	}
+
+	return localFile.Close()
+}
+
+// copyFileUsingCat downloads a file using cat, or tail when resuming
+func (c *SSHClient) copyFileUsingCat(remotePath string, dst *localDestination) error {
+	cmd := shellPathCommand("cat", remotePath)
+	if dst.offset > 0 {
+		cmd = c.seekCommand(remotePath, dst.offset)
+	}
+
+	session, err := c.newSession()
+	if err != nil {
+		return err
+	}
+	defer c.closeSession(session)
 
 	// Create local file
-	localFile, err := os.Create(localPath)
+	localFile, err := dst.open(dst.offset)
 	if err != nil {
-		return fmt.Errorf("failed to create local file: %v", err)
+		return err
 	}
 	defer localFile.Close()
 
@@ -144,7 +752,7 @@ func (c *SSHClient) copyFileUsingCat(remotePath, localPath string) error {
 	}
 
 	// Start cat command
-	if err := session.Start(fmt.Sprintf("cat '%s'", remotePath)); err != nil {
+	if err := session.Start(cmd); err != nil {
 		return fmt.Errorf("failed to start cat: %v", err)
 	}
 
@@ -158,21 +766,31 @@ func (c *SSHClient) copyFileUsingCat(remotePath, localPath string) error {
 		return fmt.Errorf("cat command failed: %v", err)
 	}
 
-	return nil
+	return localFile.Close()
 }
 
-// copyFileUsingSCP downloads a file from the remote server using SCP
-func (c *SSHClient) copyFileUsingSCP(remotePath, localPath string) error {
-	session, err := c.client.NewSession()
+// seekCommand returns a command printing remotePath from offset on. Without
+// tail, dd seeks the shared stdin before cat prints the rest.
+func (c *SSHClient) seekCommand(remotePath string, offset int64) string {
+	if c.HasCommand("tail") {
+		return shellPathCommand(fmt.Sprintf("tail -c +%d", offset+1), remotePath)
+	}
+	return fmt.Sprintf("{ dd bs=1 skip=%d count=0 2>/dev/null && cat; } < %s", offset, shellQuote(remotePath))
+}
+
+// copyFileUsingSCP downloads a file from the remote server using the SCP
+// source protocol
+func (c *SSHClient) copyFileUsingSCP(remotePath string, dst *localDestination) error {
+	session, err := c.newSession()
 	if err != nil {
-		return fmt.Errorf("failed to create session: %v", err)
+		return err
 	}
-	defer session.Close()
+	defer c.closeSession(session)
 
-	// Create local file
-	localFile, err := os.Create(localPath)
+	// Create local file, SCP always transfers the whole file
+	localFile, err := dst.open(0)
 	if err != nil {
-		return fmt.Errorf("failed to create local file: %v", err)
+		return err
 	}
 	defer localFile.Close()
 
@@ -187,7 +805,7 @@ func (c *SSHClient) copyFileUsingSCP(remotePath, localPath string) error {
 		return fmt.Errorf("failed to get stdin pipe: %v", err)
 	}
 
-	if err := session.Start("scp -f " + remotePath); err != nil {
+	if err := session.Start(shellPathCommand("scp -f", remotePath)); err != nil {
 		return fmt.Errorf("failed to start scp: %v", err)
 	}
 
@@ -196,11 +814,37 @@ func (c *SSHClient) copyFileUsingSCP(remotePath, localPath string) error {
 		return fmt.Errorf("failed to send ready signal: %v", err)
 	}
 
-	// Read file info
-	buf := make([]byte, 1024)
-	_, err = stdout.Read(buf)
-	if err != nil {
-		return fmt.Errorf("failed to read file info: %v", err)
+	// Read the file header "C<mode> <size> <name>\n", skipping time records
+	reader := bufio.NewReader(stdout)
+	var size int64
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read file info: %v", err)
+		}
+		if len(header) == 0 {
+			return fmt.Errorf("empty scp header")
+		}
+		switch header[0] {
+		case 'T':
+			if _, err := stdin.Write([]byte{0}); err != nil {
+				return fmt.Errorf("failed to send ack: %v", err)
+			}
+			continue
+		case 'C':
+			fields := strings.SplitN(strings.TrimSpace(header[1:]), " ", 3)
+			if len(fields) != 3 {
+				return fmt.Errorf("invalid scp header: %q", header)
+			}
+			size, err = strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid file size in scp header: %q", header)
+			}
+		default:
+			// 0x01 and 0x02 carry a warning or error message
+			return fmt.Errorf("scp error: %s", strings.TrimSpace(header[1:]))
+		}
+		break
 	}
 
 	// Send acknowledgment
@@ -208,31 +852,42 @@ func (c *SSHClient) copyFileUsingSCP(remotePath, localPath string) error {
 		return fmt.Errorf("failed to send ack: %v", err)
 	}
 
-	// Read file content
-	if _, err := io.Copy(localFile, stdout); err != nil {
+	// Read file content followed by the status byte
+	if _, err := io.CopyN(localFile, reader, size); err != nil {
 		return fmt.Errorf("failed to copy file: %v", err)
 	}
+	if status, err := reader.ReadByte(); err != nil || status != 0 {
+		return fmt.Errorf("scp transfer did not complete")
+	}
 
 	// Send final acknowledgment
 	if _, err := stdin.Write([]byte{0}); err != nil {
 		return fmt.Errorf("failed to send final ack: %v", err)
 	}
+	stdin.Close()
 
 	if err := session.Wait(); err != nil {
-		// SCP might return error even on success, check if file was created
-		if stat, statErr := os.Stat(localPath); statErr == nil && stat.Size() > 0 {
-			return nil
-		}
 		return fmt.Errorf("scp failed: %v", err)
 	}
 
-	return nil
+	return localFile.Close()
 }
 
-// Close closes the SSH connection
+// Close closes the SSH connection and any jump host connections below it
 func (c *SSHClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	var err error
+	if c.sftp != nil {
+		c.sftp.Close()
+	}
 	if c.client != nil {
-		return c.client.Close()
+		err = c.client.Close()
 	}
-	return nil
+	if c.jump != nil {
+		c.jump.Close()
+	}
+	return err
 }
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"backapp-server/entity"
+)
+
+// runWithin fails the test if fn does not return within d
+func runWithin(t *testing.T, d time.Duration, fn func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatalf("did not finish within %v", d)
+	}
+}
+
+func TestSingleSessionKeepsCommandsWorking(t *testing.T) {
+	client := newTestSSHClientFor(t, &entity.Server{TransferMode: "auto", MaxSessions: 1})
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "remote.txt")
+	if err := os.WriteFile(remote, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.sftpClient(); err != errSFTPDisabled {
+		t.Fatalf("sftpClient with one session = %v, want errSFTPDisabled", err)
+	}
+	runWithin(t, 30*time.Second, func() {
+		local := filepath.Join(dir, "local.txt")
+		if err := client.CopyFileFromRemote(remote, local, nil); err != nil {
+			t.Errorf("download failed: %v", err)
+		}
+		if got, err := os.ReadFile(local); err != nil || string(got) != "content" {
+			t.Errorf("downloaded %q, %v", got, err)
+		}
+		if out, err := client.RunCommand("echo ok"); err != nil || out != "ok\n" {
+			t.Errorf("RunCommand after download = %q, %v", out, err)
+		}
+	})
+}
+
+func TestSFTPModeNeedsTwoSessions(t *testing.T) {
+	client := newTestSSHClientFor(t, &entity.Server{TransferMode: "sftp", MaxSessions: 1})
+	if _, err := client.sftpClient(); err == nil || err == errSFTPDisabled {
+		t.Fatalf("sftpClient with one session in sftp mode = %v, want an error", err)
+	}
+	if err := validateMaxSessions("sftp", 1); err == nil {
+		t.Error("sftp mode with max_sessions 1 was accepted")
+	}
+	if err := validateMaxSessions("auto", 1); err != nil {
+		t.Errorf("auto mode with max_sessions 1 was rejected: %v", err)
+	}
+}
+
+func TestNewSessionTimesOut(t *testing.T) {
+	client := newTestSSHClientFor(t, &entity.Server{TransferMode: "shell", MaxSessions: 1})
+	defer func(d time.Duration) { sessionWaitTimeout = d }(sessionWaitTimeout)
+	sessionWaitTimeout = 100 * time.Millisecond
+
+	session, err := client.newSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runWithin(t, 10*time.Second, func() {
+		if _, err := client.RunCommand("true"); err == nil {
+			t.Error("RunCommand succeeded without a free session")
+		}
+	})
+	client.closeSession(session)
+	if _, err := client.RunCommand("true"); err != nil {
+		t.Errorf("RunCommand after the session was freed: %v", err)
+	}
+}
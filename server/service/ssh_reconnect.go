@@ -0,0 +1,137 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Connections are probed with keepalive requests and closed when the server
+// stops answering, so that transfers on a dead connection fail instead of
+// hanging until TCP gives up
+const (
+	keepaliveInterval = 15 * time.Second
+	keepaliveTimeout  = 30 * time.Second
+)
+
+// maxResumeAttempts limits how often a single download reconnects and
+// resumes after the connection was lost
+const maxResumeAttempts = 5
+
+// reconnectDelay is multiplied by the attempt number before reconnecting
+var reconnectDelay = 2 * time.Second
+
+// keepAlive probes client until the connection is closed or stops answering
+func keepAlive(client *ssh.Client) {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !connectionAlive(client) {
+			client.Close()
+			return
+		}
+	}
+}
+
+// connectionAlive sends a keepalive request and waits for any reply. Servers
+// answer unknown global requests with a failure, which still proves that the
+// connection works.
+func connectionAlive(client *ssh.Client) bool {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err == nil
+	case <-time.After(keepaliveTimeout):
+		return false
+	}
+}
+
+// conn returns the current connection, which reconnect may replace
+func (c *SSHClient) conn() *ssh.Client {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.client
+}
+
+// reconnect replaces the connection lost with a new connection to the same
+// server. The SFTP client of the lost connection is dropped and started again
+// on demand. If another caller already replaced lost, nothing is done.
+func (c *SSHClient) reconnect(lost *ssh.Client) error {
+	if c.server == nil {
+		return errors.New("connection cannot be re-established")
+	}
+	if c.conn() != lost {
+		return nil
+	}
+
+	// Dial without holding the locks, which would block every other user of
+	// the client for up to the connection timeout
+	fresh, err := dialServer(c.server, c.config.Timeout)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.client != lost {
+		// Another caller reconnected while this one was dialing
+		fresh.Close()
+		return nil
+	}
+	if c.sftp != nil {
+		c.sftp.Close()
+		<-c.sessions
+	}
+	c.sftp, c.sftpErr = nil, nil
+	c.client.Close()
+	if c.jump != nil {
+		c.jump.Close()
+	}
+	c.client, c.jump = fresh.client, fresh.jump
+	log.Printf("Reconnected to %s", c.addr)
+	return nil
+}
+
+// downloadResumable downloads remotePath into the partial file of dst like
+// downloadFromRemote. If the connection is lost on the way, it reconnects and
+// continues from the size of the partial file; encrypted downloads and uploads
+// to a storage backend start over.
+// The partial file is kept on failure. It reports whether any part of the file
+// was downloaded before this attempt, either by an earlier attempt or because
+// dst started at an offset.
+func (c *SSHClient) downloadResumable(remotePath string, dst *localDestination) (bool, error) {
+	resumed := dst.offset > 0 && dst.resumable()
+	for attempt := 1; ; attempt++ {
+		client := c.conn()
+		err := c.downloadFromRemote(remotePath, dst)
+		if err == nil {
+			return resumed, nil
+		}
+		if attempt > maxResumeAttempts || connectionAlive(client) {
+			return resumed, err
+		}
+
+		log.Printf("Connection lost while downloading %s: %v, reconnecting (attempt %d/%d)", remotePath, err, attempt, maxResumeAttempts)
+		time.Sleep(time.Duration(attempt) * reconnectDelay)
+		if err := c.reconnect(client); err != nil {
+			return resumed, fmt.Errorf("connection lost while downloading %s and reconnecting failed: %v", remotePath, err)
+		}
+		if dst.resumable() {
+			if stat, err := os.Stat(partialPath(dst.path)); err == nil && stat.Size() > 0 {
+				dst.offset = stat.Size()
+				resumed = true
+				log.Printf("Resuming %s at byte %d", remotePath, dst.offset)
+			}
+		}
+	}
+}
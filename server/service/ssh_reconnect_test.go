@@ -0,0 +1,43 @@
+package service
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestReconnectReplacesLostConnectionOnce(t *testing.T) {
+	client := newTestSSHClient(t, "auto")
+	if _, err := client.sftpClient(); err != nil {
+		t.Fatal(err)
+	}
+	lost := client.conn()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.reconnect(lost); err != nil {
+				t.Errorf("reconnect: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	fresh := client.conn()
+	if fresh == lost {
+		t.Fatal("connection was not replaced")
+	}
+	if err := client.reconnect(lost); err != nil || client.conn() != fresh {
+		t.Errorf("reconnect with a replaced connection changed it again: %v", err)
+	}
+	if len(client.sessions) != 0 {
+		t.Errorf("%d session slots held after reconnecting", len(client.sessions))
+	}
+	if out, err := client.RunCommand("echo ok"); err != nil || out != "ok\n" {
+		t.Errorf("RunCommand after reconnect = %q, %v", out, err)
+	}
+	if _, err := client.sftpClient(); err != nil {
+		t.Errorf("SFTP after reconnect: %v", err)
+	}
+}
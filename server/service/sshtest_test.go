@@ -0,0 +1,150 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"backapp-server/entity"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// startTestSSHServer starts an SSH server on localhost that runs exec requests
+// with the local /bin/sh and optionally serves the SFTP subsystem. It
+// accepts any password and returns the server's address.
+func startTestSSHServer(t *testing.T, allowSFTP bool) string {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) { return nil, nil },
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSHConn(conn, config, allowSFTP)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveTestSSHConn(conn net.Conn, config *ssh.ServerConfig, allowSFTP bool) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go serveTestSSHSession(channel, requests, allowSFTP)
+	}
+}
+
+func serveTestSSHSession(channel ssh.Channel, requests <-chan *ssh.Request, allowSFTP bool) {
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go func() {
+				cmd := exec.Command("/bin/sh", "-c", payload.Command)
+				cmd.Stdin = channel
+				cmd.Stdout = channel
+				cmd.Stderr = channel.Stderr()
+				status := 0
+				if err := cmd.Run(); err != nil {
+					status = 1
+					var exitErr *exec.ExitError
+					if errors.As(err, &exitErr) {
+						status = exitErr.ExitCode()
+					}
+				}
+				code := make([]byte, 4)
+				binary.BigEndian.PutUint32(code, uint32(status))
+				channel.SendRequest("exit-status", false, code)
+				channel.Close()
+			}()
+		case "subsystem":
+			if !allowSFTP {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go func() {
+				server, err := sftp.NewServer(channel)
+				if err == nil {
+					server.Serve()
+				}
+				channel.Close()
+			}()
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// newTestSSHClient opens a database in a temporary directory and connects to
+// a new test SSH server using transferMode
+func newTestSSHClient(t *testing.T, transferMode string) *SSHClient {
+	t.Helper()
+	return newTestSSHClientFor(t, &entity.Server{TransferMode: transferMode})
+}
+
+// newTestSSHClientFor connects to a fresh test server using the settings of
+// server, which is stored in a new database first
+func newTestSSHClientFor(t *testing.T, server *entity.Server) *SSHClient {
+	t.Helper()
+	if _, err := exec.LookPath("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	InitDB(filepath.Join(t.TempDir(), "test.db"))
+	server.Name = "test"
+	server.Host = startTestSSHServer(t, server.TransferMode != "shell")
+	server.Username = "test"
+	server.AuthType = "password"
+	server.Password = "test"
+	if err := DB.Create(server).Error; err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewSSHClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
@@ -0,0 +1,230 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"backapp-server/entity"
+)
+
+// Runs are written below the staging directory of their storage location and
+// only moved into the location once they succeeded. Failed runs are moved to
+// the quarantine directory if their profile asks for it.
+const (
+	stagingDirName    = ".backapp-staging"
+	quarantineDirName = ".backapp-quarantine"
+)
+
+// Cleanup policies for the files of failed runs
+const (
+	failedRunsDelete     = "delete"
+	failedRunsKeep       = "keep"
+	failedRunsQuarantine = "quarantine"
+)
+
+// normalizeFailedRunCleanup defaults an empty cleanup policy and rejects
+// unknown ones
+func normalizeFailedRunCleanup(policy string) (string, error) {
+	switch policy {
+	case "":
+		return failedRunsDelete, nil
+	case failedRunsDelete, failedRunsKeep, failedRunsQuarantine:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unsupported failed_run_cleanup: %s", policy)
+	}
+}
+
+// stagingRoot returns the directory holding the backup directory and the
+// sidecars of a run while it is written
+func stagingRoot(basePath string, runID uint) string {
+	return filepath.Join(basePath, stagingDirName, fmt.Sprintf("run-%d", runID))
+}
+
+// rebasePath moves p from below or next to oldDir to the same place relative
+// to newDir. Sidecars like "<dir>.metadata.json" are moved along with dir.
+func rebasePath(p, oldDir, newDir string) string {
+	if p == "" || !strings.HasPrefix(p, oldDir) {
+		return p
+	}
+	return newDir + strings.TrimPrefix(p, oldDir)
+}
+
+// commitStagedRun moves a successful run from staging into the storage
+// location. The paths of the run, its files, its archive index and its
+// manifest are updated first, then every staged entry is renamed into place,
+// the backup directory or archive last. If the backup directory name is
+// already taken, the run id is appended to it.
+func commitStagedRun(run *entity.BackupRun, files []entity.BackupFile, basePath string) error {
+	stagedDir := run.LocalBackupPath
+	root := filepath.Dir(stagedDir)
+	name := filepath.Base(stagedDir)
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return fmt.Errorf("failed to read staging directory: %v", err)
+	}
+	finalName := name
+	for _, candidate := range []string{name, fmt.Sprintf("%s-run%d", name, run.ID)} {
+		finalName = candidate
+		taken := false
+		for _, entry := range entries {
+			target := filepath.Join(basePath, candidate+strings.TrimPrefix(entry.Name(), name))
+			if _, err := os.Lstat(target); err == nil {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			break
+		}
+		if candidate != name {
+			return fmt.Errorf("backup directory %s already exists", filepath.Join(basePath, candidate))
+		}
+	}
+	finalDir := filepath.Join(basePath, finalName)
+
+	for i := range files {
+		files[i].LocalPath = rebasePath(files[i].LocalPath, stagedDir, finalDir)
+	}
+	if run.ArchivePath != "" {
+		index, err := loadArchiveIndex(run.ArchivePath)
+		if err != nil {
+			return err
+		}
+		for i := range index.Files {
+			index.Files[i].LocalPath = rebasePath(index.Files[i].LocalPath, stagedDir, finalDir)
+		}
+		data, err := json.MarshalIndent(index, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(archiveIndexPath(run.ArchivePath), data); err != nil {
+			return fmt.Errorf("failed to write archive index: %v", err)
+		}
+	}
+	if run.ManifestPath != "" {
+		manifest, err := loadManifest(run.ManifestPath)
+		if err != nil {
+			return err
+		}
+		for i := range manifest.Files {
+			manifest.Files[i].LocalPath = rebasePath(manifest.Files[i].LocalPath, stagedDir, finalDir)
+		}
+		if err := writeManifest(run.ManifestPath, manifest); err != nil {
+			return err
+		}
+	}
+
+	// Sidecars first, so that the backup itself only appears complete
+	primary := filepath.Base(stagedDir)
+	if run.ArchivePath != "" {
+		primary = filepath.Base(run.ArchivePath)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[j].Name() == primary && entries[i].Name() != primary
+	})
+	for _, entry := range entries {
+		staged := filepath.Join(root, entry.Name())
+		if err := os.Rename(staged, rebasePath(staged, stagedDir, finalDir)); err != nil {
+			return fmt.Errorf("failed to move %s into place: %v", entry.Name(), err)
+		}
+	}
+	removeStagingRoot(root)
+
+	run.LocalBackupPath = finalDir
+	run.MetadataPath = rebasePath(run.MetadataPath, stagedDir, finalDir)
+	run.ArchivePath = rebasePath(run.ArchivePath, stagedDir, finalDir)
+	return nil
+}
+
+// cleanupFailedRun deletes, keeps or quarantines what a failed run left in
+// staging and returns a description of what happened for the run log
+func cleanupFailedRun(run *entity.BackupRun, policy string) (string, error) {
+	if run.LocalBackupPath == "" {
+		return "", nil
+	}
+	if backend, err := runBackend(run); err == nil {
+		defer backend.Close()
+		if !isLocalBackend(backend) {
+			return cleanupBackendRun(run, backend, policy)
+		}
+	}
+	stagedDir := run.LocalBackupPath
+	root := filepath.Dir(stagedDir)
+	if filepath.Base(filepath.Dir(root)) != stagingDirName {
+		// Not staged, nothing to clean up
+		return "", nil
+	}
+	basePath := filepath.Dir(filepath.Dir(root))
+
+	switch policy {
+	case failedRunsKeep:
+		return fmt.Sprintf("Keeping the files of the failed run in %s", root), nil
+
+	case failedRunsQuarantine:
+		dest := filepath.Join(basePath, quarantineDirName, filepath.Base(root))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return "", err
+		}
+		if err := os.Rename(root, dest); err != nil {
+			return "", fmt.Errorf("failed to quarantine %s: %v", root, err)
+		}
+		removeStagingRoot(root)
+		run.LocalBackupPath = rebasePath(run.LocalBackupPath, root, dest)
+		run.MetadataPath = rebasePath(run.MetadataPath, root, dest)
+		run.ArchivePath = rebasePath(run.ArchivePath, root, dest)
+		return fmt.Sprintf("Moved the files of the failed run to %s", dest), nil
+
+	default:
+		if run.ManifestPath != "" {
+			if _, err := deleteRunManifest(run.ManifestPath); err != nil {
+				return "", err
+			}
+			run.ManifestPath = ""
+		}
+		if err := os.RemoveAll(root); err != nil {
+			return "", fmt.Errorf("failed to remove %s: %v", root, err)
+		}
+		removeStagingRoot(root)
+		run.LocalBackupPath = ""
+		run.MetadataPath = ""
+		run.ArchivePath = ""
+		return fmt.Sprintf("Removed the files of the failed run from %s", root), nil
+	}
+}
+
+// cleanupBackendRun deletes or keeps what a failed run wrote to a backend
+// that is not staged. Such runs cannot be quarantined and are kept instead.
+func cleanupBackendRun(run *entity.BackupRun, backend storageBackend, policy string) (string, error) {
+	switch policy {
+	case failedRunsKeep:
+		return fmt.Sprintf("Keeping the files of the failed run in %s", run.LocalBackupPath), nil
+	case failedRunsQuarantine:
+		return fmt.Sprintf("Runs in this storage location cannot be quarantined, keeping the files of the failed run in %s", run.LocalBackupPath), nil
+	default:
+		if err := backend.RemoveAll(run.LocalBackupPath); err != nil {
+			return "", fmt.Errorf("failed to remove %s: %v", run.LocalBackupPath, err)
+		}
+		if run.MetadataPath != "" {
+			if err := backend.Remove(run.MetadataPath); err != nil {
+				return "", fmt.Errorf("failed to remove %s: %v", run.MetadataPath, err)
+			}
+		}
+		message := fmt.Sprintf("Removed the files of the failed run from %s", run.LocalBackupPath)
+		run.LocalBackupPath = ""
+		run.MetadataPath = ""
+		return message, nil
+	}
+}
+
+// removeStagingRoot removes the staging directory of a run and the staging
+// directory of its location once they are empty
+func removeStagingRoot(root string) {
+	os.Remove(root)
+	os.Remove(filepath.Dir(root))
+}
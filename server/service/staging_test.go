@@ -0,0 +1,281 @@
+package service
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"backapp-server/entity"
+)
+
+// stagedRunFiles are written by stageRun
+var stagedRunFiles = map[string]string{
+	"etc/app.conf": "conf",
+	"var/data.bin": "data",
+	"readme":       "readme",
+}
+
+// stageRun writes a run named name into the staging directory of base like
+// the executor does, with a metadata sidecar next to the backup directory
+func stageRun(t *testing.T, base string, runID uint, name string) (*entity.BackupRun, []entity.BackupFile) {
+	t.Helper()
+	backupDir := filepath.Join(stagingRoot(base, runID), name)
+	var files []entity.BackupFile
+	for rel, content := range stagedRunFiles {
+		localPath := filepath.Join(backupDir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(localPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, entity.BackupFile{BackupRunID: runID, LocalPath: localPath, RemotePath: "/" + rel, SizeBytes: int64(len(content))})
+	}
+	run := &entity.BackupRun{ID: runID, Status: "running", LocalBackupPath: backupDir, MetadataPath: runMetadataPath(backupDir)}
+	if err := os.WriteFile(run.MetadataPath, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return run, files
+}
+
+// checkFileContents reads every file of a run with open and compares it with
+// stagedRunFiles
+func checkFileContents(t *testing.T, files []entity.BackupFile, open func(localPath string) (io.ReadCloser, int64, error)) {
+	t.Helper()
+	for _, file := range files {
+		reader, _, err := open(file.LocalPath)
+		if err != nil {
+			t.Errorf("open %s: %v", file.LocalPath, err)
+			continue
+		}
+		content, err := io.ReadAll(reader)
+		reader.Close()
+		if want := stagedRunFiles[strings.TrimPrefix(file.RemotePath, "/")]; err != nil || string(content) != want {
+			t.Errorf("%s = %q, %v, want %q", file.LocalPath, content, err, want)
+		}
+	}
+}
+
+// checkStagingRemoved fails the test if the staging directory of base is left
+func checkStagingRemoved(t *testing.T, base string) {
+	t.Helper()
+	if _, err := os.Stat(filepath.Join(base, stagingDirName)); !os.IsNotExist(err) {
+		t.Errorf("staging directory still exists: %v", err)
+	}
+}
+
+func TestCommitStagedRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		taken   []string
+		want    string
+		wantErr bool
+	}{
+		{"free name", nil, "backup", false},
+		{"directory taken", []string{"backup/"}, "backup-run7", false},
+		{"only the sidecar taken", []string{"backup.metadata.json"}, "backup-run7", false},
+		{"both names taken", []string{"backup/", "backup-run7.metadata.json"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+			for _, taken := range tt.taken {
+				var err error
+				if dir, ok := strings.CutSuffix(taken, "/"); ok {
+					err = os.MkdirAll(filepath.Join(base, dir), 0755)
+				} else {
+					err = os.WriteFile(filepath.Join(base, taken), nil, 0644)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			run, files := stageRun(t, base, 7, "backup")
+			stagedDir := run.LocalBackupPath
+
+			err := commitStagedRun(run, files, base)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("commit succeeded although both names are taken")
+				}
+				if _, statErr := os.Stat(stagedDir); statErr != nil {
+					t.Errorf("staged files are gone after a failed commit: %v", statErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			finalDir := filepath.Join(base, tt.want)
+			if run.LocalBackupPath != finalDir || run.MetadataPath != runMetadataPath(finalDir) {
+				t.Errorf("run paths = %s, %s, want them in %s", run.LocalBackupPath, run.MetadataPath, finalDir)
+			}
+			for _, file := range files {
+				if !strings.HasPrefix(file.LocalPath, finalDir+string(filepath.Separator)) {
+					t.Errorf("file path %s was not moved to %s", file.LocalPath, finalDir)
+				}
+			}
+			checkFileContents(t, files, (&localBackend{}).Open)
+			if _, err := os.Stat(run.MetadataPath); err != nil {
+				t.Errorf("metadata sidecar was not moved: %v", err)
+			}
+			checkStagingRemoved(t, base)
+		})
+	}
+}
+
+func TestCommitStagedArchiveRun(t *testing.T) {
+	for _, taken := range []bool{false, true} {
+		base := t.TempDir()
+		if taken {
+			// Only the archive name is taken, not the directory
+			if err := os.WriteFile(filepath.Join(base, "backup.tar.gz"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		run, files := stageRun(t, base, 3, "backup")
+		archivePath, _, err := createRunArchive(run.LocalBackupPath, run.ID, files, "tar.gz", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		run.ArchivePath = archivePath
+
+		if err := commitStagedRun(run, files, base); err != nil {
+			t.Fatal(err)
+		}
+		want := "backup"
+		if taken {
+			want = "backup-run3"
+		}
+		if run.ArchivePath != filepath.Join(base, want+".tar.gz") {
+			t.Errorf("archive path = %s, want %s.tar.gz in %s", run.ArchivePath, want, base)
+		}
+		index, err := loadArchiveIndex(run.ArchivePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, entry := range index.Files {
+			if entry.LocalPath != files[i].LocalPath || !strings.HasPrefix(entry.LocalPath, filepath.Join(base, want)+string(filepath.Separator)) {
+				t.Errorf("archive index path %s, file path %s", entry.LocalPath, files[i].LocalPath)
+			}
+		}
+		checkFileContents(t, files, func(localPath string) (io.ReadCloser, int64, error) {
+			return openArchiveFile(run.ArchivePath, localPath)
+		})
+		checkStagingRemoved(t, base)
+	}
+}
+
+func TestCommitStagedDedupRun(t *testing.T) {
+	base := t.TempDir()
+	run, files := stageRun(t, base, 4, "backup")
+	stats, err := ingestRunIntoChunkStore(base, run.LocalBackupPath, run.ID, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run.ManifestPath = stats.ManifestPath
+
+	if err := commitStagedRun(run, files, base); err != nil {
+		t.Fatal(err)
+	}
+	if run.ManifestPath != stats.ManifestPath {
+		t.Errorf("manifest moved to %s", run.ManifestPath)
+	}
+	manifest, err := loadManifest(run.ManifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, file := range manifest.Files {
+		if file.LocalPath != files[i].LocalPath || !strings.HasPrefix(file.LocalPath, filepath.Join(base, "backup")+string(filepath.Separator)) {
+			t.Errorf("manifest path %s, file path %s", file.LocalPath, files[i].LocalPath)
+		}
+	}
+	checkFileContents(t, files, func(localPath string) (io.ReadCloser, int64, error) {
+		return openManifestFile(run.ManifestPath, localPath)
+	})
+	checkStagingRemoved(t, base)
+}
+
+func TestCleanupFailedRun(t *testing.T) {
+	tests := []struct {
+		policy string
+		dedup  bool
+	}{
+		{failedRunsDelete, false},
+		{failedRunsDelete, true},
+		{failedRunsKeep, false},
+		{failedRunsQuarantine, false},
+	}
+	for _, tt := range tests {
+		name := tt.policy
+		if tt.dedup {
+			name += " dedup"
+		}
+		t.Run(name, func(t *testing.T) {
+			base := t.TempDir()
+			run, files := stageRun(t, base, 5, "backup")
+			root := stagingRoot(base, run.ID)
+			if tt.dedup {
+				stats, err := ingestRunIntoChunkStore(base, run.LocalBackupPath, run.ID, files)
+				if err != nil {
+					t.Fatal(err)
+				}
+				run.ManifestPath = stats.ManifestPath
+			}
+
+			message, err := cleanupFailedRun(run, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message == "" {
+				t.Error("no message for the run log")
+			}
+
+			switch tt.policy {
+			case failedRunsDelete:
+				if run.LocalBackupPath != "" || run.MetadataPath != "" || run.ManifestPath != "" {
+					t.Errorf("paths of the deleted run are still set: %+v", run)
+				}
+				checkStagingRemoved(t, base)
+				if got := chunkCount(t, base); got != 0 {
+					t.Errorf("%d chunks of the failed run are left", got)
+				}
+			case failedRunsKeep:
+				if run.LocalBackupPath != filepath.Join(root, "backup") {
+					t.Errorf("backup path of the kept run changed to %s", run.LocalBackupPath)
+				}
+				checkFileContents(t, files, (&localBackend{}).Open)
+			case failedRunsQuarantine:
+				dest := filepath.Join(base, quarantineDirName, filepath.Base(root))
+				if run.LocalBackupPath != filepath.Join(dest, "backup") || run.MetadataPath != runMetadataPath(run.LocalBackupPath) {
+					t.Errorf("quarantined run paths = %s, %s, want them in %s", run.LocalBackupPath, run.MetadataPath, dest)
+				}
+				for i := range files {
+					files[i].LocalPath = rebasePath(files[i].LocalPath, root, dest)
+				}
+				checkFileContents(t, files, (&localBackend{}).Open)
+				if _, err := os.Stat(run.MetadataPath); err != nil {
+					t.Errorf("metadata sidecar was not quarantined: %v", err)
+				}
+				checkStagingRemoved(t, base)
+			}
+		})
+	}
+}
+
+func TestCleanupFailedRunIgnoresUnstagedRuns(t *testing.T) {
+	backupDir := filepath.Join(t.TempDir(), "backup")
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	run := &entity.BackupRun{ID: 1, LocalBackupPath: backupDir}
+	if message, err := cleanupFailedRun(run, failedRunsDelete); message != "" || err != nil {
+		t.Errorf("cleanup of an unstaged run = %q, %v", message, err)
+	}
+	if _, err := os.Stat(backupDir); err != nil {
+		t.Errorf("unstaged backup directory was removed: %v", err)
+	}
+}
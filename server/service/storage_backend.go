@@ -0,0 +1,337 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"backapp-server/entity"
+
+	"gorm.io/gorm"
+)
+
+// Storage location types
+const (
+	storageLocal  = "local"
+	storageS3     = "s3"
+	storageSFTP   = "sftp"
+	storageWebDAV = "webdav"
+)
+
+// storageBackend reads and writes the files of runs in a storage location.
+// Names are the paths files are recorded under: absolute paths on the local
+// file system, object keys for object storage.
+type storageBackend interface {
+	// Join returns the name of elem below the root of the location
+	Join(elem ...string) string
+	// Create writes name. The content only appears under name once the writer
+	// is closed without error, Abort drops it.
+	Create(name string) (storageWriter, error)
+	// Open returns the content of name and its size. The error wraps
+	// os.ErrNotExist if name does not exist.
+	Open(name string) (io.ReadCloser, int64, error)
+	// Stat returns the size of name
+	Stat(name string) (int64, error)
+	// List returns the directories and files directly below dir
+	List(dir string) ([]entity.FileSystemEntry, error)
+	// Remove deletes name, it is not an error if name does not exist
+	Remove(name string) error
+	// RemoveAll deletes dir and everything below it
+	RemoveAll(dir string) error
+	// Copy makes dst a copy of src, sharing the content where possible
+	Copy(src, dst string) error
+	// Test checks that the location can be written
+	Test() error
+	// Close releases the connection to the location
+	Close() error
+}
+
+// spaceReporter is implemented by backends that can tell how much space is
+// left in the location
+type spaceReporter interface {
+	// FreeSpace returns the bytes available below the root of the location
+	FreeSpace() (int64, error)
+}
+
+// freeSpace returns the free space of backend, or -1 if it is unknown
+func freeSpace(backend storageBackend) int64 {
+	reporter, ok := backend.(spaceReporter)
+	if !ok {
+		return -1
+	}
+	free, err := reporter.FreeSpace()
+	if err != nil || free < 0 {
+		return -1
+	}
+	return free
+}
+
+// storageWriter is a pending write into a storageBackend
+type storageWriter interface {
+	io.WriteCloser
+	// Abort drops what was written, it does nothing after Close
+	Abort()
+}
+
+// normalizeStorageType defaults an empty storage type and rejects unknown
+// ones
+func normalizeStorageType(storageType string) (string, error) {
+	switch storageType {
+	case "":
+		return storageLocal, nil
+	case storageLocal, storageS3, storageSFTP, storageWebDAV:
+		return storageType, nil
+	default:
+		return "", fmt.Errorf("unsupported storage type: %s", storageType)
+	}
+}
+
+// newStorageBackend returns the backend writing to location
+func newStorageBackend(location *entity.StorageLocation) (storageBackend, error) {
+	switch location.Type {
+	case "", storageLocal:
+		return &localBackend{basePath: location.BasePath}, nil
+	case storageS3:
+		return newS3Backend(location)
+	case storageSFTP:
+		return newSFTPBackend(location)
+	case storageWebDAV:
+		return newWebDAVBackend(location)
+	default:
+		return nil, fmt.Errorf("unsupported storage type: %s", location.Type)
+	}
+}
+
+// isLocalBackend reports whether backend writes to the local file system,
+// where runs are staged and can be archived or deduplicated
+func isLocalBackend(backend storageBackend) bool {
+	_, ok := backend.(*localBackend)
+	return ok
+}
+
+// runBackend returns the backend holding the files of run. Runs that do not
+// record their location, or whose location was deleted, are looked up on the
+// local file system. The caller closes the backend.
+func runBackend(run *entity.BackupRun) (storageBackend, error) {
+	if run.StorageLocationID == nil {
+		return &localBackend{}, nil
+	}
+	var location entity.StorageLocation
+	if err := DB.First(&location, *run.StorageLocationID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &localBackend{}, nil
+		}
+		return nil, fmt.Errorf("failed to load storage location of run %d: %v", run.ID, err)
+	}
+	return newStorageBackend(&location)
+}
+
+// backendReader closes the backend a file was opened from together with the
+// file
+type backendReader struct {
+	io.ReadCloser
+	backend storageBackend
+}
+
+func (r *backendReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.backend.Close()
+	return err
+}
+
+// backendRunDir returns the directory a run named name is written to in a
+// backend that is not staged. Like commitStagedRun, the run id is appended to
+// the name if it is taken.
+func backendRunDir(backend storageBackend, name string, runID uint) (string, error) {
+	for _, candidate := range []string{name, fmt.Sprintf("%s-run%d", name, runID)} {
+		dir := backend.Join(candidate)
+		entries, err := backend.List(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		if len(entries) > 0 {
+			continue
+		}
+		if _, err := backend.Stat(runMetadataPath(dir)); err == nil {
+			continue
+		}
+		return dir, nil
+	}
+	return "", fmt.Errorf("backup directory %s already exists", backend.Join(name))
+}
+
+// writeStorageFile writes data to name in backend
+func writeStorageFile(backend storageBackend, name string, data []byte) error {
+	w, err := backend.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// readStorageFile reads name from backend
+func readStorageFile(backend storageBackend, name string) ([]byte, error) {
+	reader, _, err := backend.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// sortEntries sorts directories first, then by name
+func sortEntries(entries []entity.FileSystemEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+}
+
+// localBackend stores runs on the local file system. Names are file paths.
+type localBackend struct {
+	basePath string
+}
+
+// localFileWriter writes to the partial path of a file and renames it into
+// place on Close
+type localFileWriter struct {
+	file *os.File
+	path string
+	done bool
+}
+
+func (w *localFileWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *localFileWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	if err := os.Rename(w.file.Name(), w.path); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *localFileWriter) Abort() {
+	if !w.done {
+		w.done = true
+		w.file.Close()
+		os.Remove(w.file.Name())
+	}
+}
+
+func (b *localBackend) Join(elem ...string) string {
+	return filepath.Join(append([]string{b.basePath}, elem...)...)
+}
+
+func (b *localBackend) Create(name string) (storageWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(partialPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return &localFileWriter{file: file, path: name}, nil
+}
+
+func (b *localBackend) Open(name string) (io.ReadCloser, int64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+func (b *localBackend) Stat(name string) (int64, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return 0, fmt.Errorf("%s is not a regular file", name)
+	}
+	return info.Size(), nil
+}
+
+func (b *localBackend) List(dir string) ([]entity.FileSystemEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]entity.FileSystemEntry, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		results = append(results, entity.FileSystemEntry{
+			Name:  entry.Name(),
+			Path:  filepath.Join(dir, entry.Name()),
+			IsDir: entry.IsDir(),
+			Size:  info.Size(),
+		})
+	}
+	sortEntries(results)
+	return results, nil
+}
+
+func (b *localBackend) Remove(name string) error {
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (b *localBackend) RemoveAll(dir string) error {
+	return os.RemoveAll(dir)
+}
+
+// Copy hard-links src to dst
+func (b *localBackend) Copy(src, dst string) error {
+	if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Link(src, dst)
+}
+
+func (b *localBackend) Test() error {
+	if err := os.MkdirAll(b.basePath, 0755); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(b.basePath, ".backapp-test-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+func (b *localBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"backapp-server/entity"
+)
+
+// newTestSFTPBackend stores into a temporary directory through a new test
+// SSH server
+func newTestSFTPBackend(t *testing.T) storageBackend {
+	t.Helper()
+	server := &entity.Server{TransferMode: "sftp"}
+	newTestSSHClientFor(t, server)
+	location := &entity.StorageLocation{Name: "sftp", Type: storageSFTP, ServerID: &server.ID, BasePath: t.TempDir()}
+	backend, err := newStorageBackend(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	return backend
+}
+
+func TestStorageBackends(t *testing.T) {
+	backends := map[string]func(t *testing.T) storageBackend{
+		"local": func(t *testing.T) storageBackend {
+			backend, err := newStorageBackend(&entity.StorageLocation{Type: storageLocal, BasePath: t.TempDir()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return backend
+		},
+		"sftp": newTestSFTPBackend,
+	}
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			testStorageBackend(t, newBackend(t))
+		})
+	}
+}
+
+// testStorageBackend checks the behavior every storageBackend has to provide
+func testStorageBackend(t *testing.T, backend storageBackend) {
+	if err := backend.Test(); err != nil {
+		t.Fatalf("Test: %v", err)
+	}
+	root := backend.Join()
+	if entries, err := backend.List(root); err != nil || len(entries) != 0 {
+		t.Errorf("List of the empty root = %v, %v, the test probe must be removed", entries, err)
+	}
+
+	file := backend.Join("run", "sub", "file.txt")
+	if err := writeStorageFile(backend, file, []byte("content")); err != nil {
+		t.Fatalf("write %s: %v", file, err)
+	}
+	if data, err := readStorageFile(backend, file); err != nil || string(data) != "content" {
+		t.Errorf("read %s = %q, %v", file, data, err)
+	}
+	reader, size, err := backend.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	if size != int64(len("content")) {
+		t.Errorf("Open size = %d", size)
+	}
+	if size, err := backend.Stat(file); err != nil || size != int64(len("content")) {
+		t.Errorf("Stat = %d, %v", size, err)
+	}
+	if _, err := backend.Stat(backend.Join("run")); err == nil {
+		t.Error("Stat of a directory succeeded")
+	}
+
+	// Overwrite in place
+	if err := writeStorageFile(backend, file, []byte("new")); err != nil {
+		t.Fatalf("overwrite %s: %v", file, err)
+	}
+	if data, err := readStorageFile(backend, file); err != nil || string(data) != "new" {
+		t.Errorf("read after overwrite = %q, %v", data, err)
+	}
+
+	// An aborted write leaves neither the file nor its partial
+	aborted := backend.Join("run", "aborted.txt")
+	writer, err := backend.Create(aborted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	writer.Abort()
+	writer.Abort()
+	if _, err := backend.Stat(aborted); err == nil {
+		t.Error("aborted write appeared")
+	}
+
+	missing := backend.Join("run", "missing")
+	if _, _, err := backend.Open(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Open of a missing file = %v, want os.ErrNotExist", err)
+	}
+	if err := backend.Remove(missing); err != nil {
+		t.Errorf("Remove of a missing file = %v", err)
+	}
+
+	copied := backend.Join("other", "copy.txt")
+	if err := backend.Copy(file, copied); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if data, err := readStorageFile(backend, copied); err != nil || string(data) != "new" {
+		t.Errorf("read copy = %q, %v", data, err)
+	}
+	if err := backend.Copy(file, copied); err != nil {
+		t.Errorf("Copy onto an existing file: %v", err)
+	}
+
+	entries, err := backend.List(backend.Join("run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, entry := range entries {
+		listed = append(listed, entry.Name)
+		if entry.Path != backend.Join("run", entry.Name) {
+			t.Errorf("List entry %s has path %s", entry.Name, entry.Path)
+		}
+	}
+	if strings.Join(listed, ",") != "sub" || !entries[0].IsDir {
+		t.Errorf("List = %v, want the directory sub only", listed)
+	}
+
+	if err := backend.RemoveAll(backend.Join("run")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Stat(file); err == nil {
+		t.Error("file exists after RemoveAll of its directory")
+	}
+	if data, err := readStorageFile(backend, copied); err != nil || string(data) != "new" {
+		t.Errorf("copy after removing the original = %q, %v", data, err)
+	}
+	if err := backend.Remove(copied); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Stat(copied); err == nil {
+		t.Error("file exists after Remove")
+	}
+}
+
+func TestBackendRunDir(t *testing.T) {
+	backends := map[string]func(t *testing.T) storageBackend{
+		"local": func(t *testing.T) storageBackend { return &localBackend{basePath: t.TempDir()} },
+		"sftp":  newTestSFTPBackend,
+	}
+	tests := []struct {
+		name    string
+		taken   []string
+		want    string
+		wantErr bool
+	}{
+		{"free name", nil, "backup", false},
+		{"empty directory", []string{"backup/"}, "backup", false},
+		{"directory with files", []string{"backup/file"}, "backup-run9", false},
+		{"only the sidecar", []string{"backup.metadata.json"}, "backup-run9", false},
+		{"both names", []string{"backup/file", "backup-run9/file"}, "", true},
+	}
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			for _, tt := range tests {
+				backend := newBackend(t)
+				for _, taken := range tt.taken {
+					if dir, ok := strings.CutSuffix(taken, "/"); ok {
+						if err := os.MkdirAll(backend.Join(dir), 0755); err != nil {
+							t.Fatal(err)
+						}
+					} else if err := writeStorageFile(backend, backend.Join(taken), nil); err != nil {
+						t.Fatal(err)
+					}
+				}
+				dir, err := backendRunDir(backend, "backup", 9)
+				if tt.wantErr {
+					if err == nil {
+						t.Errorf("%s: backendRunDir = %s, want an error", tt.name, dir)
+					}
+					continue
+				}
+				if err != nil || dir != backend.Join(tt.want) {
+					t.Errorf("%s: backendRunDir = %s, %v, want %s", tt.name, dir, err, backend.Join(tt.want))
+				}
+			}
+		})
+	}
+}
+
+func TestLocalBackendSharesCopies(t *testing.T) {
+	backend := &localBackend{basePath: t.TempDir()}
+	src := backend.Join("src")
+	dst := backend.Join("dst")
+	if err := writeStorageFile(backend, src, []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Copy(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(srcInfo, dstInfo) {
+		t.Error("local copies are not hard links")
+	}
+	if _, err := os.Stat(partialPath(src)); !os.IsNotExist(err) {
+		t.Errorf("partial file was left behind: %v", err)
+	}
+}
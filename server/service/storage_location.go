@@ -1,20 +1,101 @@
 package service
 
-import "backapp-server/entity"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"backapp-server/entity"
+)
+
+// sanitizeStorageLocation removes the secret before a location is returned to
+// clients
+func sanitizeStorageLocation(location *entity.StorageLocation) *entity.StorageLocation {
+	if location != nil {
+		location.SecretAccessKey = ""
+		location.Password = ""
+	}
+	return location
+}
 
 func ServiceListStorageLocations() ([]entity.StorageLocation, error) {
 	var locs []entity.StorageLocation
 	if err := DB.Find(&locs).Error; err != nil {
 		return nil, err
 	}
+	for i := range locs {
+		sanitizeStorageLocation(&locs[i])
+	}
 	return locs, nil
 }
 
+// normalizeStorageMode defaults an empty storage mode and rejects unknown ones
+func normalizeStorageMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return "plain", nil
+	case "plain", "dedup":
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unsupported storage mode: %s", mode)
+	}
+}
+
+// validateStorageLocation checks the fields the type of location needs. The
+// base path of object storage is cleaned into a key prefix.
+func validateStorageLocation(location *entity.StorageLocation) error {
+	switch location.Type {
+	case storageLocal:
+		if location.BasePath == "" {
+			return fmt.Errorf("base_path is required for local storage")
+		}
+	case storageS3:
+		if location.Endpoint == "" || location.Bucket == "" {
+			return fmt.Errorf("endpoint and bucket are required for s3 storage")
+		}
+		if _, _, err := parseS3Endpoint(location.Endpoint); err != nil {
+			return err
+		}
+		location.BasePath = s3Prefix(location.BasePath)
+	case storageSFTP:
+		if location.ServerID == nil || *location.ServerID == 0 {
+			return fmt.Errorf("server_id is required for sftp storage")
+		}
+		if _, err := GetServerByID(*location.ServerID); err != nil {
+			return fmt.Errorf("server %d not found", *location.ServerID)
+		}
+	case storageWebDAV:
+		if _, err := parseWebDAVEndpoint(location.Endpoint); err != nil {
+			return err
+		}
+	}
+	if location.Mode == "dedup" && location.Type != storageLocal {
+		return fmt.Errorf("dedup mode is only supported on local storage")
+	}
+	return nil
+}
+
 func ServiceCreateStorageLocation(input *entity.StorageLocation) (*entity.StorageLocation, error) {
+	mode, err := normalizeStorageMode(input.Mode)
+	if err != nil {
+		return nil, err
+	}
+	input.Mode = mode
+	if input.Type, err = normalizeStorageType(input.Type); err != nil {
+		return nil, err
+	}
+	if err := validateStorageLocation(input); err != nil {
+		return nil, err
+	}
+	if input.EncryptionKeyID, err = normalizeEncryptionKeyID(input.EncryptionKeyID); err != nil {
+		return nil, err
+	}
 	if err := DB.Create(input).Error; err != nil {
 		return nil, err
 	}
-	return input, nil
+	return sanitizeStorageLocation(input), nil
 }
 
 func ServiceUpdateStorageLocation(id uint, input *entity.StorageLocation) (*entity.StorageLocation, error) {
@@ -28,12 +109,144 @@ func ServiceUpdateStorageLocation(id uint, input *entity.StorageLocation) (*enti
 	if input.BasePath != "" {
 		location.BasePath = input.BasePath
 	}
+	if input.Mode != "" {
+		// Existing runs keep reading from where they were stored
+		mode, err := normalizeStorageMode(input.Mode)
+		if err != nil {
+			return nil, err
+		}
+		location.Mode = mode
+	}
+	if input.Type != "" {
+		storageType, err := normalizeStorageType(input.Type)
+		if err != nil {
+			return nil, err
+		}
+		location.Type = storageType
+	}
+	if input.Endpoint != "" {
+		location.Endpoint = input.Endpoint
+	}
+	if input.Region != "" {
+		location.Region = input.Region
+	}
+	if input.Bucket != "" {
+		location.Bucket = input.Bucket
+	}
+	if input.AccessKeyID != "" {
+		location.AccessKeyID = input.AccessKeyID
+	}
+	if input.ServerID != nil {
+		location.ServerID = input.ServerID
+	}
+	if input.Username != "" {
+		location.Username = input.Username
+	}
+	// Secrets are never sent to clients, empty ones keep the stored secrets
+	if input.SecretAccessKey != "" {
+		location.SecretAccessKey = input.SecretAccessKey
+	}
+	if input.Password != "" {
+		location.Password = input.Password
+	}
+	if err := validateStorageLocation(&location); err != nil {
+		return nil, err
+	}
+	if location.Type != storageLocal {
+		var count int64
+		if err := DB.Model(&entity.BackupProfile{}).Where("storage_location_id = ? AND archive_format NOT IN ?", id, []string{"", "none"}).
+			Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, fmt.Errorf("archives are only supported on local storage, %d backup profile(s) archive into this location", count)
+		}
+	}
+	if input.EncryptionKeyID != nil {
+		// 0 turns encryption off, runs already stored stay encrypted
+		keyID, err := normalizeEncryptionKeyID(input.EncryptionKeyID)
+		if err != nil {
+			return nil, err
+		}
+		location.EncryptionKeyID = keyID
+	}
 	if err := DB.Save(&location).Error; err != nil {
 		return nil, err
 	}
-	return &location, nil
+	return sanitizeStorageLocation(&location), nil
 }
 
 func ServiceDeleteStorageLocation(id string) error {
+	// Profiles, runs and copies stored in the location could not be run,
+	// browsed or restored anymore
+	references := []struct {
+		model interface{}
+		what  string
+	}{
+		{&entity.BackupProfile{}, "backup profile(s)"},
+		{&entity.BackupProfileCopyTarget{}, "backup profile copy target(s)"},
+		{&entity.BackupRun{}, "backup run(s)"},
+		{&entity.BackupRunCopy{}, "backup run copies"},
+	}
+	for _, ref := range references {
+		var count int64
+		if err := DB.Model(ref.model).Where("storage_location_id = ?", id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("storage location is used by %d %s", count, ref.what)
+		}
+	}
 	return DB.Delete(&entity.StorageLocation{}, "id = ?", id).Error
 }
+
+// locationBackend loads a storage location and returns its backend
+func locationBackend(id uint) (storageBackend, error) {
+	var location entity.StorageLocation
+	if err := DB.First(&location, id).Error; err != nil {
+		return nil, err
+	}
+	return newStorageBackend(&location)
+}
+
+// ServiceTestStorageLocation checks that the storage location can be reached
+// and written and returns its free space, -1 if the location cannot tell
+func ServiceTestStorageLocation(id uint) (int64, error) {
+	backend, err := locationBackend(id)
+	if err != nil {
+		return -1, err
+	}
+	defer backend.Close()
+	if err := backend.Test(); err != nil {
+		return -1, err
+	}
+	return freeSpace(backend), nil
+}
+
+// ServiceBrowseStorageLocation lists the directories and files directly below
+// dir, a path relative to the base path of the location. Entry paths are
+// relative to the base path as well.
+func ServiceBrowseStorageLocation(id uint, dir string) ([]entity.FileSystemEntry, error) {
+	backend, err := locationBackend(id)
+	if err != nil {
+		return nil, err
+	}
+	defer backend.Close()
+	dir = path.Clean("/" + dir)
+	root := backend.Join()
+	entries, err := backend.List(backend.Join(dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return []entity.FileSystemEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		rel := entries[i].Path
+		if root != "." {
+			rel = strings.TrimPrefix(rel, strings.TrimSuffix(root, "/"))
+		}
+		entries[i].Path = "/" + strings.TrimPrefix(rel, "/")
+	}
+	return entries, nil
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"backapp-server/entity"
+)
+
+func TestDeleteStorageLocationInUse(t *testing.T) {
+	InitDB(filepath.Join(t.TempDir(), "test.db"))
+	server := &entity.Server{Name: "server", Host: "example.com", Username: "backup", AuthType: "key"}
+	if err := DB.Create(server).Error; err != nil {
+		t.Fatal(err)
+	}
+	profile := &entity.BackupProfile{Name: "profile", ServerID: server.ID, StorageLocationID: 1, NamingRuleID: 1}
+	if err := DB.Create(profile).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		use  func(locationID uint) interface{}
+		want string
+	}{
+		{"unused", nil, ""},
+		{"backup profile", func(id uint) interface{} {
+			return &entity.BackupProfile{Name: "other", ServerID: server.ID, StorageLocationID: id, NamingRuleID: 1}
+		}, "backup profile(s)"},
+		{"copy target", func(id uint) interface{} {
+			return &entity.BackupProfileCopyTarget{BackupProfileID: profile.ID, StorageLocationID: id}
+		}, "copy target(s)"},
+		{"backup run", func(id uint) interface{} {
+			return &entity.BackupRun{BackupProfileID: profile.ID, Status: "completed", StorageLocationID: &id}
+		}, "backup run(s)"},
+		{"run copy", func(id uint) interface{} {
+			return &entity.BackupRunCopy{BackupRunID: 1, StorageLocationID: id, Status: "completed"}
+		}, "run copies"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location := &entity.StorageLocation{Name: tt.name, Type: "local", BasePath: t.TempDir()}
+			if err := DB.Create(location).Error; err != nil {
+				t.Fatal(err)
+			}
+			if tt.use != nil {
+				if err := DB.Create(tt.use(location.ID)).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := ServiceDeleteStorageLocation(fmt.Sprint(location.ID))
+			var count int64
+			DB.Model(&entity.StorageLocation{}).Where("id = ?", location.ID).Count(&count)
+			if tt.want == "" {
+				if err != nil || count != 0 {
+					t.Errorf("delete of an unused location: %v, %d left", err, count)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("delete = %v, want an error about %s", err, tt.want)
+			}
+			if count != 1 {
+				t.Error("location was deleted while in use")
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package service
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"backapp-server/entity"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// useTar decides whether a recursive directory rule is streamed as one tar.
+// Incremental runs and hosts without GNU tar fetch files one by one in auto
+// mode, the former so that unchanged files can be reused.
+func (s *FileTransferService) useTar(rule entity.FileRule) bool {
+	switch rule.TransferMode {
+	case "tar":
+		return true
+	case "files":
+		return false
+	default:
+		if s.options.IncrementalMode != "off" && s.options.Previous != nil {
+			return false
+		}
+		return s.sshClient.hasGNUTar()
+	}
+}
+
+// hasGNUTar reports whether the remote tar and find are the GNU versions. The
+// tar transfer relies on their options (find -print0, tar --null -T - -h,
+// --exclude), BusyBox and BSD hosts fetch files one by one instead.
+func (c *SSHClient) hasGNUTar() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gnuTar == nil {
+		output, _ := c.RunCommand(`tar --version 2>/dev/null | grep -q 'GNU tar' && find --version 2>/dev/null | grep -q 'GNU findutils' && echo gnu`)
+		gnu := strings.TrimSpace(output) == "gnu"
+		c.gnuTar = &gnu
+	}
+	return *c.gnuTar
+}
+
+// transferDirectoryTar streams a directory with a single remote tar command
+// and unpacks it into the destination directory
+func (s *FileTransferService) transferDirectoryTar(rule entity.FileRule, filter *fileFilter) ([]entity.BackupFile, error) {
+	s.logToDatabase("INFO", fmt.Sprintf("Streaming directory as tar: %s", rule.RemotePath))
+
+	var cmd string
+	if rule.SymlinkPolicy == symlinksFollow {
+		// tar -h walks into symlink loops until the path gets too long, find
+		// -L detects them, so find lists what tar archives. Dangling symlinks are
+		// still of type l with -L and left out. Excluded trees are pruned by
+		// find, tar takes no options after -T.
+		find := "find -L . -mindepth 1"
+		if prune := filter.FindPruneArgs("."); prune != "" {
+			find += " " + prune
+		}
+		cmd = "cd " + shellQuote(optionSafePath(rule.RemotePath)) + " && " + find + " ! -type l -print0 | tar -cf - -h --null --no-recursion -T -"
+	} else {
+		cmd = "tar -cf -"
+		if excludes := filter.TarExcludeArgs(); excludes != "" {
+			cmd += " " + excludes
+		}
+		cmd += " -C " + shellQuote(rule.RemotePath) + " ."
+	}
+
+	remoteSums := func() (map[string]string, error) {
+		return s.sshClient.RemoteChecksums(rule.RemotePath, s.options.ChecksumAlgorithm)
+	}
+	return s.streamTar(rule, filter, cmd, remoteSums, true)
+}
+
+// streamTar runs cmd, which prints a tar of the files below rule.RemotePath,
+// and unpacks it. remoteSums computes the remote checksums of the files for
+// VerifyChecksums; refetch allows downloading mismatching files again one by
+// one.
+func (s *FileTransferService) streamTar(rule entity.FileRule, filter *fileFilter, cmd string, remoteSums func() (map[string]string, error), refetch bool) ([]entity.BackupFile, error) {
+	stream, err := s.sshClient.StreamCommand(cmd)
+	if err != nil {
+		s.logToDatabase("ERROR", fmt.Sprintf("Failed to start tar for %s: %v", rule.RemotePath, err))
+		return nil, fmt.Errorf("failed to start tar: %v", err)
+	}
+	defer stream.Close()
+
+	backupFiles, err := s.extractTar(stream, rule, filter)
+	if err != nil {
+		s.logToDatabase("ERROR", fmt.Sprintf("Failed to unpack tar stream of %s: %v", rule.RemotePath, err))
+		return nil, fmt.Errorf("failed to unpack tar stream: %v", err)
+	}
+
+	if err := stream.Wait(); err != nil {
+		// GNU tar exits with 1 if files changed while being read, the
+		// archive is still complete in that case
+		var exitErr *ssh.ExitError
+		switch {
+		case errors.As(err, &exitErr) && exitErr.ExitStatus() == 1:
+			s.logToDatabase("WARNING", fmt.Sprintf("tar reported changed files in %s: %v", rule.RemotePath, err))
+		case s.options.ErrorPolicy != "" && s.options.ErrorPolicy != errorPolicyStop:
+			// tar still archives everything else if single files are
+			// unreadable, so those are skipped
+			if backupFiles, err = s.skipTarFailures(rule, backupFiles, stream.Stderr(), err); err != nil {
+				return nil, err
+			}
+		default:
+			s.logToDatabase("ERROR", fmt.Sprintf("tar failed for %s: %v", rule.RemotePath, err))
+			return nil, fmt.Errorf("tar failed: %v", err)
+		}
+	}
+
+	s.logToDatabase("INFO", fmt.Sprintf("Unpacked %d files from tar stream", len(backupFiles)))
+
+	if s.options.VerifyChecksums {
+		if err := s.verifyTarChecksums(rule, backupFiles, remoteSums, refetch); err != nil {
+			return nil, err
+		}
+	}
+	return backupFiles, nil
+}
+
+// skipTarFailures records the files tar could not read as failed and drops
+// them from backupFiles, tar pads files with read errors with zeros. waitErr
+// is returned if tar failed for any other reason.
+func (s *FileTransferService) skipTarFailures(rule entity.FileRule, backupFiles []entity.BackupFile, stderr string, waitErr error) ([]entity.BackupFile, error) {
+	failed, ok := tarFileErrors(stderr)
+	if !ok {
+		s.logToDatabase("ERROR", fmt.Sprintf("tar failed for %s: %v", rule.RemotePath, waitErr))
+		return nil, fmt.Errorf("tar failed: %v", waitErr)
+	}
+
+	relPaths := make([]string, 0, len(failed))
+	for relPath := range failed {
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+
+	failedPaths := make(map[string]bool, len(failed))
+	for _, relPath := range relPaths {
+		message := failed[relPath]
+		remotePath := path.Join(rule.RemotePath, strings.TrimPrefix(path.Clean(relPath), "./"))
+		failedPaths[remotePath] = true
+		if err := s.fileFailed(rule, remotePath, errors.New(message)); err != nil {
+			s.logToDatabase("ERROR", fmt.Sprintf("tar failed for %s: %v", rule.RemotePath, err))
+			return nil, err
+		}
+	}
+
+	kept := backupFiles[:0]
+	for _, file := range backupFiles {
+		if failedPaths[file.RemotePath] {
+			s.storage().Remove(file.LocalPath)
+			continue
+		}
+		kept = append(kept, file)
+	}
+	s.dropMetadata(failedPaths)
+	return kept, nil
+}
+
+// verifyTarChecksums compares the checksums of files unpacked from a tar
+// stream with checksums computed remotely in one command. Mismatching files
+// are downloaded again one by one if refetch is set.
+func (s *FileTransferService) verifyTarChecksums(rule entity.FileRule, backupFiles []entity.BackupFile, computeRemoteSums func() (map[string]string, error), refetch bool) error {
+	remoteSums, err := computeRemoteSums()
+	if err != nil {
+		s.logToDatabase("ERROR", fmt.Sprintf("Failed to verify checksums of %s: %v", rule.RemotePath, err))
+		return err
+	}
+
+	for i := range backupFiles {
+		file := &backupFiles[i]
+		remote, ok := remoteSums[file.RemotePath]
+		if ok && remote == file.Checksum {
+			continue
+		}
+		mismatch := &ChecksumMismatchError{Path: file.RemotePath, Local: file.Checksum, Remote: remote}
+		if s.options.ChecksumRetries == 0 || !refetch {
+			s.logToDatabase("ERROR", mismatch.Error())
+			return mismatch
+		}
+		s.logToDatabase("WARNING", fmt.Sprintf("%v, downloading it again", mismatch))
+		checksum, err := s.downloadFile(RemoteFileInfo{Path: file.RemotePath}, file.LocalPath, nil)
+		if err != nil {
+			s.logToDatabase("ERROR", fmt.Sprintf("Failed to copy file %s: %v", file.RemotePath, err))
+			return fmt.Errorf("failed to copy file %s: %v", file.RemotePath, err)
+		}
+		file.Checksum = checksum
+		if size, err := s.storage().Stat(file.LocalPath); err == nil && s.options.Cipher == nil {
+			file.SizeBytes = size
+			file.FileSize = size
+		}
+	}
+	return nil
+}
+
+// extractTar unpacks the regular files and directories filter matches from r
+// into the destination directory and returns a BackupFile per unpacked file.
+// Symlinks are recorded in the metadata when the rule copies them.
+func (s *FileTransferService) extractTar(r io.Reader, rule entity.FileRule, filter *fileFilter) ([]entity.BackupFile, error) {
+	var backupFiles []entity.BackupFile
+	// Directories and symlinks are recorded once the whole tree is known
+	var entries []RemoteFileInfo
+	// Index of the backup file of every unpacked path, for hard links
+	unpacked := make(map[string]int)
+	reader := tar.NewReader(r)
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		relPath := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		if relPath == "." {
+			continue
+		}
+		if path.IsAbs(relPath) || relPath == ".." || strings.HasPrefix(relPath, "../") {
+			s.logToDatabase("WARNING", fmt.Sprintf("Skipping tar entry outside of the backup directory: %s", header.Name))
+			continue
+		}
+
+		remotePath := path.Join(rule.RemotePath, relPath)
+		localPath := filepath.Join(s.destDir, filepath.FromSlash(relPath))
+		info := RemoteFileInfo{
+			Path:       remotePath,
+			Size:       header.Size,
+			Mode:       header.FileInfo().Mode(),
+			ModTime:    header.ModTime,
+			Uid:        header.Uid,
+			Gid:        header.Gid,
+			LinkTarget: header.Linkname,
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if !filter.Excluded(relPath, true) {
+				entries = append(entries, info)
+			}
+
+		case tar.TypeSymlink:
+			if rule.SymlinkPolicy == symlinksCopy && filter.Matches(relPath) {
+				entries = append(entries, info)
+			}
+
+		case tar.TypeReg, tar.TypeLink:
+			if !filter.Matches(relPath) {
+				continue
+			}
+			if err := s.mkdirAll(filepath.Dir(localPath)); err != nil {
+				return nil, fmt.Errorf("failed to create directory: %v", err)
+			}
+
+			var file entity.BackupFile
+			if header.Typeflag == tar.TypeLink {
+				// A further name of a file unpacked before
+				target, ok := unpacked[path.Clean(strings.TrimPrefix(header.Linkname, "./"))]
+				if !ok {
+					s.logToDatabase("WARNING", fmt.Sprintf("Skipping hard link %s to a file that was not unpacked: %s", remotePath, header.Linkname))
+					continue
+				}
+				s.progress.addTotal(1, 0)
+				s.progress.filesDone.Add(1)
+				file = backupFiles[target]
+				if err := s.storage().Copy(file.LocalPath, localPath); err != nil {
+					return nil, fmt.Errorf("failed to link %s: %v", localPath, err)
+				}
+				info.Size = file.SizeBytes
+				info.Mode = info.Mode &^ os.ModeType
+			} else {
+				sum, err := newChecksum(s.options.ChecksumAlgorithm)
+				if err != nil {
+					return nil, err
+				}
+				// The size of a tar stream is only known entry by entry
+				s.progress.addTotal(1, header.Size)
+				progress := s.progress.file(header.Size)
+				err = writeTarEntry(reader, s.newDestination(localPath, sum, progress))
+				progress.finish()
+				if err != nil {
+					return nil, fmt.Errorf("failed to write %s: %v", localPath, err)
+				}
+				s.applyMetadata(localPath, info)
+				file = entity.BackupFile{
+					SizeBytes:         header.Size,
+					FileSize:          header.Size,
+					Checksum:          hex.EncodeToString(sum.Sum(nil)),
+					ChecksumAlgorithm: s.options.ChecksumAlgorithm,
+					FileRuleID:        rule.ID,
+				}
+			}
+
+			modTime := header.ModTime
+			file.RemotePath = remotePath
+			file.LocalPath = localPath
+			file.ModTime = &modTime
+			unpacked[relPath] = len(backupFiles)
+			backupFiles = append(backupFiles, file)
+			entries = append(entries, info)
+
+		default:
+			// Special files are skipped, like find -type f does
+			continue
+		}
+	}
+
+	for _, entry := range filterTree(rule.RemotePath, entries, filter) {
+		if entry.IsDir() {
+			localPath := filepath.Join(s.destDir, filepath.FromSlash(relativeRemotePath(rule.RemotePath, entry.Path)))
+			if err := s.mkdirAll(localPath); err != nil {
+				return nil, fmt.Errorf("failed to create directory: %v", err)
+			}
+		}
+		s.metadata = append(s.metadata, remoteMetadata(entry))
+	}
+	return backupFiles, nil
+}
+
+// writeTarEntry writes the content of the current tar entry to dst
+func writeTarEntry(reader *tar.Reader, dst *localDestination) error {
+	localFile, err := dst.open(0)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(localFile, reader); err != nil {
+		localFile.Close()
+		dst.discard()
+		return err
+	}
+	if err := localFile.Close(); err != nil {
+		dst.discard()
+		return err
+	}
+	return dst.commit()
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"backapp-server/entity"
+)
+
+func TestTarFollowSymlinksWithExcludes(t *testing.T) {
+	for _, name := range []string{"tar", "find"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skip("no " + name)
+		}
+	}
+	root := t.TempDir()
+	target := t.TempDir()
+	for rel, content := range map[string]string{
+		"keep.txt":        "keep",
+		"skip.tmp":        "tmp",
+		"logs/app.log":    "log",
+		"sub/keep.txt":    "sub",
+		"sub/cache/a.bin": "cache",
+	} {
+		file := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(target, "linked.txt"), []byte("linked"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestSSHClient(t, "shell")
+
+	rule := entity.FileRule{
+		ID:             1,
+		RemotePath:     root,
+		Recursive:      true,
+		TransferMode:   "tar",
+		SymlinkPolicy:  symlinksFollow,
+		ExcludePattern: "*.tmp\nlogs/\n/sub/cache",
+	}
+	files, err := NewFileTransferService(client, t.TempDir(), 0, TransferOptions{Concurrency: 1}).TransferFiles([]entity.FileRule{rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, file := range files {
+		got = append(got, strings.TrimPrefix(file.RemotePath, root+"/"))
+	}
+	sort.Strings(got)
+	want := []string{"keep.txt", "link/linked.txt", "sub/keep.txt"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("transferred %v, want %v", got, want)
+	}
+}
+
+func TestTarAutoModeNeedsGNUTools(t *testing.T) {
+	out, err := exec.Command("/bin/sh", "-c", "tar --version; find --version").Output()
+	if err != nil || !strings.Contains(string(out), "GNU tar") || !strings.Contains(string(out), "GNU findutils") {
+		t.Skip("no GNU tar and find")
+	}
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file.txt"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rule := entity.FileRule{ID: 1, RemotePath: root, Recursive: true, TransferMode: "auto", SymlinkPolicy: symlinksFollow, ExcludePattern: "*.tmp"}
+
+	for _, gnu := range []bool{true, false} {
+		client := newTestSSHClient(t, "shell")
+		if !gnu {
+			// A tar that is not GNU tar, like BusyBox's
+			bin := t.TempDir()
+			if err := os.WriteFile(filepath.Join(bin, "tar"), []byte("#!/bin/sh\necho 'tar (busybox)'\nexit 1\n"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+		}
+		service := NewFileTransferService(client, t.TempDir(), 0, TransferOptions{Concurrency: 1})
+		if got := service.useTar(rule); got != gnu {
+			t.Errorf("useTar with GNU tools %v = %v", gnu, got)
+		}
+		files, err := service.TransferFiles([]entity.FileRule{rule})
+		if err != nil {
+			t.Fatalf("transfer with GNU tools %v: %v", gnu, err)
+		}
+		if len(files) != 1 {
+			t.Errorf("transferred %d files with GNU tools %v, want 1", len(files), gnu)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package service
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backapp-server/entity"
+)
+
+// webdavBackend stores runs on a WebDAV share like Nextcloud. Names are
+// slash separated paths below the endpoint URL.
+type webdavBackend struct {
+	client   *http.Client
+	endpoint *url.URL
+	username string
+	password string
+	basePath string
+	// dirs holds the collections known to exist
+	dirs sync.Map
+}
+
+// webdavPropfind asks for the properties List, Stat and FreeSpace need
+const webdavPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:quota-available-bytes/></d:prop></d:propfind>`
+
+// webdavMultistatus is the answer to a PROPFIND request
+type webdavMultistatus struct {
+	Responses []struct {
+		Href      string `xml:"href"`
+		Propstats []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength  string `xml:"getcontentlength"`
+				QuotaAvailable string `xml:"quota-available-bytes"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// webdavResource is a file or collection of a PROPFIND answer
+type webdavResource struct {
+	name  string
+	isDir bool
+	size  int64
+	// free is the quota-available-bytes of the resource, -1 if unknown
+	free int64
+}
+
+func newWebDAVBackend(location *entity.StorageLocation) (*webdavBackend, error) {
+	endpoint, err := parseWebDAVEndpoint(location.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &webdavBackend{
+		client:   &http.Client{},
+		endpoint: endpoint,
+		username: location.Username,
+		password: location.Password,
+		basePath: path.Clean("/" + location.BasePath),
+	}, nil
+}
+
+// parseWebDAVEndpoint checks that endpoint is an http or https URL
+func parseWebDAVEndpoint(endpoint string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid webdav endpoint: %s", endpoint)
+	}
+	return u, nil
+}
+
+// url returns the URL of name, escaping every path segment
+func (b *webdavBackend) url(name string) string {
+	segments := strings.Split(strings.Trim(name, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	u := *b.endpoint
+	u.RawQuery = ""
+	return strings.TrimSuffix(u.String(), "/") + "/" + strings.Join(segments, "/")
+}
+
+// do sends a request for name and returns the response if its status is one
+// of ok. Missing resources are reported as os.ErrNotExist.
+func (b *webdavBackend) do(method, name string, body io.Reader, header http.Header, ok ...int) (*http.Response, error) {
+	req, err := http.NewRequest(method, b.url(name), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if b.username != "" || b.password != "" {
+		req.SetBasicAuth(b.username, b.password)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return nil, fmt.Errorf("%s %s failed: %s %s", method, name, resp.Status, strings.TrimSpace(string(message)))
+}
+
+// propfind returns the resources of name at depth 0 (name itself) or 1 (name
+// and its children)
+func (b *webdavBackend) propfind(name string, depth int) ([]webdavResource, error) {
+	header := http.Header{
+		"Depth":        {strconv.Itoa(depth)},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	}
+	resp, err := b.do("PROPFIND", name, strings.NewReader(webdavPropfind), header, http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var status webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("invalid PROPFIND response for %s: %v", name, err)
+	}
+
+	root := strings.TrimSuffix(b.endpoint.Path, "/")
+	resources := make([]webdavResource, 0, len(status.Responses))
+	for _, response := range status.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			continue
+		}
+		resource := webdavResource{name: path.Clean("/" + strings.TrimPrefix(href.Path, root)), free: -1}
+		for _, propstat := range response.Propstats {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			prop := propstat.Prop
+			if prop.ResourceType.Collection != nil {
+				resource.isDir = true
+			}
+			if size, err := strconv.ParseInt(prop.ContentLength, 10, 64); err == nil {
+				resource.size = size
+			}
+			if free, err := strconv.ParseInt(prop.QuotaAvailable, 10, 64); err == nil {
+				resource.free = free
+			}
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+// mkdirAll creates dir and its parents with MKCOL
+func (b *webdavBackend) mkdirAll(dir string) error {
+	dir = path.Clean("/" + dir)
+	if _, ok := b.dirs.Load(dir); ok || dir == "/" {
+		return nil
+	}
+	if resources, err := b.propfind(dir, 0); err != nil || len(resources) == 0 || !resources[0].isDir {
+		if err := b.mkdirAll(path.Dir(dir)); err != nil {
+			return err
+		}
+		// 405 means the collection exists already
+		resp, err := b.do("MKCOL", dir, nil, nil, http.StatusCreated, http.StatusMethodNotAllowed)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	b.dirs.Store(dir, true)
+	return nil
+}
+
+// webdavWriter streams a PUT request to the partial path of a file and moves
+// it into place on Close
+type webdavWriter struct {
+	backend *webdavBackend
+	name    string
+	partial string
+	pipe    *io.PipeWriter
+	result  chan error
+	done    bool
+}
+
+// errUploadAborted ends the body of an aborted upload
+var errUploadAborted = errors.New("upload aborted")
+
+func (b *webdavBackend) Join(elem ...string) string {
+	return path.Join(append([]string{b.basePath}, elem...)...)
+}
+
+func (b *webdavBackend) Create(name string) (storageWriter, error) {
+	if err := b.mkdirAll(path.Dir(name)); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %v", path.Dir(name), err)
+	}
+	reader, pipe := io.Pipe()
+	w := &webdavWriter{backend: b, name: name, partial: partialPath(name), pipe: pipe, result: make(chan error, 1)}
+	go func() {
+		resp, err := b.do(http.MethodPut, w.partial, reader, nil, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+		if err == nil {
+			resp.Body.Close()
+			reader.Close()
+		} else {
+			// Unblock writes if the request failed early
+			reader.CloseWithError(err)
+		}
+		w.result <- err
+	}()
+	return w, nil
+}
+
+func (w *webdavWriter) Write(p []byte) (int, error) {
+	return w.pipe.Write(p)
+}
+
+func (w *webdavWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.pipe.Close()
+	if err := <-w.result; err != nil {
+		w.backend.Remove(w.partial)
+		return fmt.Errorf("failed to upload %s: %v", w.name, err)
+	}
+	if err := w.backend.move(w.partial, w.name); err != nil {
+		w.backend.Remove(w.partial)
+		return err
+	}
+	return nil
+}
+
+func (w *webdavWriter) Abort() {
+	if !w.done {
+		w.done = true
+		w.pipe.CloseWithError(errUploadAborted)
+		<-w.result
+		w.backend.Remove(w.partial)
+	}
+}
+
+// move renames src to dst, replacing dst
+func (b *webdavBackend) move(src, dst string) error {
+	return b.transfer("MOVE", src, dst)
+}
+
+// transfer sends a MOVE or COPY request from src to dst
+func (b *webdavBackend) transfer(method, src, dst string) error {
+	header := http.Header{"Destination": {b.url(dst)}, "Overwrite": {"T"}}
+	resp, err := b.do(method, src, nil, header, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *webdavBackend) Open(name string) (io.ReadCloser, int64, error) {
+	resp, err := b.do(http.MethodGet, name, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (b *webdavBackend) Stat(name string) (int64, error) {
+	resources, err := b.propfind(name, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(resources) == 0 || resources[0].isDir {
+		return 0, fmt.Errorf("%s is not a regular file", name)
+	}
+	return resources[0].size, nil
+}
+
+func (b *webdavBackend) List(dir string) ([]entity.FileSystemEntry, error) {
+	resources, err := b.propfind(dir, 1)
+	if err != nil {
+		return nil, err
+	}
+	dir = path.Clean("/" + dir)
+	results := make([]entity.FileSystemEntry, 0, len(resources))
+	for _, resource := range resources {
+		// The answer includes dir itself
+		if resource.name == dir {
+			continue
+		}
+		results = append(results, entity.FileSystemEntry{
+			Name:  path.Base(resource.name),
+			Path:  resource.name,
+			IsDir: resource.isDir,
+			Size:  resource.size,
+		})
+	}
+	sortEntries(results)
+	return results, nil
+}
+
+func (b *webdavBackend) Remove(name string) error {
+	resp, err := b.do(http.MethodDelete, name, nil, nil, http.StatusOK, http.StatusNoContent)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// RemoveAll deletes dir, DELETE on a collection removes its members as well
+func (b *webdavBackend) RemoveAll(dir string) error {
+	if path.Clean("/"+dir) == "/" {
+		return fmt.Errorf("refusing to remove the whole share")
+	}
+	b.dirs.Clear()
+	return b.Remove(dir)
+}
+
+// Copy copies src to dst on the server
+func (b *webdavBackend) Copy(src, dst string) error {
+	if err := b.mkdirAll(path.Dir(dst)); err != nil {
+		return err
+	}
+	return b.transfer("COPY", src, dst)
+}
+
+func (b *webdavBackend) Test() error {
+	if err := b.mkdirAll(b.basePath); err != nil {
+		return fmt.Errorf("failed to create %s: %v", b.basePath, err)
+	}
+	probe := b.Join(fmt.Sprintf(".backapp-test-%d", time.Now().UnixNano()))
+	if err := writeStorageFile(b, probe, []byte("backapp")); err != nil {
+		return err
+	}
+	return b.Remove(probe)
+}
+
+// FreeSpace reads the quota-available-bytes property (RFC 4331). Servers
+// without a quota report a negative value or none.
+func (b *webdavBackend) FreeSpace() (int64, error) {
+	resources, err := b.propfind(b.basePath, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(resources) == 0 || resources[0].free < 0 {
+		return -1, nil
+	}
+	return resources[0].free, nil
+}
+
+func (b *webdavBackend) Close() error {
+	b.client.CloseIdleConnections()
+	return nil
+}
@@ -1,4 +1,4 @@
-import type { BackupProfile, BackupProfileCreateInput, BackupProfileUpdateInput } from '../types/backup-profile';
+import type { BackupProfile, BackupProfileCreateInput, BackupProfileUpdateInput, RetentionPlan } from '../types/backup-profile';
 import { fetchJSON, fetchWithoutResponse } from './client';
 
 export const backupProfileApi = {
@@ -59,4 +59,14 @@ export const backupProfileApi = {
       method: 'POST',
     });
   },
+
+  async previewRetention(id: number): Promise<RetentionPlan> {
+    return fetchJSON<RetentionPlan>(`/backup-profiles/${id}/retention/preview`);
+  },
+
+  async applyRetention(id: number): Promise<RetentionPlan> {
+    return fetchJSON<RetentionPlan>(`/backup-profiles/${id}/retention/apply`, {
+      method: 'POST',
+    });
+  },
 };
@@ -1,4 +1,11 @@
-import type { BackupRun } from '../types/backup-run';
+import type {
+  BackupRun,
+  BackupRunBulkDeleteResult,
+  BackupRunCopy,
+  BackupRunEntry,
+  BackupRunProgress,
+  BackupRunRestoreResult,
+} from '../types/backup-run';
 import type { BackupFile } from '../types/backup-file';
 import type { BackupRunLog } from '../types/backup-run-log';
 import { fetchJSON } from './client';
@@ -30,8 +37,43 @@ export const backupRunApi = {
     return fetchJSON<BackupRunLog[]>(`/backup-runs/${id}/logs`);
   },
 
-  async delete(id: number): Promise<boolean> {
-    await fetchJSON(`/backup-runs/${id}`, { method: 'DELETE' });
+  async getProgress(id: number): Promise<BackupRunProgress> {
+    return fetchJSON<BackupRunProgress>(`/backup-runs/${id}/progress`);
+  },
+
+  async browse(id: number, path = '/'): Promise<BackupRunEntry[]> {
+    return fetchJSON<BackupRunEntry[]>(`/backup-runs/${id}/browse?path=${encodeURIComponent(path)}`);
+  },
+
+  async restore(id: number, targetPath: string): Promise<BackupRunRestoreResult> {
+    return fetchJSON<BackupRunRestoreResult>(`/backup-runs/${id}/restore`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ target_path: targetPath }),
+    });
+  },
+
+  async retryCopies(id: number): Promise<BackupRunCopy[]> {
+    return fetchJSON<BackupRunCopy[]>(`/backup-runs/${id}/copies/retry`, {
+      method: 'POST',
+    });
+  },
+
+  async delete(id: number, keepFiles = false): Promise<boolean> {
+    const url = keepFiles ? `/backup-runs/${id}?keep_files=true` : `/backup-runs/${id}`;
+    await fetchJSON(url, { method: 'DELETE' });
     return true;
   },
+
+  async bulkDelete(ids: number[], keepFiles = false): Promise<BackupRunBulkDeleteResult> {
+    return fetchJSON<BackupRunBulkDeleteResult>('/backup-runs/bulk-delete', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ run_ids: ids, keep_files: keepFiles }),
+    });
+  },
 };
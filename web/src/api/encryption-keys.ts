@@ -0,0 +1,34 @@
+import type { EncryptionKey, EncryptionKeyCreateInput, EncryptionKeyRotateInput } from '../types/encryption-key';
+import { fetchJSON, fetchWithoutResponse } from './client';
+
+export const encryptionKeyApi = {
+  async list(): Promise<EncryptionKey[]> {
+    return fetchJSON<EncryptionKey[]>('/encryption-keys');
+  },
+
+  async create(data: EncryptionKeyCreateInput): Promise<EncryptionKey> {
+    return fetchJSON<EncryptionKey>('/encryption-keys', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify(data),
+    });
+  },
+
+  async rotate(id: number, data: EncryptionKeyRotateInput): Promise<EncryptionKey> {
+    return fetchJSON<EncryptionKey>(`/encryption-keys/${id}/rotate`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify(data),
+    });
+  },
+
+  async delete(id: number): Promise<boolean> {
+    return fetchWithoutResponse(`/encryption-keys/${id}`, {
+      method: 'DELETE',
+    });
+  },
+};
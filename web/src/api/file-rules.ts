@@ -1,4 +1,4 @@
-import type { FileRule, FileRuleCreateInput, FileRuleUpdateInput } from '../types/file-rule';
+import type { FileRule, FileRuleCreateInput, FileRulePreview, FileRuleUpdateInput } from '../types/file-rule';
 import { fetchJSON, fetchWithoutResponse } from './client';
 
 export const fileRuleApi = {
@@ -26,6 +26,20 @@ export const fileRuleApi = {
     });
   },
 
+  async preview(id: number): Promise<FileRulePreview> {
+    return fetchJSON<FileRulePreview>(`/file-rules/${id}/preview`);
+  },
+
+  async previewUnsaved(serverId: number, data: FileRuleCreateInput): Promise<FileRulePreview> {
+    return fetchJSON<FileRulePreview>(`/servers/${serverId}/file-rules/preview`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify(data),
+    });
+  },
+
   async delete(id: number): Promise<boolean> {
     return fetchWithoutResponse(`/file-rules/${id}`, {
       method: 'DELETE',
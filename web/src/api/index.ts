@@ -6,3 +6,4 @@ export { fileRuleApi } from './file-rules';
 export { backupProfileApi } from './backup-profiles';
 export { backupRunApi } from './backup-runs';
 export { fileExplorerApi } from './file-explorer';
+export { encryptionKeyApi } from './encryption-keys';
@@ -1,4 +1,4 @@
-import type { Server, ServerCreateInput } from '../types/server';
+import type { DockerInventory, Server, ServerCreateInput, ServerHostKey } from '../types/server';
 import { fetchJSON, fetchWithoutResponse } from './client';
 
 export const serverApi = {
@@ -38,4 +38,32 @@ export const serverApi = {
       method: 'POST',
     });
   },
+
+  async listDocker(id: number): Promise<DockerInventory> {
+    const response = await fetchJSON<DockerInventory>(`/servers/${id}/docker`);
+    if (response.error) {
+      throw new Error(response.error);
+    }
+    return response;
+  },
+
+  async getHostKey(id: number): Promise<ServerHostKey> {
+    return fetchJSON<ServerHostKey>(`/servers/${id}/host-key`);
+  },
+
+  async approveHostKey(id: number, fingerprint?: string): Promise<ServerHostKey> {
+    return fetchJSON<ServerHostKey>(`/servers/${id}/host-key/approve`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ fingerprint }),
+    });
+  },
+
+  async resetHostKey(id: number): Promise<boolean> {
+    return fetchWithoutResponse(`/servers/${id}/host-key`, {
+      method: 'DELETE',
+    });
+  },
 };
@@ -1,4 +1,5 @@
 import type { StorageLocation, StorageLocationCreateInput } from '../types/storage-location';
+import type { FileSystemEntry } from './file-explorer';
 import { fetchJSON, fetchWithoutResponse } from './client';
 
 export const storageLocationApi = {
@@ -31,4 +32,19 @@ export const storageLocationApi = {
       method: 'DELETE',
     });
   },
+
+  async testConnection(id: number): Promise<{ success: boolean; message: string; free_bytes?: number }> {
+    return fetchJSON<{ success: boolean; message: string; free_bytes?: number }>(`/storage-locations/${id}/test-connection`, {
+      method: 'POST',
+    });
+  },
+
+  async browse(id: number, path?: string): Promise<FileSystemEntry[]> {
+    const params = new URLSearchParams();
+    if (path) {
+      params.append('path', path);
+    }
+    const queryString = params.toString();
+    return fetchJSON<FileSystemEntry[]>(`/storage-locations/${id}/browse${queryString ? '?' + queryString : ''}`);
+  },
 };
@@ -38,6 +38,8 @@ function BackupProfileInfoGrid({ profile }: BackupProfileInfoGridProps) {
     switch (status) {
       case 'completed':
         return <SuccessIcon fontSize="small" color="success" />;
+      case 'partial':
+        return <SuccessIcon fontSize="small" color="warning" />;
       case 'failed':
         return <ErrorIcon fontSize="small" color="error" />;
       case 'running':
@@ -51,6 +53,8 @@ function BackupProfileInfoGrid({ profile }: BackupProfileInfoGridProps) {
     switch (status) {
       case 'completed':
         return 'success';
+      case 'partial':
+        return 'warning';
       case 'failed':
         return 'error';
       case 'running':
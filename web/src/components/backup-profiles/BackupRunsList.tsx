@@ -167,7 +167,7 @@ function BackupRunsList({ runs }: BackupRunsListProps) {
                       size="small"
                       onClick={async (e) => {
                         e.stopPropagation();
-                        if (!confirm(`Delete backup run #${run.id}? This will remove its records.`)) return;
+                        if (!confirm(`Delete backup run #${run.id}? This will remove its records and its files from the storage location.`)) return;
                         try {
                           await backupRunApi.delete(run.id);
                           // Optimistically remove row by reloading page; parent list owns data
@@ -2,7 +2,7 @@ import { Close as CloseIcon } from '@mui/icons-material';
 import { Alert, Box, Button, CircularProgress, Dialog, DialogActions, DialogContent, DialogTitle, IconButton, Stack, Step, StepLabel, Stepper, TextField, Typography } from '@mui/material';
 import { useEffect, useMemo, useState } from 'react';
 import { backupProfileApi, commandApi, namingRuleApi, serverApi, storageLocationApi, fileRuleApi } from '../../api';
-import type { NamingRule, Server, StorageLocation } from '../../types';
+import type { FileRuleCompression, FileRuleSourceType, NamingRule, Server, StorageLocation } from '../../types';
 import { interpolate, computeDerived } from '../../templates/templateEngine';
 import PathPickerField from '../common/PathPickerField';
 import { NamingRuleSelector, StorageLocationSelector, CronTextField, ProfileNameTextField } from '../forms';
@@ -21,7 +21,17 @@ interface TemplateConfig {
   result: {
     profile: Record<string, any>;
     commands?: Array<{ run_stage: 'pre' | 'post'; command: string }>;
-    file_rules?: Array<{ remote_path: string; recursive?: boolean; exclude_pattern?: string }>;
+    file_rules?: Array<{
+      remote_path?: string;
+      recursive?: boolean;
+      exclude_pattern?: string;
+      source_type?: FileRuleSourceType;
+      command?: string;
+      output_name?: string;
+      compression?: FileRuleCompression;
+      docker_target?: string;
+      docker_image?: string;
+    }>;
   };
   computed?: Record<string, string>;
 }
@@ -134,11 +144,17 @@ export default function GenericTemplateWizard({ open, onClose, onSuccess, templa
 
       // File rules
       for (const fr of template.result.file_rules || []) {
-        const remote_path = interpolate(fr.remote_path, allVars);
+        const remote_path = interpolate(fr.remote_path || '', allVars);
         await fileRuleApi.create(newProfile.id, {
           remote_path,
           recursive: fr.recursive ?? false,
           exclude_pattern: fr.exclude_pattern ? interpolate(fr.exclude_pattern, allVars) : undefined,
+          source_type: fr.source_type,
+          command: fr.command ? interpolate(fr.command, allVars) : undefined,
+          output_name: fr.output_name ? interpolate(fr.output_name, allVars) : undefined,
+          compression: fr.compression,
+          docker_target: fr.docker_target ? interpolate(fr.docker_target, allVars) : undefined,
+          docker_image: fr.docker_image,
         });
       }
 
@@ -6,5 +6,8 @@ export interface BackupFile {
   size_bytes?: number;
   file_size?: number;
   checksum?: string;
+  checksum_algorithm?: string;
+  mod_time?: string;
+  reused?: boolean;
   created_at: string;
 }
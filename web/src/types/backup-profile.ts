@@ -5,6 +5,22 @@ import type { Command } from './command';
 import type { FileRule } from './file-rule';
 import type { BackupRun } from './backup-run';
 
+export type ChecksumAlgorithm = 'sha256' | 'sha512' | 'sha1' | 'md5';
+
+export type IncrementalMode = 'off' | 'metadata' | 'checksum';
+
+export type ArchiveFormat = 'none' | 'tar.gz' | 'tar.zst';
+
+export type ErrorPolicy = 'stop' | 'skip' | 'threshold';
+
+export type FailedRunCleanup = 'delete' | 'keep' | 'quarantine';
+
+export interface BackupProfileCopyTarget {
+  id?: number;
+  backup_profile_id?: number;
+  storage_location_id: number;
+}
+
 export interface BackupProfile {
   id: number;
   name: string;
@@ -13,6 +29,25 @@ export interface BackupProfile {
   naming_rule_id: number;
   schedule_cron?: string;
   enabled: boolean;
+  transfer_concurrency?: number;
+  checksum_algorithm?: ChecksumAlgorithm;
+  verify_checksums?: boolean;
+  checksum_retries?: number;
+  incremental_mode?: IncrementalMode;
+  archive_format?: ArchiveFormat;
+  archive_level?: number;
+  encryption_key_id?: number | null;
+  error_policy?: ErrorPolicy;
+  max_failed_files?: number;
+  failed_run_cleanup?: FailedRunCleanup;
+  retention_keep_last?: number;
+  retention_keep_daily?: number;
+  retention_keep_weekly?: number;
+  retention_keep_monthly?: number;
+  retention_keep_yearly?: number;
+  retention_min_age_days?: number;
+  retention_max_total_bytes?: number;
+  copy_targets?: BackupProfileCopyTarget[];
   created_at: string;
   server?: Server;
   storage_location?: StorageLocation;
@@ -29,6 +64,25 @@ export interface BackupProfileCreateInput {
   naming_rule_id: number;
   schedule_cron?: string;
   enabled: boolean;
+  transfer_concurrency?: number;
+  checksum_algorithm?: ChecksumAlgorithm;
+  verify_checksums?: boolean;
+  checksum_retries?: number;
+  incremental_mode?: IncrementalMode;
+  archive_format?: ArchiveFormat;
+  archive_level?: number;
+  encryption_key_id?: number | null;
+  error_policy?: ErrorPolicy;
+  max_failed_files?: number;
+  failed_run_cleanup?: FailedRunCleanup;
+  retention_keep_last?: number;
+  retention_keep_daily?: number;
+  retention_keep_weekly?: number;
+  retention_keep_monthly?: number;
+  retention_keep_yearly?: number;
+  retention_min_age_days?: number;
+  retention_max_total_bytes?: number;
+  copy_targets?: BackupProfileCopyTarget[];
 }
 
 export interface BackupProfileUpdateInput {
@@ -38,4 +92,43 @@ export interface BackupProfileUpdateInput {
   naming_rule_id?: number;
   schedule_cron?: string;
   enabled?: boolean;
+  transfer_concurrency?: number;
+  checksum_algorithm?: ChecksumAlgorithm;
+  verify_checksums?: boolean;
+  checksum_retries?: number;
+  incremental_mode?: IncrementalMode;
+  archive_format?: ArchiveFormat;
+  archive_level?: number;
+  encryption_key_id?: number | null;
+  error_policy?: ErrorPolicy;
+  max_failed_files?: number;
+  failed_run_cleanup?: FailedRunCleanup;
+  retention_keep_last?: number;
+  retention_keep_daily?: number;
+  retention_keep_weekly?: number;
+  retention_keep_monthly?: number;
+  retention_keep_yearly?: number;
+  retention_min_age_days?: number;
+  retention_max_total_bytes?: number;
+  copy_targets?: BackupProfileCopyTarget[];
+}
+
+export interface RetentionDecision {
+  run_id: number;
+  start_time: string;
+  status: string;
+  path: string;
+  size_bytes: number;
+  keep: boolean;
+  reasons: string[];
+  error?: string;
+}
+
+export interface RetentionPlan {
+  profile_id: number;
+  dry_run: boolean;
+  runs: RetentionDecision[];
+  kept_runs: number;
+  removed_runs: number;
+  removed_bytes: number;
 }
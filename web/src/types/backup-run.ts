@@ -1,6 +1,6 @@
 import type { BackupFile } from './backup-file';
 
-export type BackupRunStatus = 'pending' | 'running' | 'completed' | 'success' | 'failed';
+export type BackupRunStatus = 'pending' | 'running' | 'completed' | 'success' | 'partial' | 'failed';
 
 export interface BackupRun {
   id: number;
@@ -9,9 +9,100 @@ export interface BackupRun {
   end_time?: string;
   status: BackupRunStatus;
   local_backup_path?: string;
+  storage_location_id?: number;
   total_files?: number;
   total_size_bytes?: number;
   error_message?: string;
   log?: string;
+  transferred_bytes?: number;
+  reused_bytes?: number;
+  reused_files?: number;
+  manifest_path?: string;
+  archive_path?: string;
+  compressed_size_bytes?: number;
+  encryption_key_id?: number;
+  metadata_path?: string;
+  failed_files?: number;
+  progress_files_done?: number;
+  progress_files_total?: number;
+  progress_bytes_done?: number;
+  progress_bytes_total?: number;
+  progress_rules_done?: number;
+  progress_rules_total?: number;
+  progress_bytes_per_second?: number;
+  progress_eta_seconds?: number;
+  progress_updated_at?: string;
   backup_files?: BackupFile[];
+  file_errors?: BackupFileError[];
+  copies?: BackupRunCopy[];
+}
+
+export type BackupRunCopyStatus = 'pending' | 'copying' | 'completed' | 'failed';
+
+export interface BackupRunCopy {
+  id: number;
+  backup_run_id: number;
+  storage_location_id: number;
+  status: BackupRunCopyStatus;
+  local_backup_path?: string;
+  metadata_path?: string;
+  copied_files: number;
+  copied_bytes: number;
+  attempts: number;
+  error_message?: string;
+  start_time?: string;
+  end_time?: string;
+}
+
+export interface BackupFileError {
+  id: number;
+  backup_run_id: number;
+  file_rule_id?: number;
+  remote_path: string;
+  error: string;
+  created_at: string;
+}
+
+export interface BackupRunProgress {
+  run_id: number;
+  status: BackupRunStatus;
+  live: boolean;
+  files_done: number;
+  files_total: number;
+  bytes_done: number;
+  bytes_total: number;
+  rules_done: number;
+  rules_total: number;
+  bytes_per_second: number;
+  eta_seconds: number | null;
+  updated_at: string | null;
+}
+
+export interface BackupRunEntry {
+  name: string;
+  path: string;
+  is_dir: boolean;
+  size: number;
+  file_id?: number;
+}
+
+export interface BackupRunRestoreResult {
+  target_path: string;
+  files: number;
+  bytes: number;
+  directories: number;
+  symlinks: number;
+  metadata_errors?: string[];
+}
+
+export interface BackupRunDeleteResult {
+  run_id: number;
+  deleted: boolean;
+  error?: string;
+}
+
+export interface BackupRunBulkDeleteResult {
+  deleted: number;
+  failed: number;
+  results: BackupRunDeleteResult[];
 }
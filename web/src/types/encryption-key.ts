@@ -0,0 +1,26 @@
+export type EncryptionKeyType = 'age' | 'passphrase';
+
+export interface EncryptionKey {
+  id: number;
+  name: string;
+  type: EncryptionKeyType;
+  recipient?: string;
+  // Only returned once for generated age identities
+  secret?: string;
+  salt?: string;
+  rotated_at?: string;
+  rotated_to_id?: number;
+  created_at: string;
+}
+
+export interface EncryptionKeyCreateInput {
+  name: string;
+  type: EncryptionKeyType;
+  recipient?: string;
+  secret?: string;
+}
+
+export interface EncryptionKeyRotateInput {
+  recipient?: string;
+  secret?: string;
+}
@@ -1,9 +1,26 @@
+export type FileRuleTransferMode = 'auto' | 'files' | 'tar';
+
+export type FileRuleSymlinkPolicy = 'follow' | 'copy' | 'skip';
+
+export type FileRuleSourceType = 'path' | 'command' | 'docker_volume' | 'docker_container';
+
+export type FileRuleCompression = 'none' | 'gzip' | 'zstd';
+
 export interface FileRule {
   id: number;
   backup_profile_id: number;
   remote_path: string;
   recursive: boolean;
   exclude_pattern?: string;
+  include_pattern?: string;
+  transfer_mode?: FileRuleTransferMode;
+  symlink_policy?: FileRuleSymlinkPolicy;
+  source_type?: FileRuleSourceType;
+  command?: string;
+  output_name?: string;
+  compression?: FileRuleCompression;
+  docker_target?: string;
+  docker_image?: string;
   created_at: string;
 }
 
@@ -11,10 +28,41 @@ export interface FileRuleCreateInput {
   remote_path: string;
   recursive: boolean;
   exclude_pattern?: string;
+  include_pattern?: string;
+  transfer_mode?: FileRuleTransferMode;
+  symlink_policy?: FileRuleSymlinkPolicy;
+  source_type?: FileRuleSourceType;
+  command?: string;
+  output_name?: string;
+  compression?: FileRuleCompression;
+  docker_target?: string;
+  docker_image?: string;
 }
 
 export interface FileRuleUpdateInput {
   remote_path?: string;
   recursive?: boolean;
   exclude_pattern?: string;
+  include_pattern?: string;
+  transfer_mode?: FileRuleTransferMode;
+  symlink_policy?: FileRuleSymlinkPolicy;
+  source_type?: FileRuleSourceType;
+  command?: string;
+  output_name?: string;
+  compression?: FileRuleCompression;
+  docker_target?: string;
+  docker_image?: string;
+}
+
+export interface FileRulePreviewFile {
+  path: string;
+  size: number;
+  mod_time: string;
+}
+
+export interface FileRulePreview {
+  files: FileRulePreviewFile[];
+  total_files: number;
+  total_bytes: number;
+  truncated: boolean;
 }
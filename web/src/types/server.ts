@@ -1,3 +1,5 @@
+export type TransferMode = 'auto' | 'sftp' | 'shell';
+
 
 export interface Server {
   id: number;
@@ -5,10 +7,27 @@ export interface Server {
   host: string;
   port: number;
   username: string;
-  auth_type: 'password' | 'key';
+  auth_type: 'password' | 'key' | 'agent';
   password?: string;
   keyfile?: string;
+  jump_host_id?: number;
+  transfer_mode?: TransferMode;
+  max_sessions?: number;
   created_at: string;
+  host_key?: string;
+  host_key_fingerprint?: string;
+  host_key_approved_at?: string;
+}
+
+export interface ServerHostKey {
+  server_id: number;
+  stored_key?: string;
+  stored_fingerprint?: string;
+  approved_at?: string;
+  presented_key?: string;
+  presented_fingerprint?: string;
+  matches: boolean;
+  scan_error?: string;
 }
 
 export interface ServerCreateInput {
@@ -16,7 +35,31 @@ export interface ServerCreateInput {
   host: string;
   port: number;
   username: string;
-  auth_type: 'password' | 'key';
+  auth_type: 'password' | 'key' | 'agent';
   password?: string;
   keyfile?: string;
+  passphrase?: string;
+  jump_host_id?: number;
+  transfer_mode?: TransferMode;
+  max_sessions?: number;
+}
+
+export interface DockerContainer {
+  id: string;
+  name: string;
+  image: string;
+  state: string;
+  status: string;
+}
+
+export interface DockerVolume {
+  name: string;
+  driver: string;
+  mountpoint: string;
+}
+
+export interface DockerInventory {
+  containers: DockerContainer[];
+  volumes: DockerVolume[];
+  error?: string;
 }
@@ -1,11 +1,35 @@
+export type StorageMode = 'plain' | 'dedup';
+export type StorageType = 'local' | 's3' | 'sftp' | 'webdav';
+
 export interface StorageLocation {
   id: number;
   name: string;
   base_path: string;
+  type?: StorageType;
+  endpoint?: string;
+  region?: string;
+  bucket?: string;
+  access_key_id?: string;
+  server_id?: number | null;
+  username?: string;
+  mode?: StorageMode;
+  encryption_key_id?: number | null;
   created_at: string;
 }
 
 export interface StorageLocationCreateInput {
   name: string;
   base_path: string;
+  type?: StorageType;
+  endpoint?: string;
+  region?: string;
+  bucket?: string;
+  access_key_id?: string;
+  server_id?: number | null;
+  username?: string;
+  // Leave secrets empty on update to keep the stored ones
+  secret_access_key?: string;
+  password?: string;
+  mode?: StorageMode;
+  encryption_key_id?: number | null;
 }